@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/m-mizutani/minerva/pkg/api"
+	"github.com/pkg/errors"
+	cli "github.com/urfave/cli/v2"
+)
+
+type auditArguments struct {
+	region        string
+	metaTableName string
+	start         string
+	end           string
+	principal     string
+	searchID      string
+}
+
+func auditCommand(args *arguments) *cli.Command {
+	var auditArgs auditArguments
+
+	return &cli.Command{
+		Name:  "audit",
+		Usage: "Query audit events of API access",
+		Action: func(c *cli.Context) error {
+			return auditAction(auditArgs)
+		},
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "region",
+				Aliases:     []string{"r"},
+				Usage:       "AWS region",
+				Destination: &auditArgs.region,
+				EnvVars:     []string{"REGION"},
+				Required:    true,
+			},
+			&cli.StringFlag{
+				Name:        "search-table",
+				Aliases:     []string{"s"},
+				Usage:       "Search DynamoDB table name",
+				Destination: &auditArgs.metaTableName,
+				EnvVars:     []string{"SEARCH_TABLE_NAME"},
+				Required:    true,
+			},
+			&cli.StringFlag{
+				Name:        "start",
+				Usage:       "Start time (UTC) such as 2020-01-02T00:00:00",
+				Destination: &auditArgs.start,
+				Required:    true,
+			},
+			&cli.StringFlag{
+				Name:        "end",
+				Usage:       "End time (UTC), default is now",
+				Destination: &auditArgs.end,
+			},
+			&cli.StringFlag{
+				Name:        "principal",
+				Aliases:     []string{"p"},
+				Usage:       "Filter by principal such as jwt:alice or apikey:ci",
+				Destination: &auditArgs.principal,
+			},
+			&cli.StringFlag{
+				Name:        "search-id",
+				Usage:       "Filter by search ID",
+				Destination: &auditArgs.searchID,
+			},
+		},
+	}
+}
+
+func auditAction(auditArgs auditArguments) error {
+	timeFmt := "2006-01-02T15:04:05"
+	q := api.AuditQuery{
+		End:       time.Now().UTC(),
+		Principal: auditArgs.principal,
+		SearchID:  auditArgs.searchID,
+	}
+
+	start, err := time.Parse(timeFmt, auditArgs.start)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid start time: %s", auditArgs.start)
+	}
+	q.Start = start
+
+	if auditArgs.end != "" {
+		end, err := time.Parse(timeFmt, auditArgs.end)
+		if err != nil {
+			return errors.Wrapf(err, "Invalid end time: %s", auditArgs.end)
+		}
+		q.End = end
+	}
+
+	events, err := api.QueryAuditEvents(auditArgs.region, auditArgs.metaTableName, q)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	for _, event := range events {
+		if err := encoder.Encode(event); err != nil {
+			return errors.Wrap(err, "Fail to output audit event")
+		}
+	}
+
+	return nil
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"os"
 
 	"github.com/m-mizutani/minerva/pkg/models"
 	"github.com/pkg/errors"
@@ -64,13 +66,13 @@ func readMessageRecord(pr *reader.ParquetReader) (models.Record, error) {
 
 func dumpAction(args arguments, dumpArgs dumpArguments) error {
 	for _, msgFile := range dumpArgs.messageFiles.Value() {
-		if err := dumpParquetFile(msgFile, newMessageRecord, readMessageRecord); err != nil {
+		if err := dumpParquetFile(os.Stdout, msgFile, newMessageRecord, readMessageRecord); err != nil {
 			return err
 		}
 	}
 
 	for _, idxFile := range dumpArgs.indexFiles.Value() {
-		if err := dumpParquetFile(idxFile, newIndexRecord, readIndexRecord); err != nil {
+		if err := dumpParquetFile(os.Stdout, idxFile, newIndexRecord, readIndexRecord); err != nil {
 			return err
 		}
 	}
@@ -78,7 +80,8 @@ func dumpAction(args arguments, dumpArgs dumpArguments) error {
 	return nil
 }
 
-func dumpParquetFile(filepath string, newRec newRecord, read readRecord) error {
+// dumpParquetFile writes records in parquet file to w as JSON lines
+func dumpParquetFile(w io.Writer, filepath string, newRec newRecord, read readRecord) error {
 	fr, err := local.NewLocalFileReader(filepath)
 	if err != nil {
 		return errors.Wrap(err, "Failed to open")
@@ -101,7 +104,7 @@ func dumpParquetFile(filepath string, newRec newRecord, read readRecord) error {
 		if err != nil {
 			return err
 		}
-		fmt.Println(string(raw))
+		fmt.Fprintln(w, string(raw))
 	}
 
 	return nil
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/m-mizutani/minerva/pkg/merger"
+	"github.com/m-mizutani/minerva/pkg/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xitongsys/parquet-go-source/local"
+)
+
+func writeParquet(t *testing.T, cfg *merger.ParquetConfig, schema models.ParquetSchemaName, records []models.Record) string {
+	fd, err := ioutil.TempFile("", "*.parquet")
+	require.NoError(t, err)
+	fd.Close()
+
+	fw, err := local.NewLocalFileWriter(fd.Name())
+	require.NoError(t, err)
+	pw, err := cfg.NewWriter(fw, schema, false)
+	require.NoError(t, err)
+	for _, rec := range records {
+		require.NoError(t, pw.Write(rec))
+	}
+	require.NoError(t, pw.WriteStop())
+	require.NoError(t, fw.Close())
+
+	return fd.Name()
+}
+
+func TestDumpParquetRoundTrip(t *testing.T) {
+	var indexRecords, messageRecords []models.Record
+	for i := 0; i < 3000; i++ {
+		indexRecords = append(indexRecords, &models.IndexRecord{
+			Tag:       "app.log",
+			Timestamp: 1577934000 + int64(i),
+			Field:     fmt.Sprintf("field%d", i%3),
+			Term:      fmt.Sprintf("term-%d", i%700),
+			ObjectID:  int64(i / 1000),
+			Seq:       int32(i % 1000),
+		})
+		messageRecords = append(messageRecords, &models.MessageRecord{
+			Timestamp: 1577934000 + int64(i),
+			ObjectID:  int64(i / 1000),
+			Seq:       int32(i % 1000),
+			Message:   fmt.Sprintf(`{"user":"user%d","msg":"login"}`, i),
+		})
+	}
+
+	testCases := []struct {
+		title string
+		raw   string
+	}{
+		{title: "default", raw: ""},
+		{title: "gzip", raw: `{"compression":"GZIP"}`},
+		{title: "zstd with delta encodings", raw: `{"compression":"ZSTD","encodings":{"index":{"term":"DELTA_BYTE_ARRAY","field":"DELTA_LENGTH_BYTE_ARRAY","timestamp":"DELTA_BINARY_PACKED","seq":"DELTA_BINARY_PACKED"},"message":{"message":"PLAIN","object_id":"DELTA_BINARY_PACKED"}}}`},
+		{title: "uncompressed dictionary", raw: `{"compression":"UNCOMPRESSED","encodings":{"message":{"message":"PLAIN_DICTIONARY"}}}`},
+		{title: "small row groups and pages in parallel", raw: `{"row_group_size":16384,"page_size":1024,"parallelism":4}`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.title, func(tt *testing.T) {
+			cfg, err := merger.ParseParquetConfig(tc.raw)
+			require.NoError(tt, err)
+
+			idxFile := writeParquet(tt, cfg, models.ParquetSchemaIndex, indexRecords)
+			defer os.Remove(idxFile)
+			msgFile := writeParquet(tt, cfg, models.ParquetSchemaMessage, messageRecords)
+			defer os.Remove(msgFile)
+
+			var idxOut, msgOut bytes.Buffer
+			require.NoError(tt, dumpParquetFile(&idxOut, idxFile, newIndexRecord, readIndexRecord))
+			require.NoError(tt, dumpParquetFile(&msgOut, msgFile, newMessageRecord, readMessageRecord))
+
+			idxLines := strings.Split(strings.TrimSpace(idxOut.String()), "\n")
+			require.Equal(tt, len(indexRecords), len(idxLines))
+			for i, line := range idxLines {
+				var rec models.IndexRecord
+				require.NoError(tt, json.Unmarshal([]byte(line), &rec))
+				assert.Equal(tt, indexRecords[i], &rec)
+			}
+
+			msgLines := strings.Split(strings.TrimSpace(msgOut.String()), "\n")
+			require.Equal(tt, len(messageRecords), len(msgLines))
+			for i, line := range msgLines {
+				var rec models.MessageRecord
+				require.NoError(tt, json.Unmarshal([]byte(line), &rec))
+				assert.Equal(tt, messageRecords[i], &rec)
+			}
+		})
+	}
+}
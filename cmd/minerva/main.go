@@ -19,6 +19,10 @@ func main() {
 		Commands: []*cli.Command{
 			proxyCommand(&args),
 			dumpCommand(&args),
+			sigmaCommand(&args),
+			auditCommand(&args),
+			partitionsCommand(&args),
+			purgeCommand(&args),
 		},
 	}
 
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/m-mizutani/minerva/internal/adaptor"
+	"github.com/m-mizutani/minerva/internal/repository"
+	"github.com/m-mizutani/minerva/internal/service"
+	"github.com/m-mizutani/minerva/internal/util"
+	"github.com/m-mizutani/minerva/pkg/merger"
+	"github.com/m-mizutani/minerva/pkg/partition"
+	"github.com/pkg/errors"
+	cli "github.com/urfave/cli/v2"
+)
+
+type partitionsArguments struct {
+	region        string
+	bucket        string
+	prefix        string
+	database      string
+	metaTableName string
+	begin         string
+	end           string
+	dryRun        bool
+	mergeWindow   time.Duration
+}
+
+func partitionsCommand(args *arguments) *cli.Command {
+	var partArgs partitionsArguments
+
+	return &cli.Command{
+		Name:  "partitions",
+		Usage: "Manage partitions of Athena tables",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "repair",
+				Usage: "Reconcile partitions in S3, Glue Data Catalog and meta table",
+				Action: func(c *cli.Context) error {
+					return partitionsRepairAction(partArgs)
+				},
+				Flags: append(partitionsFlags(&partArgs), &cli.DurationFlag{
+					Name:        "merge-window",
+					Usage:       "Partitions newer than the window are not repaired because raw objects of them may be being merged",
+					Destination: &partArgs.mergeWindow,
+					Value:       partition.DefaultRepairMergeWindow,
+				}),
+			},
+			{
+				Name:  "compact",
+				Usage: "Re-merge small merged objects in each partition into larger ones",
+				Action: func(c *cli.Context) error {
+					return partitionsCompactAction(partArgs)
+				},
+				Flags: partitionsFlags(&partArgs),
+			},
+		},
+	}
+}
+
+// partitionsFlags returns flags used by all partitions subcommands
+func partitionsFlags(partArgs *partitionsArguments) []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:        "region",
+			Aliases:     []string{"r"},
+			Usage:       "AWS region",
+			Destination: &partArgs.region,
+			EnvVars:     []string{"REGION"},
+			Required:    true,
+		},
+		&cli.StringFlag{
+			Name:        "bucket",
+			Aliases:     []string{"b"},
+			Usage:       "S3 bucket of parquet files",
+			Destination: &partArgs.bucket,
+			EnvVars:     []string{"S3_BUCKET"},
+			Required:    true,
+		},
+		&cli.StringFlag{
+			Name:        "prefix",
+			Usage:       "S3 prefix of parquet files, e.g. production/",
+			Destination: &partArgs.prefix,
+			EnvVars:     []string{"S3_PREFIX"},
+		},
+		&cli.StringFlag{
+			Name:        "database",
+			Aliases:     []string{"d"},
+			Usage:       "Athena database name",
+			Destination: &partArgs.database,
+			EnvVars:     []string{"ATHENA_DB_NAME"},
+			Required:    true,
+		},
+		&cli.StringFlag{
+			Name:        "meta-table",
+			Aliases:     []string{"m"},
+			Usage:       "Meta DynamoDB table name",
+			Destination: &partArgs.metaTableName,
+			EnvVars:     []string{"META_TABLE_NAME"},
+			Required:    true,
+		},
+		&cli.StringFlag{
+			Name:        "begin",
+			Usage:       "Begin time (UTC) such as 2020-01-02T00:00:00",
+			Destination: &partArgs.begin,
+			Required:    true,
+		},
+		&cli.StringFlag{
+			Name:        "end",
+			Usage:       "End time (UTC), default is now",
+			Destination: &partArgs.end,
+		},
+		&cli.BoolFlag{
+			Name:        "dry-run",
+			Usage:       "Only print changes without modification",
+			Destination: &partArgs.dryRun,
+		},
+	}
+}
+
+func (x partitionsArguments) timeRange() (time.Time, time.Time, error) {
+	timeFmt := "2006-01-02T15:04:05"
+	begin, err := time.Parse(timeFmt, x.begin)
+	if err != nil {
+		return begin, begin, errors.Wrapf(err, "Invalid begin time: %s", x.begin)
+	}
+	end := time.Now().UTC()
+	if x.end != "" {
+		if end, err = time.Parse(timeFmt, x.end); err != nil {
+			return begin, end, errors.Wrapf(err, "Invalid end time: %s", x.end)
+		}
+	}
+	return begin, end, nil
+}
+
+func partitionsRepairAction(partArgs partitionsArguments) error {
+	begin, end, err := partArgs.timeRange()
+	if err != nil {
+		return err
+	}
+
+	repairer := &partition.Repairer{
+		S3:          adaptor.NewS3Client(partArgs.region),
+		Glue:        adaptor.NewGlueClient(partArgs.region),
+		Meta:        service.NewMetaService(repository.NewMetaDynamoDB(partArgs.region, partArgs.metaTableName), util.NewExpRetryTimer),
+		Bucket:      partArgs.bucket,
+		Prefix:      partArgs.prefix,
+		Database:    partArgs.database,
+		MergeWindow: partArgs.mergeWindow,
+		DryRun:      partArgs.dryRun,
+	}
+
+	changes, err := repairer.Repair(begin, end, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	for _, c := range changes {
+		fmt.Println(c.String())
+	}
+	if partArgs.dryRun {
+		fmt.Printf("%d changes (dry run, not applied)\n", len(changes))
+	} else {
+		fmt.Printf("%d changes applied\n", len(changes))
+	}
+
+	return nil
+}
+
+func partitionsCompactAction(partArgs partitionsArguments) error {
+	begin, end, err := partArgs.timeRange()
+	if err != nil {
+		return err
+	}
+
+	compactor := &merger.Compactor{
+		S3:       adaptor.NewS3Client(partArgs.region),
+		Glue:     adaptor.NewGlueClient(partArgs.region),
+		Meta:     service.NewMetaService(repository.NewMetaDynamoDB(partArgs.region, partArgs.metaTableName), util.NewExpRetryTimer),
+		Bucket:   partArgs.bucket,
+		Prefix:   partArgs.prefix,
+		Database: partArgs.database,
+		DryRun:   partArgs.dryRun,
+	}
+
+	results, err := compactor.Compact(begin, end)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range results {
+		fmt.Printf("%s: %d objects -> %d objects (%d rows)\n", c.Location, len(c.Sources), len(c.Outputs), c.Rows)
+	}
+	if partArgs.dryRun {
+		fmt.Printf("%d partitions (dry run, not compacted)\n", len(results))
+	} else {
+		fmt.Printf("%d partitions compacted\n", len(results))
+	}
+
+	return nil
+}
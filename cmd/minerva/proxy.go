@@ -2,16 +2,27 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 
 	"github.com/gin-gonic/gin"
 	"github.com/m-mizutani/minerva/pkg/api"
+	"github.com/m-mizutani/minerva/pkg/models"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
 )
 
 type proxyArguments struct {
-	addr string
-	port int
+	addr           string
+	port           int
+	authConfig     string
+	maskConfigFile string
+	adminConfig    string
+	tagPartition   string
+	projection     bool
+	granularity    string
+	dailyQuota     string
+	monthlyQuota   string
 }
 
 func proxyCommand(args *arguments) *cli.Command {
@@ -78,17 +89,149 @@ func proxyCommand(args *arguments) *cli.Command {
 				Value:       "messages",
 				Destination: &apiArgs.MessageTableName,
 			},
+			&cli.DurationFlag{
+				Name:        "search-cache-ttl",
+				Usage:       "Reuse result of identical search within the duration (e.g. 10m), 0 disables cache",
+				Destination: &apiArgs.SearchCacheTTL,
+				EnvVars:     []string{"SEARCH_CACHE_TTL"},
+			},
+			&cli.StringFlag{
+				Name:        "daily-scan-quota",
+				Usage:       "Daily quota of Athena scanned size per user (e.g. 500GB), empty means unlimited",
+				Destination: &proxyArgs.dailyQuota,
+				EnvVars:     []string{"DAILY_SCAN_QUOTA"},
+			},
+			&cli.StringFlag{
+				Name:        "monthly-scan-quota",
+				Usage:       "Monthly quota of Athena scanned size per user (e.g. 5TB), empty means unlimited",
+				Destination: &proxyArgs.monthlyQuota,
+				EnvVars:     []string{"MONTHLY_SCAN_QUOTA"},
+			},
+			&cli.DurationFlag{
+				Name:        "audit-retention",
+				Usage:       "Retention of audit events in search table (e.g. 8760h)",
+				Destination: &apiArgs.AuditRetention,
+				EnvVars:     []string{"AUDIT_RETENTION"},
+			},
+			&cli.StringFlag{
+				Name:        "auth-config",
+				Usage:       "Auth config JSON (JWT and API keys), same as AUTH_CONFIG of apiHandler. If not set, no authentication and x-permitted-tags header is trusted",
+				Destination: &proxyArgs.authConfig,
+				EnvVars:     []string{"AUTH_CONFIG"},
+			},
+			&cli.StringFlag{
+				Name:        "mask-config",
+				Usage:       "Mask config JSON file to mask sensitive fields in search result",
+				Destination: &proxyArgs.maskConfigFile,
+				EnvVars:     []string{"MASK_CONFIG_FILE"},
+			},
+			&cli.StringFlag{
+				Name:        "admin-config",
+				Usage:       "Admin config JSON, same as ADMIN_CONFIG of apiHandler. Admin can change saved searches of others and get audit events and usage",
+				Destination: &proxyArgs.adminConfig,
+				EnvVars:     []string{"ADMIN_CONFIG"},
+			},
+			&cli.StringFlag{
+				Name:        "tag-partition",
+				Usage:       "Tag partition config JSON, must be same as indexer's TAG_PARTITION",
+				Destination: &proxyArgs.tagPartition,
+				EnvVars:     []string{"TAG_PARTITION"},
+			},
+			&cli.BoolFlag{
+				Name:        "partition-projection",
+				Usage:       "Athena tables use partition projection, same as PARTITION_PROJECTION of apiHandler",
+				Destination: &proxyArgs.projection,
+				EnvVars:     []string{"PARTITION_PROJECTION"},
+			},
+			&cli.StringFlag{
+				Name:        "partition-granularity",
+				Usage:       "Granularity of dt partition (hourly or daily), same as PARTITION_GRANULARITY of apiHandler",
+				Destination: &proxyArgs.granularity,
+				EnvVars:     []string{"PARTITION_GRANULARITY"},
+			},
 		},
 
 		Action: func(c *cli.Context) error {
+			// proxyArgs is not logged as it is because authConfig has API keys
 			logger.WithFields(logrus.Fields{
-				"args":      args,
-				"proxyArgs": proxyArgs,
-				"apiArgs":   apiArgs,
+				"args":         args,
+				"addr":         proxyArgs.addr,
+				"port":         proxyArgs.port,
+				"auth":         proxyArgs.authConfig != "",
+				"maskConfig":   proxyArgs.maskConfigFile,
+				"tagPartition": proxyArgs.tagPartition,
+				"projection":   proxyArgs.projection,
+				"granularity":  proxyArgs.granularity,
+				"dailyQuota":   proxyArgs.dailyQuota,
+				"monthlyQuota": proxyArgs.monthlyQuota,
+				"apiArgs":      apiArgs,
 			}).Info("Start API server")
 
+			if proxyArgs.dailyQuota != "" {
+				size, err := api.ParseByteSize(proxyArgs.dailyQuota)
+				if err != nil {
+					return err
+				}
+				apiArgs.DailyScanQuota = size
+			}
+			if proxyArgs.monthlyQuota != "" {
+				size, err := api.ParseByteSize(proxyArgs.monthlyQuota)
+				if err != nil {
+					return err
+				}
+				apiArgs.MonthlyScanQuota = size
+			}
+
+			if proxyArgs.maskConfigFile != "" {
+				raw, err := ioutil.ReadFile(proxyArgs.maskConfigFile)
+				if err != nil {
+					return errors.Wrapf(err, "Fail to read mask config: %s", proxyArgs.maskConfigFile)
+				}
+				config, err := api.ParseMaskConfig(raw)
+				if err != nil {
+					return err
+				}
+				apiArgs.Masking = config
+			}
+
+			if proxyArgs.adminConfig != "" {
+				config, err := api.ParseAdminConfig([]byte(proxyArgs.adminConfig))
+				if err != nil {
+					return err
+				}
+				apiArgs.Admin = config
+			}
+
+			tagPartition, err := models.ParseTagPartition(proxyArgs.tagPartition)
+			if err != nil {
+				return err
+			}
+			apiArgs.TagPartition = tagPartition
+
+			projected, err := models.ParseProjectedGranularity(proxyArgs.projection, proxyArgs.granularity)
+			if err != nil {
+				return err
+			}
+			apiArgs.ProjectedGranularity = projected
+
 			r := gin.Default()
 			v1 := r.Group("/api/v1")
+			v1.Use(api.AuditMiddleware(apiArgs.AuditSink()))
+
+			if proxyArgs.authConfig != "" {
+				config, err := api.ParseAuthConfig([]byte(proxyArgs.authConfig))
+				if err != nil {
+					return err
+				}
+				authenticators, err := api.NewAuthenticators(config)
+				if err != nil {
+					return err
+				}
+				v1.Use(api.AuthMiddleware(authenticators...))
+			} else {
+				logger.Warn("Authentication is disabled")
+			}
+
 			api.SetupRoute(v1, &apiArgs)
 
 			bindAddr := fmt.Sprintf("%s:%d", proxyArgs.addr, proxyArgs.port)
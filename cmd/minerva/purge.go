@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/athena"
+	"github.com/m-mizutani/minerva/internal/adaptor"
+	"github.com/m-mizutani/minerva/internal/repository"
+	"github.com/m-mizutani/minerva/internal/service"
+	"github.com/m-mizutani/minerva/internal/util"
+	"github.com/m-mizutani/minerva/pkg/merger"
+	"github.com/m-mizutani/minerva/pkg/models"
+	"github.com/m-mizutani/minerva/pkg/purge"
+	"github.com/pkg/errors"
+	cli "github.com/urfave/cli/v2"
+)
+
+type purgeArguments struct {
+	region        string
+	bucket        string
+	prefix        string
+	database      string
+	metaTableName string
+	outputPath    string
+	searchOutput  string
+	terms         cli.StringSlice
+	tags          cli.StringSlice
+	begin         string
+	end           string
+	reason        string
+	projection    bool
+	granularity   string
+	parquetConfig string
+	dryRun        bool
+}
+
+func purgeCommand(args *arguments) *cli.Command {
+	var purgeArgs purgeArguments
+
+	return &cli.Command{
+		Name:  "purge",
+		Usage: "Delete logs that have all of terms from merged objects, e.g. for data-subject deletion request",
+		Action: func(c *cli.Context) error {
+			return purgeAction(purgeArgs)
+		},
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "region",
+				Aliases:     []string{"r"},
+				Usage:       "AWS region",
+				Destination: &purgeArgs.region,
+				EnvVars:     []string{"REGION"},
+				Required:    true,
+			},
+			&cli.StringFlag{
+				Name:        "bucket",
+				Aliases:     []string{"b"},
+				Usage:       "S3 bucket of parquet files",
+				Destination: &purgeArgs.bucket,
+				EnvVars:     []string{"S3_BUCKET"},
+				Required:    true,
+			},
+			&cli.StringFlag{
+				Name:        "prefix",
+				Usage:       "S3 prefix of parquet files, e.g. production/",
+				Destination: &purgeArgs.prefix,
+				EnvVars:     []string{"S3_PREFIX"},
+			},
+			&cli.StringFlag{
+				Name:        "database",
+				Aliases:     []string{"d"},
+				Usage:       "Athena database name",
+				Destination: &purgeArgs.database,
+				EnvVars:     []string{"ATHENA_DB_NAME"},
+				Required:    true,
+			},
+			&cli.StringFlag{
+				Name:        "meta-table",
+				Aliases:     []string{"m"},
+				Usage:       "Meta DynamoDB table name to lock partitions",
+				Destination: &purgeArgs.metaTableName,
+				EnvVars:     []string{"META_TABLE_NAME"},
+				Required:    true,
+			},
+			&cli.StringFlag{
+				Name:        "output",
+				Aliases:     []string{"o"},
+				Usage:       "S3 path of Athena query output, e.g. s3://bucket/prefix/output",
+				Destination: &purgeArgs.outputPath,
+				Required:    true,
+			},
+			&cli.StringFlag{
+				Name:        "search-output-prefix",
+				Usage:       "S3 key prefix of Athena query outputs of search API, default is <prefix>output/. Outputs that have the terms are deleted",
+				Destination: &purgeArgs.searchOutput,
+			},
+			&cli.StringSliceFlag{
+				Name:        "term",
+				Aliases:     []string{"t"},
+				Usage:       "Identifier to be deleted (multiple terms mean AND)",
+				Destination: &purgeArgs.terms,
+				Required:    true,
+			},
+			&cli.StringSliceFlag{
+				Name:        "tag",
+				Usage:       "Limit target logs by tag",
+				Destination: &purgeArgs.tags,
+			},
+			&cli.StringFlag{
+				Name:        "begin",
+				Usage:       "Begin time (UTC) such as 2020-01-02T00:00:00",
+				Destination: &purgeArgs.begin,
+				Required:    true,
+			},
+			&cli.StringFlag{
+				Name:        "end",
+				Usage:       "End time (UTC), default is now",
+				Destination: &purgeArgs.end,
+			},
+			&cli.StringFlag{
+				Name:        "reason",
+				Usage:       "Reason of deletion recorded in audit record, e.g. ticket ID",
+				Destination: &purgeArgs.reason,
+				Required:    true,
+			},
+			&cli.BoolFlag{
+				Name:        "partition-projection",
+				Usage:       "Athena tables use partition projection, same as PARTITION_PROJECTION of Lambda functions",
+				Destination: &purgeArgs.projection,
+				EnvVars:     []string{"PARTITION_PROJECTION"},
+			},
+			&cli.StringFlag{
+				Name:        "partition-granularity",
+				Usage:       "Granularity of dt partition (hourly or daily), same as PARTITION_GRANULARITY of Lambda functions",
+				Destination: &purgeArgs.granularity,
+				EnvVars:     []string{"PARTITION_GRANULARITY"},
+			},
+			&cli.StringFlag{
+				Name:        "parquet-config",
+				Usage:       "JSON of parquet writer settings for rewritten objects, same as merger",
+				Destination: &purgeArgs.parquetConfig,
+				EnvVars:     []string{"PARQUET_CONFIG"},
+			},
+			&cli.BoolFlag{
+				Name:        "dry-run",
+				Usage:       "Only find and rewrite objects in local without replacement",
+				Destination: &purgeArgs.dryRun,
+			},
+		},
+	}
+}
+
+func purgeAction(purgeArgs purgeArguments) error {
+	timeFmt := "2006-01-02T15:04:05"
+	begin, err := time.Parse(timeFmt, purgeArgs.begin)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid begin time: %s", purgeArgs.begin)
+	}
+	end := time.Now().UTC()
+	if purgeArgs.end != "" {
+		if end, err = time.Parse(timeFmt, purgeArgs.end); err != nil {
+			return errors.Wrapf(err, "Invalid end time: %s", purgeArgs.end)
+		}
+	}
+
+	projected, err := models.ParseProjectedGranularity(purgeArgs.projection, purgeArgs.granularity)
+	if err != nil {
+		return err
+	}
+
+	parquetConfig, err := merger.ParseParquetConfig(purgeArgs.parquetConfig)
+	if err != nil {
+		return err
+	}
+
+	ssn := session.Must(session.NewSession(&aws.Config{Region: aws.String(purgeArgs.region)}))
+	purger := &purge.Purger{
+		S3:   adaptor.NewS3Client(purgeArgs.region),
+		Meta: service.NewMetaService(repository.NewMetaDynamoDB(purgeArgs.region, purgeArgs.metaTableName), util.NewExpRetryTimer),
+		Finder: &purge.AthenaFinder{
+			Client:     athena.New(ssn),
+			Database:   purgeArgs.database,
+			OutputPath: purgeArgs.outputPath,
+			Projected:  projected,
+		},
+		Bucket:       purgeArgs.bucket,
+		Prefix:       purgeArgs.prefix,
+		OutputPrefix: purgeArgs.searchOutput,
+		Parquet:      parquetConfig,
+		DryRun:       purgeArgs.dryRun,
+	}
+
+	req := &purge.Request{
+		Terms:  purgeArgs.terms.Value(),
+		Tags:   purgeArgs.tags.Value(),
+		Begin:  begin,
+		End:    end,
+		Reason: purgeArgs.reason,
+	}
+
+	record, err := purger.Purge(req, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	for _, obj := range record.Objects {
+		fmt.Printf("%-8s %s (%d -> %d rows)\n", obj.Table, obj.Location, obj.RowsBefore, obj.RowsAfter)
+	}
+	for _, key := range record.Outputs {
+		fmt.Printf("%-8s s3://%s/%s\n", "output", purgeArgs.bucket, key)
+	}
+	for _, key := range record.RawObjects {
+		fmt.Printf("%-8s s3://%s/%s\n", "raw", purgeArgs.bucket, key)
+	}
+	if purgeArgs.dryRun {
+		fmt.Printf("%d rows in %d objects will be removed (dry run, not applied)\n", record.RemovedRows, len(record.Objects))
+	} else {
+		fmt.Printf("%d rows in %d objects removed, record ID: %s\n", record.RemovedRows, len(record.Objects), record.ID)
+	}
+
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+
+	"github.com/m-mizutani/minerva/pkg/api"
+	"github.com/m-mizutani/minerva/pkg/sigma"
+	"github.com/pkg/errors"
+	cli "github.com/urfave/cli/v2"
+)
+
+type sigmaArguments struct {
+	tagMapFile  string
+	savedSearch bool
+	lookback    int64
+	interval    int64
+	threshold   int64
+}
+
+// sigmaSavedSearch is request body of POST /saved_search
+type sigmaSavedSearch struct {
+	Name      string      `json:"name"`
+	Query     []api.Query `json:"query"`
+	Lookback  int64       `json:"lookback"`
+	Interval  int64       `json:"interval"`
+	Threshold int64       `json:"threshold"`
+}
+
+type sigmaOutput struct {
+	File string `json:"file"`
+	*sigma.Result
+	SavedSearches []sigmaSavedSearch `json:"saved_searches,omitempty"`
+}
+
+func sigmaCommand(args *arguments) *cli.Command {
+	var sigmaArgs sigmaArguments
+
+	return &cli.Command{
+		Name:      "sigma",
+		Usage:     "Convert Sigma rules to minerva search queries",
+		ArgsUsage: "RULE_FILE [RULE_FILE ...]",
+		Action: func(c *cli.Context) error {
+			return sigmaAction(sigmaArgs, c.Args().Slice())
+		},
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "tag-map",
+				Aliases:     []string{"t"},
+				Usage:       "YAML file of mapping from logsource to tags",
+				Destination: &sigmaArgs.tagMapFile,
+			},
+			&cli.BoolFlag{
+				Name:        "saved-search",
+				Aliases:     []string{"s"},
+				Usage:       "Output request body of saved search",
+				Destination: &sigmaArgs.savedSearch,
+			},
+			&cli.Int64Flag{
+				Name:        "lookback",
+				Usage:       "Lookback seconds of saved search",
+				Value:       3600,
+				Destination: &sigmaArgs.lookback,
+			},
+			&cli.Int64Flag{
+				Name:        "interval",
+				Usage:       "Interval seconds of saved search",
+				Value:       3600,
+				Destination: &sigmaArgs.interval,
+			},
+			&cli.Int64Flag{
+				Name:        "threshold",
+				Usage:       "Threshold of hit count to notify alert",
+				Value:       1,
+				Destination: &sigmaArgs.threshold,
+			},
+		},
+	}
+}
+
+var invalidSavedSearchNameChars = regexp.MustCompile(`[^a-zA-Z0-9_.\-]+`)
+
+func toSavedSearchName(result *sigma.Result, idx int) string {
+	base := result.ID
+	if base == "" {
+		base = result.Title
+	}
+	base = invalidSavedSearchNameChars.ReplaceAllString(base, "_")
+	if len(base) > 100 {
+		base = base[:100]
+	}
+
+	if len(result.Searches) == 1 {
+		return base
+	}
+	return fmt.Sprintf("%s-%d", base, idx)
+}
+
+func sigmaAction(sigmaArgs sigmaArguments, files []string) error {
+	if len(files) == 0 {
+		return fmt.Errorf("No rule file is specified")
+	}
+
+	var tagMap sigma.TagMap
+	if sigmaArgs.tagMapFile != "" {
+		raw, err := ioutil.ReadFile(sigmaArgs.tagMapFile)
+		if err != nil {
+			return errors.Wrapf(err, "Fail to read tag map file: %s", sigmaArgs.tagMapFile)
+		}
+		if tagMap, err = sigma.ParseTagMap(raw); err != nil {
+			return err
+		}
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+
+	for _, file := range files {
+		raw, err := ioutil.ReadFile(file)
+		if err != nil {
+			return errors.Wrapf(err, "Fail to read rule file: %s", file)
+		}
+
+		rule, err := sigma.ParseRule(raw)
+		if err != nil {
+			return errors.Wrapf(err, "Invalid rule: %s", file)
+		}
+
+		result, err := sigma.Convert(rule, tagMap)
+		if err != nil {
+			return errors.Wrapf(err, "Fail to convert rule: %s", file)
+		}
+
+		output := sigmaOutput{File: file, Result: result}
+		if sigmaArgs.savedSearch {
+			for i, s := range result.Searches {
+				output.SavedSearches = append(output.SavedSearches, sigmaSavedSearch{
+					Name:      toSavedSearchName(result, i),
+					Query:     s.Query,
+					Lookback:  sigmaArgs.lookback,
+					Interval:  sigmaArgs.interval,
+					Threshold: sigmaArgs.threshold,
+				})
+			}
+		}
+
+		for _, msg := range result.Unsupported {
+			logger.WithField("file", file).Warn(msg)
+		}
+
+		if err := encoder.Encode(output); err != nil {
+			return errors.Wrap(err, "Fail to output result")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,21 @@
+package adaptor
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+// CloudWatchClientFactory is interface CloudWatchClient constructor
+type CloudWatchClientFactory func(region string) CloudWatchClient
+
+// CloudWatchClient is interface of AWS SDK CloudWatch (only for custom metrics)
+type CloudWatchClient interface {
+	PutMetricData(input *cloudwatch.PutMetricDataInput) (*cloudwatch.PutMetricDataOutput, error)
+}
+
+// NewCloudWatchClient creates actual AWS CloudWatch SDK client
+func NewCloudWatchClient(region string) CloudWatchClient {
+	ssn := session.New(&aws.Config{Region: aws.String(region)})
+	return cloudwatch.New(ssn)
+}
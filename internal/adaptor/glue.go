@@ -0,0 +1,25 @@
+package adaptor
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/glue"
+)
+
+// GlueClientFactory is interface GlueClient constructor
+type GlueClientFactory func(region string) GlueClient
+
+// GlueClient is interface of AWS SDK Glue (Data Catalog)
+type GlueClient interface {
+	GetTable(input *glue.GetTableInput) (*glue.GetTableOutput, error)
+	BatchCreatePartition(input *glue.BatchCreatePartitionInput) (*glue.BatchCreatePartitionOutput, error)
+	GetPartitions(input *glue.GetPartitionsInput) (*glue.GetPartitionsOutput, error)
+	BatchDeletePartition(input *glue.BatchDeletePartitionInput) (*glue.BatchDeletePartitionOutput, error)
+	UpdatePartition(input *glue.UpdatePartitionInput) (*glue.UpdatePartitionOutput, error)
+}
+
+// NewGlueClient creates actual AWS Glue SDK client
+func NewGlueClient(region string) GlueClient {
+	ssn := session.New(&aws.Config{Region: aws.String(region)})
+	return glue.New(ssn)
+}
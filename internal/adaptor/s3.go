@@ -18,6 +18,12 @@ type S3Client interface {
 	PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error)
 	DeleteObjects(input *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error)
 	HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error)
+	ListObjectsV2(input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error)
+	CopyObject(input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error)
+	CreateMultipartUpload(input *s3.CreateMultipartUploadInput) (*s3.CreateMultipartUploadOutput, error)
+	UploadPart(input *s3.UploadPartInput) (*s3.UploadPartOutput, error)
+	CompleteMultipartUpload(input *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUpload(input *s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error)
 	Upload(bucket, key string, body io.Reader, encoding string) error
 }
 
@@ -55,6 +61,30 @@ func (x *awsS3Client) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutpu
 	return x.client.HeadObject(input)
 }
 
+func (x *awsS3Client) ListObjectsV2(input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	return x.client.ListObjectsV2(input)
+}
+
+func (x *awsS3Client) CopyObject(input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	return x.client.CopyObject(input)
+}
+
+func (x *awsS3Client) CreateMultipartUpload(input *s3.CreateMultipartUploadInput) (*s3.CreateMultipartUploadOutput, error) {
+	return x.client.CreateMultipartUpload(input)
+}
+
+func (x *awsS3Client) UploadPart(input *s3.UploadPartInput) (*s3.UploadPartOutput, error) {
+	return x.client.UploadPart(input)
+}
+
+func (x *awsS3Client) CompleteMultipartUpload(input *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error) {
+	return x.client.CompleteMultipartUpload(input)
+}
+
+func (x *awsS3Client) AbortMultipartUpload(input *s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error) {
+	return x.client.AbortMultipartUpload(input)
+}
+
 func (x *awsS3Client) Upload(bucket, key string, body io.Reader, encoding string) error {
 	uploader := s3manager.NewUploaderWithClient(x.client)
 	_, err := uploader.Upload(&s3manager.UploadInput{
@@ -0,0 +1,232 @@
+package mmdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/big"
+)
+
+// Data types of MaxMind DB format
+const (
+	typeExtended  = 0
+	typePointer   = 1
+	typeString    = 2
+	typeDouble    = 3
+	typeBytes     = 4
+	typeUint16    = 5
+	typeUint32    = 6
+	typeMap       = 7
+	typeInt32     = 8
+	typeUint64    = 9
+	typeUint128   = 10
+	typeArray     = 11
+	typeContainer = 12
+	typeEnd       = 13
+	typeBool      = 14
+	typeFloat     = 15
+)
+
+const maxDecodeDepth = 32
+
+// decoder decodes data section (or metadata). Pointer is offset from beginning of buf.
+type decoder struct {
+	buf []byte
+}
+
+func (x *decoder) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("Invalid MaxMind DB data: "+format, args...)
+}
+
+func (x *decoder) read(offset, n uint) ([]byte, error) {
+	if offset+n > uint(len(x.buf)) || offset+n < offset {
+		return nil, x.errorf("out of range %d+%d", offset, n)
+	}
+	return x.buf[offset : offset+n], nil
+}
+
+// decode returns value at offset and offset of next value.
+func (x *decoder) decode(offset uint, depth int) (interface{}, uint, error) {
+	if depth > maxDecodeDepth {
+		return nil, 0, x.errorf("too deep data structure")
+	}
+
+	ctrl, err := x.read(offset, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset++
+
+	dataType := uint(ctrl[0] >> 5)
+	if dataType == typePointer {
+		ptr, next, err := x.decodePointer(ctrl[0], offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := x.decode(ptr, depth+1)
+		return v, next, err
+	}
+
+	if dataType == typeExtended {
+		ext, err := x.read(offset, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		dataType = 7 + uint(ext[0])
+		offset++
+	}
+
+	size, offset, err := x.decodeSize(ctrl[0], offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Each entry of map and array has at least one byte of control. Size larger than the rest of buffer is broken and must not be used to allocate.
+	switch dataType {
+	case typeMap, typeArray:
+		if size > uint(len(x.buf))-offset {
+			return nil, 0, x.errorf("too large size %d of container at %d", size, offset)
+		}
+	}
+
+	switch dataType {
+	case typeMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := x.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, x.errorf("map key must be string, but %T", k)
+			}
+			v, next, err := x.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+			offset = next
+		}
+		return m, offset, nil
+
+	case typeArray:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			v, next, err := x.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			offset = next
+		}
+		return a, offset, nil
+
+	case typeBool:
+		return size != 0, offset, nil
+
+	case typeContainer, typeEnd:
+		return nil, 0, x.errorf("unsupported data type %d", dataType)
+	}
+
+	raw, err := x.read(offset, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	next := offset + size
+
+	switch dataType {
+	case typeString:
+		return string(raw), next, nil
+	case typeBytes:
+		return append([]byte{}, raw...), next, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, x.errorf("invalid size of double: %d", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(raw)), next, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, x.errorf("invalid size of float: %d", size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(raw))), next, nil
+	case typeUint16, typeUint32, typeUint64:
+		if size > 8 {
+			return nil, 0, x.errorf("invalid size of uint: %d", size)
+		}
+		var v uint64
+		for _, b := range raw {
+			v = v<<8 | uint64(b)
+		}
+		return v, next, nil
+	case typeInt32:
+		if size > 4 {
+			return nil, 0, x.errorf("invalid size of int32: %d", size)
+		}
+		var v uint32
+		for _, b := range raw {
+			v = v<<8 | uint32(b)
+		}
+		return int64(int32(v)), next, nil
+	case typeUint128:
+		if size > 16 {
+			return nil, 0, x.errorf("invalid size of uint128: %d", size)
+		}
+		return new(big.Int).SetBytes(raw), next, nil
+	}
+
+	return nil, 0, x.errorf("unknown data type %d", dataType)
+}
+
+func (x *decoder) decodeSize(ctrl byte, offset uint) (uint, uint, error) {
+	size := uint(ctrl & 0x1f)
+	if size < 29 {
+		return size, offset, nil
+	}
+
+	n := size - 28
+	raw, err := x.read(offset, n)
+	if err != nil {
+		return 0, 0, err
+	}
+	var v uint
+	for _, b := range raw {
+		v = v<<8 | uint(b)
+	}
+
+	switch size {
+	case 29:
+		return 29 + v, offset + n, nil
+	case 30:
+		return 285 + v, offset + n, nil
+	default:
+		return 65821 + v, offset + n, nil
+	}
+}
+
+func (x *decoder) decodePointer(ctrl byte, offset uint) (uint, uint, error) {
+	ss := uint((ctrl >> 3) & 0x3)
+	vvv := uint(ctrl & 0x7)
+
+	raw, err := x.read(offset, ss+1)
+	if err != nil {
+		return 0, 0, err
+	}
+	next := offset + ss + 1
+
+	var v uint
+	for _, b := range raw {
+		v = v<<8 | uint(b)
+	}
+
+	switch ss {
+	case 0:
+		return vvv<<8 | v, next, nil
+	case 1:
+		return (vvv<<16 | v) + 2048, next, nil
+	case 2:
+		return (vvv<<24 | v) + 526336, next, nil
+	default:
+		return v, next, nil
+	}
+}
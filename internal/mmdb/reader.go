@@ -0,0 +1,174 @@
+// Package mmdb is a minimal reader of MaxMind DB format (GeoIP2, GeoLite2 and compatible databases).
+package mmdb
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+const (
+	metadataMaxSize   = 128 * 1024
+	dataSectionOffset = 16 // Size of data section separator
+)
+
+// Metadata of database
+type Metadata struct {
+	NodeCount    uint
+	RecordSize   uint
+	IPVersion    uint
+	DatabaseType string
+}
+
+// Reader looks up data of IP address from database on memory.
+type Reader struct {
+	Metadata Metadata
+	buf      []byte
+	data     *decoder
+	ipv4Node uint
+}
+
+// Open loads database file.
+func Open(path string) (*Reader, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to read MaxMind DB: %s", path)
+	}
+
+	reader, err := New(raw)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to load MaxMind DB: %s", path)
+	}
+	return reader, nil
+}
+
+// New creates Reader from binary of database.
+func New(raw []byte) (*Reader, error) {
+	searchFrom := 0
+	if len(raw) > metadataMaxSize {
+		searchFrom = len(raw) - metadataMaxSize
+	}
+	pos := bytes.LastIndex(raw[searchFrom:], metadataMarker)
+	if pos < 0 {
+		return nil, fmt.Errorf("Metadata marker is not found")
+	}
+	metaStart := searchFrom + pos + len(metadataMarker)
+
+	metaDecoder := &decoder{buf: raw[metaStart:]}
+	v, _, err := metaDecoder.decode(0, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to decode metadata")
+	}
+	meta, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Metadata must be map, but %T", v)
+	}
+
+	reader := &Reader{buf: raw}
+	reader.Metadata.NodeCount = uint(toUint(meta["node_count"]))
+	reader.Metadata.RecordSize = uint(toUint(meta["record_size"]))
+	reader.Metadata.IPVersion = uint(toUint(meta["ip_version"]))
+	reader.Metadata.DatabaseType, _ = meta["database_type"].(string)
+
+	switch reader.Metadata.RecordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("Unsupported record size: %d", reader.Metadata.RecordSize)
+	}
+	if reader.Metadata.IPVersion != 4 && reader.Metadata.IPVersion != 6 {
+		return nil, fmt.Errorf("Unsupported IP version: %d", reader.Metadata.IPVersion)
+	}
+
+	treeSize := reader.Metadata.NodeCount * reader.Metadata.RecordSize / 4
+	dataStart := treeSize + dataSectionOffset
+	if dataStart > uint(searchFrom+pos) {
+		return nil, fmt.Errorf("Search tree is larger than file: %d nodes", reader.Metadata.NodeCount)
+	}
+	reader.data = &decoder{buf: raw[dataStart : searchFrom+pos]}
+
+	// IPv4 address is in ::/96 of IPv6 database
+	if reader.Metadata.IPVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < reader.Metadata.NodeCount; i++ {
+			node = reader.readNode(node, 0)
+		}
+		reader.ipv4Node = node
+	}
+
+	return reader, nil
+}
+
+func toUint(v interface{}) uint64 {
+	if n, ok := v.(uint64); ok {
+		return n
+	}
+	return 0
+}
+
+func (x *Reader) readNode(node uint, bit uint) uint {
+	switch x.Metadata.RecordSize {
+	case 24:
+		b := x.buf[node*6+bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := x.buf[node*7:]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		b := x.buf[node*8+bit*4:]
+		return uint(b[0])<<24 | uint(b[1])<<16 | uint(b[2])<<8 | uint(b[3])
+	}
+}
+
+// Lookup returns data of the IP address. nil is returned if no data for the address.
+func (x *Reader) Lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	var addr []byte
+	if v4 := ip.To4(); v4 != nil {
+		addr = v4
+		if x.Metadata.IPVersion == 6 {
+			node = x.ipv4Node
+		}
+	} else if v6 := ip.To16(); v6 != nil {
+		if x.Metadata.IPVersion == 4 {
+			return nil, nil
+		}
+		addr = v6
+	} else {
+		return nil, fmt.Errorf("Invalid IP address: %v", ip)
+	}
+
+	nodeCount := x.Metadata.NodeCount
+	for i := 0; i < len(addr)*8 && node < nodeCount; i++ {
+		bit := uint(addr[i/8]>>(7-uint(i%8))) & 1
+		node = x.readNode(node, bit)
+	}
+
+	if node == nodeCount {
+		return nil, nil
+	} else if node < nodeCount {
+		return nil, fmt.Errorf("Invalid search tree, reached node %d", node)
+	}
+
+	v, _, err := x.data.decode(node-nodeCount-dataSectionOffset, 0)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to decode data of %v", ip)
+	}
+	return v, nil
+}
+
+// LookupString parses IP address and calls Lookup. nil is returned if addr is not IP address.
+func (x *Reader) LookupString(addr string) (interface{}, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, nil
+	}
+	return x.Lookup(ip)
+}
@@ -0,0 +1,95 @@
+package mmdb_test
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/m-mizutani/minerva/internal/mmdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func buildDB(t *testing.T, recordSize uint) *mmdb.Reader {
+	w := mmdb.NewWriter("Test-City")
+	w.RecordSize = recordSize
+	require.NoError(t, w.Insert("192.0.2.0/24", map[string]interface{}{
+		"country":  map[string]interface{}{"iso_code": "JP"},
+		"location": map[string]interface{}{"latitude": 35.6, "longitude": 139.7},
+	}))
+	require.NoError(t, w.Insert("198.51.100.0/24", map[string]interface{}{
+		"country": map[string]interface{}{"iso_code": "US"},
+		"flags":   []interface{}{true, false},
+		"name":    strings.Repeat("x", 300),
+	}))
+	// More specific network in wider one
+	require.NoError(t, w.Insert("10.0.0.0/8", map[string]interface{}{"net": "wide"}))
+	require.NoError(t, w.Insert("10.1.0.0/16", map[string]interface{}{"net": "narrow"}))
+	require.NoError(t, w.Insert("2001:db8::/32", map[string]interface{}{"autonomous_system_number": uint32(64500)}))
+
+	buf := &bytes.Buffer{}
+	_, err := w.WriteTo(buf)
+	require.NoError(t, err)
+
+	reader, err := mmdb.New(buf.Bytes())
+	require.NoError(t, err)
+	return reader
+}
+
+func TestReader(t *testing.T) {
+	for _, size := range []uint{24, 28, 32} {
+		reader := buildDB(t, size)
+		assert.Equal(t, size, reader.Metadata.RecordSize)
+		assert.Equal(t, uint(6), reader.Metadata.IPVersion)
+		assert.Equal(t, "Test-City", reader.Metadata.DatabaseType)
+
+		v, err := reader.LookupString("192.0.2.10")
+		require.NoError(t, err)
+		data := v.(map[string]interface{})
+		assert.Equal(t, "JP", data["country"].(map[string]interface{})["iso_code"])
+		assert.Equal(t, 139.7, data["location"].(map[string]interface{})["longitude"])
+
+		v, err = reader.LookupString("198.51.100.255")
+		require.NoError(t, err)
+		data = v.(map[string]interface{})
+		assert.Equal(t, "US", data["country"].(map[string]interface{})["iso_code"])
+		assert.Equal(t, []interface{}{true, false}, data["flags"])
+		assert.Equal(t, 300, len(data["name"].(string)))
+
+		v, err = reader.LookupString("10.2.3.4")
+		require.NoError(t, err)
+		assert.Equal(t, "wide", v.(map[string]interface{})["net"])
+		v, err = reader.LookupString("10.1.3.4")
+		require.NoError(t, err)
+		assert.Equal(t, "narrow", v.(map[string]interface{})["net"])
+
+		v, err = reader.Lookup(net.ParseIP("2001:db8::1"))
+		require.NoError(t, err)
+		assert.Equal(t, uint64(64500), v.(map[string]interface{})["autonomous_system_number"])
+
+		v, err = reader.LookupString("203.0.113.1")
+		require.NoError(t, err)
+		assert.Nil(t, v)
+
+		v, err = reader.LookupString("not-ip")
+		require.NoError(t, err)
+		assert.Nil(t, v)
+	}
+}
+
+func TestReaderInvalidData(t *testing.T) {
+	_, err := mmdb.New([]byte("not a database"))
+	assert.Error(t, err)
+
+	marker := "\xab\xcd\xefMaxMind.com"
+	// map and array of 16M entries without data
+	for _, raw := range []string{
+		marker + "\xff\xff\xff\xff",
+		marker + "\x1f\x04\xff\xff\xff",
+	} {
+		_, err = mmdb.New([]byte(raw))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "too large size")
+	}
+}
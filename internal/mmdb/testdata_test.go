@@ -0,0 +1,58 @@
+package mmdb_test
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/m-mizutani/minerva/internal/mmdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var updateTestData = flag.Bool("update-testdata", false, "Regenerate MaxMind DB fixtures of other packages")
+
+// indexerTestData is fixture of pkg/indexer enrichment test. Writer is only in test of mmdb, then the fixture is generated here and committed.
+var indexerTestData = map[string]map[string]interface{}{
+	"city.mmdb": {
+		"192.0.2.0/24": map[string]interface{}{
+			"country":  map[string]interface{}{"iso_code": "JP"},
+			"city":     map[string]interface{}{"names": map[string]interface{}{"en": "Tokyo"}},
+			"location": map[string]interface{}{"latitude": 35.6, "longitude": 139.7},
+		},
+		"198.51.100.0/24": map[string]interface{}{
+			"country": map[string]interface{}{"iso_code": "US"},
+		},
+	},
+	"asn.mmdb": {
+		"192.0.2.0/24": map[string]interface{}{
+			"autonomous_system_number":       uint32(64500),
+			"autonomous_system_organization": "Example Net",
+		},
+	},
+}
+
+// TestIndexerTestData checks that fixtures are same as generated ones. Run with -update-testdata to regenerate them.
+func TestIndexerTestData(t *testing.T) {
+	for fname, networks := range indexerTestData {
+		w := mmdb.NewWriter("Test")
+		for network, data := range networks {
+			require.NoError(t, w.Insert(network, data))
+		}
+		buf := &bytes.Buffer{}
+		_, err := w.WriteTo(buf)
+		require.NoError(t, err)
+
+		fpath := filepath.Join("..", "..", "pkg", "indexer", "testdata", fname)
+		if *updateTestData {
+			require.NoError(t, ioutil.WriteFile(fpath, buf.Bytes(), 0644))
+			continue
+		}
+
+		raw, err := ioutil.ReadFile(fpath)
+		require.NoError(t, err)
+		assert.Equal(t, buf.Bytes(), raw, "%s is outdated, run test with -update-testdata", fname)
+	}
+}
@@ -0,0 +1,268 @@
+package mmdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// Writer builds small database of MaxMind DB format for test. Fixtures of other packages are also generated by it, see TestIndexerTestData.
+type Writer struct {
+	DatabaseType string
+	// RecordSize is one of 24, 28 and 32. Default is 24.
+	RecordSize uint
+	root       *writerNode
+}
+
+type writerNode struct {
+	children [2]*writerNode
+	data     interface{}
+}
+
+// NewWriter is constructor of IPv6 database Writer. IPv4 networks are stored in ::/96.
+func NewWriter(dbType string) *Writer {
+	return &Writer{
+		DatabaseType: dbType,
+		RecordSize:   24,
+		root:         &writerNode{},
+	}
+}
+
+// Insert sets data to network, e.g. "192.0.2.0/24". Data is map, array, string, float64, bool, int or uint types.
+func (x *Writer) Insert(network string, data interface{}) error {
+	_, ipnet, err := net.ParseCIDR(network)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid network: %s", network)
+	}
+
+	addr := ipnet.IP.To16()
+	ones, bits := ipnet.Mask.Size()
+	if bits == 32 {
+		addr = append(make([]byte, 12), ipnet.IP.To4()...)
+		ones += 96
+	}
+
+	node := x.root
+	for i := 0; i < ones; i++ {
+		bit := (addr[i/8] >> (7 - uint(i%8))) & 1
+		// Push down data of wider network
+		if node.data != nil {
+			node.children[0] = &writerNode{data: node.data}
+			node.children[1] = &writerNode{data: node.data}
+			node.data = nil
+		}
+		if node.children[bit] == nil {
+			node.children[bit] = &writerNode{}
+		}
+		node = node.children[bit]
+	}
+	node.data = data
+	node.children = [2]*writerNode{}
+
+	return nil
+}
+
+// WriteTo outputs database.
+func (x *Writer) WriteTo(w io.Writer) (int64, error) {
+	switch x.RecordSize {
+	case 24, 28, 32:
+	default:
+		return 0, fmt.Errorf("Unsupported record size: %d", x.RecordSize)
+	}
+
+	// Number nodes in breadth first order, leaves are not nodes of search tree
+	var nodes []*writerNode
+	index := map[*writerNode]uint{}
+	queue := []*writerNode{x.root}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		index[node] = uint(len(nodes))
+		nodes = append(nodes, node)
+		for _, child := range node.children {
+			if child != nil && (child.children[0] != nil || child.children[1] != nil) {
+				queue = append(queue, child)
+			}
+		}
+	}
+	nodeCount := uint(len(nodes))
+
+	data := &bytes.Buffer{}
+	dataOffsets := map[*writerNode]uint{}
+	record := func(child *writerNode) (uint, error) {
+		if child == nil {
+			return nodeCount, nil
+		}
+		if idx, ok := index[child]; ok {
+			return idx, nil
+		}
+		if child.data == nil {
+			return nodeCount, nil
+		}
+		if _, ok := dataOffsets[child]; !ok {
+			dataOffsets[child] = uint(data.Len())
+			if err := encode(data, child.data); err != nil {
+				return 0, err
+			}
+		}
+		return nodeCount + dataSectionOffset + dataOffsets[child], nil
+	}
+
+	tree := &bytes.Buffer{}
+	for _, node := range nodes {
+		left, err := record(node.children[0])
+		if err != nil {
+			return 0, err
+		}
+		right, err := record(node.children[1])
+		if err != nil {
+			return 0, err
+		}
+
+		switch x.RecordSize {
+		case 24:
+			tree.Write([]byte{byte(left >> 16), byte(left >> 8), byte(left), byte(right >> 16), byte(right >> 8), byte(right)})
+		case 28:
+			tree.Write([]byte{byte(left >> 16), byte(left >> 8), byte(left),
+				byte((left>>24)<<4) | byte((right>>24)&0x0f),
+				byte(right >> 16), byte(right >> 8), byte(right)})
+		case 32:
+			b := make([]byte, 8)
+			binary.BigEndian.PutUint32(b[0:], uint32(left))
+			binary.BigEndian.PutUint32(b[4:], uint32(right))
+			tree.Write(b)
+		}
+	}
+
+	out := &bytes.Buffer{}
+	out.Write(tree.Bytes())
+	out.Write(make([]byte, dataSectionOffset))
+	out.Write(data.Bytes())
+	out.Write(metadataMarker)
+	meta := map[string]interface{}{
+		"node_count":                  uint32(nodeCount),
+		"record_size":                 uint16(x.RecordSize),
+		"ip_version":                  uint16(6),
+		"database_type":               x.DatabaseType,
+		"languages":                   []interface{}{"en"},
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(0),
+		"description":                 map[string]interface{}{},
+	}
+	if err := encode(out, meta); err != nil {
+		return 0, err
+	}
+
+	n, err := w.Write(out.Bytes())
+	if err != nil {
+		return int64(n), errors.Wrap(err, "Fail to write MaxMind DB")
+	}
+	return int64(n), nil
+}
+
+func writeControl(w *bytes.Buffer, dataType uint, size uint) {
+	var ctrl byte
+	var ext []byte
+	if dataType > 7 {
+		ext = []byte{byte(dataType - 7)}
+	} else {
+		ctrl = byte(dataType << 5)
+	}
+
+	var sizeBytes []byte
+	switch {
+	case size < 29:
+		ctrl |= byte(size)
+	case size < 285:
+		ctrl |= 29
+		sizeBytes = []byte{byte(size - 29)}
+	case size < 65821:
+		ctrl |= 30
+		s := size - 285
+		sizeBytes = []byte{byte(s >> 8), byte(s)}
+	default:
+		ctrl |= 31
+		s := size - 65821
+		sizeBytes = []byte{byte(s >> 16), byte(s >> 8), byte(s)}
+	}
+
+	w.WriteByte(ctrl)
+	w.Write(ext)
+	w.Write(sizeBytes)
+}
+
+func writeUint(w *bytes.Buffer, dataType uint, v uint64) {
+	var b []byte
+	for ; v > 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	writeControl(w, dataType, uint(len(b)))
+	w.Write(b)
+}
+
+func encode(w *bytes.Buffer, v interface{}) error {
+	switch value := v.(type) {
+	case string:
+		writeControl(w, typeString, uint(len(value)))
+		w.WriteString(value)
+	case []byte:
+		writeControl(w, typeBytes, uint(len(value)))
+		w.Write(value)
+	case float64:
+		writeControl(w, typeDouble, 8)
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, math.Float64bits(value))
+		w.Write(b)
+	case bool:
+		size := uint(0)
+		if value {
+			size = 1
+		}
+		writeControl(w, typeBool, size)
+	case uint16:
+		writeUint(w, typeUint16, uint64(value))
+	case uint32:
+		writeUint(w, typeUint32, uint64(value))
+	case uint64:
+		writeUint(w, typeUint64, value)
+	case uint:
+		writeUint(w, typeUint64, uint64(value))
+	case int:
+		if value < 0 || value > math.MaxInt32 {
+			return fmt.Errorf("int must be 0 to MaxInt32: %d", value)
+		}
+		writeUint(w, typeUint32, uint64(value))
+	case map[string]interface{}:
+		keys := make([]string, 0, len(value))
+		for k := range value {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		writeControl(w, typeMap, uint(len(value)))
+		for _, k := range keys {
+			if err := encode(w, k); err != nil {
+				return err
+			}
+			if err := encode(w, value[k]); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		writeControl(w, typeArray, uint(len(value)))
+		for _, item := range value {
+			if err := encode(w, item); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("Unsupported data type for MaxMind DB: %T", v)
+	}
+	return nil
+}
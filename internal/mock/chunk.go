@@ -61,6 +61,15 @@ func (x *ChunkMockDB) GetMergableChunks(schema string, createdBefore time.Time,
 	return output, nil
 }
 
+// GetAllChunks returns all chunks of the schema
+func (x *ChunkMockDB) GetAllChunks(schema string) ([]*models.Chunk, error) {
+	var output []*models.Chunk
+	for _, chunk := range x.Data["chunk/"+schema] {
+		output = append(output, chunk)
+	}
+	return output, nil
+}
+
 // PutChunk saves a new chunk into DB. The chunk must be overwritten by UUID.
 func (x *ChunkMockDB) PutChunk(recordID string, objSize int64, schema, partition string, created time.Time) error {
 	chunkKey := uuid.New().String()
@@ -0,0 +1,35 @@
+package mock
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+// CloudWatchClient is mock of AWS CloudWatch SDK. It just stores metric data.
+type CloudWatchClient struct {
+	Input []*cloudwatch.PutMetricDataInput
+}
+
+// PutMetricData of mock stores input
+func (x *CloudWatchClient) PutMetricData(input *cloudwatch.PutMetricDataInput) (*cloudwatch.PutMetricDataOutput, error) {
+	x.Input = append(x.Input, input)
+	return &cloudwatch.PutMetricDataOutput{}, nil
+}
+
+// Metric returns sum of values of the metric name in the namespace
+func (x *CloudWatchClient) Metric(namespace, name string) (float64, bool) {
+	var sum float64
+	found := false
+	for _, input := range x.Input {
+		if aws.StringValue(input.Namespace) != namespace {
+			continue
+		}
+		for _, d := range input.MetricData {
+			if aws.StringValue(d.MetricName) == name {
+				sum += aws.Float64Value(d.Value)
+				found = true
+			}
+		}
+	}
+	return sum, found
+}
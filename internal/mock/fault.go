@@ -0,0 +1,69 @@
+package mock
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// FaultS3Client is S3Client mock that injects failures. Fault is called with API name (e.g. "PutObject") and S3 key before each operation, and the operation fails with returned error if it's not nil. Fault of DeleteObjects is called for each key and no object is deleted if any of them fails. Key of CopyObject is destination key.
+type FaultS3Client struct {
+	*S3Client
+	Fault func(op, key string) error
+}
+
+// NewFaultS3Client is constructor of FaultS3Client. nil fault never fails.
+func NewFaultS3Client(region string, fault func(op, key string) error) *FaultS3Client {
+	return &FaultS3Client{
+		S3Client: NewS3Client(region).(*S3Client),
+		Fault:    fault,
+	}
+}
+
+func (x *FaultS3Client) fault(op, key string) error {
+	if x.Fault == nil {
+		return nil
+	}
+	return x.Fault(op, key)
+}
+
+// GetObject of FaultS3Client
+func (x *FaultS3Client) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	if err := x.fault("GetObject", aws.StringValue(input.Key)); err != nil {
+		return nil, err
+	}
+	return x.S3Client.GetObject(input)
+}
+
+// PutObject of FaultS3Client
+func (x *FaultS3Client) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	if err := x.fault("PutObject", aws.StringValue(input.Key)); err != nil {
+		return nil, err
+	}
+	return x.S3Client.PutObject(input)
+}
+
+// CopyObject of FaultS3Client
+func (x *FaultS3Client) CopyObject(input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	if err := x.fault("CopyObject", aws.StringValue(input.Key)); err != nil {
+		return nil, err
+	}
+	return x.S3Client.CopyObject(input)
+}
+
+// DeleteObjects of FaultS3Client
+func (x *FaultS3Client) DeleteObjects(input *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+	for _, obj := range input.Delete.Objects {
+		if err := x.fault("DeleteObjects", aws.StringValue(obj.Key)); err != nil {
+			return nil, err
+		}
+	}
+	return x.S3Client.DeleteObjects(input)
+}
+
+// UploadPart of FaultS3Client
+func (x *FaultS3Client) UploadPart(input *s3.UploadPartInput) (*s3.UploadPartOutput, error) {
+	if err := x.fault("UploadPart", aws.StringValue(input.Key)); err != nil {
+		return nil, err
+	}
+	return x.S3Client.UploadPart(input)
+}
@@ -0,0 +1,225 @@
+package mock
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/glue"
+)
+
+// GlueCatalog is on memory fake of Glue Data Catalog. Table must be registered by PutTable before creating partitions.
+type GlueCatalog struct {
+	// FailValues makes BatchCreatePartition fail for partitions that has one of the values
+	FailValues map[string]bool
+	// BatchCalls is number of BatchCreatePartition calls
+	BatchCalls int
+	// OnUpdatePartition is called after UpdatePartition to check state of the moment
+	OnUpdatePartition func(input *glue.UpdatePartitionInput)
+
+	tables     map[string]*glue.TableData
+	partitions map[string]map[string]*glue.PartitionInput
+}
+
+// NewGlueCatalog is constructor of GlueCatalog
+func NewGlueCatalog() *GlueCatalog {
+	return &GlueCatalog{
+		FailValues: map[string]bool{},
+		tables:     map[string]*glue.TableData{},
+		partitions: map[string]map[string]*glue.PartitionInput{},
+	}
+}
+
+func glueTableKey(db, table string) string { return db + "." + table }
+
+// PutTable registers a table with partition keys
+func (x *GlueCatalog) PutTable(db, table, location string, partitionKeys ...string) {
+	data := &glue.TableData{
+		DatabaseName: aws.String(db),
+		Name:         aws.String(table),
+		StorageDescriptor: &glue.StorageDescriptor{
+			Location:     aws.String(location),
+			InputFormat:  aws.String("org.apache.hadoop.hive.ql.io.parquet.MapredParquetInputFormat"),
+			OutputFormat: aws.String("org.apache.hadoop.hive.ql.io.parquet.MapredParquetOutputFormat"),
+			SerdeInfo: &glue.SerDeInfo{
+				SerializationLibrary: aws.String("org.apache.hadoop.hive.ql.io.parquet.serde.ParquetHiveSerDe"),
+			},
+		},
+	}
+	for _, key := range partitionKeys {
+		data.PartitionKeys = append(data.PartitionKeys, &glue.Column{Name: aws.String(key), Type: aws.String("string")})
+	}
+
+	x.tables[glueTableKey(db, table)] = data
+	x.partitions[glueTableKey(db, table)] = map[string]*glue.PartitionInput{}
+}
+
+// PutPartition registers a partition directly without BatchCreatePartition
+func (x *GlueCatalog) PutPartition(db, table, location string, values ...string) {
+	sd := *x.tables[glueTableKey(db, table)].StorageDescriptor
+	sd.Location = aws.String(location)
+	x.partitions[glueTableKey(db, table)][strings.Join(values, "/")] = &glue.PartitionInput{
+		Values:            aws.StringSlice(values),
+		StorageDescriptor: &sd,
+	}
+}
+
+// Partitions returns partition values joined by "/" in sorted order
+func (x *GlueCatalog) Partitions(db, table string) []string {
+	var values []string
+	for v := range x.partitions[glueTableKey(db, table)] {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	return values
+}
+
+// Partition returns created partition. nil is returned if not found.
+func (x *GlueCatalog) Partition(db, table string, values ...string) *glue.PartitionInput {
+	return x.partitions[glueTableKey(db, table)][strings.Join(values, "/")]
+}
+
+// GetTable of GlueCatalog returns registered table
+func (x *GlueCatalog) GetTable(input *glue.GetTableInput) (*glue.GetTableOutput, error) {
+	table, ok := x.tables[glueTableKey(aws.StringValue(input.DatabaseName), aws.StringValue(input.Name))]
+	if !ok {
+		return nil, awserr.New(glue.ErrCodeEntityNotFoundException, "table not found", nil)
+	}
+	return &glue.GetTableOutput{Table: table}, nil
+}
+
+// GetPartitions of GlueCatalog returns all partitions of table in sorted order. Expression is not supported. NextToken is index of next partition and MaxResults is supported.
+func (x *GlueCatalog) GetPartitions(input *glue.GetPartitionsInput) (*glue.GetPartitionsOutput, error) {
+	db, tableName := aws.StringValue(input.DatabaseName), aws.StringValue(input.TableName)
+	if _, ok := x.tables[glueTableKey(db, tableName)]; !ok {
+		return nil, awserr.New(glue.ErrCodeEntityNotFoundException, "table not found", nil)
+	}
+
+	keys := x.Partitions(db, tableName)
+	start := 0
+	if input.NextToken != nil {
+		if _, err := fmt.Sscanf(*input.NextToken, "%d", &start); err != nil {
+			return nil, awserr.New(glue.ErrCodeInvalidInputException, "invalid token", nil)
+		}
+	}
+	end := len(keys)
+	if input.MaxResults != nil && start+int(*input.MaxResults) < end {
+		end = start + int(*input.MaxResults)
+	}
+
+	output := &glue.GetPartitionsOutput{}
+	for _, key := range keys[start:end] {
+		p := x.partitions[glueTableKey(db, tableName)][key]
+		output.Partitions = append(output.Partitions, &glue.Partition{
+			DatabaseName:      input.DatabaseName,
+			TableName:         input.TableName,
+			Values:            p.Values,
+			StorageDescriptor: p.StorageDescriptor,
+		})
+	}
+	if end < len(keys) {
+		output.NextToken = aws.String(fmt.Sprintf("%d", end))
+	}
+
+	return output, nil
+}
+
+// BatchDeletePartition of GlueCatalog removes partitions. Not existing partition is returned as error in output.
+func (x *GlueCatalog) BatchDeletePartition(input *glue.BatchDeletePartitionInput) (*glue.BatchDeletePartitionOutput, error) {
+	key := glueTableKey(aws.StringValue(input.DatabaseName), aws.StringValue(input.TableName))
+	if _, ok := x.tables[key]; !ok {
+		return nil, awserr.New(glue.ErrCodeEntityNotFoundException, "table not found", nil)
+	}
+	if len(input.PartitionsToDelete) > 25 {
+		return nil, awserr.New(glue.ErrCodeInvalidInputException, "too many partitions", nil)
+	}
+
+	output := &glue.BatchDeletePartitionOutput{}
+	for _, p := range input.PartitionsToDelete {
+		pkey := strings.Join(aws.StringValueSlice(p.Values), "/")
+		if _, ok := x.partitions[key][pkey]; !ok {
+			output.Errors = append(output.Errors, &glue.PartitionError{
+				PartitionValues: p.Values,
+				ErrorDetail: &glue.ErrorDetail{
+					ErrorCode:    aws.String(glue.ErrCodeEntityNotFoundException),
+					ErrorMessage: aws.String("partition not found"),
+				},
+			})
+			continue
+		}
+		delete(x.partitions[key], pkey)
+	}
+
+	return output, nil
+}
+
+// UpdatePartition of GlueCatalog replaces existing partition with PartitionInput
+func (x *GlueCatalog) UpdatePartition(input *glue.UpdatePartitionInput) (*glue.UpdatePartitionOutput, error) {
+	key := glueTableKey(aws.StringValue(input.DatabaseName), aws.StringValue(input.TableName))
+	if _, ok := x.tables[key]; !ok {
+		return nil, awserr.New(glue.ErrCodeEntityNotFoundException, "table not found", nil)
+	}
+	pkey := strings.Join(aws.StringValueSlice(input.PartitionValueList), "/")
+	if _, ok := x.partitions[key][pkey]; !ok {
+		return nil, awserr.New(glue.ErrCodeEntityNotFoundException, "partition not found", nil)
+	}
+
+	x.partitions[key][pkey] = input.PartitionInput
+	if x.OnUpdatePartition != nil {
+		x.OnUpdatePartition(input)
+	}
+	return &glue.UpdatePartitionOutput{}, nil
+}
+
+// BatchCreatePartition of GlueCatalog stores partitions. Errors of each partition are returned in output like actual Glue.
+func (x *GlueCatalog) BatchCreatePartition(input *glue.BatchCreatePartitionInput) (*glue.BatchCreatePartitionOutput, error) {
+	x.BatchCalls++
+
+	key := glueTableKey(aws.StringValue(input.DatabaseName), aws.StringValue(input.TableName))
+	table, ok := x.tables[key]
+	if !ok {
+		return nil, awserr.New(glue.ErrCodeEntityNotFoundException, "table not found", nil)
+	}
+	if len(input.PartitionInputList) > 100 {
+		return nil, awserr.New(glue.ErrCodeInvalidInputException, "too many partitions", nil)
+	}
+
+	output := &glue.BatchCreatePartitionOutput{}
+	addError := func(p *glue.PartitionInput, code, msg string) {
+		output.Errors = append(output.Errors, &glue.PartitionError{
+			PartitionValues: p.Values,
+			ErrorDetail: &glue.ErrorDetail{
+				ErrorCode:    aws.String(code),
+				ErrorMessage: aws.String(msg),
+			},
+		})
+	}
+
+	for _, p := range input.PartitionInputList {
+		values := aws.StringValueSlice(p.Values)
+		pkey := strings.Join(values, "/")
+
+		if len(values) != len(table.PartitionKeys) {
+			addError(p, glue.ErrCodeInvalidInputException, fmt.Sprintf("number of values must be %d", len(table.PartitionKeys)))
+			continue
+		}
+		if _, exists := x.partitions[key][pkey]; exists {
+			addError(p, glue.ErrCodeAlreadyExistsException, "partition already exists")
+			continue
+		}
+		failed := false
+		for _, v := range values {
+			failed = failed || x.FailValues[v]
+		}
+		if failed {
+			addError(p, glue.ErrCodeInternalServiceException, "injected failure")
+			continue
+		}
+
+		x.partitions[key][pkey] = p
+	}
+
+	return output, nil
+}
@@ -2,6 +2,7 @@ package mock
 
 import (
 	"math/rand"
+	"time"
 
 	"github.com/m-mizutani/minerva/internal/repository"
 	"github.com/m-mizutani/minerva/pkg/models"
@@ -11,6 +12,12 @@ type MetaRepository struct {
 	idMap        map[string]int64
 	pathMap      map[string]map[string]*repository.MetaRecordObject
 	partitionMap map[string]bool
+	lockMap      map[string]*partitionLock
+}
+
+type partitionLock struct {
+	owner     string
+	expiresAt time.Time
 }
 
 func NewMetaRepository() repository.MetaRepository {
@@ -18,6 +25,7 @@ func NewMetaRepository() repository.MetaRepository {
 		idMap:        make(map[string]int64),
 		pathMap:      make(map[string]map[string]*repository.MetaRecordObject),
 		partitionMap: make(map[string]bool),
+		lockMap:      make(map[string]*partitionLock),
 	}
 }
 
@@ -32,7 +40,9 @@ func (x *MetaRepository) GetObjecID(s3path string) (int64, error) {
 }
 
 func (x *MetaRepository) PutRecordObjects(objects []*repository.MetaRecordObject) error {
+	now := time.Now().UTC()
 	for _, path := range objects {
+		path.ExpiresAt = now.Add(repository.MetaRecordTTL).Unix()
 		schemaMap, ok := x.pathMap[path.RecordID]
 		if !ok {
 			schemaMap = make(map[string]*repository.MetaRecordObject)
@@ -67,3 +77,25 @@ func (x *MetaRepository) PutPartition(partitionKey string) error {
 	x.partitionMap[partitionKey] = true
 	return nil
 }
+
+func (x *MetaRepository) DeletePartition(partitionKey string) error {
+	delete(x.partitionMap, partitionKey)
+	return nil
+}
+
+func (x *MetaRepository) LockPartition(partitionKey, owner string, ttl time.Duration) (bool, error) {
+	now := time.Now().UTC()
+	if lock, ok := x.lockMap[partitionKey]; ok && lock.owner != owner && !lock.expiresAt.Before(now) {
+		return false, nil
+	}
+
+	x.lockMap[partitionKey] = &partitionLock{owner: owner, expiresAt: now.Add(ttl)}
+	return true, nil
+}
+
+func (x *MetaRepository) UnlockPartition(partitionKey, owner string) error {
+	if lock, ok := x.lockMap[partitionKey]; ok && lock.owner == owner {
+		delete(x.lockMap, partitionKey)
+	}
+	return nil
+}
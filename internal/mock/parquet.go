@@ -0,0 +1,58 @@
+package mock
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/m-mizutani/minerva/internal/adaptor"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// PutParquet writes records as parquet object with schema of obj, e.g. new(models.IndexRecord), and puts it by client.
+func PutParquet(client adaptor.S3Client, bucket, key string, obj interface{}, records ...interface{}) error {
+	fd, err := ioutil.TempFile("", "*.parquet")
+	if err != nil {
+		return err
+	}
+	fd.Close()
+	defer os.Remove(fd.Name())
+
+	fw, err := local.NewLocalFileWriter(fd.Name())
+	if err != nil {
+		return err
+	}
+	pw, err := writer.NewParquetWriter(fw, obj, 1)
+	if err != nil {
+		fw.Close()
+		return err
+	}
+	for _, rec := range records {
+		if err := pw.Write(rec); err != nil {
+			fw.Close()
+			return err
+		}
+	}
+	if err := pw.WriteStop(); err != nil {
+		fw.Close()
+		return err
+	}
+	if err := fw.Close(); err != nil {
+		return err
+	}
+
+	f, err := os.Open(fd.Name())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = client.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Body:   f,
+	})
+	return err
+}
@@ -3,11 +3,19 @@ package mock
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/google/uuid"
 	"github.com/klauspost/compress/gzip"
 	"github.com/m-mizutani/minerva/internal/adaptor"
 )
@@ -27,19 +35,40 @@ type S3Client struct {
 type s3Object struct {
 	data     []byte
 	encoding string
+	modified time.Time
 }
 
 var mockS3ClientDataStore = map[string]map[string]*s3Object{}
 
+// s3MultipartUpload is in-progress multipart upload. It's shared by all clients as data store.
+type s3MultipartUpload struct {
+	bucket string
+	key    string
+	parts  map[int64][]byte
+}
+
+var mockS3MultipartUploads = map[string]*s3MultipartUpload{}
+
+// MultipartUploads returns number of in-progress (not completed and not aborted) multipart uploads of the bucket
+func MultipartUploads(bucket string) int {
+	n := 0
+	for _, upload := range mockS3MultipartUploads {
+		if upload.bucket == bucket {
+			n++
+		}
+	}
+	return n
+}
+
 // GetObject of S3Client loads []bytes from memory
 func (x *S3Client) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
 	bucket, ok := x.data[*input.Bucket]
 	if !ok {
-		return nil, errors.New(s3.ErrCodeNoSuchKey)
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "no such bucket", nil)
 	}
 	obj, ok := bucket[*input.Key]
 	if !ok {
-		return nil, errors.New(s3.ErrCodeNoSuchKey)
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "no such key", nil)
 	}
 
 	var body io.Reader
@@ -49,6 +78,27 @@ func (x *S3Client) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, err
 			log.Fatal("gzip.NewReader", err)
 		}
 		body = gr
+	} else if input.Range != nil && strings.HasPrefix(*input.Range, "bytes=-") {
+		// Suffix range "bytes=-length"
+		var length int
+		if n, _ := fmt.Sscanf(*input.Range, "bytes=-%d", &length); n < 1 || length <= 0 {
+			return nil, awserr.New("InvalidRange", "invalid range", nil)
+		}
+		if length > len(obj.data) {
+			length = len(obj.data)
+		}
+		body = bytes.NewReader(obj.data[len(obj.data)-length:])
+	} else if input.Range != nil {
+		// Only "bytes=first-" and "bytes=first-last" are supported
+		var first, last int
+		n, _ := fmt.Sscanf(*input.Range, "bytes=%d-%d", &first, &last)
+		if n < 1 || first >= len(obj.data) {
+			return nil, awserr.New("InvalidRange", "invalid range", nil)
+		}
+		if n < 2 || last >= len(obj.data) {
+			last = len(obj.data) - 1
+		}
+		body = bytes.NewReader(obj.data[first : last+1])
 	} else {
 		body = bytes.NewReader(obj.data)
 	}
@@ -71,7 +121,8 @@ func (x *S3Client) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, err
 	}
 
 	bucket[*input.Key] = &s3Object{
-		data: raw,
+		data:     raw,
+		modified: time.Now().UTC(),
 	}
 
 	return &s3.PutObjectOutput{}, nil
@@ -95,6 +146,117 @@ func (x *S3Client) DeleteObjects(input *s3.DeleteObjectsInput) (*s3.DeleteObject
 	return nil, nil
 }
 
+// CopyObject of S3Client copies data in memory. CopySource must be URL encoded "bucket/key".
+func (x *S3Client) CopyObject(input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	src, err := url.PathUnescape(aws.StringValue(input.CopySource))
+	if err != nil {
+		return nil, awserr.New("InvalidArgument", "invalid copy source", err)
+	}
+	parts := strings.SplitN(src, "/", 2)
+	if len(parts) != 2 {
+		return nil, awserr.New("InvalidArgument", "invalid copy source", nil)
+	}
+
+	srcObj, ok := x.data[parts[0]][parts[1]]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "no such key", nil)
+	}
+
+	bucket, ok := x.data[*input.Bucket]
+	if !ok {
+		bucket = map[string]*s3Object{}
+		x.data[*input.Bucket] = bucket
+	}
+	obj := *srcObj
+	obj.modified = time.Now().UTC()
+	bucket[*input.Key] = &obj
+
+	return &s3.CopyObjectOutput{}, nil
+}
+
+// CreateMultipartUpload of S3Client starts multipart upload in memory
+func (x *S3Client) CreateMultipartUpload(input *s3.CreateMultipartUploadInput) (*s3.CreateMultipartUploadOutput, error) {
+	uploadID := uuid.New().String()
+	mockS3MultipartUploads[uploadID] = &s3MultipartUpload{
+		bucket: aws.StringValue(input.Bucket),
+		key:    aws.StringValue(input.Key),
+		parts:  map[int64][]byte{},
+	}
+	return &s3.CreateMultipartUploadOutput{
+		Bucket:   input.Bucket,
+		Key:      input.Key,
+		UploadId: aws.String(uploadID),
+	}, nil
+}
+
+// UploadPart of S3Client saves a part of multipart upload. ETag is "etag-<part number>".
+func (x *S3Client) UploadPart(input *s3.UploadPartInput) (*s3.UploadPartOutput, error) {
+	upload, ok := mockS3MultipartUploads[aws.StringValue(input.UploadId)]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchUpload, "no such upload", nil)
+	}
+
+	raw, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	upload.parts[aws.Int64Value(input.PartNumber)] = raw
+
+	return &s3.UploadPartOutput{
+		ETag: aws.String(fmt.Sprintf("etag-%d", aws.Int64Value(input.PartNumber))),
+	}, nil
+}
+
+// CompleteMultipartUpload of S3Client concatenates parts in order of given part list and saves it as object
+func (x *S3Client) CompleteMultipartUpload(input *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error) {
+	uploadID := aws.StringValue(input.UploadId)
+	upload, ok := mockS3MultipartUploads[uploadID]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchUpload, "no such upload", nil)
+	}
+	if input.MultipartUpload == nil || len(input.MultipartUpload.Parts) == 0 {
+		return nil, awserr.New("MalformedXML", "no part", nil)
+	}
+
+	var raw []byte
+	var prev int64
+	for _, part := range input.MultipartUpload.Parts {
+		num := aws.Int64Value(part.PartNumber)
+		data, ok := upload.parts[num]
+		if !ok || aws.StringValue(part.ETag) != fmt.Sprintf("etag-%d", num) {
+			return nil, awserr.New("InvalidPart", "invalid part", nil)
+		}
+		if num <= prev {
+			return nil, awserr.New("InvalidPartOrder", "invalid part order", nil)
+		}
+		prev = num
+		raw = append(raw, data...)
+	}
+
+	bucket, ok := x.data[upload.bucket]
+	if !ok {
+		bucket = map[string]*s3Object{}
+		x.data[upload.bucket] = bucket
+	}
+	bucket[upload.key] = &s3Object{data: raw, modified: time.Now().UTC()}
+	delete(mockS3MultipartUploads, uploadID)
+
+	return &s3.CompleteMultipartUploadOutput{
+		Bucket: aws.String(upload.bucket),
+		Key:    aws.String(upload.key),
+	}, nil
+}
+
+// AbortMultipartUpload of S3Client discards parts of multipart upload
+func (x *S3Client) AbortMultipartUpload(input *s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error) {
+	uploadID := aws.StringValue(input.UploadId)
+	if _, ok := mockS3MultipartUploads[uploadID]; !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchUpload, "no such upload", nil)
+	}
+	delete(mockS3MultipartUploads, uploadID)
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
 // Upload of S3Client put data from io.Reader
 func (x *S3Client) Upload(bucket, key string, body io.Reader, encoding string) error {
 	raw, err := ioutil.ReadAll(body)
@@ -111,10 +273,83 @@ func (x *S3Client) Upload(bucket, key string, body io.Reader, encoding string) e
 	bkt[key] = &s3Object{
 		data:     raw,
 		encoding: encoding,
+		modified: time.Now().UTC(),
 	}
 	return nil
 }
 
+// ListObjectsV2 of S3Client returns keys and common prefixes in sorted order. MaxKeys and ContinuationToken (as last key) are supported for pagination test.
+func (x *S3Client) ListObjectsV2(input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	bucket, ok := x.data[*input.Bucket]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchBucket, "no such bucket", nil)
+	}
+
+	prefix := aws.StringValue(input.Prefix)
+	delimiter := aws.StringValue(input.Delimiter)
+	var keys []string
+	for key := range bucket {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	maxKeys := int(aws.Int64Value(input.MaxKeys))
+	if maxKeys == 0 {
+		maxKeys = 1000
+	}
+	after := aws.StringValue(input.ContinuationToken)
+	if after == "" {
+		after = aws.StringValue(input.StartAfter)
+	}
+
+	output := &s3.ListObjectsV2Output{}
+	seen := map[string]bool{}
+	count := 0
+	for _, key := range keys {
+		if key <= after {
+			continue
+		}
+
+		entry := key
+		if delimiter != "" {
+			if idx := strings.Index(key[len(prefix):], delimiter); idx >= 0 {
+				entry = key[:len(prefix)+idx+len(delimiter)]
+			}
+		}
+		if seen[entry] {
+			continue
+		}
+		if count >= maxKeys {
+			output.IsTruncated = aws.Bool(true)
+			break
+		}
+		seen[entry] = true
+		count++
+
+		if entry != key {
+			output.CommonPrefixes = append(output.CommonPrefixes, &s3.CommonPrefix{Prefix: aws.String(entry)})
+			// Skip all keys in the common prefix
+			after = entry + "\xff"
+		} else {
+			output.Contents = append(output.Contents, &s3.Object{
+				Key:          aws.String(key),
+				Size:         aws.Int64(int64(len(bucket[key].data))),
+				LastModified: aws.Time(bucket[key].modified),
+			})
+			after = key
+		}
+		output.NextContinuationToken = aws.String(after)
+	}
+	if !aws.BoolValue(output.IsTruncated) {
+		output.NextContinuationToken = nil
+	}
+	output.KeyCount = aws.Int64(int64(count))
+
+	return output, nil
+}
+
 func (x *S3Client) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
 	bucket, ok := x.data[*input.Bucket]
 	if !ok {
@@ -127,3 +362,15 @@ func (x *S3Client) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput,
 
 	return &s3.HeadObjectOutput{}, nil
 }
+
+// Keys returns sorted S3 keys that start with prefix in the bucket. It's helper to check objects in test.
+func (x *S3Client) Keys(bucket, prefix string) []string {
+	var keys []string
+	for key := range x.data[bucket] {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -1,6 +1,7 @@
 package mock_test
 
 import (
+	"errors"
 	"io/ioutil"
 	"strings"
 	"testing"
@@ -74,4 +75,114 @@ func TestS3Mock(t *testing.T) {
 		})
 		require.Error(tt, err)
 	})
+
+	t.Run("Can get a part of object by Range", func(tt *testing.T) {
+		bucket := uuid.New().String()
+		client := mock.NewS3Client("test")
+		_, err := client.PutObject(&s3.PutObjectInput{
+			Bucket: &bucket,
+			Key:    aws.String("k1/obj"),
+			Body:   strings.NewReader("abcdef"),
+		})
+		require.NoError(tt, err)
+
+		out1, err := client.GetObject(&s3.GetObjectInput{
+			Bucket: &bucket,
+			Key:    aws.String("k1/obj"),
+			Range:  aws.String("bytes=2-3"),
+		})
+		require.NoError(tt, err)
+		raw1, err := ioutil.ReadAll(out1.Body)
+		require.NoError(tt, err)
+		assert.Equal(tt, "cd", string(raw1))
+
+		out2, err := client.GetObject(&s3.GetObjectInput{
+			Bucket: &bucket,
+			Key:    aws.String("k1/obj"),
+			Range:  aws.String("bytes=4-"),
+		})
+		require.NoError(tt, err)
+		raw2, err := ioutil.ReadAll(out2.Body)
+		require.NoError(tt, err)
+		assert.Equal(tt, "ef", string(raw2))
+	})
+}
+
+func TestS3MockListObjects(t *testing.T) {
+	bucket := uuid.New().String()
+	client := mock.NewS3Client("test")
+	for _, key := range []string{"p/a/1", "p/a/2", "p/b/1", "p/c", "q/d"} {
+		_, err := client.PutObject(&s3.PutObjectInput{
+			Bucket: &bucket,
+			Key:    aws.String(key),
+			Body:   strings.NewReader("abc"),
+		})
+		require.NoError(t, err)
+	}
+
+	t.Run("With delimiter", func(tt *testing.T) {
+		out, err := client.ListObjectsV2(&s3.ListObjectsV2Input{
+			Bucket:    &bucket,
+			Prefix:    aws.String("p/"),
+			Delimiter: aws.String("/"),
+		})
+		require.NoError(tt, err)
+		require.Equal(tt, 2, len(out.CommonPrefixes))
+		assert.Equal(tt, "p/a/", *out.CommonPrefixes[0].Prefix)
+		assert.Equal(tt, "p/b/", *out.CommonPrefixes[1].Prefix)
+		require.Equal(tt, 1, len(out.Contents))
+		assert.Equal(tt, "p/c", *out.Contents[0].Key)
+	})
+
+	t.Run("Pagination", func(tt *testing.T) {
+		input := &s3.ListObjectsV2Input{
+			Bucket:  &bucket,
+			Prefix:  aws.String("p/"),
+			MaxKeys: aws.Int64(3),
+		}
+		out, err := client.ListObjectsV2(input)
+		require.NoError(tt, err)
+		assert.Equal(tt, 3, len(out.Contents))
+		assert.True(tt, aws.BoolValue(out.IsTruncated))
+
+		input.ContinuationToken = out.NextContinuationToken
+		out, err = client.ListObjectsV2(input)
+		require.NoError(tt, err)
+		require.Equal(tt, 1, len(out.Contents))
+		assert.Equal(tt, "p/c", *out.Contents[0].Key)
+		assert.False(tt, aws.BoolValue(out.IsTruncated))
+	})
+}
+
+func TestFaultS3Client(t *testing.T) {
+	bucket := uuid.New().String()
+	client := mock.NewFaultS3Client("test", func(op, key string) error {
+		if op == "DeleteObjects" && key == "k2" {
+			return errors.New("injected")
+		}
+		return nil
+	})
+
+	for _, key := range []string{"k1", "k2"} {
+		_, err := client.PutObject(&s3.PutObjectInput{
+			Bucket: &bucket,
+			Key:    aws.String(key),
+			Body:   strings.NewReader("abc"),
+		})
+		require.NoError(t, err)
+	}
+
+	_, err := client.DeleteObjects(&s3.DeleteObjectsInput{
+		Bucket: &bucket,
+		Delete: &s3.Delete{Objects: []*s3.ObjectIdentifier{{Key: aws.String("k1")}, {Key: aws.String("k2")}}},
+	})
+	require.Error(t, err)
+	assert.Equal(t, []string{"k1", "k2"}, client.Keys(bucket, "k"))
+
+	_, err = client.DeleteObjects(&s3.DeleteObjectsInput{
+		Bucket: &bucket,
+		Delete: &s3.Delete{Objects: []*s3.ObjectIdentifier{{Key: aws.String("k1")}}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"k2"}, client.Keys(bucket, "k"))
 }
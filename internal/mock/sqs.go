@@ -3,6 +3,7 @@ package mock
 import (
 	"fmt"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/google/uuid"
 	"github.com/m-mizutani/minerva/internal/adaptor"
@@ -13,8 +14,9 @@ type SQSClientFactory func(region string) adaptor.SQSClient
 
 // SQSClient is mock of AWS SQS SDK
 type SQSClient struct {
-	Input      []*sqs.SendMessageInput
-	queueIndex int
+	Input []*sqs.SendMessageInput
+	// queueIndex is index of next message in Input by queue URL
+	queueIndex map[string]int
 	receipts   map[string]struct{}
 	Region     string
 }
@@ -22,8 +24,9 @@ type SQSClient struct {
 // NewSQSClient creates mock SQS client
 func NewSQSClient(region string) adaptor.SQSClient {
 	return &SQSClient{
-		Region:   region,
-		receipts: make(map[string]struct{}),
+		Region:     region,
+		queueIndex: make(map[string]int),
+		receipts:   make(map[string]struct{}),
 	}
 }
 
@@ -33,25 +36,31 @@ func (x *SQSClient) SendMessage(input *sqs.SendMessageInput) (*sqs.SendMessageOu
 	return nil, nil
 }
 
+// ReceiveMessage of mock returns a message sent to the queue URL in order. A message is received only once.
 func (x *SQSClient) ReceiveMessage(input *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
-	if len(x.Input) <= x.queueIndex {
+	url := aws.StringValue(input.QueueUrl)
+	for i := x.queueIndex[url]; i < len(x.Input); i++ {
+		if aws.StringValue(x.Input[i].QueueUrl) != url {
+			continue
+		}
+
+		receipt := uuid.New().String()
+		x.receipts[receipt] = struct{}{}
+		x.queueIndex[url] = i + 1
 		return &sqs.ReceiveMessageOutput{
-			Messages: []*sqs.Message{},
+			Messages: []*sqs.Message{
+				{
+					Body:          x.Input[i].MessageBody,
+					ReceiptHandle: &receipt,
+				},
+			},
 		}, nil
 	}
 
-	receipt := uuid.New().String()
-	x.receipts[receipt] = struct{}{}
-	output := sqs.ReceiveMessageOutput{
-		Messages: []*sqs.Message{
-			{
-				Body:          x.Input[x.queueIndex].MessageBody,
-				ReceiptHandle: &receipt,
-			},
-		},
-	}
-	x.queueIndex++
-	return &output, nil
+	x.queueIndex[url] = len(x.Input)
+	return &sqs.ReceiveMessageOutput{
+		Messages: []*sqs.Message{},
+	}, nil
 }
 
 func (x *SQSClient) DeleteMessage(input *sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error) {
@@ -16,6 +16,7 @@ import (
 type ChunkRepository interface {
 	GetWritableChunks(schema, partition string, writableTotalSize int64) ([]*models.Chunk, error)
 	GetMergableChunks(schema string, createdBefore time.Time, minChunkSize int64) ([]*models.Chunk, error)
+	GetAllChunks(schema string) ([]*models.Chunk, error)
 	PutChunk(recordID string, objSize int64, schema, partition string, created time.Time) error
 	UpdateChunk(chunk *models.Chunk, recordID string, objSize, writableSize int64) error
 	FreezeChunk(chunk *models.Chunk) (*models.Chunk, error)
@@ -71,6 +72,16 @@ func (x *ChunkDynamoDB) GetMergableChunks(schema string, createdBefore time.Time
 	return chunks, nil
 }
 
+// GetAllChunks returns all chunks of the schema regardless of status. It's for sweeper to know record IDs not merged yet.
+func (x *ChunkDynamoDB) GetAllChunks(schema string) ([]*models.Chunk, error) {
+	var chunks []*models.Chunk
+	if err := x.table.Get("pk", x.chunkPK(schema)).All(&chunks); err != nil {
+		return nil, errors.Wrap(err, "Failed get all chunks")
+	}
+
+	return chunks, nil
+}
+
 // GetWritableChunks returns writable chunks for now (because chunks are not locked)
 func (x *ChunkDynamoDB) GetWritableChunks(schema, partition string, writableTotalSize int64) ([]*models.Chunk, error) {
 	var chunks []*models.Chunk
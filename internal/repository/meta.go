@@ -18,6 +18,9 @@ type MetaRepository interface {
 	GetRecordObjects(recordIDs []string, schema models.ParquetSchemaName) ([]*MetaRecordObject, error)
 	HeadPartition(partitionKey string) (bool, error)
 	PutPartition(partitionKey string) error
+	DeletePartition(partitionKey string) error
+	LockPartition(partitionKey, owner string, ttl time.Duration) (bool, error)
+	UnlockPartition(partitionKey, owner string) error
 }
 
 // MetaDynamoDB is implementation of MetaRepository
@@ -31,11 +34,19 @@ type metaBase struct {
 	SKey      string `dynamo:"sk"`
 }
 
+type metaPartitionLock struct {
+	metaBase
+	Owner string `dynamo:"lock_owner"`
+}
+
 type metaObjectCount struct {
 	metaBase
 	ID int64 `dynamo:"id"`
 }
 
+// MetaRecordTTL is lifetime of MetaRecordObject in DynamoDB
+const MetaRecordTTL = time.Hour * 24 * 30
+
 type MetaRecordObject struct {
 	metaBase
 	models.S3Object
@@ -44,6 +55,11 @@ type MetaRecordObject struct {
 	Schema   models.ParquetSchemaName `dynamo:"schema"`
 }
 
+// PutAt returns time when the record was put. It's calculated from ExpiresAt.
+func (x *MetaRecordObject) PutAt() time.Time {
+	return time.Unix(x.ExpiresAt, 0).Add(-MetaRecordTTL).UTC()
+}
+
 func (x *MetaRecordObject) HashKey() interface{} {
 	return fmt.Sprintf("record/%s", x.RecordID)
 }
@@ -83,7 +99,7 @@ func (x *MetaDynamoDB) PutRecordObjects(records []*MetaRecordObject) error {
 	for _, item := range records {
 		item.PKey = item.HashKey().(string)
 		item.SKey = item.RangeKey().(string)
-		item.ExpiresAt = now.Add(time.Hour * 24 * 30).Unix()
+		item.ExpiresAt = now.Add(MetaRecordTTL).Unix()
 		items = append(items, item)
 	}
 
@@ -135,6 +151,15 @@ func (x *MetaDynamoDB) HeadPartition(partitionKey string) (bool, error) {
 	return true, nil
 }
 
+func (x *MetaDynamoDB) DeletePartition(partitionKey string) error {
+	pkey := toPartitionKey(partitionKey)
+	if err := x.table.Delete("pk", pkey).Range("sk", "@").Run(); err != nil {
+		return errors.Wrapf(err, "Fail to delete partition key: %s", pkey)
+	}
+
+	return nil
+}
+
 func (x *MetaDynamoDB) PutPartition(partitionKey string) error {
 	now := time.Now().UTC()
 	pindex := metaBase{
@@ -149,3 +174,41 @@ func (x *MetaDynamoDB) PutPartition(partitionKey string) error {
 
 	return nil
 }
+
+// LockPartition puts lock item of the partition if the partition is not locked, the lock is expired or the lock has same owner. It returns false if other owner has the lock.
+func (x *MetaDynamoDB) LockPartition(partitionKey, owner string, ttl time.Duration) (bool, error) {
+	now := time.Now().UTC()
+	lock := metaPartitionLock{
+		metaBase: metaBase{
+			ExpiresAt: now.Add(ttl).Unix(),
+			PKey:      toPartitionKey(partitionKey),
+			SKey:      "lock",
+		},
+		Owner: owner,
+	}
+
+	query := x.table.Put(lock).
+		If("attribute_not_exists(pk) OR expires_at < ? OR lock_owner = ?", now.Unix(), owner)
+	if err := query.Run(); err != nil {
+		if isConditionalCheckErr(err) {
+			return false, nil
+		}
+		return false, errors.Wrapf(err, "Fail to put partition lock: %s", lock.PKey)
+	}
+
+	return true, nil
+}
+
+// UnlockPartition deletes lock item of the partition only if the owner has the lock.
+func (x *MetaDynamoDB) UnlockPartition(partitionKey, owner string) error {
+	pkey := toPartitionKey(partitionKey)
+	query := x.table.Delete("pk", pkey).Range("sk", "lock").If("lock_owner = ?", owner)
+	if err := query.Run(); err != nil {
+		if isConditionalCheckErr(err) {
+			return nil // Lock was expired and taken by other owner
+		}
+		return errors.Wrapf(err, "Fail to delete partition lock: %s", pkey)
+	}
+
+	return nil
+}
@@ -57,6 +57,10 @@ func (x *ChunkService) GetMergableChunks(schema string, now time.Time) ([]*model
 	return x.repo.GetMergableChunks(schema, now.Add(-x.args.FreezedAfter), x.args.ChunkMinSize)
 }
 
+func (x *ChunkService) GetAllChunks(schema string) ([]*models.Chunk, error) {
+	return x.repo.GetAllChunks(schema)
+}
+
 func (x *ChunkService) PutChunk(recordID string, size int64, schema, partition string, now time.Time) error {
 	return x.repo.PutChunk(recordID, size, schema, partition, now)
 }
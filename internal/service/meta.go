@@ -1,6 +1,9 @@
 package service
 
 import (
+	"strings"
+	"time"
+
 	"github.com/guregu/dynamo"
 	"github.com/m-mizutani/minerva/internal/repository"
 	"github.com/m-mizutani/minerva/internal/util"
@@ -11,6 +14,9 @@ import (
 
 const getObjectsRetryLimit = 10
 
+// PartitionLockTTL is lifetime of partition lock. Lock of a job that died is released after it.
+const PartitionLockTTL = time.Hour
+
 // MetaService is accessor of MetaRepository
 type MetaService struct {
 	repo              repository.MetaRepository
@@ -94,6 +100,41 @@ func (x *MetaService) GetObjects(targetRecordIDs []string, schema models.Parquet
 	return objects, nil
 }
 
+// LookupObject retrieves a MetaRecordObject without retry. It returns nil if not found.
+func (x *MetaService) LookupObject(recordID string, schema models.ParquetSchemaName) (*repository.MetaRecordObject, error) {
+	results, err := x.repo.GetRecordObjects([]string{recordID}, schema)
+	if err != nil {
+		if err == dynamo.ErrNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(results) == 0 {
+		return nil, nil
+	}
+	return results[0], nil
+}
+
+// LookupObjects retrieves MetaRecordObjects without retry. Records not found, e.g. expired by TTL, are not included in results.
+func (x *MetaService) LookupObjects(targetRecordIDs []string, schema models.ParquetSchemaName) ([]*repository.MetaRecordObject, error) {
+	var objects []*repository.MetaRecordObject
+
+	const step = 128
+	for i := 0; i < len(targetRecordIDs); i += step {
+		ep := i + step
+		if len(targetRecordIDs) < ep {
+			ep = len(targetRecordIDs)
+		}
+
+		results, err := x.repo.GetRecordObjects(targetRecordIDs[i:ep], schema)
+		if err != nil && err != dynamo.ErrNotFound {
+			return nil, err
+		}
+		objects = append(objects, results...)
+	}
+	return objects, nil
+}
+
 // HeadPartition checks an existance of partition and cache the result.
 func (x *MetaService) HeadPartition(partitionKey string) (bool, error) {
 	if exists, ok := x.cachePartitionKey[partitionKey]; ok && exists {
@@ -108,6 +149,15 @@ func (x *MetaService) HeadPartition(partitionKey string) (bool, error) {
 	return exists, nil
 }
 
+// DeletePartition removes marker of partition and the cache.
+func (x *MetaService) DeletePartition(partitionKey string) error {
+	if err := x.repo.DeletePartition(partitionKey); err != nil {
+		return err
+	}
+	delete(x.cachePartitionKey, partitionKey)
+	return nil
+}
+
 // PutPartition register an existance of partition and cache the result.
 func (x *MetaService) PutPartition(partitionKey string) error {
 	if err := x.repo.PutPartition(partitionKey); err != nil {
@@ -116,3 +166,17 @@ func (x *MetaService) PutPartition(partitionKey string) error {
 	x.cachePartitionKey[partitionKey] = true
 	return nil
 }
+
+func toPartitionLockKey(location string) string {
+	return strings.TrimSuffix(location, "/") + "/"
+}
+
+// LockPartition acquires lock of the partition for owner. The lock prevents that compaction, retention and purge modify objects of same partition at same time. *location* is S3 path of original partition location. Same owner can acquire the lock again to extend it. It returns false if other owner has the lock.
+func (x *MetaService) LockPartition(location, owner string) (bool, error) {
+	return x.repo.LockPartition(toPartitionLockKey(location), owner, PartitionLockTTL)
+}
+
+// UnlockPartition releases lock of the partition if owner has it.
+func (x *MetaService) UnlockPartition(location, owner string) error {
+	return x.repo.UnlockPartition(toPartitionLockKey(location), owner)
+}
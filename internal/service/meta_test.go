@@ -3,6 +3,7 @@ package service_test
 import (
 	"math/rand"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -68,6 +69,10 @@ func testMetaService(t *testing.T, svc *service.MetaService) {
 	t.Run("Partition", func(tt *testing.T) {
 		testMetaPartition(tt, svc)
 	})
+
+	t.Run("PartitionLock", func(tt *testing.T) {
+		testMetaPartitionLock(tt, svc)
+	})
 }
 
 func testMetaServiceObjectID(t *testing.T, svc *service.MetaService) {
@@ -210,6 +215,35 @@ func testMetaObjectPathSet(t *testing.T, svc *service.MetaService) {
 		require.Error(tt, err)
 		assert.Nil(tt, result)
 	})
+
+	t.Run("Lookup objects without missing items", func(tt *testing.T) {
+		prefix := uuid.New().String()
+		id1 := uuid.New().String()
+		id2 := uuid.New().String()
+		items := []*repository.MetaRecordObject{
+			{
+				RecordID: id1,
+				Schema:   models.ParquetSchemaIndex,
+				S3Object: models.S3Object{
+					Bucket: "blue",
+					Region: "ap-northeast-1",
+					Key:    prefix + "/obj1",
+				},
+			},
+		}
+
+		err := svc.PutObjects(items)
+		require.NoError(tt, err)
+
+		results, err := svc.LookupObjects([]string{id1, id2}, models.ParquetSchemaIndex)
+		require.NoError(tt, err)
+		require.Equal(tt, 1, len(results))
+		assert.Equal(tt, prefix+"/obj1", results[0].Key)
+
+		results, err = svc.LookupObjects([]string{id2}, models.ParquetSchemaIndex)
+		require.NoError(tt, err)
+		assert.Equal(tt, 0, len(results))
+	})
 }
 
 func testMetaPartition(t *testing.T, svc *service.MetaService) {
@@ -233,3 +267,33 @@ func testMetaPartition(t *testing.T, svc *service.MetaService) {
 		assert.True(tt, exists)
 	})
 }
+
+func testMetaPartitionLock(t *testing.T, svc *service.MetaService) {
+	location := "s3://blue/" + uuid.New().String() + "/indices/dt=2020-01-02-03/"
+
+	locked, err := svc.LockPartition(location, "owner-a")
+	require.NoError(t, err)
+	assert.True(t, locked)
+
+	// Location without trailing slash is same partition
+	locked, err = svc.LockPartition(strings.TrimSuffix(location, "/"), "owner-b")
+	require.NoError(t, err)
+	assert.False(t, locked)
+
+	// Same owner can extend the lock
+	locked, err = svc.LockPartition(location, "owner-a")
+	require.NoError(t, err)
+	assert.True(t, locked)
+
+	// Other owner can not release the lock
+	require.NoError(t, svc.UnlockPartition(location, "owner-b"))
+	locked, err = svc.LockPartition(location, "owner-b")
+	require.NoError(t, err)
+	assert.False(t, locked)
+
+	require.NoError(t, svc.UnlockPartition(location, "owner-a"))
+	locked, err = svc.LockPartition(location, "owner-b")
+	require.NoError(t, err)
+	assert.True(t, locked)
+	require.NoError(t, svc.UnlockPartition(location, "owner-b"))
+}
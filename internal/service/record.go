@@ -1,6 +1,7 @@
 package service
 
 import (
+	"fmt"
 	"io"
 	"sync"
 
@@ -13,6 +14,10 @@ import (
 
 type RecordService struct {
 	ObjectSizeLimit int64
+	// TagPartition adds tag partition to RawObject if not nil
+	TagPartition *models.TagPartition
+	// DTGranularity is unit of "dt" partition. Default is hourly.
+	DTGranularity models.DTGranularity
 
 	s3Service  *S3Service
 	newEncoder adaptor.EncoderFactory
@@ -32,9 +37,10 @@ func NewRecordService(newS3 adaptor.S3ClientFactory, newEncoder adaptor.EncoderF
 }
 
 func (x *RecordService) Dump(q *models.LogQueue, objectID int64, dstBase *models.S3Object) error {
+	tagKey := x.TagPartition.Value(q.Tag)
 	prefixs := []*models.RawObjectPrefix{
-		models.NewRawObjectPrefix(models.ParquetSchemaIndex, *dstBase, q.Src, q.Timestamp),
-		models.NewRawObjectPrefix(models.ParquetSchemaMessage, *dstBase, q.Src, q.Timestamp),
+		models.NewRawObjectPrefix(models.ParquetSchemaIndex, *dstBase, q.Src, q.Timestamp, x.DTGranularity, tagKey),
+		models.NewRawObjectPrefix(models.ParquetSchemaMessage, *dstBase, q.Src, q.Timestamp, x.DTGranularity, tagKey),
 	}
 
 	for _, prefix := range prefixs {
@@ -57,16 +63,22 @@ func (x *RecordService) Close() error {
 	return nil
 }
 
-func (x *RecordService) Load(src *models.S3Object, schema models.ParquetSchemaName, ch chan *models.RecordQueue) error {
+// Load decodes records of a raw object and sends them to ch. It returns number of loaded records.
+func (x *RecordService) Load(src *models.S3Object, schema models.ParquetSchemaName, ch chan *models.RecordQueue) (int, error) {
 	const bufferSize = 512
+	if schema != models.ParquetSchemaIndex && schema != models.ParquetSchemaMessage {
+		return 0, fmt.Errorf("Unsupported schema '%v' in RecordService.Load", schema)
+	}
+
 	body, err := x.s3Service.AsyncDownload(*src)
 	if err != nil {
-		return errors.Wrap(err, "Failed AsyncDownload")
+		return 0, errors.Wrap(err, "Failed AsyncDownload")
 	}
 	defer body.Close()
 
 	decoder := x.newDecoder(body)
 	var q *models.RecordQueue
+	count := 0
 	for {
 		var record models.Record
 		switch schema {
@@ -74,16 +86,15 @@ func (x *RecordService) Load(src *models.S3Object, schema models.ParquetSchemaNa
 			record = &models.IndexRecord{}
 		case models.ParquetSchemaMessage:
 			record = &models.MessageRecord{}
-		default:
-			logger.Fatalf("Unsupported schema '%v' in RecordService.Load", schema)
 		}
 
 		if err := decoder.Decode(&record); err != nil {
 			if err == io.EOF {
 				break
 			}
-			return errors.Wrap(err, "Failed to decode record")
+			return count, errors.Wrap(err, "Failed to decode record")
 		}
+		count++
 
 		if q == nil {
 			q = &models.RecordQueue{}
@@ -100,7 +111,7 @@ func (x *RecordService) Load(src *models.S3Object, schema models.ParquetSchemaNa
 		ch <- q
 	}
 
-	return nil
+	return count, nil
 }
 
 func (x *RecordService) RawObjects() []*models.RawObject {
@@ -49,8 +49,9 @@ func TestRecordService(t *testing.T) {
 		ch := make(chan *models.RecordQueue, 1)
 		go func() {
 			defer close(ch)
-			err := svc.Load(idxObj.Object(), models.ParquetSchemaName(idxObj.Schema()), ch)
+			n, err := svc.Load(idxObj.Object(), models.ParquetSchemaName(idxObj.Schema()), ch)
 			require.NoError(tt, err)
+			assert.Equal(tt, 1, n)
 		}()
 
 		for q := range ch {
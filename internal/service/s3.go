@@ -1,9 +1,11 @@
 package service
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/url"
 	"os"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -35,6 +37,11 @@ func NewS3Service(newS3 adaptor.S3ClientFactory) *S3Service {
 	}
 }
 
+// NewS3ServiceWithClient is constructor of S3Service that uses the client for any region
+func NewS3ServiceWithClient(client adaptor.S3Client) *S3Service {
+	return NewS3Service(func(region string) adaptor.S3Client { return client })
+}
+
 // AsyncUpload is for uploading object by io.Reader.
 func (x *S3Service) AsyncUpload(body io.Reader, dst models.S3Object, encoding string) error {
 	client := x.newS3(dst.Region)
@@ -129,6 +136,41 @@ func (x *S3Service) UploadFileToS3(filePath string, dst models.S3Object) error {
 	return nil
 }
 
+// UploadBytesToS3 puts raw data as an object
+func (x *S3Service) UploadBytesToS3(raw []byte, dst models.S3Object) error {
+	client := x.newS3(dst.Region)
+	if _, err := client.PutObject(&s3.PutObjectInput{
+		Body:   bytes.NewReader(raw),
+		Bucket: aws.String(dst.Bucket),
+		Key:    aws.String(dst.Key),
+	}); err != nil {
+		return errors.Wrapf(err, "Fail to put an object: %s/%s", dst.Bucket, dst.Key)
+	}
+
+	return nil
+}
+
+// ReadObjectTail reads last size bytes of the object by range request. Whole object is returned if it's smaller than size.
+func (x *S3Service) ReadObjectTail(obj models.S3Object, size int64) ([]byte, error) {
+	client := x.newS3(obj.Region)
+	output, err := client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(obj.Bucket),
+		Key:    aws.String(obj.Key),
+		Range:  aws.String(fmt.Sprintf("bytes=-%d", size)),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to get tail of object: %s/%s", obj.Bucket, obj.Key)
+	}
+	defer output.Body.Close()
+
+	raw, err := ioutil.ReadAll(output.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to read tail of object: %s/%s", obj.Bucket, obj.Key)
+	}
+
+	return raw, nil
+}
+
 // DownloadS3Object downloads a specified remote object from S3
 func (x *S3Service) DownloadS3Object(obj models.S3Object) (*string, error) {
 	client := x.newS3(obj.Region)
@@ -199,7 +241,7 @@ func (x *S3Service) DownloadS3Object(obj models.S3Object) (*string, error) {
 // DeleteS3Objects is warpper of s3.DeleteObjects
 func (x *S3Service) DeleteS3Objects(objects []*models.S3Object) error {
 	if len(objects) == 0 {
-		logger.Warn("No target for DeleteObjects")
+		logger.Debug("No target for DeleteObjects")
 		return nil
 	}
 
@@ -234,7 +276,224 @@ func (x *S3Service) DeleteS3Objects(objects []*models.S3Object) error {
 		if err != nil {
 			return errors.Wrapf(err, "Fail to delete objects: %v", resp)
 		}
+		if resp != nil && len(resp.Errors) > 0 {
+			e := resp.Errors[0]
+			return fmt.Errorf("Fail to delete %d objects: %s %s", len(resp.Errors), aws.StringValue(e.Key), aws.StringValue(e.Message))
+		}
+	}
+
+	return nil
+}
+
+// DeleteS3Keys deletes objects of keys in the bucket by DeleteS3Objects
+func (x *S3Service) DeleteS3Keys(region, bucket string, keys []string) error {
+	var objects []*models.S3Object
+	for _, key := range keys {
+		obj := models.NewS3Object(region, bucket, key)
+		objects = append(objects, &obj)
+	}
+	return x.DeleteS3Objects(objects)
+}
+
+// CopyS3Object copies src object to dst. Both must be in same region.
+func (x *S3Service) CopyS3Object(src, dst models.S3Object) error {
+	client := x.newS3(dst.Region)
+	if _, err := client.CopyObject(&s3.CopyObjectInput{
+		Bucket:     aws.String(dst.Bucket),
+		Key:        aws.String(dst.Key),
+		CopySource: aws.String(url.PathEscape(src.Bucket + "/" + src.Key)),
+	}); err != nil {
+		return errors.Wrapf(err, "Fail to copy object from s3://%s/%s to s3://%s/%s", src.Bucket, src.Key, dst.Bucket, dst.Key)
+	}
+	return nil
+}
+
+// ListS3Objects returns all objects that have Key of prefix as key prefix. If delimiter is true, only objects directly under the prefix are returned.
+func (x *S3Service) ListS3Objects(prefix models.S3Object, delimiter bool) ([]*s3.Object, error) {
+	objects, _, err := x.listS3(prefix, delimiter)
+	return objects, err
+}
+
+// ListS3Dirs returns common prefixes directly under Key of prefix, e.g. "prefix/dt=2020-01-02/"
+func (x *S3Service) ListS3Dirs(prefix models.S3Object) ([]string, error) {
+	_, dirs, err := x.listS3(prefix, true)
+	return dirs, err
+}
+
+func (x *S3Service) listS3(prefix models.S3Object, delimiter bool) ([]*s3.Object, []string, error) {
+	client := x.newS3(prefix.Region)
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(prefix.Bucket),
+		Prefix: aws.String(prefix.Key),
+	}
+	if delimiter {
+		input.Delimiter = aws.String("/")
+	}
+
+	var objects []*s3.Object
+	var dirs []string
+	for {
+		output, err := client.ListObjectsV2(input)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "Fail to list objects: s3://%s/%s", prefix.Bucket, prefix.Key)
+		}
+		objects = append(objects, output.Contents...)
+		for _, p := range output.CommonPrefixes {
+			dirs = append(dirs, aws.StringValue(p.Prefix))
+		}
+
+		if !aws.BoolValue(output.IsTruncated) {
+			break
+		}
+		input.ContinuationToken = output.NextContinuationToken
 	}
 
+	return objects, dirs, nil
+}
+
+// DefaultMultipartPartSize is part size of S3MultipartWriter if not specified
+const DefaultMultipartPartSize = 16 * 1024 * 1024 // 16MB
+
+// S3MultipartWriter is io.WriteCloser to upload an object by S3 multipart upload. Written data is buffered up to part size and uploaded as a part. The object is created by Close and not visible until then. Abort must be called if writing fails.
+//
+// Abort is never called if the process is killed, e.g. timeout of Lambda, and uploaded parts remain and are charged. The destination bucket must have lifecycle rule AbortIncompleteMultipartUpload to clean them up.
+type S3MultipartWriter struct {
+	client   adaptor.S3Client
+	dst      models.S3Object
+	partSize int
+	uploadID *string
+	buf      []byte
+	parts    []*s3.CompletedPart
+	size     int64
+	closed   bool
+}
+
+// NewMultipartWriter starts multipart upload to dst. partSize must be 5MB or more for actual S3 because parts except last one smaller than 5MB are rejected. Zero means DefaultMultipartPartSize.
+func (x *S3Service) NewMultipartWriter(dst models.S3Object, partSize int) (*S3MultipartWriter, error) {
+	if partSize <= 0 {
+		partSize = DefaultMultipartPartSize
+	}
+
+	client := x.newS3(dst.Region)
+	output, err := client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket: aws.String(dst.Bucket),
+		Key:    aws.String(dst.Key),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to create multipart upload: %s/%s", dst.Bucket, dst.Key)
+	}
+
+	return &S3MultipartWriter{
+		client:   client,
+		dst:      dst,
+		partSize: partSize,
+		uploadID: output.UploadId,
+		buf:      make([]byte, 0, partSize),
+	}, nil
+}
+
+// Write buffers data and uploads parts if buffer exceeds part size
+func (x *S3MultipartWriter) Write(p []byte) (int, error) {
+	if x.closed {
+		return 0, fmt.Errorf("Multipart upload is already closed: %s/%s", x.dst.Bucket, x.dst.Key)
+	}
+
+	n := len(p)
+	for len(p) > 0 {
+		size := x.partSize - len(x.buf)
+		if size > len(p) {
+			size = len(p)
+		}
+		x.buf = append(x.buf, p[:size]...)
+		p = p[size:]
+
+		if len(x.buf) >= x.partSize {
+			if err := x.uploadPart(); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	x.size += int64(n)
+	return n, nil
+}
+
+func (x *S3MultipartWriter) uploadPart() error {
+	partNumber := int64(len(x.parts) + 1)
+	output, err := x.client.UploadPart(&s3.UploadPartInput{
+		Bucket:     aws.String(x.dst.Bucket),
+		Key:        aws.String(x.dst.Key),
+		UploadId:   x.uploadID,
+		PartNumber: aws.Int64(partNumber),
+		Body:       bytes.NewReader(x.buf),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Fail to upload part %d: %s/%s", partNumber, x.dst.Bucket, x.dst.Key)
+	}
+
+	x.parts = append(x.parts, &s3.CompletedPart{
+		ETag:       output.ETag,
+		PartNumber: aws.Int64(partNumber),
+	})
+	x.buf = x.buf[:0]
+	return nil
+}
+
+// Size returns total written bytes
+func (x *S3MultipartWriter) Size() int64 { return x.size }
+
+// Close uploads rest of buffer as last part and completes multipart upload. Then the object becomes visible.
+func (x *S3MultipartWriter) Close() error {
+	if x.closed {
+		return nil
+	}
+
+	if len(x.buf) > 0 || len(x.parts) == 0 {
+		if err := x.uploadPart(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := x.client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(x.dst.Bucket),
+		Key:             aws.String(x.dst.Key),
+		UploadId:        x.uploadID,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: x.parts},
+	}); err != nil {
+		return errors.Wrapf(err, "Fail to complete multipart upload: %s/%s", x.dst.Bucket, x.dst.Key)
+	}
+
+	x.closed = true
+	logger.WithFields(logrus.Fields{
+		"bucket": x.dst.Bucket,
+		"key":    x.dst.Key,
+		"parts":  len(x.parts),
+		"size":   x.size,
+	}).Debug("Completed multipart upload")
+
+	return nil
+}
+
+// Abort discards uploaded parts. It does nothing after Close succeeded, then it can be called by defer.
+func (x *S3MultipartWriter) Abort() error {
+	if x.closed {
+		return nil
+	}
+	x.closed = true
+	x.buf = nil
+
+	if _, err := x.client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(x.dst.Bucket),
+		Key:      aws.String(x.dst.Key),
+		UploadId: x.uploadID,
+	}); err != nil {
+		return errors.Wrapf(err, "Fail to abort multipart upload: %s/%s", x.dst.Bucket, x.dst.Key)
+	}
+
+	logger.WithFields(logrus.Fields{
+		"bucket": x.dst.Bucket,
+		"key":    x.dst.Key,
+	}).Warn("Aborted multipart upload")
+
 	return nil
 }
@@ -1,6 +1,7 @@
 package service_test
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"strings"
@@ -83,3 +84,99 @@ func TestDeleteObjects(t *testing.T) {
 	})
 	require.NoError(t, err)
 }
+
+func TestS3ListCopyAndDelete(t *testing.T) {
+	bucket := uuid.New().String()
+	client := mock.NewS3Client("dokoka").(*mock.S3Client)
+	svc := service.NewS3ServiceWithClient(client)
+
+	var keys []string
+	for i := 0; i < 1001; i++ {
+		key := fmt.Sprintf("p/dt=%d/k%d", i%3, i)
+		require.NoError(t, client.Upload(bucket, key, strings.NewReader("a"), ""))
+		keys = append(keys, key)
+	}
+
+	dirs, err := svc.ListS3Dirs(models.NewS3Object("dokoka", bucket, "p/"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"p/dt=0/", "p/dt=1/", "p/dt=2/"}, dirs)
+
+	objects, err := svc.ListS3Objects(models.NewS3Object("dokoka", bucket, "p/"), true)
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(objects))
+	objects, err = svc.ListS3Objects(models.NewS3Object("dokoka", bucket, "p/"), false)
+	require.NoError(t, err)
+	assert.Equal(t, 1001, len(objects))
+
+	require.NoError(t, svc.CopyS3Object(models.NewS3Object("dokoka", bucket, keys[0]), models.NewS3Object("dokoka", bucket, "copied/k 0")))
+	assert.Equal(t, []string{"copied/k 0"}, client.Keys(bucket, "copied/"))
+
+	// Over limit of DeleteObjects
+	require.NoError(t, svc.DeleteS3Keys("dokoka", bucket, keys))
+	assert.Empty(t, client.Keys(bucket, "p/"))
+}
+
+func TestS3MultipartWriter(t *testing.T) {
+	t.Run("upload written data as parts", func(tt *testing.T) {
+		bucket := uuid.New().String()
+		svc := service.NewS3Service(mock.NewS3Client)
+		dst := models.NewS3Object("dokoka", bucket, "multipart.txt")
+
+		w, err := svc.NewMultipartWriter(dst, 10)
+		require.NoError(tt, err)
+		for _, s := range []string{"five ", "timeless words", " and", " more"} {
+			_, err := w.Write([]byte(s))
+			require.NoError(tt, err)
+		}
+		assert.Equal(tt, 1, mock.MultipartUploads(bucket))
+
+		// Not visible before Close
+		client := mock.NewS3Client("dokoka")
+		_, err = client.GetObject(&s3.GetObjectInput{Bucket: &bucket, Key: aws.String("multipart.txt")})
+		require.Error(tt, err)
+
+		require.NoError(tt, w.Close())
+		require.NoError(tt, w.Abort()) // no effect after Close
+		assert.Equal(tt, int64(28), w.Size())
+		assert.Equal(tt, 0, mock.MultipartUploads(bucket))
+
+		out, err := client.GetObject(&s3.GetObjectInput{Bucket: &bucket, Key: aws.String("multipart.txt")})
+		require.NoError(tt, err)
+		raw, err := ioutil.ReadAll(out.Body)
+		require.NoError(tt, err)
+		assert.Equal(tt, "five timeless words and more", string(raw))
+	})
+
+	t.Run("empty object can be uploaded", func(tt *testing.T) {
+		bucket := uuid.New().String()
+		svc := service.NewS3Service(mock.NewS3Client)
+		dst := models.NewS3Object("dokoka", bucket, "empty.txt")
+
+		w, err := svc.NewMultipartWriter(dst, 10)
+		require.NoError(tt, err)
+		require.NoError(tt, w.Close())
+
+		_, err = mock.NewS3Client("dokoka").GetObject(&s3.GetObjectInput{Bucket: &bucket, Key: aws.String("empty.txt")})
+		require.NoError(tt, err)
+	})
+
+	t.Run("abort discards uploaded parts", func(tt *testing.T) {
+		bucket := uuid.New().String()
+		svc := service.NewS3Service(mock.NewS3Client)
+		dst := models.NewS3Object("dokoka", bucket, "aborted.txt")
+
+		w, err := svc.NewMultipartWriter(dst, 10)
+		require.NoError(tt, err)
+		_, err = w.Write([]byte("five timeless words"))
+		require.NoError(tt, err)
+		require.NoError(tt, w.Abort())
+		assert.Equal(tt, 0, mock.MultipartUploads(bucket))
+
+		_, err = w.Write([]byte("more"))
+		assert.Error(tt, err)
+		require.NoError(tt, w.Close()) // no effect after Abort
+
+		_, err = mock.NewS3Client("dokoka").GetObject(&s3.GetObjectInput{Bucket: &bucket, Key: aws.String("aborted.txt")})
+		require.Error(tt, err)
+	})
+}
@@ -109,6 +109,37 @@ func (x *SQSService) ReceiveMessage(url string, timeout int64, msg interface{})
 	return receipt, nil
 }
 
+// PeekMessages receives all messages in the queue without deleting them, and returns their bodies. Received messages are invisible for timeout seconds, then a message is not received twice in a peek. Note that receiving a message increments its receive count, then it should not be used for queue with redrive policy.
+func (x *SQSService) PeekMessages(url string, timeout int64) ([]string, error) {
+	region, err := extractSQSRegion(url)
+	if err != nil {
+		return nil, err
+	}
+	client := x.newSQS(region)
+
+	var bodies []string
+	for {
+		output, err := client.ReceiveMessage(&sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(url),
+			VisibilityTimeout:   aws.Int64(timeout),
+			MaxNumberOfMessages: aws.Int64(10),
+			WaitTimeSeconds:     aws.Int64(1),
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "Fail to peek SQS messages: %s", url)
+		}
+		if len(output.Messages) == 0 {
+			break
+		}
+
+		for _, msg := range output.Messages {
+			bodies = append(bodies, aws.StringValue(msg.Body))
+		}
+	}
+
+	return bodies, nil
+}
+
 // DeleteMessage is wrapper of sqs:DeleteMessage
 func (x *SQSService) DeleteMessage(url string, receipt string) error {
 	region, err := extractSQSRegion(url)
@@ -7,16 +7,16 @@ import (
 	"github.com/aws/aws-lambda-go/events"
 )
 
-// EncapBySQS encapslates data by events.SQSEvent and returns it.
-func EncapBySQS(data interface{}) *events.SQSEvent {
-	raw, err := json.Marshal(data)
-	if err != nil {
-		log.Fatalf("Can not marshal: %+v: %v", err, data)
+// EncapBySQS encapslates data by events.SQSEvent and returns it. Each data becomes one SQS message.
+func EncapBySQS(data ...interface{}) *events.SQSEvent {
+	var ev events.SQSEvent
+	for _, d := range data {
+		raw, err := json.Marshal(d)
+		if err != nil {
+			log.Fatalf("Can not marshal: %+v: %v", err, d)
+		}
+		ev.Records = append(ev.Records, events.SQSMessage{Body: string(raw)})
 	}
 
-	return &events.SQSEvent{
-		Records: []events.SQSMessage{
-			{Body: string(raw)},
-		},
-	}
+	return &ev
 }
@@ -0,0 +1,44 @@
+package transform
+
+import (
+	"sort"
+	"unicode/utf8"
+)
+
+// TermMatch indicates a position of matched term in a field value. Begin and End are character (rune) offsets in the value string.
+type TermMatch struct {
+	Field string `json:"field"`
+	Term  string `json:"term"`
+	Begin int    `json:"begin"`
+	End   int    `json:"end"`
+}
+
+// MatchTerms finds positions of terms in a log. The log is flattened and tokenized in the same way as LogToIndexRecord, then a matched position is same as one of indexed term. Numbers in the log should be decoded with UseNumber as indexer does, float64 may be formatted differently from the indexed term.
+func MatchTerms(v interface{}, terms map[string]bool) []TermMatch {
+	var matches []TermMatch
+
+	for _, kv := range toKeyValuePairs(v, "", false) {
+		pos := 0
+		for _, token := range globalTokenizer.Split(formatValue(kv.Value)) {
+			length := utf8.RuneCountInString(token.Data)
+			if !token.IsDelim && terms[token.Data] {
+				matches = append(matches, TermMatch{
+					Field: kv.Key,
+					Term:  token.Data,
+					Begin: pos,
+					End:   pos + length,
+				})
+			}
+			pos += length
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Field != matches[j].Field {
+			return matches[i].Field < matches[j].Field
+		}
+		return matches[i].Begin < matches[j].Begin
+	})
+
+	return matches
+}
@@ -0,0 +1,73 @@
+package transform_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/m-mizutani/minerva/internal/transform"
+	"github.com/m-mizutani/minerva/pkg/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchTerms(t *testing.T) {
+	var v interface{}
+	raw := `{"user":{"name":"mizutani@cookpad.com"},"src":"10.0.0.1","port":8080,"msg":"ログイン by mizutani"}`
+	require.NoError(t, json.Unmarshal([]byte(raw), &v))
+
+	matches := transform.MatchTerms(v, map[string]bool{
+		"mizutani": true,
+		"10.0.0.1": true,
+		"8080":     true,
+	})
+
+	assert.Equal(t, []transform.TermMatch{
+		{Field: "msg", Term: "mizutani", Begin: 8, End: 16},
+		{Field: "port", Term: "8080", Begin: 0, End: 4},
+		{Field: "src", Term: "10.0.0.1", Begin: 0, End: 8},
+		{Field: "user.name", Term: "mizutani", Begin: 0, End: 8},
+	}, matches)
+}
+
+func TestMatchTermsSameAsIndex(t *testing.T) {
+	raw := `{"count":1234567,"ratio":0.25,"big":1e3,"one":1.0,"huge":123456789012345678901}`
+	decode := func() interface{} {
+		var v interface{}
+		decoder := json.NewDecoder(strings.NewReader(raw))
+		decoder.UseNumber()
+		require.NoError(t, decoder.Decode(&v))
+		return v
+	}
+
+	// Indexer decodes a log with UseNumber and a number is indexed as original text
+	records, err := transform.LogToIndexRecord(&models.LogQueue{Value: decode()}, 1)
+	require.NoError(t, err)
+	terms := map[string]bool{}
+	for _, r := range records {
+		terms[r.(models.IndexRecord).Term] = true
+	}
+	assert.True(t, terms["1234567"])
+	assert.True(t, terms["25"])
+	assert.True(t, terms["1e3"])
+	assert.True(t, terms["123456789012345678901"])
+
+	// Float64 is indexed by %v as before
+	records, err = transform.LogToIndexRecord(&models.LogQueue{Value: map[string]interface{}{"count": float64(1234567)}}, 1)
+	require.NoError(t, err)
+	for _, r := range records {
+		assert.NotEqual(t, "1234567", r.(models.IndexRecord).Term)
+	}
+
+	// API decodes a log with UseNumber as well
+	matches := transform.MatchTerms(decode(), terms)
+	assert.Equal(t, []transform.TermMatch{
+		{Field: "big", Term: "1e3", Begin: 0, End: 3},
+		{Field: "count", Term: "1234567", Begin: 0, End: 7},
+		{Field: "huge", Term: "123456789012345678901", Begin: 0, End: 21},
+		{Field: "one", Term: "1", Begin: 0, End: 1},
+		{Field: "one", Term: "0", Begin: 2, End: 3},
+		{Field: "ratio", Term: "0", Begin: 0, End: 1},
+		{Field: "ratio", Term: "25", Begin: 2, End: 4},
+	}, matches)
+}
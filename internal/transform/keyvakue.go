@@ -136,3 +136,18 @@ func toKeyValuePairs(v interface{}, keyPrefix string, omitempty bool) []keyValue
 		return []keyValuePair{} // returns empty list.
 	}
 }
+
+// FieldValue is a flattened field of log and string of the value.
+type FieldValue struct {
+	Field string
+	Value string
+}
+
+// FlattenLog converts a log to list of field and value string in the same way as LogToIndexRecord.
+func FlattenLog(v interface{}) []FieldValue {
+	var fields []FieldValue
+	for _, kv := range toKeyValuePairs(v, "", false) {
+		fields = append(fields, FieldValue{Field: kv.Key, Value: formatValue(kv.Value)})
+	}
+	return fields
+}
@@ -1,6 +1,7 @@
 package transform
 
 import (
+	"encoding/json"
 	"fmt"
 
 	"github.com/m-mizutani/minerva/internal/tokenizer"
@@ -16,6 +17,14 @@ type indexTerm struct {
 
 var globalTokenizer = tokenizer.NewSimpleTokenizer()
 
+// formatValue converts a field value to string for indexing and highlight. A number decoded with UseNumber is formatted as original text of JSON.
+func formatValue(v interface{}) string {
+	if n, ok := v.(json.Number); ok {
+		return n.String()
+	}
+	return fmt.Sprintf("%v", v)
+}
+
 // LogToIndexRecord transforms from LogQueue to IndexRecord(s). Wrapper of logToIndexRecord.
 func LogToIndexRecord(q *models.LogQueue, objID int64) ([]interface{}, error) {
 	var out []interface{}
@@ -23,7 +32,7 @@ func LogToIndexRecord(q *models.LogQueue, objID int64) ([]interface{}, error) {
 	kvList := toKeyValuePairs(q.Value, "", false)
 
 	for _, kv := range kvList {
-		tokens := globalTokenizer.Split(fmt.Sprintf("%v", kv.Value))
+		tokens := globalTokenizer.Split(formatValue(kv.Value))
 
 		for _, token := range tokens {
 			if token.IsDelim || token.IsSpace() {
@@ -3,15 +3,21 @@ package main
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
 	"github.com/m-mizutani/minerva/internal"
 	"github.com/sirupsen/logrus"
 
 	ginadapter "github.com/awslabs/aws-lambda-go-api-proxy/gin"
 	"github.com/gin-gonic/gin"
 	"github.com/m-mizutani/minerva/pkg/api"
+	"github.com/m-mizutani/minerva/pkg/models"
+	"github.com/pkg/errors"
 )
 
 var logger = internal.Logger
@@ -30,9 +36,89 @@ func main() {
 		MetaTableName:    os.Getenv("META_TABLE_NAME"),
 	}
 
+	if v := os.Getenv("SEARCH_CACHE_TTL"); v != "" {
+		ttl, err := time.ParseDuration(v)
+		if err != nil {
+			logger.WithError(err).WithField("SEARCH_CACHE_TTL", v).Fatal("Invalid duration format")
+		}
+		args.SearchCacheTTL = ttl
+	}
+
+	for env, dst := range map[string]*int64{
+		"DAILY_SCAN_QUOTA":   &args.DailyScanQuota,
+		"MONTHLY_SCAN_QUOTA": &args.MonthlyScanQuota,
+	} {
+		if v := os.Getenv(env); v != "" {
+			size, err := api.ParseByteSize(v)
+			if err != nil {
+				logger.WithError(err).WithField(env, v).Fatal("Invalid byte size format")
+			}
+			*dst = size
+		}
+	}
+
+	if v := os.Getenv("AUDIT_RETENTION"); v != "" {
+		retention, err := time.ParseDuration(v)
+		if err != nil {
+			logger.WithError(err).WithField("AUDIT_RETENTION", v).Fatal("Invalid duration format")
+		}
+		args.AuditRetention = retention
+	}
+
+	if v := os.Getenv("MASK_CONFIG"); v != "" {
+		config, err := api.ParseMaskConfig([]byte(v))
+		if err != nil {
+			logger.WithError(err).Fatal("Invalid MASK_CONFIG")
+		}
+		args.Masking = config
+	}
+
+	if v := os.Getenv("ADMIN_CONFIG"); v != "" {
+		config, err := api.ParseAdminConfig([]byte(v))
+		if err != nil {
+			logger.WithError(err).Fatal("Invalid ADMIN_CONFIG")
+		}
+		args.Admin = config
+	}
+
+	tagPartition, err := models.ParseTagPartition(os.Getenv("TAG_PARTITION"))
+	if err != nil {
+		logger.WithError(err).Fatal("Invalid TAG_PARTITION")
+	}
+	args.TagPartition = tagPartition
+
+	projected, err := models.ParseProjectedGranularity(os.Getenv("PARTITION_PROJECTION") == "true", os.Getenv("PARTITION_GRANULARITY"))
+	if err != nil {
+		logger.WithError(err).Fatal("Invalid PARTITION_GRANULARITY")
+	}
+	args.ProjectedGranularity = projected
+
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.Default()
 	v1 := r.Group("/api/v1")
+	v1.Use(api.AuditMiddleware(args.AuditSink()))
+
+	authConfig := os.Getenv("AUTH_CONFIG")
+	if arn := os.Getenv("AUTH_CONFIG_SECRET_ARN"); arn != "" {
+		v, err := getSecretString(args.Region, arn)
+		if err != nil {
+			logger.WithError(err).WithField("AUTH_CONFIG_SECRET_ARN", arn).Fatal("Fail to get auth config")
+		}
+		authConfig = v
+	}
+
+	if authConfig != "" {
+		config, err := api.ParseAuthConfig([]byte(authConfig))
+		if err != nil {
+			logger.WithError(err).Fatal("Invalid AUTH_CONFIG")
+		}
+		authenticators, err := api.NewAuthenticators(config)
+		if err != nil {
+			logger.WithError(err).Fatal("Fail to setup authenticators")
+		}
+		v1.Use(api.AuthMiddleware(authenticators...))
+	}
+
 	api.SetupRoute(v1, &args)
 	ginLambda := ginadapter.New(r)
 
@@ -40,3 +126,18 @@ func main() {
 		return ginLambda.Proxy(req)
 	})
 }
+
+// getSecretString retrieves a secret of Secrets Manager. Auth config has API keys, then it's not given by environment variable.
+func getSecretString(region, secretID string) (string, error) {
+	ssn := session.Must(session.NewSession(&aws.Config{Region: aws.String(region)}))
+	client := secretsmanager.New(ssn)
+
+	output, err := client.GetSecretValue(&secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(secretID),
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "Fail to get secret value: %s", secretID)
+	}
+
+	return aws.StringValue(output.SecretString), nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"time"
+
+	"github.com/m-mizutani/minerva/pkg/handler"
+	"github.com/m-mizutani/minerva/pkg/merger"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var logger = handler.Logger
+
+const (
+	defaultCompactionMinAge = 24 * time.Hour
+	// compactionLookback is range of partitions checked by each run. Partitions older than it are not compacted because runs are scheduled hourly.
+	compactionLookback = 7 * 24 * time.Hour
+)
+
+func main() {
+	handler.StartLambda(Handler)
+}
+
+// Handler is exported for testing. It's invoked by scheduled event and compacts partitions older than COMPACTION_MIN_AGE.
+func Handler(args handler.Arguments) error {
+	minAge := defaultCompactionMinAge
+	if args.CompactionMinAge != "" {
+		d, err := time.ParseDuration(args.CompactionMinAge)
+		if err != nil {
+			return errors.Wrapf(err, "Invalid COMPACTION_MIN_AGE: %s", args.CompactionMinAge)
+		}
+		minAge = d
+	}
+
+	parquetConfig, err := merger.ParseParquetConfig(args.ParquetConfig)
+	if err != nil {
+		return err
+	}
+
+	compactor := &merger.Compactor{
+		S3:       args.S3Client(),
+		Glue:     args.GlueClient(),
+		Meta:     args.MetaService(),
+		Bucket:   args.S3Bucket,
+		Prefix:   args.S3Prefix,
+		Database: args.AthenaDBName,
+
+		SortRecords: args.MergeSortRecords,
+		Parquet:     parquetConfig,
+	}
+
+	end := time.Now().UTC().Add(-minAge)
+	results, err := compactor.Compact(end.Add(-compactionLookback), end)
+	if err != nil {
+		return err
+	}
+
+	var sources int
+	for _, c := range results {
+		sources += len(c.Sources)
+	}
+	logger.WithFields(logrus.Fields{
+		"partitions": len(results),
+		"sources":    sources,
+	}).Info("Done compaction")
+
+	return nil
+}
@@ -20,7 +20,7 @@ func main() {
 }
 
 func mergeHandler(args handler.Arguments) error {
-	// Clean up /tmp for undeleted .parquet files
+	// Clean up /tmp for undeleted .parquet files and sort runs. No .parquet file is created in streaming mode.
 	if _, ok := os.LookupEnv("AWS_LAMBDA_FUNCTION_NAME"); ok {
 		tmpDir := "/tmp"
 		files, err := ioutil.ReadDir(tmpDir)
@@ -29,9 +29,9 @@ func mergeHandler(args handler.Arguments) error {
 		}
 
 		for _, file := range files {
-			if strings.HasSuffix(file.Name(), ".parquet") {
+			if strings.HasSuffix(file.Name(), ".parquet") || strings.HasSuffix(file.Name(), ".sort") {
 				if err := os.Remove(filepath.Join(tmpDir, file.Name())); err != nil {
-					logger.WithError(err).Warn("can not remove existing .parquet file")
+					logger.WithError(err).Warn("can not remove existing temp file")
 				}
 			}
 		}
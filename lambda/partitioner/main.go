@@ -1,10 +1,9 @@
 package main
 
 import (
-	"fmt"
-
 	"github.com/m-mizutani/minerva/pkg/handler"
 	"github.com/m-mizutani/minerva/pkg/models"
+	"github.com/m-mizutani/minerva/pkg/partition"
 	"github.com/pkg/errors"
 )
 
@@ -14,7 +13,7 @@ func main() {
 	handler.StartLambda(Handler)
 }
 
-// Handler is exported for testing
+// Handler is exported for testing. All PartitionQueue in SQS event are created by batch.
 func Handler(args handler.Arguments) error {
 	records, err := args.DecapSQSEvent()
 	if err != nil {
@@ -22,18 +21,25 @@ func Handler(args handler.Arguments) error {
 	}
 
 	meta := args.MetaService()
-	outputPath := fmt.Sprintf("s3://%s/%soutput", args.S3Bucket, args.S3Prefix)
+	var queues []*models.PartitionQueue
 	for _, record := range records {
 		var q models.PartitionQueue
 		if err := record.Bind(&q); err != nil {
 			return err
 		}
 
-		logger.WithField("queue", q).Info("Run composer")
-
-		if err := createPartition(args.AwsRegion, args.AthenaDBName, &q, meta, outputPath); err != nil {
-			return errors.Wrapf(err, "Fail to create partition")
+		if has, err := meta.HeadPartition(q.Location); err != nil {
+			return err
+		} else if has {
+			continue // Nothing to do
 		}
+		queues = append(queues, &q)
+	}
+
+	logger.WithField("queues", len(queues)).Info("Run partitioner")
+
+	if err := partition.Create(args.GlueClient(), args.AthenaDBName, queues, meta); err != nil {
+		return errors.Wrap(err, "Fail to create partition")
 	}
 
 	return nil
@@ -0,0 +1,133 @@
+package main_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/m-mizutani/minerva/internal/adaptor"
+	"github.com/m-mizutani/minerva/internal/mock"
+	"github.com/m-mizutani/minerva/internal/repository"
+	"github.com/m-mizutani/minerva/internal/testutil"
+	"github.com/m-mizutani/minerva/pkg/handler"
+	"github.com/m-mizutani/minerva/pkg/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	partitioner "github.com/m-mizutani/minerva/lambda/partitioner"
+)
+
+func newQueue(table, dt string) models.PartitionQueue {
+	return models.PartitionQueue{
+		Location:  "s3://bucket/prefix/" + table + "/dt=" + dt + "/",
+		TableName: table,
+		Keys:      map[string]string{"dt": dt},
+	}
+}
+
+func newArgs(catalog *mock.GlueCatalog, meta repository.MetaRepository, queues ...interface{}) handler.Arguments {
+	return handler.Arguments{
+		EnvVars:  handler.EnvVars{AthenaDBName: "db"},
+		Event:    testutil.EncapBySQS(queues...),
+		NewGlue:  func(region string) adaptor.GlueClient { return catalog },
+		MetaRepo: meta,
+	}
+}
+
+func TestPartitioner(t *testing.T) {
+	t.Run("Create partitions by batch", func(tt *testing.T) {
+		catalog := mock.NewGlueCatalog()
+		catalog.PutTable("db", "indices", "s3://bucket/prefix/indices/", "dt")
+		catalog.PutTable("db", "messages", "s3://bucket/prefix/messages/", "dt")
+		meta := mock.NewMetaRepository()
+
+		args := newArgs(catalog, meta,
+			newQueue("indices", "2020-01-02-03"),
+			newQueue("messages", "2020-01-02-03"),
+			newQueue("indices", "2020-01-02-04"),
+			newQueue("indices", "2020-01-02-03"), // duplicated
+		)
+		require.NoError(tt, partitioner.Handler(args))
+
+		assert.Equal(tt, 2, catalog.BatchCalls) // one call per table
+		assert.Equal(tt, []string{"2020-01-02-03", "2020-01-02-04"}, catalog.Partitions("db", "indices"))
+		assert.Equal(tt, []string{"2020-01-02-03"}, catalog.Partitions("db", "messages"))
+
+		p := catalog.Partition("db", "indices", "2020-01-02-04")
+		require.NotNil(tt, p)
+		assert.Equal(tt, "s3://bucket/prefix/indices/dt=2020-01-02-04/", *p.StorageDescriptor.Location)
+		assert.NotNil(tt, p.StorageDescriptor.SerdeInfo)
+
+		has, err := meta.HeadPartition("s3://bucket/prefix/indices/dt=2020-01-02-04/")
+		require.NoError(tt, err)
+		assert.True(tt, has)
+
+		// Marked partitions are skipped
+		require.NoError(tt, partitioner.Handler(newArgs(catalog, meta, newQueue("indices", "2020-01-02-03"))))
+		assert.Equal(tt, 2, catalog.BatchCalls)
+	})
+
+	t.Run("Values in order of table partition keys", func(tt *testing.T) {
+		catalog := mock.NewGlueCatalog()
+		catalog.PutTable("db", "indices", "s3://bucket/prefix/indices/", "dt", "tag_group")
+		meta := mock.NewMetaRepository()
+
+		q := models.PartitionQueue{
+			Location:  "s3://bucket/prefix/indices/dt=2020-01-02-03/tag_group=aws/",
+			TableName: "indices",
+			Keys:      map[string]string{"tag_group": "aws", "dt": "2020-01-02-03"},
+		}
+		require.NoError(tt, partitioner.Handler(newArgs(catalog, meta, q)))
+		assert.Equal(tt, []string{"2020-01-02-03/aws"}, catalog.Partitions("db", "indices"))
+	})
+
+	t.Run("Already existing partition is marked", func(tt *testing.T) {
+		catalog := mock.NewGlueCatalog()
+		catalog.PutTable("db", "indices", "s3://bucket/prefix/indices/", "dt")
+		require.NoError(tt, partitioner.Handler(newArgs(catalog, mock.NewMetaRepository(), newQueue("indices", "2020-01-02-03"))))
+
+		meta := mock.NewMetaRepository()
+		require.NoError(tt, partitioner.Handler(newArgs(catalog, meta, newQueue("indices", "2020-01-02-03"))))
+		has, err := meta.HeadPartition("s3://bucket/prefix/indices/dt=2020-01-02-03/")
+		require.NoError(tt, err)
+		assert.True(tt, has)
+	})
+
+	t.Run("Failed partition is not marked", func(tt *testing.T) {
+		catalog := mock.NewGlueCatalog()
+		catalog.PutTable("db", "indices", "s3://bucket/prefix/indices/", "dt")
+		catalog.FailValues["2020-01-02-04"] = true
+		meta := mock.NewMetaRepository()
+
+		err := partitioner.Handler(newArgs(catalog, meta,
+			newQueue("indices", "2020-01-02-03"),
+			newQueue("indices", "2020-01-02-04"),
+		))
+		require.Error(tt, err)
+
+		has, err := meta.HeadPartition("s3://bucket/prefix/indices/dt=2020-01-02-03/")
+		require.NoError(tt, err)
+		assert.True(tt, has)
+		has, err = meta.HeadPartition("s3://bucket/prefix/indices/dt=2020-01-02-04/")
+		require.NoError(tt, err)
+		assert.False(tt, has)
+	})
+
+	t.Run("Missing table", func(tt *testing.T) {
+		catalog := mock.NewGlueCatalog()
+		err := partitioner.Handler(newArgs(catalog, mock.NewMetaRepository(), newQueue("indices", "2020-01-02-03")))
+		assert.Error(tt, err)
+	})
+
+	t.Run("Many partitions are split into batches", func(tt *testing.T) {
+		catalog := mock.NewGlueCatalog()
+		catalog.PutTable("db", "indices", "s3://bucket/prefix/indices/", "dt")
+
+		var queues []interface{}
+		for i := 0; i < 150; i++ {
+			queues = append(queues, newQueue("indices", fmt.Sprintf("2020-01-02-%03d", i)))
+		}
+		require.NoError(tt, partitioner.Handler(newArgs(catalog, mock.NewMetaRepository(), queues...)))
+		assert.Equal(tt, 2, catalog.BatchCalls)
+		assert.Equal(tt, 150, len(catalog.Partitions("db", "indices")))
+	})
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/m-mizutani/minerva/internal"
+	"github.com/m-mizutani/minerva/pkg/api"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var logger = internal.Logger
+
+// athenaQueryStateChange is detail of "Athena Query State Change" event
+type athenaQueryStateChange struct {
+	CurrentState     string `json:"currentState"`
+	QueryExecutionID string `json:"queryExecutionId"`
+}
+
+func main() {
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.SetLevel(logrus.InfoLevel)
+	internal.SetupLogger(os.Getenv("LOG_LEVEL"))
+
+	args := api.MinervaHandler{
+		Region:        os.Getenv("AWS_REGION"),
+		MetaTableName: os.Getenv("META_TABLE_NAME"),
+	}
+
+	lambda.Start(func(event events.CloudWatchEvent) error {
+		var detail athenaQueryStateChange
+		if err := json.Unmarshal(event.Detail, &detail); err != nil {
+			return errors.Wrapf(err, "Fail to parse Athena query state change: %s", string(event.Detail))
+		}
+
+		switch detail.CurrentState {
+		case "SUCCEEDED", "FAILED", "CANCELLED":
+			return args.CompleteAthenaQuery(detail.QueryExecutionID)
+		default:
+			return nil
+		}
+	})
+}
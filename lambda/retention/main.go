@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/m-mizutani/minerva/pkg/handler"
+	"github.com/m-mizutani/minerva/pkg/partition"
+	"github.com/sirupsen/logrus"
+)
+
+var logger = handler.Logger
+
+func main() {
+	handler.StartLambda(Handler)
+}
+
+// Handler is exported for testing. It's invoked by scheduled event and deletes expired partitions.
+func Handler(args handler.Arguments) error {
+	policy, err := partition.ParseRetentionPolicy(args.RetentionConfig)
+	if err != nil {
+		return err
+	}
+	if policy == nil {
+		return fmt.Errorf("RETENTION_CONFIG is required for retention")
+	}
+
+	expirer := &partition.Expirer{
+		S3:       args.S3Client(),
+		Glue:     args.GlueClient(),
+		Meta:     args.MetaService(),
+		Bucket:   args.S3Bucket,
+		Prefix:   args.S3Prefix,
+		Database: args.AthenaDBName,
+	}
+
+	report, err := expirer.Expire(policy, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	logger.WithFields(logrus.Fields{
+		"partitions":     len(report.Partitions),
+		"raw_partitions": len(report.RawPartitions),
+		"outputs":        report.Outputs,
+		"objects":        report.Objects,
+		"bytes":          report.Bytes,
+	}).Info("Done retention")
+
+	return nil
+}
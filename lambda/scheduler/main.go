@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/m-mizutani/minerva/internal"
+	"github.com/m-mizutani/minerva/pkg/api"
+	"github.com/m-mizutani/minerva/pkg/models"
+	"github.com/sirupsen/logrus"
+)
+
+var logger = internal.Logger
+
+func main() {
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.SetLevel(logrus.InfoLevel)
+	internal.SetupLogger(os.Getenv("LOG_LEVEL"))
+
+	args := api.MinervaHandler{
+		DatabaseName:     os.Getenv("ATHENA_DB_NAME"),
+		IndexTableName:   os.Getenv("INDEX_TABLE_NAME"),
+		MessageTableName: os.Getenv("MESSAGE_TABLE_NAME"),
+		OutputPath:       fmt.Sprintf("s3://%s/%soutput", os.Getenv("S3_BUCKET"), os.Getenv("S3_PREFIX")),
+		Region:           os.Getenv("AWS_REGION"),
+		MetaTableName:    os.Getenv("META_TABLE_NAME"),
+	}
+
+	// Partition settings must be same as apiHandler to build same SQL
+	tagPartition, err := models.ParseTagPartition(os.Getenv("TAG_PARTITION"))
+	if err != nil {
+		logger.WithError(err).Fatal("Invalid TAG_PARTITION")
+	}
+	args.TagPartition = tagPartition
+
+	projected, err := models.ParseProjectedGranularity(os.Getenv("PARTITION_PROJECTION") == "true", os.Getenv("PARTITION_GRANULARITY"))
+	if err != nil {
+		logger.WithError(err).Fatal("Invalid PARTITION_GRANULARITY")
+	}
+	args.ProjectedGranularity = projected
+
+	if v := os.Getenv("ALERT_WEBHOOK_URL"); v != "" {
+		args.Notifiers = append(args.Notifiers, api.NewWebhookNotifier(v))
+	}
+	if v := os.Getenv("ALERT_SNS_TOPIC_ARN"); v != "" {
+		args.Notifiers = append(args.Notifiers, api.NewSNSNotifier(args.Region, v))
+	}
+
+	lambda.Start(func() error {
+		return args.RunScheduledSearches(time.Now().UTC())
+	})
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"time"
+
+	"github.com/m-mizutani/minerva/pkg/handler"
+	"github.com/m-mizutani/minerva/pkg/sweeper"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var logger = handler.Logger
+
+func main() {
+	handler.StartLambda(Handler)
+}
+
+// Handler is exported for testing. It's invoked by scheduled event and finds orphan raw objects older than SWEEPER_MIN_AGE.
+func Handler(args handler.Arguments) error {
+	minAge := sweeper.DefaultMinAge
+	if args.SweeperMinAge != "" {
+		d, err := time.ParseDuration(args.SweeperMinAge)
+		if err != nil {
+			return errors.Wrapf(err, "Invalid SWEEPER_MIN_AGE: %s", args.SweeperMinAge)
+		}
+		minAge = d
+	}
+
+	sw := &sweeper.Sweeper{
+		S3:         args.S3Client(),
+		Chunk:      args.ChunkService(),
+		Meta:       args.MetaService(),
+		SQS:        args.SQSService(),
+		CloudWatch: args.CloudWatchClient(),
+
+		Region:          args.S3Region,
+		Bucket:          args.S3Bucket,
+		Prefix:          args.S3Prefix,
+		ComposeQueueURL: args.ComposeQueueURL,
+		MergeDLQURL:     args.MergeDLQURL,
+
+		MinAge:  minAge,
+		Requeue: args.SweeperRequeue,
+	}
+
+	report, err := sw.Sweep(time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	logger.WithFields(logrus.Fields{
+		"scanned":  report.Scanned,
+		"orphans":  len(report.Orphans),
+		"pending":  report.Pending,
+		"requeued": report.Requeued,
+	}).Info("Done sweeper")
+
+	return nil
+}
@@ -36,12 +36,36 @@ interface MinervaProperties extends cdk.StackProps {
   readonly concurrentExecution?: number;
   readonly disableIndexer?: boolean;
   readonly disableMerger?: boolean;
+  readonly searchCacheTTL?: string;
+  readonly authConfigSecretARN?: string; // ARN of Secrets Manager secret that has JSON of api.AuthConfig, lambdaRole needs secretsmanager:GetSecretValue for it
+  readonly dailyScanQuota?: string; // e.g. "500GB"
+  readonly monthlyScanQuota?: string; // e.g. "5TB"
+  readonly auditRetention?: string; // e.g. "8760h"
+  readonly maskConfig?: string; // JSON of api.MaskConfig
+  readonly adminConfig?: string; // JSON of api.AdminConfig
+  readonly redactConfig?: string; // JSON of indexer.RedactConfig
+  readonly enrichConfig?: string; // JSON of indexer.EnrichConfig, database files should be in ./build with indexer
+  readonly iocConfig?: string; // JSON of indexer.IOCConfig
+  readonly tagPartition?: string; // JSON of models.TagPartition, changing it requires new Athena tables
+  readonly partitionGranularity?: string; // "hourly" (default) or "daily", search works with both in migration period
+  readonly partitionProjection?: boolean; // Use Athena partition projection instead of partitioner
+  readonly mergeSortRecords?: boolean; // Sort records in merged objects to prune row groups by parquet statistics
+  readonly parquetConfig?: string; // JSON of merger.ParquetConfig, e.g. {"compression": "ZSTD"}
+  readonly mergeStreaming?: boolean; // Upload merged object by S3 multipart upload without temp file in /tmp
+  readonly partitionProjectionStart?: string; // First date of projected dt, e.g. "2020-01-01"
+  readonly retentionConfig?: string; // JSON of partition.RetentionPolicy, retention job is enabled if set
+  readonly compactionMinAge?: string; // e.g. "24h", compaction of small merged objects is enabled if set (not with partitionProjection)
+  readonly sweeperMinAge?: string; // e.g. "24h", sweeper of orphan raw objects is enabled if set. Lambda role requires cloudwatch:PutMetricData and sqs:ReceiveMessage of mergerDLQ
+  readonly sweeperRequeue?: boolean; // Sweeper sends orphan raw objects to compose queue, otherwise only reports them
+  readonly enableScheduler?: boolean; // Run saved searches periodically and send alerts
+  readonly alertWebhookURL?: string;
+  readonly alertSNSTopicARN?: string;
 }
 
 export class MinervaStack extends cdk.Stack {
   // SQS
   readonly indexerQueue: sqs.Queue;
-  readonly partitionQueue: sqs.Queue;
+  readonly partitionQueue?: sqs.Queue;
   readonly mergeQueue: sqs.Queue;
   readonly composeQueue: sqs.Queue;
   readonly indexerDLQ: sqs.Queue;
@@ -51,9 +75,14 @@ export class MinervaStack extends cdk.Stack {
   // Lambda functions
   readonly indexer: lambda.Function;
   readonly merger: lambda.Function;
-  readonly partitioner: lambda.Function;
+  readonly partitioner?: lambda.Function;
   readonly composer: lambda.Function;
   readonly dispatcher: lambda.Function;
+  readonly scheduler?: lambda.Function;
+  readonly queryWatcher: lambda.Function;
+  readonly retention?: lambda.Function;
+  readonly compactor?: lambda.Function;
+  readonly sweeper?: lambda.Function;
 
   // DynamoDB table
   readonly metaTable: dynamodb.ITable;
@@ -68,6 +97,9 @@ export class MinervaStack extends cdk.Stack {
       props.lambdaRoleARN,
       { mutable: false }
     );
+    // Lifecycle rules can not be added to the imported bucket. The bucket needs
+    // AbortIncompleteMultipartUpload rule to delete parts of multipart upload
+    // left by merger Lambda that timed out or crashed. See README.
     const dataBucket = s3.Bucket.fromBucketArn(
       this,
       "dataBucket",
@@ -116,7 +148,9 @@ export class MinervaStack extends cdk.Stack {
         queue: this.mergerDLQ,
       },
     });
-    this.partitionQueue = new sqs.Queue(this, "partitionQueue");
+    if (!props.partitionProjection) {
+      this.partitionQueue = new sqs.Queue(this, "partitionQueue");
+    }
     this.composeQueue = new sqs.Queue(this, "composeQueue", {
       visibilityTimeout: composerTimeout,
     });
@@ -130,11 +164,19 @@ export class MinervaStack extends cdk.Stack {
       SENTRY_DSN: props.sentryDSN || "",
       SENTRY_ENVIRONMENT: props.sentryEnv || "",
       LOG_LEVEL: props.logLevel || "INFO",
+      TAG_PARTITION: props.tagPartition || "",
+      PARTITION_GRANULARITY: props.partitionGranularity || "hourly",
+      PARTITION_PROJECTION: props.partitionProjection ? "true" : "false",
+      MERGE_SORT_RECORDS: props.mergeSortRecords ? "true" : "false",
+      PARQUET_CONFIG: props.parquetConfig || "",
+      MERGE_STREAMING: props.mergeStreaming ? "true" : "false",
 
       // From resource
       META_TABLE_NAME: this.metaTable.tableName,
       CHUNK_TABLE_NAME: this.chunkTable.tableName,
-      PARTITION_QUEUE_URL: this.partitionQueue.queueUrl,
+      PARTITION_QUEUE_URL: this.partitionQueue
+        ? this.partitionQueue.queueUrl
+        : "",
       COMPOSE_QUEUE_URL: this.composeQueue.queueUrl,
       MERGE_QUEUE_URL: this.mergeQueue.queueUrl,
     };
@@ -148,7 +190,12 @@ export class MinervaStack extends cdk.Stack {
         role: lambdaRole,
         timeout: indexerTimeout,
         memorySize: 2048,
-        environment: defaultEnvVars,
+        environment: {
+          ...defaultEnvVars,
+          REDACT_CONFIG: props.redactConfig || "",
+          ENRICH_CONFIG: props.enrichConfig || "",
+          IOC_CONFIG: props.iocConfig || "",
+        },
         reservedConcurrentExecutions: props.concurrentExecution,
       });
       this.indexer.addEventSource(
@@ -204,26 +251,33 @@ export class MinervaStack extends cdk.Stack {
       });
     }
 
-    this.partitioner = new lambda.Function(this, "partitioner", {
-      runtime: lambda.Runtime.GO_1_X,
-      handler: "partitioner",
-      code: buildPath,
-      role: lambdaRole,
-      timeout: cdk.Duration.seconds(30),
-      memorySize: 2048,
-      environment: defaultEnvVars,
-      reservedConcurrentExecutions: props.concurrentExecution,
-      events: [new SqsEventSource(this.partitionQueue, { batchSize: 1 })],
-    });
+    if (this.partitionQueue) {
+      this.partitioner = new lambda.Function(this, "partitioner", {
+        runtime: lambda.Runtime.GO_1_X,
+        handler: "partitioner",
+        code: buildPath,
+        role: lambdaRole,
+        timeout: cdk.Duration.seconds(30),
+        memorySize: 2048,
+        environment: defaultEnvVars,
+        reservedConcurrentExecutions: props.concurrentExecution,
+        events: [new SqsEventSource(this.partitionQueue, { batchSize: 10 })],
+      });
+    }
+
+    const partitionKeys = [{ name: "dt", type: glue.Schema.STRING }];
+    if (props.tagPartition) {
+      partitionKeys.push({ name: "tag_group", type: glue.Schema.STRING });
+    }
 
     const indexDB = new glue.Database(this, "indexDB", {
       databaseName: props.athenaDatabaseName,
     });
 
-    new glue.Table(this, "indexTable", {
+    const indexTable = new glue.Table(this, "indexTable", {
       tableName: indexTableName,
       database: indexDB,
-      partitionKeys: [{ name: "dt", type: glue.Schema.STRING }],
+      partitionKeys: partitionKeys,
       columns: [
         { name: "tag", type: glue.Schema.STRING },
         { name: "timestamp", type: glue.Schema.BIG_INT },
@@ -237,10 +291,10 @@ export class MinervaStack extends cdk.Stack {
       dataFormat: glue.DataFormat.PARQUET,
     });
 
-    new glue.Table(this, "messageTable", {
+    const messageTable = new glue.Table(this, "messageTable", {
       tableName: messageTableName,
       database: indexDB,
-      partitionKeys: [{ name: "dt", type: glue.Schema.STRING }],
+      partitionKeys: partitionKeys,
       columns: [
         { name: "timestamp", type: glue.Schema.BIG_INT },
         { name: "object_id", type: glue.Schema.BIG_INT },
@@ -252,6 +306,11 @@ export class MinervaStack extends cdk.Stack {
       dataFormat: glue.DataFormat.PARQUET,
     });
 
+    if (props.partitionProjection) {
+      setPartitionProjection(indexTable, props, "indices");
+      setPartitionProjection(messageTable, props, "messages");
+    }
+
     // API handler
     const apiHandler = new lambda.Function(this, "apiHandler", {
       runtime: lambda.Runtime.GO_1_X,
@@ -260,8 +319,126 @@ export class MinervaStack extends cdk.Stack {
       role: lambdaRole,
       timeout: cdk.Duration.seconds(120),
       memorySize: 2048,
+      environment: {
+        ...defaultEnvVars,
+        SEARCH_CACHE_TTL: props.searchCacheTTL || "",
+        AUTH_CONFIG_SECRET_ARN: props.authConfigSecretARN || "",
+        DAILY_SCAN_QUOTA: props.dailyScanQuota || "",
+        MONTHLY_SCAN_QUOTA: props.monthlyScanQuota || "",
+        AUDIT_RETENTION: props.auditRetention || "",
+        MASK_CONFIG: props.maskConfig || "",
+        ADMIN_CONFIG: props.adminConfig || "",
+      },
+    });
+
+    // Complete searches and record usage when Athena queries are completed
+    this.queryWatcher = new lambda.Function(this, "queryWatcher", {
+      runtime: lambda.Runtime.GO_1_X,
+      handler: "queryWatcher",
+      code: buildPath,
+      role: lambdaRole,
+      timeout: cdk.Duration.seconds(30),
+      memorySize: 128,
       environment: defaultEnvVars,
     });
+    new events.Rule(this, "AthenaQueryStateChange", {
+      eventPattern: {
+        source: ["aws.athena"],
+        detailType: ["Athena Query State Change"],
+        detail: { currentState: ["SUCCEEDED", "FAILED", "CANCELLED"] },
+      },
+      targets: [new eventTargets.LambdaFunction(this.queryWatcher)],
+    });
+
+    // Scheduler of saved search
+    if (props.enableScheduler) {
+      this.scheduler = new lambda.Function(this, "scheduler", {
+        runtime: lambda.Runtime.GO_1_X,
+        handler: "scheduler",
+        code: buildPath,
+        role: lambdaRole,
+        timeout: cdk.Duration.seconds(300),
+        memorySize: 1024,
+        reservedConcurrentExecutions: 1,
+        environment: {
+          ...defaultEnvVars,
+          ALERT_WEBHOOK_URL: props.alertWebhookURL || "",
+          ALERT_SNS_TOPIC_ARN: props.alertSNSTopicARN || "",
+        },
+      });
+      new events.Rule(this, "PeriodicScheduler", {
+        schedule: events.Schedule.rate(cdk.Duration.minutes(5)),
+        targets: [new eventTargets.LambdaFunction(this.scheduler)],
+      });
+    }
+
+    // Retention of merged objects and partitions
+    if (props.retentionConfig) {
+      this.retention = new lambda.Function(this, "retention", {
+        runtime: lambda.Runtime.GO_1_X,
+        handler: "retention",
+        code: buildPath,
+        role: lambdaRole,
+        timeout: cdk.Duration.seconds(900),
+        memorySize: 512,
+        reservedConcurrentExecutions: 1,
+        environment: {
+          ...defaultEnvVars,
+          RETENTION_CONFIG: props.retentionConfig,
+        },
+      });
+      new events.Rule(this, "DailyRetention", {
+        schedule: events.Schedule.cron({ minute: "30", hour: "3" }),
+        targets: [new eventTargets.LambdaFunction(this.retention)],
+      });
+    }
+
+    // Compaction of small merged objects. It switches partition location, then it does not work with partition projection.
+    if (props.compactionMinAge) {
+      if (props.partitionProjection) {
+        throw new Error("compactionMinAge can not be used with partitionProjection");
+      }
+      this.compactor = new lambda.Function(this, "compactor", {
+        runtime: lambda.Runtime.GO_1_X,
+        handler: "compactor",
+        code: buildPath,
+        role: lambdaRole,
+        timeout: cdk.Duration.seconds(900),
+        memorySize: 3008,
+        reservedConcurrentExecutions: 1,
+        environment: {
+          ...defaultEnvVars,
+          COMPACTION_MIN_AGE: props.compactionMinAge,
+        },
+      });
+      new events.Rule(this, "PeriodicCompaction", {
+        schedule: events.Schedule.rate(cdk.Duration.hours(1)),
+        targets: [new eventTargets.LambdaFunction(this.compactor)],
+      });
+    }
+
+    // Sweeper of orphan raw objects that are not merged and not deleted
+    if (props.sweeperMinAge) {
+      this.sweeper = new lambda.Function(this, "sweeper", {
+        runtime: lambda.Runtime.GO_1_X,
+        handler: "sweeper",
+        code: buildPath,
+        role: lambdaRole,
+        timeout: cdk.Duration.seconds(900),
+        memorySize: 1024,
+        reservedConcurrentExecutions: 1,
+        environment: {
+          ...defaultEnvVars,
+          SWEEPER_MIN_AGE: props.sweeperMinAge,
+          SWEEPER_REQUEUE: props.sweeperRequeue ? "true" : "false",
+          MERGE_DLQ_URL: this.mergerDLQ.queueUrl,
+        },
+      });
+      new events.Rule(this, "PeriodicSweeper", {
+        schedule: events.Schedule.rate(cdk.Duration.hours(6)),
+        targets: [new eventTargets.LambdaFunction(this.sweeper)],
+      });
+    }
 
     const api = new apigateway.LambdaRestApi(this, "minervaAPI", {
       handler: apiHandler,
@@ -293,6 +470,19 @@ export class MinervaStack extends cdk.Stack {
     searchAPIwithID
       .addResource("timeseries")
       .addMethod("GET", undefined, apiOption);
+
+    const savedSearchAPI = v1.addResource("saved_search");
+    savedSearchAPI.addMethod("POST", undefined, apiOption);
+    savedSearchAPI.addMethod("GET", undefined, apiOption);
+    const savedSearchAPIwithName = savedSearchAPI.addResource("{name}");
+    savedSearchAPIwithName.addMethod("GET", undefined, apiOption);
+    savedSearchAPIwithName.addMethod("DELETE", undefined, apiOption);
+    savedSearchAPIwithName
+      .addResource("runs")
+      .addMethod("GET", undefined, apiOption);
+
+    v1.addResource("usage").addMethod("GET", undefined, apiOption);
+    v1.addResource("audit").addMethod("GET", undefined, apiOption);
   }
 }
 
@@ -310,3 +500,47 @@ function getMetaTable(scope: cdk.Construct, metaTableName?: string) {
     stream: dynamodb.StreamViewType.NEW_IMAGE,
   });
 }
+
+// setPartitionProjection configures Athena partition projection of the table. New partition can be searched without partitioner. Tag partition can be projected only with "default" in tag partition config, because values of tag_group must be known.
+function setPartitionProjection(
+  table: glue.Table,
+  props: MinervaProperties,
+  dirName: string
+) {
+  const start = props.partitionProjectionStart || "2020-01-01";
+  const daily = props.partitionGranularity === "daily";
+
+  const params: { [key: string]: string } = {
+    classification: "parquet",
+    has_encrypted_data: "false",
+    "projection.enabled": "true",
+    "projection.dt.type": "date",
+    "projection.dt.format": daily ? "yyyy-MM-dd" : "yyyy-MM-dd-HH",
+    "projection.dt.range": (daily ? start : start + "-00") + ",NOW",
+    "projection.dt.interval": "1",
+    "projection.dt.interval.unit": daily ? "DAYS" : "HOURS",
+  };
+
+  let location = `s3://${props.dataS3Bucket}/${props.dataS3Prefix}${dirName}/dt=\${dt}/`;
+
+  if (props.tagPartition) {
+    const config = JSON.parse(props.tagPartition);
+    if (!config.default) {
+      throw new Error(
+        "tagPartition must have 'default' to use partitionProjection"
+      );
+    }
+    const groups: string[] = (config.groups || []).map(
+      (g: { name: string }) => g.name
+    );
+    params["projection.tag_group.type"] = "enum";
+    params["projection.tag_group.values"] = groups
+      .concat([config.default])
+      .join(",");
+    location += "tag_group=\${tag_group}/";
+  }
+  params["storage.location.template"] = location;
+
+  const cfnTable = table.node.defaultChild as glue.CfnTable;
+  cfnTable.addPropertyOverride("TableInput.Parameters", params);
+}
@@ -4,8 +4,8 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/athena"
+	"github.com/aws/aws-sdk-go/service/athena/athenaiface"
 )
 
 type queryStatus string
@@ -47,10 +47,7 @@ type athenaQueryStatus struct {
 	ScannedSize int64
 }
 
-func getAthenaQueryStatus(region, queryID string) (*athenaQueryStatus, Error) {
-	ssn := session.Must(session.NewSession(&aws.Config{Region: &region}))
-	athenaClient := athena.New(ssn)
-
+func getAthenaQueryStatus(athenaClient athenaiface.AthenaAPI, queryID string) (*athenaQueryStatus, Error) {
 	output, err := athenaClient.GetQueryExecution(&athena.GetQueryExecutionInput{
 		QueryExecutionId: &queryID,
 	})
@@ -0,0 +1,280 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/guregu/dynamo"
+	"github.com/pkg/errors"
+)
+
+const (
+	auditContextKey       = "minerva.audit"
+	auditDateFormat       = "2006-01-02"
+	auditTimeFormat       = "2006-01-02T15:04:05"
+	auditMaxQueryDays     = 93
+	defaultAuditRetention = 365 * 24 * time.Hour
+)
+
+// AuditEvent is a record of API access
+type AuditEvent struct {
+	PK        string `dynamo:"pk" json:"-"`
+	SK        string `dynamo:"sk" json:"-"`
+	ExpiresAt int64  `dynamo:"expires_at" json:"-"`
+
+	Time          time.Time `dynamo:"time" json:"time"`
+	Principal     string    `dynamo:"principal" json:"principal,omitempty"`
+	RequestID     string    `dynamo:"request_id" json:"request_id,omitempty"`
+	Method        string    `dynamo:"method" json:"method"`
+	Path          string    `dynamo:"path" json:"path"`
+	IPAddr        string    `dynamo:"ipaddr" json:"ipaddr"`
+	UserAgent     string    `dynamo:"user_agent" json:"user_agent"`
+	ResponseCode  int       `dynamo:"resp_code" json:"resp_code"`
+	PermittedTags string    `dynamo:"permitted_tags" json:"permitted_tags,omitempty"`
+
+	// Search related fields are set by handlers
+	SearchID    searchID `dynamo:"search_id" json:"search_id,omitempty"`
+	Query       []Query  `dynamo:"query" json:"query,omitempty"`
+	StartTime   int64    `dynamo:"start_time" json:"start_time,omitempty"`
+	EndTime     int64    `dynamo:"end_time" json:"end_time,omitempty"`
+	ScannedSize int64    `dynamo:"scanned_size" json:"scanned_size,omitempty"`
+	// Unmasked is true if original values of masked fields are returned
+	Unmasked bool `dynamo:"unmasked" json:"unmasked,omitempty"`
+}
+
+// AuditSink stores AuditEvent durably.
+type AuditSink interface {
+	PutAuditEvent(event *AuditEvent) error
+}
+
+type auditRepository interface {
+	AuditSink
+	// listAuditEvents returns events of the date (YYYY-MM-DD) in time order.
+	listAuditEvents(date string) ([]*AuditEvent, error)
+}
+
+// setAuditSearch records search information of the request to be written by AuditMiddleware.
+func setAuditSearch(c *gin.Context, id searchID, query []Query, start, end, scannedSize int64) {
+	c.Set(auditContextKey, &AuditEvent{
+		SearchID:    id,
+		Query:       query,
+		StartTime:   start,
+		EndTime:     end,
+		ScannedSize: scannedSize,
+	})
+}
+
+// setAuditUnmasked records that masked fields are returned as original values.
+func setAuditUnmasked(c *gin.Context) {
+	if v, ok := c.Get(auditContextKey); ok {
+		if event, ok := v.(*AuditEvent); ok {
+			event.Unmasked = true
+			return
+		}
+	}
+	c.Set(auditContextKey, &AuditEvent{Unmasked: true})
+}
+
+// AuditMiddleware writes AuditEvent of each request to sink after the request is handled. It should be used before AuthMiddleware to record rejected requests also.
+func AuditMiddleware(sink AuditSink) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		event := &AuditEvent{}
+		if v, ok := c.Get(auditContextKey); ok {
+			if search, ok := v.(*AuditEvent); ok {
+				event = search
+			}
+		}
+		if event.SearchID == "" {
+			event.SearchID = searchID(c.Param("search_id"))
+		}
+
+		event.Time = time.Now().UTC()
+		event.Principal = principalID(c)
+		event.RequestID = c.GetHeader("x-request-id")
+		event.Method = c.Request.Method
+		event.Path = c.Request.URL.Path
+		event.IPAddr = c.ClientIP()
+		event.UserAgent = c.Request.UserAgent()
+		event.ResponseCode = c.Writer.Status()
+		event.PermittedTags = c.GetHeader(permittedTagsHeader)
+
+		if err := sink.PutAuditEvent(event); err != nil {
+			// Response is already sent, then only logging
+			Logger.WithError(err).WithField("event", event).Error("Fail to put audit event")
+		}
+	}
+}
+
+// AuditSink returns sink of audit events in meta table
+func (x *MinervaHandler) AuditSink() AuditSink {
+	return x.newAuditRepo()
+}
+
+func (x *MinervaHandler) newAuditRepo() auditRepository {
+	if x.auditRepo != nil {
+		return x.auditRepo
+	}
+
+	retention := x.AuditRetention
+	if retention <= 0 {
+		retention = defaultAuditRetention
+	}
+	return &auditRepoDynamoDB{
+		region:    x.Region,
+		tableName: x.MetaTableName,
+		retention: retention,
+	}
+}
+
+// ------------------------------------------------------------
+// DynamoDB implementation
+//
+
+type auditRepoDynamoDB struct {
+	region    string
+	tableName string
+	retention time.Duration
+}
+
+func auditDateToKey(date string) string {
+	return "audit:" + date
+}
+
+func (x *auditRepoDynamoDB) table() dynamo.Table {
+	db := dynamo.New(session.New(), &aws.Config{Region: aws.String(x.region)})
+	return db.Table(x.tableName)
+}
+
+func (x *auditRepoDynamoDB) PutAuditEvent(event *AuditEvent) error {
+	event.PK = auditDateToKey(event.Time.Format(auditDateFormat))
+	event.SK = event.Time.Format(time.RFC3339Nano) + "/" + uuid.New().String()
+	event.ExpiresAt = event.Time.Add(x.retention).Unix()
+
+	if err := x.table().Put(event).Run(); err != nil {
+		return errors.Wrapf(err, "Fail to put audit event: %v", *event)
+	}
+	return nil
+}
+
+func (x *auditRepoDynamoDB) listAuditEvents(date string) ([]*AuditEvent, error) {
+	var events []*AuditEvent
+	if err := x.table().Get("pk", auditDateToKey(date)).All(&events); err != nil {
+		return nil, errors.Wrapf(err, "Fail to list audit events: %s", date)
+	}
+	return events, nil
+}
+
+// ------------------------------------------------------------
+// Query
+//
+
+// AuditQuery is condition of audit events. Principal and SearchID are optional.
+type AuditQuery struct {
+	Start     time.Time
+	End       time.Time
+	Principal string
+	SearchID  string
+}
+
+func (x *AuditQuery) validate() error {
+	if x.End.Before(x.Start) {
+		return fmt.Errorf("end must be after start")
+	}
+	if x.End.Sub(x.Start) > auditMaxQueryDays*24*time.Hour {
+		return fmt.Errorf("Time range must be %d days or less", auditMaxQueryDays)
+	}
+	return nil
+}
+
+func (x *AuditQuery) match(event *AuditEvent) bool {
+	return !event.Time.Before(x.Start) && !event.Time.After(x.End) &&
+		(x.Principal == "" || x.Principal == event.Principal) &&
+		(x.SearchID == "" || x.SearchID == string(event.SearchID))
+}
+
+func queryAuditEvents(repo auditRepository, q AuditQuery) ([]*AuditEvent, error) {
+	if err := q.validate(); err != nil {
+		return nil, err
+	}
+
+	var results []*AuditEvent
+	start := q.Start.UTC().Truncate(24 * time.Hour)
+	for day := start; !day.After(q.End); day = day.Add(24 * time.Hour) {
+		events, err := repo.listAuditEvents(day.Format(auditDateFormat))
+		if err != nil {
+			return nil, err
+		}
+		for _, event := range events {
+			if q.match(event) {
+				results = append(results, event)
+			}
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Time.Before(results[j].Time)
+	})
+	return results, nil
+}
+
+// QueryAuditEvents retrieves audit events from meta table directly. It's used by CLI.
+func QueryAuditEvents(region, metaTableName string, q AuditQuery) ([]*AuditEvent, error) {
+	repo := &auditRepoDynamoDB{region: region, tableName: metaTableName}
+	return queryAuditEvents(repo, q)
+}
+
+// GetAuditEventsResponse is response of GetAuditEvents
+type GetAuditEventsResponse struct {
+	Events []*AuditEvent `json:"events"`
+}
+
+// GetAuditEvents returns audit events. 'start' and 'end' (YYYY-MM-DDTHH:MM:SS, UTC) are required, 'principal' and 'search_id' are optional. Only admin can get audit events because they have queries of all principals.
+func (x *MinervaHandler) GetAuditEvents(c *gin.Context) (*Response, Error) {
+	if !x.Admin.isAdmin(getPrincipal(c)) {
+		return nil, newUserErrorf(http.StatusForbidden, "Not allowed to get audit events")
+	}
+
+	var q AuditQuery
+	for _, p := range []struct {
+		key string
+		dst *time.Time
+	}{
+		{"start", &q.Start},
+		{"end", &q.End},
+	} {
+		v := c.Query(p.key)
+		if v == "" {
+			return nil, newUserErrorf(http.StatusBadRequest, "'%s' is required", p.key)
+		}
+		t, err := time.Parse(auditTimeFormat, v)
+		if err != nil {
+			return nil, wrapUserError(err, http.StatusBadRequest, fmt.Sprintf("Fail to parse '%s', must be %s", p.key, auditTimeFormat))
+		}
+		*p.dst = t
+	}
+	q.Principal = strings.TrimSpace(c.Query("principal"))
+	q.SearchID = strings.TrimSpace(c.Query("search_id"))
+
+	if err := q.validate(); err != nil {
+		return nil, wrapUserError(err, http.StatusBadRequest, err.Error())
+	}
+
+	events, err := queryAuditEvents(x.newAuditRepo(), q)
+	if err != nil {
+		return nil, wrapSystemError(err, http.StatusInternalServerError, "Fail to query audit events")
+	}
+	if events == nil {
+		events = []*AuditEvent{}
+	}
+
+	return &Response{http.StatusOK, &GetAuditEventsResponse{Events: events}}, nil
+}
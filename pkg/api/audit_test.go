@@ -0,0 +1,120 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/m-mizutani/minerva/internal/mock"
+	"github.com/m-mizutani/minerva/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditEvents(t *testing.T) {
+	tester := api.NewSchedulerTester(mock.NewS3Client("test"))
+	tester.Handler.Admin = &api.AdminConfig{Roles: []string{"auditor"}}
+	auth, err := api.NewAPIKeyAuthenticator([]api.APIKeyConfig{
+		{Name: "blue", Key: "key-blue", Tags: []string{"app.access", "app.error"}},
+		{Name: "auditor", Key: "key-auditor", Tags: []string{"*"}, Roles: []string{"auditor"}},
+	})
+	require.NoError(t, err)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	v1 := r.Group("/api/v1")
+	v1.Use(api.AuditMiddleware(tester.Handler.AuditSink()))
+	v1.Use(api.AuthMiddleware(auth))
+	api.SetupRoute(v1, tester.Handler)
+
+	begin := time.Now().UTC().Add(-time.Minute)
+	body, err := json.Marshal(api.NewRequest([]string{"mizutani", "login"}, "2020-01-02T00:00:00", "2020-01-02T01:00:00"))
+	require.NoError(t, err)
+
+	blue := map[string]string{"x-api-key": "key-blue", "x-request-id": "req-1"}
+	w := doRequest(r, "POST", "/api/v1/search", blue, body)
+	require.Equal(t, http.StatusCreated, w.Code)
+	var execResp api.ExecSearchResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &execResp))
+
+	tester.Athena.ScannedSize = 1234
+	tester.Athena.CompleteAll("SUCCEEDED", "s3://test-bucket/output/1.csv")
+	w = doRequest(r, "GET", "/api/v1/search/"+string(execResp.SearchID), blue, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = doRequest(r, "POST", "/api/v1/search", map[string]string{"x-api-key": "invalid"}, body)
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+
+	queryAudit := func(tt *testing.T, params url.Values) []*api.AuditEvent {
+		params.Set("start", begin.Format("2006-01-02T15:04:05"))
+		params.Set("end", time.Now().UTC().Add(time.Minute).Format("2006-01-02T15:04:05"))
+		w := doRequest(r, "GET", "/api/v1/audit?"+params.Encode(), map[string]string{"x-api-key": "key-auditor"}, nil)
+		require.Equal(tt, http.StatusOK, w.Code, w.Body.String())
+
+		var resp api.GetAuditEventsResponse
+		require.NoError(tt, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp.Events
+	}
+
+	t.Run("all events", func(tt *testing.T) {
+		events := queryAudit(tt, url.Values{})
+		require.Equal(tt, 3, len(events))
+
+		exec := events[0]
+		assert.Equal(tt, "apikey:blue", exec.Principal)
+		assert.Equal(tt, "req-1", exec.RequestID)
+		assert.Equal(tt, "POST", exec.Method)
+		assert.Equal(tt, "/api/v1/search", exec.Path)
+		assert.Equal(tt, http.StatusCreated, exec.ResponseCode)
+		assert.Equal(tt, "app.access,app.error", exec.PermittedTags)
+		assert.Equal(tt, string(execResp.SearchID), string(exec.SearchID))
+		require.Equal(tt, 2, len(exec.Query))
+		assert.Equal(tt, "mizutani", exec.Query[0].Term)
+		assert.Equal(tt, int64(1577923200), exec.StartTime)
+		assert.Equal(tt, int64(1577926800), exec.EndTime)
+
+		get := events[1]
+		assert.Equal(tt, "GET", get.Method)
+		assert.Equal(tt, http.StatusOK, get.ResponseCode)
+		assert.Equal(tt, int64(1234), get.ScannedSize)
+
+		rejected := events[2]
+		assert.Equal(tt, "", rejected.Principal)
+		assert.Equal(tt, http.StatusUnauthorized, rejected.ResponseCode)
+	})
+
+	t.Run("filter by principal and search ID", func(tt *testing.T) {
+		events := queryAudit(tt, url.Values{"principal": {"apikey:blue"}})
+		assert.Equal(tt, 2, len(events))
+
+		events = queryAudit(tt, url.Values{"search_id": {string(execResp.SearchID)}})
+		assert.Equal(tt, 2, len(events))
+
+		// Previous audit queries are also recorded
+		events = queryAudit(tt, url.Values{"principal": {"apikey:auditor"}})
+		assert.Equal(tt, 3, len(events))
+		assert.Equal(tt, "/api/v1/audit", events[0].Path)
+	})
+
+	t.Run("invalid time range", func(tt *testing.T) {
+		auditor := map[string]string{"x-api-key": "key-auditor"}
+		w := doRequest(r, "GET", "/api/v1/audit?start=2020-01-02T00:00:00", auditor, nil)
+		assert.Equal(tt, http.StatusBadRequest, w.Code)
+		w = doRequest(r, "GET", "/api/v1/audit?start=2020-01-02T00:00:00&end=2020-01-01T00:00:00", auditor, nil)
+		assert.Equal(tt, http.StatusBadRequest, w.Code)
+		w = doRequest(r, "GET", "/api/v1/audit?start=2020-01-01T00:00:00&end=2020-12-01T00:00:00", auditor, nil)
+		assert.Equal(tt, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("non-admin principal is not allowed", func(tt *testing.T) {
+		q := url.Values{
+			"start": {begin.Format("2006-01-02T15:04:05")},
+			"end":   {time.Now().UTC().Add(time.Minute).Format("2006-01-02T15:04:05")},
+		}
+		w := doRequest(r, "GET", "/api/v1/audit?"+q.Encode(), blue, nil)
+		assert.Equal(tt, http.StatusForbidden, w.Code)
+	})
+}
@@ -0,0 +1,331 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	principalContextKey = "minerva.principal"
+	permittedTagsHeader = "x-permitted-tags"
+	apiKeyHeader        = "x-api-key"
+	allTags             = "*"
+)
+
+// Principal is an authenticated requester.
+type Principal struct {
+	// ID is identifier of principal, e.g. "jwt:<sub>" or "apikey:<name>"
+	ID string
+	// PermittedTags is list of tags that the principal can see. nil means all tags.
+	PermittedTags []string
+	// Roles are used to check privilege such as unmasking
+	Roles []string
+}
+
+// Authenticator identifies principal of a request. It returns nil without error if the request has no credential for the Authenticator.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// AuthConfig is configuration of authenticators. It's JSON format.
+type AuthConfig struct {
+	JWT     *JWTConfig     `json:"jwt"`
+	APIKeys []APIKeyConfig `json:"api_keys"`
+}
+
+// JWTConfig is configuration of JWTAuthenticator
+type JWTConfig struct {
+	// JWKS is path or URL of JWK set
+	JWKS string `json:"jwks"`
+	// Issuer and Audience are required. A token issued for other service by same IdP must not be accepted.
+	Issuer   string `json:"issuer"`
+	Audience string `json:"audience"`
+	// TagClaim is name of claim used for TagMap, e.g. "groups". All tags are permitted if empty.
+	TagClaim string `json:"tag_claim"`
+	// TagMap maps value of TagClaim to permitted tags. "*" means all tags.
+	TagMap map[string][]string `json:"tag_map"`
+	// RoleClaim is name of claim used as roles of principal, e.g. "groups".
+	RoleClaim string `json:"role_claim"`
+}
+
+// APIKeyConfig is a static API key
+type APIKeyConfig struct {
+	Name  string   `json:"name"`
+	Key   string   `json:"key"`
+	Tags  []string `json:"tags"`
+	Roles []string `json:"roles"`
+}
+
+// AdminConfig specifies principals that can manage resources of others and see audit events and usage of all principals. It's JSON format.
+type AdminConfig struct {
+	Roles      []string `json:"roles"`
+	Principals []string `json:"principals"`
+}
+
+// ParseAdminConfig decodes JSON of AdminConfig.
+func ParseAdminConfig(raw []byte) (*AdminConfig, error) {
+	var config AdminConfig
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, errors.Wrap(err, "Fail to parse admin config")
+	}
+	return &config, nil
+}
+
+// isAdmin returns true if the principal is listed in Principals or has one of Roles. A request without authentication is never admin.
+func (x *AdminConfig) isAdmin(principal *Principal) bool {
+	if x == nil || principal == nil {
+		return false
+	}
+	for _, id := range x.Principals {
+		if id == principal.ID {
+			return true
+		}
+	}
+	for _, role := range x.Roles {
+		for _, r := range principal.Roles {
+			if role == r {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ParseAuthConfig decodes JSON of AuthConfig.
+func ParseAuthConfig(raw []byte) (*AuthConfig, error) {
+	var config AuthConfig
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, errors.Wrap(err, "Fail to parse auth config")
+	}
+	return &config, nil
+}
+
+// NewAuthenticators builds Authenticators from config.
+func NewAuthenticators(config *AuthConfig) ([]Authenticator, error) {
+	var authenticators []Authenticator
+
+	if config.JWT != nil {
+		auth, err := NewJWTAuthenticator(*config.JWT)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, auth)
+	}
+
+	if len(config.APIKeys) > 0 {
+		auth, err := NewAPIKeyAuthenticator(config.APIKeys)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, auth)
+	}
+
+	return authenticators, nil
+}
+
+// toPermittedTags converts tag list of config. nil is returned if the list has "*".
+func toPermittedTags(tags []string) []string {
+	permitted := []string{}
+	for _, tag := range tags {
+		if tag == allTags {
+			return nil
+		}
+		permitted = append(permitted, tag)
+	}
+	return permitted
+}
+
+// ------------------------------------------------------------
+// JWT
+//
+
+// JWTAuthenticator validates Bearer token in Authorization header.
+type JWTAuthenticator struct {
+	config JWTConfig
+	keys   *jwksStore
+	now    func() time.Time
+}
+
+// NewJWTAuthenticator is constructor of JWTAuthenticator. JWKS is loaded at first.
+func NewJWTAuthenticator(config JWTConfig) (*JWTAuthenticator, error) {
+	if config.JWKS == "" {
+		return nil, fmt.Errorf("'jwks' is required for JWT authentication")
+	}
+	if config.Issuer == "" || config.Audience == "" {
+		return nil, fmt.Errorf("Both of 'issuer' and 'audience' are required for JWT authentication")
+	}
+
+	keys, err := newJWKSStore(config.JWKS)
+	if err != nil {
+		return nil, err
+	}
+
+	return &JWTAuthenticator{
+		config: config,
+		keys:   keys,
+		now:    time.Now,
+	}, nil
+}
+
+// Authenticate of JWTAuthenticator
+func (x *JWTAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	authz := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authz, "Bearer ") {
+		return nil, nil
+	}
+
+	token := strings.TrimSpace(strings.TrimPrefix(authz, "Bearer "))
+	claims, err := verifyJWT(token, x.keys, x.config.Issuer, x.config.Audience, x.now())
+	if err != nil {
+		return nil, err
+	}
+
+	sub := claims.getString("sub")
+	if sub == "" {
+		return nil, fmt.Errorf("No 'sub' claim in JWT")
+	}
+
+	principal := &Principal{ID: "jwt:" + sub}
+	if x.config.RoleClaim != "" {
+		principal.Roles = claims.getStrings(x.config.RoleClaim)
+	}
+	if x.config.TagClaim == "" {
+		return principal, nil
+	}
+
+	tagSet := map[string]bool{}
+	for _, v := range claims.getStrings(x.config.TagClaim) {
+		for _, tag := range x.config.TagMap[v] {
+			if tag == allTags {
+				return principal, nil
+			}
+			tagSet[tag] = true
+		}
+	}
+
+	principal.PermittedTags = []string{}
+	for tag := range tagSet {
+		principal.PermittedTags = append(principal.PermittedTags, tag)
+	}
+	sort.Strings(principal.PermittedTags)
+
+	return principal, nil
+}
+
+// ------------------------------------------------------------
+// API key
+//
+
+// APIKeyAuthenticator validates static key in x-api-key header.
+type APIKeyAuthenticator struct {
+	keys []APIKeyConfig
+}
+
+// NewAPIKeyAuthenticator is constructor of APIKeyAuthenticator
+func NewAPIKeyAuthenticator(keys []APIKeyConfig) (*APIKeyAuthenticator, error) {
+	names := map[string]bool{}
+	for _, key := range keys {
+		if key.Name == "" || key.Key == "" {
+			return nil, fmt.Errorf("Both of 'name' and 'key' are required for API key")
+		}
+		if names[key.Name] {
+			return nil, fmt.Errorf("Duplicated API key name: %s", key.Name)
+		}
+		names[key.Name] = true
+	}
+
+	return &APIKeyAuthenticator{keys: keys}, nil
+}
+
+// Authenticate of APIKeyAuthenticator
+func (x *APIKeyAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	apiKey := r.Header.Get(apiKeyHeader)
+	if apiKey == "" {
+		return nil, nil
+	}
+
+	for _, key := range x.keys {
+		if subtle.ConstantTimeCompare([]byte(key.Key), []byte(apiKey)) == 1 {
+			return &Principal{
+				ID:            "apikey:" + key.Name,
+				PermittedTags: toPermittedTags(key.Tags),
+				Roles:         key.Roles,
+			}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Invalid API key")
+}
+
+// ------------------------------------------------------------
+// Middleware
+//
+
+// AuthMiddleware rejects a request that is not authenticated by any of authenticators. x-permitted-tags header is overwritten by permission of the principal, then the header from client is never trusted.
+func AuthMiddleware(authenticators ...Authenticator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal, err := authenticate(c.Request, authenticators)
+		if err != nil {
+			Logger.WithFields(logrus.Fields{
+				"error":  err,
+				"path":   c.Request.URL.Path,
+				"ipaddr": c.ClientIP(),
+			}).Warn("Authentication failed")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Authentication failed"})
+			return
+		}
+
+		if principal.PermittedTags == nil {
+			c.Request.Header.Set(permittedTagsHeader, allTags)
+		} else if len(principal.PermittedTags) == 0 {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": "No permitted tag"})
+			return
+		} else {
+			c.Request.Header.Set(permittedTagsHeader, strings.Join(principal.PermittedTags, ","))
+		}
+
+		c.Set(principalContextKey, principal)
+		c.Next()
+	}
+}
+
+func authenticate(r *http.Request, authenticators []Authenticator) (*Principal, error) {
+	for _, auth := range authenticators {
+		principal, err := auth.Authenticate(r)
+		if err != nil {
+			return nil, err
+		}
+		if principal != nil {
+			return principal, nil
+		}
+	}
+
+	return nil, fmt.Errorf("No credential")
+}
+
+// getPrincipal returns authenticated principal. nil is returned if AuthMiddleware is not used.
+func getPrincipal(c *gin.Context) *Principal {
+	if v, ok := c.Get(principalContextKey); ok {
+		if principal, ok := v.(*Principal); ok {
+			return principal
+		}
+	}
+	return nil
+}
+
+// principalID returns ID of authenticated principal. Empty string is returned if AuthMiddleware is not used.
+func principalID(c *gin.Context) string {
+	if principal := getPrincipal(c); principal != nil {
+		return principal.ID
+	}
+	return ""
+}
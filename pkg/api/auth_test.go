@@ -0,0 +1,278 @@
+package api_test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/m-mizutani/minerva/internal/mock"
+	"github.com/m-mizutani/minerva/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+type testKeys struct {
+	rsaKey   *rsa.PrivateKey
+	weakKey  *rsa.PrivateKey
+	ecKey    *ecdsa.PrivateKey
+	jwksPath string
+}
+
+func newTestKeys(t *testing.T) *testKeys {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	weakKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	jwks := map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kty": "RSA",
+				"kid": "rsa1",
+				"use": "sig",
+				"n":   b64(rsaKey.N.Bytes()),
+				"e":   b64(big.NewInt(int64(rsaKey.E)).Bytes()),
+			},
+			{
+				"kty": "RSA",
+				"kid": "weak1",
+				"n":   b64(weakKey.N.Bytes()),
+				"e":   b64(big.NewInt(int64(weakKey.E)).Bytes()),
+			},
+			{
+				"kty": "EC",
+				"kid": "ec1",
+				"crv": "P-256",
+				"x":   b64(ecKey.X.Bytes()),
+				"y":   b64(ecKey.Y.Bytes()),
+			},
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "minerva-auth")
+	require.NoError(t, err)
+
+	path := filepath.Join(dir, "jwks.json")
+	raw, err := json.Marshal(jwks)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(path, raw, 0600))
+
+	return &testKeys{rsaKey: rsaKey, weakKey: weakKey, ecKey: ecKey, jwksPath: path}
+}
+
+func (x *testKeys) sign(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	require.NoError(t, err)
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+
+	signed := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch alg {
+	case "RS256":
+		key := x.rsaKey
+		if kid == "weak1" {
+			key = x.weakKey
+		}
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		require.NoError(t, err)
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, x.ecKey, digest[:])
+		require.NoError(t, err)
+		sig = make([]byte, 64)
+		copy(sig[32-len(r.Bytes()):32], r.Bytes())
+		copy(sig[64-len(s.Bytes()):], s.Bytes())
+	}
+
+	return signed + "." + b64(sig)
+}
+
+func newClaims(sub string, groups ...string) map[string]interface{} {
+	return map[string]interface{}{
+		"sub":    sub,
+		"iss":    "https://issuer.example.com",
+		"aud":    []string{"minerva"},
+		"exp":    time.Now().Add(time.Hour).Unix(),
+		"groups": groups,
+	}
+}
+
+func newAuthRouter(t *testing.T, keys *testKeys) (*gin.Engine, *api.SchedulerTester) {
+	config, err := api.ParseAuthConfig([]byte(`{
+		"jwt": {
+			"jwks": "` + keys.jwksPath + `",
+			"issuer": "https://issuer.example.com",
+			"audience": "minerva",
+			"tag_claim": "groups",
+			"tag_map": {
+				"admin": ["*"],
+				"dev": ["app.access", "app.error"],
+				"ops": ["app.error", "infra.syslog"]
+			}
+		},
+		"api_keys": [
+			{"name": "ci", "key": "secret-key-1", "tags": ["app.access"]},
+			{"name": "root", "key": "secret-key-2", "tags": ["*"]}
+		]
+	}`))
+	require.NoError(t, err)
+
+	authenticators, err := api.NewAuthenticators(config)
+	require.NoError(t, err)
+
+	gin.SetMode(gin.TestMode)
+	tester := api.NewSchedulerTester(mock.NewS3Client("test"))
+	r := gin.New()
+	v1 := r.Group("/api/v1")
+	v1.Use(api.AuthMiddleware(authenticators...))
+	v1.GET("/echo", func(c *gin.Context) {
+		c.String(http.StatusOK, c.GetHeader("x-permitted-tags"))
+	})
+	api.SetupRoute(v1, tester.Handler)
+
+	return r, tester
+}
+
+func doRequest(r *gin.Engine, method, path string, headers map[string]string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	keys := newTestKeys(t)
+	defer os.RemoveAll(filepath.Dir(keys.jwksPath))
+	r, _ := newAuthRouter(t, keys)
+	bearer := func(token string) map[string]string {
+		return map[string]string{"Authorization": "Bearer " + token}
+	}
+
+	expired := newClaims("blue", "admin")
+	expired["exp"] = time.Now().Add(-time.Hour).Unix()
+	wrongIssuer := newClaims("blue", "admin")
+	wrongIssuer["iss"] = "https://evil.example.com"
+	wrongAudience := newClaims("blue", "admin")
+	wrongAudience["aud"] = "other"
+	noExp := newClaims("blue", "admin")
+	delete(noExp, "exp")
+	noIssuer := newClaims("blue", "admin")
+	delete(noIssuer, "iss")
+	noAudience := newClaims("blue", "admin")
+	delete(noAudience, "aud")
+
+	tampered := keys.sign(t, "RS256", "rsa1", newClaims("blue", "dev"))
+	tampered = tampered[:len(tampered)-4] + "AAAA"
+
+	testCases := []struct {
+		title   string
+		headers map[string]string
+		code    int
+		tags    string
+	}{
+		{"RS256 admin", bearer(keys.sign(t, "RS256", "rsa1", newClaims("blue", "admin"))), 200, "*"},
+		{"ES256 dev and ops", bearer(keys.sign(t, "ES256", "ec1", newClaims("orange", "dev", "ops"))), 200, "app.access,app.error,infra.syslog"},
+		{"client header is overwritten", map[string]string{
+			"Authorization":    "Bearer " + keys.sign(t, "RS256", "rsa1", newClaims("blue", "dev")),
+			"x-permitted-tags": "*",
+		}, 200, "app.access,app.error"},
+		{"no mapped group", bearer(keys.sign(t, "RS256", "rsa1", newClaims("red", "guest"))), 403, ""},
+		{"expired", bearer(keys.sign(t, "RS256", "rsa1", expired)), 401, ""},
+		{"no exp", bearer(keys.sign(t, "RS256", "rsa1", noExp)), 401, ""},
+		{"wrong issuer", bearer(keys.sign(t, "RS256", "rsa1", wrongIssuer)), 401, ""},
+		{"wrong audience", bearer(keys.sign(t, "RS256", "rsa1", wrongAudience)), 401, ""},
+		{"no issuer", bearer(keys.sign(t, "RS256", "rsa1", noIssuer)), 401, ""},
+		{"no audience", bearer(keys.sign(t, "RS256", "rsa1", noAudience)), 401, ""},
+		{"unknown kid", bearer(keys.sign(t, "RS256", "rsa2", newClaims("blue", "admin"))), 401, ""},
+		{"alg and key mismatch", bearer(keys.sign(t, "ES256", "rsa1", newClaims("blue", "admin"))), 401, ""},
+		{"tampered signature", bearer(tampered), 401, ""},
+		{"RSA key under 2048 bits", bearer(keys.sign(t, "RS256", "weak1", newClaims("blue", "admin"))), 401, ""},
+		{"alg none", bearer(keys.sign(t, "none", "rsa1", newClaims("blue", "admin"))), 401, ""},
+		{"API key", map[string]string{"x-api-key": "secret-key-1"}, 200, "app.access"},
+		{"API key for all tags", map[string]string{"x-api-key": "secret-key-2"}, 200, "*"},
+		{"invalid API key", map[string]string{"x-api-key": "secret-key-3"}, 401, ""},
+		{"no credential", map[string]string{"x-permitted-tags": "*"}, 401, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.title, func(tt *testing.T) {
+			w := doRequest(r, "GET", "/api/v1/echo", tc.headers, nil)
+			assert.Equal(tt, tc.code, w.Code)
+			if tc.code == 200 {
+				assert.Equal(tt, tc.tags, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestJWTConfigRequiresIssuerAndAudience(t *testing.T) {
+	keys := newTestKeys(t)
+	defer os.RemoveAll(filepath.Dir(keys.jwksPath))
+
+	_, err := api.NewJWTAuthenticator(api.JWTConfig{JWKS: keys.jwksPath, Issuer: "https://issuer.example.com", Audience: "minerva"})
+	assert.NoError(t, err)
+	_, err = api.NewJWTAuthenticator(api.JWTConfig{JWKS: keys.jwksPath, Audience: "minerva"})
+	assert.Error(t, err)
+	_, err = api.NewJWTAuthenticator(api.JWTConfig{JWKS: keys.jwksPath, Issuer: "https://issuer.example.com"})
+	assert.Error(t, err)
+}
+
+func TestAuthPrincipalOfSearch(t *testing.T) {
+	keys := newTestKeys(t)
+	defer os.RemoveAll(filepath.Dir(keys.jwksPath))
+	r, tester := newAuthRouter(t, keys)
+
+	body, err := json.Marshal(api.NewRequest([]string{"mizutani"}, "2020-01-02T00:00:00", "2020-01-02T01:00:00"))
+	require.NoError(t, err)
+
+	t.Run("JWT", func(tt *testing.T) {
+		token := keys.sign(tt, "RS256", "rsa1", newClaims("blue", "admin"))
+		w := doRequest(r, "POST", "/api/v1/search", map[string]string{"Authorization": "Bearer " + token}, body)
+		require.Equal(tt, http.StatusCreated, w.Code)
+
+		var resp api.ExecSearchResponse
+		require.NoError(tt, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(tt, "jwt:blue", tester.SearchPrincipal(string(resp.SearchID)))
+	})
+
+	t.Run("API key", func(tt *testing.T) {
+		w := doRequest(r, "POST", "/api/v1/search", map[string]string{"x-api-key": "secret-key-1"}, body)
+		require.Equal(tt, http.StatusCreated, w.Code)
+
+		var resp api.ExecSearchResponse
+		require.NoError(tt, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(tt, "apikey:ci", tester.SearchPrincipal(string(resp.SearchID)))
+	})
+
+	t.Run("rejected request does not start search", func(tt *testing.T) {
+		w := doRequest(r, "POST", "/api/v1/search", nil, body)
+		assert.Equal(tt, http.StatusUnauthorized, w.Code)
+		assert.Equal(tt, 2, len(tester.Athena.Queries))
+	})
+}
@@ -5,13 +5,14 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"regexp"
 	"strings"
 	"time"
 
 	"github.com/m-mizutani/minerva/internal/tokenizer"
+	"github.com/m-mizutani/minerva/pkg/models"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/athena"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
@@ -21,6 +22,9 @@ import (
 
 const hardLimitOfSearchResult = 1000 * 1000 // 1,000,000
 
+// athenaQueryRefTTL is lifetime of reference from Athena query ID to search. It must be longer than Athena query timeout.
+const athenaQueryRefTTL = 7 * 24 * time.Hour
+
 type ExecSearchResponse struct {
 	SearchID searchID `json:"search_id"`
 }
@@ -33,6 +37,11 @@ type ExecSearchRequest struct {
 	Query         []Query `json:"query"`
 	StartDateTime string  `json:"start_dt"`
 	EndDateTime   string  `json:"end_dt"`
+	// Tags limits search to logs of the tags. Athena scans only partitions of the tags if tag partitioning is enabled.
+	Tags []string `json:"tags"`
+
+	// Force bypasses cached search result and always executes Athena query
+	Force bool `json:"force"`
 }
 
 const searchRowLimit = 1000 * 1000
@@ -50,13 +59,57 @@ func (x *MinervaHandler) ExecSearch(c *gin.Context) (*Response, Error) {
 		return nil, wrapUserError(err, 400, "Fail to parse requested body")
 	}
 
-	sql, err := buildSQL(req, x.IndexTableName, x.MessageTableName)
+	if apiErr := x.checkQuota(principalID(c), time.Now().UTC()); apiErr != nil {
+		return nil, apiErr
+	}
+
+	item, apiErr := x.execSearch(req, c.GetHeader("x-request-id"), principalID(c))
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	setAuditSearch(c, item.ID, item.Query, item.StartTime.Unix(), item.EndTime.Unix(), item.ScannedSize)
+
+	return &Response{201, &ExecSearchResponse{
+		SearchID: item.ID,
+	}}, nil
+}
+
+// execSearch starts Athena query (or reuses cached result) and saves searchItem. It's used by both of API and scheduler.
+func (x *MinervaHandler) execSearch(req ExecSearchRequest, requestID, principal string) (*searchItem, Error) {
+	start, end, err := parseRequestTimes(req)
 	if err != nil {
-		return nil, wrapUserError(err, 400, "Fail to create SQL for Athena")
+		return nil, wrapUserError(err, http.StatusBadRequest, err.Error())
+	}
+
+	repo := x.newSearchRepo()
+	now := time.Now().UTC()
+	hash := buildRequestHash(req, *start, *end)
+
+	if x.SearchCacheTTL > 0 && !req.Force {
+		cached, err := lookupCachedSearch(repo, hash, now, x.SearchCacheTTL)
+		if err != nil {
+			return nil, wrapSystemError(err, http.StatusInternalServerError, "Fail to lookup cached search")
+		}
+
+		if cached != nil {
+			item, err := cloneSearch(repo, cached, requestID, principal, now)
+			if err != nil {
+				return nil, wrapSystemError(err, http.StatusInternalServerError, "Fail to clone cached search")
+			}
+
+			Logger.WithFields(logrus.Fields{
+				"search_id":   item.ID,
+				"cached_from": cached.ID,
+			}).Info("Reuse cached search result")
+
+			return item, nil
+		}
 	}
 
-	ssn := session.Must(session.NewSession(&aws.Config{Region: &x.Region}))
-	athenaClient := athena.New(ssn)
+	sql, err := buildSQL(req, x.IndexTableName, x.MessageTableName, x.TagPartition, x.ProjectedGranularity)
+	if err != nil {
+		return nil, wrapUserError(err, 400, "Fail to create SQL for Athena")
+	}
 
 	input := &athena.StartQueryExecutionInput{
 		QueryExecutionContext: &athena.QueryExecutionContext{
@@ -70,7 +123,7 @@ func (x *MinervaHandler) ExecSearch(c *gin.Context) (*Response, Error) {
 
 	Logger.WithField("input", input).Info("Athena Query")
 
-	response, err := athenaClient.StartQueryExecution(input)
+	response, err := x.athenaClient().StartQueryExecution(input)
 	Logger.WithFields(logrus.Fields{
 		"err":    err,
 		"input":  input,
@@ -81,52 +134,80 @@ func (x *MinervaHandler) ExecSearch(c *gin.Context) (*Response, Error) {
 		return nil, wrapSystemError(err, 500, "Fail StartQueryExecution in putQuery")
 	}
 
-	start, end, err := parseRequestTimes(req)
-	if err != nil {
-		return nil, wrapUserError(err, http.StatusBadRequest, err.Error())
-	}
-
-	now := time.Now().UTC()
-	item := searchItem{
+	item := &searchItem{
 		ID:            searchID(uuid.New().String()),
 		Status:        statusRunning,
 		CreatedAt:     &now,
 		StartTime:     *start,
 		EndTime:       *end,
 		Query:         req.Query,
-		RequestID:     c.GetHeader("x-request-id"),
+		RequestID:     requestID,
+		Principal:     principal,
 		AthenaQueryID: aws.StringValue(response.QueryExecutionId),
+		QueryHash:     hash,
 	}
 
-	if err := x.newSearchRepo().put(&item); err != nil {
+	if err := repo.put(item); err != nil {
 		return nil, wrapSystemErrorf(err, http.StatusInternalServerError, "Fail to put searchItem of ExecSearch")
 	}
+	if err := repo.putAthenaQuery(item.AthenaQueryID, item.ID, now.Add(athenaQueryRefTTL)); err != nil {
+		return nil, wrapSystemErrorf(err, http.StatusInternalServerError, "Fail to put Athena query of ExecSearch")
+	}
 
-	return &Response{201, &ExecSearchResponse{
-		SearchID: item.ID,
-	}}, nil
+	if x.SearchCacheTTL > 0 {
+		if err := repo.putQueryHash(hash, item.ID, now.Add(x.SearchCacheTTL)); err != nil {
+			return nil, wrapSystemErrorf(err, http.StatusInternalServerError, "Fail to put query hash of ExecSearch")
+		}
+	}
+
+	return item, nil
 }
 
-func buildSQL(req ExecSearchRequest, idxTable, msgTable string) (*string, error) {
-	tokenizer := tokenizer.NewSimpleTokenizer()
+var validTagPattern = regexp.MustCompile(`^[A-Za-z0-9._\-:/]+$`)
+
+// buildTagCond returns conditions of tags for indices and messages tables. Condition of messages table is empty if tag partition is disabled because messages table has no tag column.
+func buildTagCond(tags []string, tp *models.TagPartition) (string, string, error) {
+	if len(tags) == 0 {
+		return "", "", nil
+	}
 
-	termSet := map[string]struct{}{}
+	var tagValues, partValues []string
+	partSet := map[string]bool{}
+	for _, tag := range tags {
+		if !validTagPattern.MatchString(tag) {
+			return "", "", fmt.Errorf("Invalid tag: %s", tag)
+		}
+		tagValues = append(tagValues, fmt.Sprintf("'%s'", tag))
 
+		if v := tp.Value(tag); v != "" && !partSet[v] {
+			partSet[v] = true
+			partValues = append(partValues, fmt.Sprintf("'%s'", v))
+		}
+	}
+
+	idxCond := fmt.Sprintf("\nAND indices.tag IN (%s)", strings.Join(tagValues, ", "))
+	var msgCond string
+	if len(partValues) > 0 {
+		parts := strings.Join(partValues, ", ")
+		idxCond += fmt.Sprintf("\nAND indices.%s IN (%s)", models.TagPartitionKey, parts)
+		msgCond = fmt.Sprintf("\nAND messages.%s IN (%s)", models.TagPartitionKey, parts)
+	}
+
+	return idxCond, msgCond, nil
+}
+
+func buildSQL(req ExecSearchRequest, idxTable, msgTable string, tp *models.TagPartition, projected models.DTGranularity) (*string, error) {
 	if len(req.Query) == 0 {
 		return nil, fmt.Errorf("No query. 'query' field is required")
 	}
 
-	for _, q := range req.Query {
-		tokens := tokenizer.Split(q.Term)
-		for _, t := range tokens {
-			if t.IsDelim {
-				continue
-			}
-
-			termSet[t.Data] = struct{}{}
-		}
+	idxTagCond, msgTagCond, err := buildTagCond(req.Tags, tp)
+	if err != nil {
+		return nil, err
 	}
 
+	termSet := queryToTermSet(req.Query)
+
 	var termCond []string
 	for t := range termSet {
 		termCond = append(termCond, fmt.Sprintf("indices.term = '%s'", t))
@@ -138,7 +219,6 @@ func buildSQL(req ExecSearchRequest, idxTable, msgTable string) (*string, error)
 		queryCond = append(queryCond, fmt.Sprintf("messages.message LIKE '%%%s%%'", q.Term))
 	}
 
-	dtFmt := "2006-01-02-15"
 	start, end, err := parseRequestTimes(req)
 	if err != nil {
 		return nil, err
@@ -146,17 +226,16 @@ func buildSQL(req ExecSearchRequest, idxTable, msgTable string) (*string, error)
 
 	idxTerms := strings.Join(termCond, "\nOR ")
 	idxWhere := fmt.Sprintf(
-		"'%s' <= indices.dt \n"+
-			"AND indices.dt <= '%s' \n"+
+		"%s \n"+
 			"AND %d <= indices.timestamp \n"+
-			"AND indices.timestamp <= %d \n"+
+			"AND indices.timestamp <= %d %s\n"+
 			"AND (%s)",
-		start.Format(dtFmt), end.Format(dtFmt),
-		start.Unix(), end.Unix(),
+		models.DTCondition("indices.dt", *start, *end, projected),
+		start.Unix(), end.Unix(), idxTagCond,
 		idxTerms)
 	msgTerms := strings.Join(queryCond, " AND ")
-	msgWhere := fmt.Sprintf("'%s' <= messages.dt \nAND messages.dt <= '%s' \nAND %s",
-		start.Format(dtFmt), end.Format(dtFmt), msgTerms)
+	msgWhere := fmt.Sprintf("%s %s\nAND %s",
+		models.DTCondition("messages.dt", *start, *end, projected), msgTagCond, msgTerms)
 
 	sql := fmt.Sprintf(`WITH tindex AS (
 SELECT indices.object_id, indices.seq, indices.tag
@@ -180,6 +259,25 @@ ORDER BY messages.timestamp`,
 	return &sql, nil
 }
 
+// queryToTermSet splits query terms into index terms by same tokenizer as indexer.
+func queryToTermSet(query []Query) map[string]bool {
+	tokenizer := tokenizer.NewSimpleTokenizer()
+	termSet := map[string]bool{}
+
+	for _, q := range query {
+		tokens := tokenizer.Split(q.Term)
+		for _, t := range tokens {
+			if t.IsDelim {
+				continue
+			}
+
+			termSet[t.Data] = true
+		}
+	}
+
+	return termSet
+}
+
 func parseRequestTimes(req ExecSearchRequest) (*time.Time, *time.Time, error) {
 	inputFmt := "2006-01-02T15:04:05"
 
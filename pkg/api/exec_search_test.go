@@ -2,9 +2,12 @@ package api_test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/m-mizutani/minerva/pkg/api"
+	"github.com/m-mizutani/minerva/pkg/models"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestArgsToSQL(t *testing.T) {
@@ -13,7 +16,7 @@ func TestArgsToSQL(t *testing.T) {
 		"2019-10-24T11:14:15",
 		"2019-10-24T15:14:15")
 
-	sql, err := api.BuildSQL(q, "indices", "messages")
+	sql, err := api.BuildSQL(q, "indices", "messages", nil, "")
 	assert.NoError(t, err)
 	assert.Contains(t, *sql, "term = 'mizutani'")
 	assert.Contains(t, *sql, "term = 'cookpad'")
@@ -25,3 +28,141 @@ func TestArgsToSQL(t *testing.T) {
 
 	// fmt.Println(*sql)
 }
+
+func TestQueryHash(t *testing.T) {
+	start := time.Date(2019, 10, 24, 11, 14, 15, 0, time.UTC)
+	end := time.Date(2019, 10, 24, 15, 14, 15, 0, time.UTC)
+	q1 := api.NewRequest([]string{"blue", "orange"}, "", "").Query
+	q2 := api.NewRequest([]string{" orange", "blue", "blue"}, "", "").Query
+	q3 := api.NewRequest([]string{"blue", "red"}, "", "").Query
+
+	assert.Equal(t, api.BuildQueryHash(q1, start, end), api.BuildQueryHash(q2, start, end))
+	assert.NotEqual(t, api.BuildQueryHash(q1, start, end), api.BuildQueryHash(q3, start, end))
+	assert.NotEqual(t, api.BuildQueryHash(q1, start, end), api.BuildQueryHash(q1, start, end.Add(time.Second)))
+}
+
+func TestSearchCache(t *testing.T) {
+	req := api.NewRequest([]string{"mizutani"}, "2019-10-24T11:14:15", "2019-10-24T15:14:15")
+	end := time.Date(2019, 10, 24, 15, 14, 15, 0, time.UTC)
+	ttl := 10 * time.Minute
+
+	t.Run("Reuse succeeded search", func(tt *testing.T) {
+		tester := api.NewSearchCacheTester()
+		created := end.Add(time.Hour)
+		tester.PutSearch("s1", req, "SUCCEEDED", created)
+
+		id, err := tester.Lookup(req, created.Add(time.Minute), ttl)
+		require.NoError(tt, err)
+		assert.Equal(tt, api.SearchID("s1"), id)
+	})
+
+	t.Run("Not reuse expired search", func(tt *testing.T) {
+		tester := api.NewSearchCacheTester()
+		created := end.Add(time.Hour)
+		tester.PutSearch("s1", req, "SUCCEEDED", created)
+
+		id, err := tester.Lookup(req, created.Add(time.Hour), ttl)
+		require.NoError(tt, err)
+		assert.Equal(tt, api.SearchID(""), id)
+	})
+
+	t.Run("Not reuse failed search", func(tt *testing.T) {
+		tester := api.NewSearchCacheTester()
+		created := end.Add(time.Hour)
+		tester.PutSearch("s1", req, "FAILED", created)
+
+		id, err := tester.Lookup(req, created.Add(time.Minute), ttl)
+		require.NoError(tt, err)
+		assert.Equal(tt, api.SearchID(""), id)
+	})
+
+	t.Run("Not reuse search of not indexed range", func(tt *testing.T) {
+		tester := api.NewSearchCacheTester()
+		created := end.Add(time.Minute)
+		tester.PutSearch("s1", req, "SUCCEEDED", created)
+
+		id, err := tester.Lookup(req, created.Add(time.Minute), ttl)
+		require.NoError(tt, err)
+		assert.Equal(tt, api.SearchID(""), id)
+	})
+
+	t.Run("Not reuse different query", func(tt *testing.T) {
+		tester := api.NewSearchCacheTester()
+		created := end.Add(time.Hour)
+		tester.PutSearch("s1", req, "SUCCEEDED", created)
+
+		other := api.NewRequest([]string{"cookpad"}, "2019-10-24T11:14:15", "2019-10-24T15:14:15")
+		id, err := tester.Lookup(other, created.Add(time.Minute), ttl)
+		require.NoError(tt, err)
+		assert.Equal(tt, api.SearchID(""), id)
+	})
+}
+
+func TestBuildSQLWithTags(t *testing.T) {
+	q := api.NewRequest([]string{"mizutani"}, "2019-10-24T11:14:15", "2019-10-24T15:14:15")
+	q.Tags = []string{"aws.cloudtrail", "aws.guardduty"}
+
+	t.Run("without tag partition", func(tt *testing.T) {
+		sql, err := api.BuildSQL(q, "indices", "messages", nil, "")
+		require.NoError(tt, err)
+		assert.Contains(tt, *sql, "indices.tag IN ('aws.cloudtrail', 'aws.guardduty')")
+		assert.NotContains(tt, *sql, "tag_group")
+	})
+
+	t.Run("with tag groups", func(tt *testing.T) {
+		tp, err := models.ParseTagPartition(`{"groups":[{"name":"aws","tags":["aws.*"]}]}`)
+		require.NoError(tt, err)
+		sql, err := api.BuildSQL(q, "indices", "messages", tp, "")
+		require.NoError(tt, err)
+		assert.Contains(tt, *sql, "indices.tag IN ('aws.cloudtrail', 'aws.guardduty')")
+		assert.Contains(tt, *sql, "indices.tag_group IN ('aws')")
+		assert.Contains(tt, *sql, "messages.tag_group IN ('aws')")
+	})
+
+	t.Run("invalid tag", func(tt *testing.T) {
+		q.Tags = []string{"aws' OR 1=1 --"}
+		_, err := api.BuildSQL(q, "indices", "messages", nil, "")
+		assert.Error(tt, err)
+	})
+}
+
+func TestRequestHashWithTags(t *testing.T) {
+	start := time.Date(2019, 10, 24, 11, 14, 15, 0, time.UTC)
+	end := time.Date(2019, 10, 24, 15, 14, 15, 0, time.UTC)
+	q1 := api.NewRequest([]string{"blue"}, "", "")
+	q2 := api.NewRequest([]string{"blue"}, "", "")
+	q2.Tags = []string{"b", "a"}
+	q3 := api.NewRequest([]string{"blue"}, "", "")
+	q3.Tags = []string{"a", "b", "a"}
+
+	assert.Equal(t, api.BuildQueryHash(q1.Query, start, end), api.BuildRequestHash(q1, start, end))
+	assert.NotEqual(t, api.BuildRequestHash(q1, start, end), api.BuildRequestHash(q2, start, end))
+	assert.Equal(t, api.BuildRequestHash(q2, start, end), api.BuildRequestHash(q3, start, end))
+}
+
+func TestBuildSQLWithMixedGranularity(t *testing.T) {
+	q := api.NewRequest([]string{"mizutani"}, "2019-10-24T11:14:15", "2019-10-26T02:00:00")
+	sql, err := api.BuildSQL(q, "indices", "messages", nil, "")
+	require.NoError(t, err)
+
+	// Hourly partitions
+	assert.Contains(t, *sql, "'2019-10-24-11' <= indices.dt AND indices.dt <= '2019-10-26-02'")
+	assert.Contains(t, *sql, "'2019-10-24-11' <= messages.dt AND messages.dt <= '2019-10-26-02'")
+	// Daily partitions
+	assert.Contains(t, *sql, "indices.dt IN ('2019-10-24', '2019-10-25', '2019-10-26')")
+	assert.Contains(t, *sql, "messages.dt IN ('2019-10-24', '2019-10-25', '2019-10-26')")
+}
+
+func TestBuildSQLWithProjection(t *testing.T) {
+	q := api.NewRequest([]string{"mizutani"}, "2019-10-24T11:14:15", "2019-10-26T02:00:00")
+
+	hourly, err := api.BuildSQL(q, "indices", "messages", nil, models.DTHourly)
+	require.NoError(t, err)
+	assert.Contains(t, *hourly, "'2019-10-24-11' <= indices.dt AND indices.dt <= '2019-10-26-02'")
+	assert.NotContains(t, *hourly, "indices.dt IN")
+
+	daily, err := api.BuildSQL(q, "indices", "messages", nil, models.DTDaily)
+	require.NoError(t, err)
+	assert.Contains(t, *daily, "messages.dt IN ('2019-10-24', '2019-10-25', '2019-10-26')")
+	assert.NotContains(t, *daily, "'2019-10-24-11'")
+}
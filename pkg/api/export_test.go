@@ -1,16 +1,34 @@
 package api
 
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/athena"
+	"github.com/aws/aws-sdk-go/service/athena/athenaiface"
+	"github.com/google/uuid"
+	"github.com/guregu/dynamo"
+	"github.com/m-mizutani/minerva/internal/adaptor"
+	"github.com/m-mizutani/minerva/internal/mock"
+)
+
 var (
-	BuildSQL   = buildSQL
-	NewRequest = newRequest
+	BuildSQL         = buildSQL
+	NewRequest       = newRequest
+	BuildQueryHash   = buildQueryHash
+	BuildRequestHash = buildRequestHash
+	HighlightLogs    = highlightLogs
 )
 
 type LogFilter logFilter
 type LogDataSet logDataSet
 type LogQueue logQueue
+type LogData = logData
 type SearchID searchID
 
-func ExtractLogs(ch chan *LogQueue, filter LogFilter) (*LogDataSet, error) {
+// FetchLogs builds result cache from the log stream on S3 mock and fetches logs from it.
+func FetchLogs(ch chan *LogQueue, filter LogFilter) (*LogDataSet, error) {
 	pipe := make(chan *logQueue)
 	go func() {
 		defer close(pipe)
@@ -18,7 +36,17 @@ func ExtractLogs(ch chan *LogQueue, filter LogFilter) (*LogDataSet, error) {
 			pipe <- (*logQueue)(q)
 		}
 	}()
-	v, err := extractLogs(pipe, logFilter(filter))
+
+	cache, err := newResultCache(mock.NewS3Client("test"), fmt.Sprintf("s3://%s/output/result.csv", uuid.New().String()))
+	if err != nil {
+		return nil, err
+	}
+	summary, err := cache.build(pipe)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := cache.fetch(logFilter(filter), summary)
 	return (*LogDataSet)(v), err
 }
 
@@ -34,3 +62,373 @@ func newRequest(terms []string, start, end string) ExecSearchRequest {
 		EndDateTime:   end,
 	}
 }
+
+// searchRepoMemory is on memory searchRepository for testing
+type searchRepoMemory struct {
+	items  map[searchID]*searchItem
+	hashes map[string]searchID
+	saved  map[string]*savedSearch
+	runs   map[string][]*savedSearchRun
+	usages map[string]map[string]int64
+	athena map[string]searchID
+}
+
+func newSearchRepoMemory() *searchRepoMemory {
+	return &searchRepoMemory{
+		items:  make(map[searchID]*searchItem),
+		hashes: make(map[string]searchID),
+		saved:  make(map[string]*savedSearch),
+		runs:   make(map[string][]*savedSearchRun),
+		usages: make(map[string]map[string]int64),
+		athena: make(map[string]searchID),
+	}
+}
+
+func (x *searchRepoMemory) put(item *searchItem) error {
+	v := *item
+	x.items[item.ID] = &v
+	return nil
+}
+
+func (x *searchRepoMemory) get(id searchID) (*searchItem, error) {
+	item, ok := x.items[id]
+	if !ok {
+		return nil, nil
+	}
+	v := *item
+	return &v, nil
+}
+
+func (x *searchRepoMemory) putQueryHash(hash string, id searchID, expiresAt time.Time) error {
+	x.hashes[hash] = id
+	return nil
+}
+
+func (x *searchRepoMemory) getQueryHash(hash string) (*searchID, error) {
+	id, ok := x.hashes[hash]
+	if !ok {
+		return nil, nil
+	}
+	return &id, nil
+}
+
+func (x *searchRepoMemory) putSavedSearch(item *savedSearch) error {
+	v := *item
+	x.saved[item.Name] = &v
+	return nil
+}
+
+func (x *searchRepoMemory) getSavedSearch(name string) (*savedSearch, error) {
+	item, ok := x.saved[name]
+	if !ok {
+		return nil, nil
+	}
+	v := *item
+	return &v, nil
+}
+
+func (x *searchRepoMemory) listSavedSearches() ([]*savedSearch, error) {
+	var items []*savedSearch
+	for _, item := range x.saved {
+		v := *item
+		items = append(items, &v)
+	}
+	return items, nil
+}
+
+func (x *searchRepoMemory) deleteSavedSearch(name string) error {
+	delete(x.saved, name)
+	return nil
+}
+
+func (x *searchRepoMemory) putSavedSearchRun(run *savedSearchRun) error {
+	v := *run
+	for i, r := range x.runs[run.Name] {
+		if r.SearchID == run.SearchID {
+			x.runs[run.Name][i] = &v
+			return nil
+		}
+	}
+	// Keep newest first as same as DynamoDB implementation
+	x.runs[run.Name] = append([]*savedSearchRun{&v}, x.runs[run.Name]...)
+	return nil
+}
+
+func (x *searchRepoMemory) listSavedSearchRuns(name string) ([]*savedSearchRun, error) {
+	var runs []*savedSearchRun
+	for _, r := range x.runs[name] {
+		v := *r
+		runs = append(runs, &v)
+	}
+	return runs, nil
+}
+
+func (x *searchRepoMemory) putAthenaQuery(queryID string, id searchID, expiresAt time.Time) error {
+	x.athena[queryID] = id
+	return nil
+}
+
+func (x *searchRepoMemory) getAthenaQuery(queryID string) (*searchID, error) {
+	id, ok := x.athena[queryID]
+	if !ok {
+		return nil, nil
+	}
+	return &id, nil
+}
+
+// markUsageRecorded evaluates same condition with DynamoDB implementation on attributes marshaled by dynamo as put does.
+func (x *searchRepoMemory) markUsageRecorded(id searchID) (bool, error) {
+	item, ok := x.items[id]
+	if !ok {
+		return false, nil
+	}
+
+	attrs, err := dynamo.MarshalItem(item)
+	if err != nil {
+		return false, err
+	}
+	if v, ok := attrs["usage_recorded"]; ok && v.BOOL != nil && *v.BOOL {
+		return false, nil
+	}
+
+	item.UsageRecorded = true
+	return true, nil
+}
+
+func (x *searchRepoMemory) addUsage(period, principal string, size int64, expiresAt time.Time) error {
+	if _, ok := x.usages[period]; !ok {
+		x.usages[period] = make(map[string]int64)
+	}
+	x.usages[period][principal] += size
+	return nil
+}
+
+func (x *searchRepoMemory) getUsage(period, principal string) (int64, error) {
+	return x.usages[period][principal], nil
+}
+
+func (x *searchRepoMemory) listUsage(period string) ([]*usageItem, error) {
+	var items []*usageItem
+	for principal, size := range x.usages[period] {
+		items = append(items, &usageItem{Principal: principal, ScannedSize: size})
+	}
+	return items, nil
+}
+
+// SearchCacheTester is wrapper to test search cache with on memory repository
+type SearchCacheTester struct {
+	repo *searchRepoMemory
+}
+
+func NewSearchCacheTester() *SearchCacheTester {
+	return &SearchCacheTester{repo: newSearchRepoMemory()}
+}
+
+// PutSearch registers a search item and the query hash.
+func (x *SearchCacheTester) PutSearch(id SearchID, req ExecSearchRequest, status string, createdAt time.Time) {
+	start, end, err := parseRequestTimes(req)
+	if err != nil {
+		panic(err)
+	}
+
+	hash := buildRequestHash(req, *start, *end)
+	x.repo.put(&searchItem{
+		ID:        searchID(id),
+		Status:    queryStatus(status),
+		Query:     req.Query,
+		StartTime: *start,
+		EndTime:   *end,
+		CreatedAt: &createdAt,
+		QueryHash: hash,
+	})
+	x.repo.putQueryHash(hash, searchID(id), createdAt)
+}
+
+// Lookup returns ID of reusable search. Empty string is returned if not found.
+func (x *SearchCacheTester) Lookup(req ExecSearchRequest, now time.Time, ttl time.Duration) (SearchID, error) {
+	start, end, err := parseRequestTimes(req)
+	if err != nil {
+		return "", err
+	}
+
+	item, err := lookupCachedSearch(x.repo, buildRequestHash(req, *start, *end), now, ttl)
+	if err != nil || item == nil {
+		return "", err
+	}
+	return SearchID(item.ID), nil
+}
+
+// FilterParams is filterParams implementation for testing
+type FilterParams struct {
+	Params  map[string]string
+	Headers map[string]string
+}
+
+func (x *FilterParams) Query(key string) string     { return x.Params[key] }
+func (x *FilterParams) GetHeader(key string) string { return x.Headers[key] }
+
+func LoadLogs(client adaptor.S3Client, id SearchID, s3path string, fp *FilterParams) (*LogDataSet, error) {
+	logSet, err := loadLogs(client, searchID(id), s3path, fp, nil)
+	if err != nil {
+		return nil, err
+	}
+	return (*LogDataSet)(logSet), nil
+}
+
+// FakeAthena is athenaiface.AthenaAPI for testing. StartQueryExecution always succeeds and the query keeps RUNNING until CompleteAll.
+type FakeAthena struct {
+	athenaiface.AthenaAPI
+	Queries []string
+	// ScannedSize is set to completed queries by CompleteAll
+	ScannedSize int64
+	status      map[string]*athena.QueryExecution
+}
+
+func (x *FakeAthena) StartQueryExecution(input *athena.StartQueryExecutionInput) (*athena.StartQueryExecutionOutput, error) {
+	queryID := fmt.Sprintf("query-%d", len(x.Queries))
+	x.Queries = append(x.Queries, aws.StringValue(input.QueryString))
+	x.status[queryID] = &athena.QueryExecution{
+		Status: &athena.QueryExecutionStatus{State: aws.String("RUNNING")},
+	}
+	return &athena.StartQueryExecutionOutput{QueryExecutionId: aws.String(queryID)}, nil
+}
+
+func (x *FakeAthena) GetQueryExecution(input *athena.GetQueryExecutionInput) (*athena.GetQueryExecutionOutput, error) {
+	exec, ok := x.status[aws.StringValue(input.QueryExecutionId)]
+	if !ok {
+		return nil, fmt.Errorf("Query is not found: %s", aws.StringValue(input.QueryExecutionId))
+	}
+	return &athena.GetQueryExecutionOutput{QueryExecution: exec}, nil
+}
+
+// CompleteAll changes state of all running queries with output path.
+func (x *FakeAthena) CompleteAll(state, outputPath string) {
+	now := time.Now().UTC()
+	for _, exec := range x.status {
+		if aws.StringValue(exec.Status.State) != "RUNNING" {
+			continue
+		}
+		exec.Status.State = aws.String(state)
+		exec.Status.CompletionDateTime = &now
+		exec.ResultConfiguration = &athena.ResultConfiguration{OutputLocation: aws.String(outputPath)}
+		exec.Statistics = &athena.QueryExecutionStatistics{DataScannedInBytes: aws.Int64(x.ScannedSize)}
+	}
+}
+
+// SchedulerTester is MinervaHandler with on memory repository, FakeAthena and given S3 client
+type SchedulerTester struct {
+	Handler *MinervaHandler
+	Athena  *FakeAthena
+	repo    *searchRepoMemory
+}
+
+func NewSchedulerTester(s3client adaptor.S3Client, notifiers ...Notifier) *SchedulerTester {
+	fakeAthena := &FakeAthena{status: make(map[string]*athena.QueryExecution)}
+	repo := newSearchRepoMemory()
+
+	return &SchedulerTester{
+		Handler: &MinervaHandler{
+			DatabaseName:     "test-db",
+			IndexTableName:   "indices",
+			MessageTableName: "messages",
+			OutputPath:       "s3://test-bucket/output",
+			Region:           "test-region",
+			Notifiers:        notifiers,
+			searchRepo:       repo,
+			auditRepo:        &auditRepoMemory{},
+			newS3:            func(string) adaptor.S3Client { return s3client },
+			newAthena:        func(string) athenaiface.AthenaAPI { return fakeAthena },
+		},
+		Athena: fakeAthena,
+		repo:   repo,
+	}
+}
+
+// SavedSearch is parameters of savedSearch for testing
+type SavedSearch struct {
+	Name      string
+	Terms     []string
+	Lookback  int64
+	Interval  int64
+	Threshold int64
+}
+
+func (x *SchedulerTester) PutSavedSearch(s SavedSearch, now time.Time) error {
+	item := &savedSearch{
+		Name:      s.Name,
+		Lookback:  s.Lookback,
+		Interval:  s.Interval,
+		Threshold: s.Threshold,
+		CreatedAt: now,
+		NextRunAt: now,
+	}
+	for _, t := range s.Terms {
+		item.Query = append(item.Query, Query{Term: t})
+	}
+	if err := item.validate(); err != nil {
+		return err
+	}
+	return x.repo.putSavedSearch(item)
+}
+
+func (x *SchedulerTester) NextRunAt(name string) time.Time {
+	return x.repo.saved[name].NextRunAt
+}
+
+// SavedSearchRun is result of savedSearchRun for testing
+type SavedSearchRun struct {
+	SearchID string
+	Status   string
+	HitCount int64
+	Notified bool
+}
+
+// Runs returns runs of the saved search, newest first.
+func (x *SchedulerTester) Runs(name string) []SavedSearchRun {
+	var runs []SavedSearchRun
+	for _, r := range x.repo.runs[name] {
+		runs = append(runs, SavedSearchRun{
+			SearchID: string(r.SearchID),
+			Status:   string(r.Status),
+			HitCount: r.HitCount,
+			Notified: r.Notified,
+		})
+	}
+	return runs
+}
+
+// SearchPrincipal returns principal recorded in search item
+func (x *SchedulerTester) SearchPrincipal(id string) string {
+	item, ok := x.repo.items[searchID(id)]
+	if !ok {
+		return ""
+	}
+	return item.Principal
+}
+
+// auditRepoMemory is on memory auditRepository for testing
+type auditRepoMemory struct {
+	events []*AuditEvent
+}
+
+func (x *auditRepoMemory) PutAuditEvent(event *AuditEvent) error {
+	v := *event
+	x.events = append(x.events, &v)
+	return nil
+}
+
+func (x *auditRepoMemory) listAuditEvents(date string) ([]*AuditEvent, error) {
+	var events []*AuditEvent
+	for _, event := range x.events {
+		if event.Time.Format(auditDateFormat) == date {
+			v := *event
+			events = append(events, &v)
+		}
+	}
+	return events, nil
+}
+
+func MaskLog(config *MaskConfig, tag string, log interface{}) {
+	m := &masker{rules: config.Rules, hashKey: []byte(config.HashKey)}
+	m.mask(tag, log)
+}
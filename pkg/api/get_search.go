@@ -11,7 +11,7 @@ type GetSearchResponse struct {
 	MetaData *searchMetaData `json:"metadata"`
 }
 
-func (x MinervaHandler) getMetaData(id searchID) (*searchMetaData, Error) {
+func (x *MinervaHandler) getMetaData(id searchID) (*searchMetaData, Error) {
 	repo := x.newSearchRepo()
 
 	item, err := repo.get(id)
@@ -22,21 +22,9 @@ func (x MinervaHandler) getMetaData(id searchID) (*searchMetaData, Error) {
 	}
 
 	if item.Status == statusRunning {
-		status, err := getAthenaQueryStatus(x.Region, item.AthenaQueryID)
-		if err != nil {
+		if err := x.completeSearch(repo, item); err != nil {
 			return nil, err
 		}
-
-		if status.Status != statusRunning {
-			item.CompletedAt = status.CompletedAt
-			item.Status = toQueryStatus(status.Status)
-			item.OutputPath = status.OutputPath
-			item.ScannedSize = status.ScannedSize
-
-			if err := repo.put(item); err != nil {
-				return nil, wrapSystemError(err, http.StatusInternalServerError, "Fail to update search item")
-			}
-		}
 	}
 
 	return &searchMetaData{
@@ -47,10 +35,72 @@ func (x MinervaHandler) getMetaData(id searchID) (*searchMetaData, Error) {
 		EndTime:        item.EndTime.Unix(),
 		SubmittedTime:  *item.CreatedAt,
 		ScannedSize:    item.ScannedSize,
+		CachedFrom:     item.CachedFrom,
+		Principal:      item.Principal,
 		outputPath:     item.OutputPath,
 	}, nil
 }
 
+// completeSearch updates the running search item by status of Athena query, and records usage if the query has been completed.
+func (x *MinervaHandler) completeSearch(repo searchRepository, item *searchItem) Error {
+	status, err := getAthenaQueryStatus(x.athenaClient(), item.AthenaQueryID)
+	if err != nil {
+		return err
+	}
+
+	if status.Status == statusRunning {
+		return nil
+	}
+
+	item.CompletedAt = status.CompletedAt
+	item.Status = toQueryStatus(status.Status)
+	item.OutputPath = status.OutputPath
+	item.ScannedSize = status.ScannedSize
+
+	if err := repo.put(item); err != nil {
+		return wrapSystemError(err, http.StatusInternalServerError, "Fail to update search item")
+	}
+	if err := recordUsage(repo, item); err != nil {
+		return wrapSystemError(err, http.StatusInternalServerError, "Fail to record usage")
+	}
+
+	return nil
+}
+
+// CompleteAthenaQuery is called by Athena query state change event. It completes the search of the query, then usage is recorded even if nobody checks status of the search.
+func (x *MinervaHandler) CompleteAthenaQuery(queryID string) error {
+	repo := x.newSearchRepo()
+
+	id, err := repo.getAthenaQuery(queryID)
+	if err != nil {
+		return err
+	} else if id == nil {
+		Logger.WithField("query_id", queryID).Debug("Athena query is not minerva search")
+		return nil
+	}
+
+	item, err := repo.get(*id)
+	if err != nil {
+		return err
+	} else if item == nil {
+		Logger.WithField("search_id", *id).Warn("Search item of Athena query is not found")
+		return nil
+	}
+
+	if item.Status != statusRunning {
+		// Completed by status check. Usage must have been recorded, but it's safe to try again.
+		if err := recordUsage(repo, item); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	if err := x.completeSearch(repo, item); err != nil {
+		return err
+	}
+	return nil
+}
+
 func (x *MinervaHandler) GetSearch(c *gin.Context) (*Response, Error) {
 	id := searchID(c.Param("search_id"))
 
@@ -58,6 +108,7 @@ func (x *MinervaHandler) GetSearch(c *gin.Context) (*Response, Error) {
 	if err != nil {
 		return nil, err
 	}
+	setAuditSearch(c, id, meta.Query, meta.StartTime, meta.EndTime, meta.ScannedSize)
 
 	return &Response{
 		Code: http.StatusOK,
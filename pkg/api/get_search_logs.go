@@ -2,6 +2,7 @@ package api
 
 import (
 	"github.com/gin-gonic/gin"
+	"github.com/m-mizutani/minerva/internal/transform"
 	"github.com/sirupsen/logrus"
 )
 
@@ -11,6 +12,9 @@ type logData struct {
 	Tag       string      `json:"tag"`
 	Timestamp int64       `json:"timestamp"`
 	Log       interface{} `json:"log"`
+
+	// Highlights has positions of search terms in the log. It's set only when highlight option is enabled.
+	Highlights []transform.TermMatch `json:"highlights,omitempty"`
 }
 
 type GetSearchLogMetaData struct {
@@ -20,6 +24,9 @@ type GetSearchLogMetaData struct {
 	Offset   int64    `json:"offset"`
 	Limit    int64    `json:"limit"`
 	Tags     []string `json:"tags"`
+
+	// NextCursor is set if more logs remain. Pass it as 'cursor' parameter to get next page.
+	NextCursor string `json:"next_cursor,omitempty"`
 }
 
 type GetSearchLogsResponse struct {
@@ -28,7 +35,7 @@ type GetSearchLogsResponse struct {
 	MetaData GetSearchLogMetaData `json:"metadata"`
 }
 
-func (x MinervaHandler) GetSearchLogs(c *gin.Context) (*Response, Error) {
+func (x *MinervaHandler) GetSearchLogs(c *gin.Context) (*Response, Error) {
 	id := searchID(c.Param("search_id"))
 
 	Logger.WithFields(logrus.Fields{
@@ -44,22 +51,33 @@ func (x MinervaHandler) GetSearchLogs(c *gin.Context) (*Response, Error) {
 	if err != nil {
 		return nil, err
 	}
+	setAuditSearch(c, id, meta.Query, meta.StartTime, meta.EndTime, meta.ScannedSize)
 
 	resp.MetaData.searchMetaData = *meta
 
+	m, err := x.newMasker(c)
+	if err != nil {
+		return nil, err
+	}
+
 	if resp.MetaData.Status == statusSuccess {
 		s3path := meta.outputPath
 
-		logSet, err := loadLogs(x.Region, s3path, c)
+		logSet, err := loadLogs(x.s3Client(), id, s3path, c, m)
 		if err != nil {
 			return nil, err
 		}
+		if logSet.Filter.Highlight {
+			highlightLogs(logSet.Logs, meta.Query)
+		}
+
 		resp.Logs = logSet.Logs
 		resp.MetaData.Total = logSet.Total
 		resp.MetaData.Offset = logSet.Filter.Offset
 		resp.MetaData.Limit = logSet.Filter.Limit
 		resp.MetaData.SubTotal = logSet.SubTotal
 		resp.MetaData.Tags = logSet.Tags
+		resp.MetaData.NextCursor = logSet.NextCursor
 	}
 	Logger.WithField("resp", resp).Debug("Done getSearchLogs")
 
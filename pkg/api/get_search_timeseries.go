@@ -29,6 +29,7 @@ func (x *MinervaHandler) GetSearchTimeSeries(c *gin.Context) (*Response, Error)
 	if err != nil {
 		return nil, err
 	}
+	setAuditSearch(c, id, meta.Query, meta.StartTime, meta.EndTime, meta.ScannedSize)
 
 	resp.MetaData.searchMetaData = *meta
 
@@ -53,28 +54,27 @@ func (x *MinervaHandler) GetSearchTimeSeries(c *gin.Context) (*Response, Error)
 	}
 
 	if resp.MetaData.Status == athena.QueryExecutionStateSucceeded {
-		ch, err := getLogStream(x.Region, meta.outputPath)
+		cache, _, err := loadResultCache(x.s3Client(), meta.outputPath)
 		if err != nil {
-			return nil, wrapSystemError(err, 500, "Fail to create LogStream")
+			return nil, wrapSystemErrorf(err, 500, "Fail to load result cache: %s", meta.outputPath)
 		}
 
-		for q := range ch {
-			log, err := recordToLogData(q.Record)
-			if err != nil {
-				return nil, wrapSystemError(err, 500, "Fail to convert CSV record")
-			}
-
-			arr, ok := tsData[log.Tag]
+		err = cache.scan(func(row *resultCacheRow) error {
+			arr, ok := tsData[row.Tag]
 			if !ok {
 				arr = make([]int64, tsUnitSize)
-				tsData[log.Tag] = arr
+				tsData[row.Tag] = arr
 			}
 
-			idx := int(float64(log.Timestamp-tsMin) / tsUnitSpan)
+			idx := int(float64(row.Timestamp-tsMin) / tsUnitSpan)
 			if idx >= len(arr) {
 				idx = len(arr) - 1
 			}
 			arr[idx]++
+			return nil
+		})
+		if err != nil {
+			return nil, wrapSystemError(err, 500, "Fail to read result cache")
 		}
 	}
 
@@ -1,7 +1,15 @@
 package api
 
 import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/athena"
+	"github.com/aws/aws-sdk-go/service/athena/athenaiface"
 	"github.com/gin-gonic/gin"
+	"github.com/m-mizutani/minerva/internal/adaptor"
+	"github.com/m-mizutani/minerva/pkg/models"
 	"github.com/sirupsen/logrus"
 )
 
@@ -16,6 +24,15 @@ type Handler interface {
 	GetSearch(c *gin.Context) (*Response, Error)
 	GetSearchLogs(c *gin.Context) (*Response, Error)
 	GetSearchTimeSeries(c *gin.Context) (*Response, Error)
+
+	PutSavedSearch(c *gin.Context) (*Response, Error)
+	GetSavedSearches(c *gin.Context) (*Response, Error)
+	GetSavedSearch(c *gin.Context) (*Response, Error)
+	DeleteSavedSearch(c *gin.Context) (*Response, Error)
+	GetSavedSearchRuns(c *gin.Context) (*Response, Error)
+
+	GetUsage(c *gin.Context) (*Response, Error)
+	GetAuditEvents(c *gin.Context) (*Response, Error)
 }
 
 type MinervaHandler struct {
@@ -25,12 +42,60 @@ type MinervaHandler struct {
 	OutputPath       string
 	MetaTableName    string
 	Region           string
+
+	// SearchCacheTTL is lifetime of search result that can be reused by identical search. Zero disables the cache.
+	SearchCacheTTL time.Duration
+
+	// DailyScanQuota and MonthlyScanQuota are limits of Athena scanned bytes per principal. Zero means unlimited.
+	DailyScanQuota   int64
+	MonthlyScanQuota int64
+
+	// AuditRetention is lifetime of audit events in meta table. Default is 365 days.
+	AuditRetention time.Duration
+
+	// Masking is rules to mask sensitive fields in search result. nil disables masking.
+	Masking *MaskConfig
+
+	// TagPartition must be same as indexer's one to prune partitions by tags of search. nil means tag partitioning is disabled.
+	TagPartition *models.TagPartition
+
+	// ProjectedGranularity is granularity of "dt" if Athena tables use partition projection. Empty means tables have partitions of both hourly and daily.
+	ProjectedGranularity models.DTGranularity
+
+	// Admin is allowed to change saved searches of others and to get audit events and usage. nil means no admin.
+	Admin *AdminConfig
+
+	// Notifiers are used by scheduler to send alert of saved search.
+	Notifiers []Notifier
+
+	searchRepo searchRepository
+	auditRepo  auditRepository
+	newS3      adaptor.S3ClientFactory
+	newAthena  func(region string) athenaiface.AthenaAPI
 }
 
 func (x *MinervaHandler) newSearchRepo() searchRepository {
+	if x.searchRepo != nil {
+		return x.searchRepo
+	}
 	return newSearchRepoDynamoDB(x.Region, x.MetaTableName)
 }
 
+func (x *MinervaHandler) s3Client() adaptor.S3Client {
+	if x.newS3 != nil {
+		return x.newS3(x.Region)
+	}
+	return adaptor.NewS3Client(x.Region)
+}
+
+func (x *MinervaHandler) athenaClient() athenaiface.AthenaAPI {
+	if x.newAthena != nil {
+		return x.newAthena(x.Region)
+	}
+	ssn := session.Must(session.NewSession(&aws.Config{Region: &x.Region}))
+	return athena.New(ssn)
+}
+
 // Handler is handler interface
 func sendResponse(c *gin.Context, resp *Response, err Error) {
 	var code int
@@ -41,6 +106,7 @@ func sendResponse(c *gin.Context, resp *Response, err Error) {
 	Logger.WithFields(logrus.Fields{
 		"path":       c.FullPath(),
 		"request_id": c.GetHeader("x-request-id"),
+		"principal":  principalID(c),
 		"ipaddr":     c.ClientIP(),
 		"user_agent": c.Request.UserAgent(),
 		"resp_code":  code,
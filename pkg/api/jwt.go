@@ -0,0 +1,237 @@
+package api
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pkg/errors"
+)
+
+// jwtLeeway is acceptable clock skew for exp and nbf
+const jwtLeeway = time.Minute
+
+// jwksRefreshInterval is minimum interval to reload JWKS from URL when unknown kid is found
+const jwksRefreshInterval = 5 * time.Minute
+
+// jwtMinRSAKeyBits is minimum size of RSA public key. A smaller key in JWKS is ignored.
+const jwtMinRSAKeyBits = 2048
+
+// jwtValidMethods is list of acceptable alg. "none" and HMAC are never accepted.
+var jwtValidMethods = []string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwkSet struct {
+	Keys []jwk `json:"keys"`
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(raw), nil
+}
+
+func (x *jwk) publicKey() (crypto.PublicKey, error) {
+	switch x.Kty {
+	case "RSA":
+		n, err := decodeBigInt(x.N)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid 'n' of JWK: %s", x.Kid)
+		}
+		e, err := decodeBigInt(x.E)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid 'e' of JWK: %s", x.Kid)
+		}
+		if n.BitLen() < jwtMinRSAKeyBits {
+			return nil, fmt.Errorf("RSA key of JWK is too small (%d bits): %s", n.BitLen(), x.Kid)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch x.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("Unsupported curve of JWK: %s", x.Crv)
+		}
+		px, err := decodeBigInt(x.X)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid 'x' of JWK: %s", x.Kid)
+		}
+		py, err := decodeBigInt(x.Y)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid 'y' of JWK: %s", x.Kid)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: px, Y: py}, nil
+
+	default:
+		return nil, fmt.Errorf("Unsupported key type of JWK: %s", x.Kty)
+	}
+}
+
+// jwksStore holds public keys loaded from JWKS file or URL.
+type jwksStore struct {
+	source   string
+	keys     map[string]crypto.PublicKey
+	loadedAt time.Time
+	mutex    sync.Mutex
+}
+
+func newJWKSStore(source string) (*jwksStore, error) {
+	store := &jwksStore{source: source}
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (x *jwksStore) isURL() bool {
+	return strings.HasPrefix(x.source, "https://") || strings.HasPrefix(x.source, "http://")
+}
+
+func (x *jwksStore) load() error {
+	var raw []byte
+	if x.isURL() {
+		client := &http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Get(x.source)
+		if err != nil {
+			return errors.Wrapf(err, "Fail to get JWKS: %s", x.source)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("Fail to get JWKS, status %d: %s", resp.StatusCode, x.source)
+		}
+		if raw, err = ioutil.ReadAll(resp.Body); err != nil {
+			return errors.Wrapf(err, "Fail to read JWKS: %s", x.source)
+		}
+	} else {
+		var err error
+		if raw, err = ioutil.ReadFile(x.source); err != nil {
+			return errors.Wrapf(err, "Fail to read JWKS file: %s", x.source)
+		}
+	}
+
+	var set jwkSet
+	if err := json.Unmarshal(raw, &set); err != nil {
+		return errors.Wrapf(err, "Fail to parse JWKS: %s", x.source)
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, key := range set.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		pubKey, err := key.publicKey()
+		if err != nil {
+			// Other keys are still available not to stop authentication by a weak or unsupported key in JWKS of IdP.
+			Logger.WithError(err).WithField("kid", key.Kid).Warn("Ignore invalid key in JWKS")
+			continue
+		}
+		keys[key.Kid] = pubKey
+	}
+
+	x.keys = keys
+	x.loadedAt = time.Now()
+	return nil
+}
+
+// lookup returns public key of kid. JWKS from URL is reloaded if kid is not found to follow key rotation.
+func (x *jwksStore) lookup(kid string) (crypto.PublicKey, error) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	if key, ok := x.keys[kid]; ok {
+		return key, nil
+	}
+
+	if x.isURL() && time.Since(x.loadedAt) > jwksRefreshInterval {
+		if err := x.load(); err != nil {
+			return nil, err
+		}
+		if key, ok := x.keys[kid]; ok {
+			return key, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Unknown kid of JWT: %s", kid)
+}
+
+// jwtClaims is claim set of JWT. Registered claims are validated by verifyJWT.
+type jwtClaims map[string]interface{}
+
+func (x jwtClaims) getString(key string) string {
+	s, _ := x[key].(string)
+	return s
+}
+
+// getStrings returns values of claim as list. A string claim is treated as list of one element.
+func (x jwtClaims) getStrings(key string) []string {
+	switch v := x[key].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
+
+// verifyJWT checks signature and registered claims (exp, nbf, iss, aud) of token. The key is selected by kid in JWT header.
+func verifyJWT(token string, keys *jwksStore, issuer, audience string, now time.Time) (jwtClaims, error) {
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods(jwtValidMethods),
+		jwt.WithLeeway(jwtLeeway),
+		jwt.WithExpirationRequired(),
+		jwt.WithTimeFunc(func() time.Time { return now }),
+		jwt.WithIssuer(issuer),
+		jwt.WithAudience(audience),
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.NewParser(options...).ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return keys.lookup(kid)
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid JWT")
+	}
+
+	return jwtClaims(claims), nil
+}
@@ -11,10 +11,10 @@ import (
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/gin-gonic/gin"
 	"github.com/itchyny/gojq"
+	"github.com/m-mizutani/minerva/internal/adaptor"
+	"github.com/m-mizutani/minerva/internal/transform"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
@@ -31,6 +31,14 @@ type logQueue struct {
 	Error  error
 }
 
+// highlightLogs sets positions of search terms to each log.
+func highlightLogs(logs []*logData, query []Query) {
+	termSet := queryToTermSet(query)
+	for _, log := range logs {
+		log.Highlights = transform.MatchTerms(log.Log, termSet)
+	}
+}
+
 func recordToLogData(record []string) (*logData, error) {
 	var values interface{}
 	if err := json.Unmarshal([]byte(record[2]), &values); err != nil {
@@ -57,6 +65,11 @@ type logFilter struct {
 	Begin         *int64
 	End           *int64
 	PermittedTags map[string]bool
+	Cursor        *resultCursor
+	Highlight     bool
+	Masker        *masker
+	// SearchID is set by loader of the search result to bind cursor to the search
+	SearchID searchID
 }
 
 type filterParams interface {
@@ -76,6 +89,9 @@ func buildLogFilter(fp filterParams) (*logFilter, Error) {
 		} else {
 			return nil, wrapUserError(err, 400, "Fail to parse 'limit'")
 		}
+		if filter.Limit <= 0 {
+			return nil, newUserErrorf(400, "'limit' must be positive")
+		}
 	}
 
 	if v := fp.Query("offset"); v != "" {
@@ -118,6 +134,22 @@ func buildLogFilter(fp filterParams) (*logFilter, Error) {
 		}
 	}
 
+	if v := fp.Query("highlight"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			filter.Highlight = b
+		} else {
+			return nil, wrapUserError(err, 400, "Fail to parse 'highlight', must be boolean")
+		}
+	}
+
+	if v := fp.Query("cursor"); v != "" {
+		if cursor, err := decodeResultCursor(v); err == nil {
+			filter.Cursor = cursor
+		} else {
+			return nil, wrapUserError(err, 400, "Fail to parse 'cursor'")
+		}
+	}
+
 	permitted := fp.GetHeader("x-permitted-tags")
 	switch permitted {
 	case "":
@@ -144,6 +176,7 @@ type logDataSet struct {
 	FirstTimestamp int64
 	LastTimestamp  int64
 	Filter         logFilter
+	NextCursor     string
 }
 
 type tagSet struct {
@@ -161,103 +194,85 @@ func (x *tagSet) toList() []string {
 	return tagList
 }
 
-func extractLogs(ch chan *logQueue, filter logFilter) (*logDataSet, error) {
-	var logs []*logData
-	var total, seq int64
-	tags := newTagSet()
-
-	for q := range ch {
-		if q.Error != nil {
-			return nil, q.Error
-		}
+// isPermitted checks if the tag is allowed to be seen by the requester.
+func (x *logFilter) isPermitted(tag string) bool {
+	if x.PermittedTags == nil {
+		return true
+	}
+	_, ok := x.PermittedTags[tag]
+	return ok
+}
 
-		log, err := recordToLogData(q.Record)
-		if err != nil {
-			return nil, err
+// apply filters a log by target tags, time range and jq query. It returns empty list if the log is not matched. Multiple logs can be returned by jq query.
+func (x *logFilter) apply(log *logData) ([]*logData, error) {
+	if x.TargetTags != nil {
+		if _, ok := x.TargetTags[log.Tag]; !ok {
+			return nil, nil
 		}
+	}
 
-		if filter.PermittedTags != nil {
-			if _, ok := filter.PermittedTags[log.Tag]; !ok {
-				continue
-			}
-		}
+	if x.Begin != nil && log.Timestamp < *x.Begin {
+		return nil, nil
+	}
+	if x.End != nil && *x.End < log.Timestamp {
+		return nil, nil
+	}
 
-		total++
-		// tags has all set of tag in whole log data.
-		tags.add(log.Tag)
+	// Masking must be done before jq query not to reveal original values via the query
+	if x.Masker != nil {
+		x.Masker.mask(log.Tag, log.Log)
+	}
 
-		if filter.TargetTags != nil {
-			if _, ok := filter.TargetTags[log.Tag]; !ok {
-				continue
-			}
-		}
+	if x.Query == nil {
+		return []*logData{log}, nil
+	}
 
-		if filter.Begin != nil && log.Timestamp < *filter.Begin {
-			continue
+	var logs []*logData
+	iter := x.Query.Run(log.Log)
+	for {
+		v, ok := iter.Next()
+		if !ok {
+			break
 		}
-		if filter.End != nil && *filter.End < log.Timestamp {
-			continue
+		if err, ok := v.(error); ok {
+			return nil, err
 		}
 
-		if filter.Query != nil {
-			iter := filter.Query.Run(log.Log)
-			for {
-				v, ok := iter.Next()
-				if !ok {
-					break
-				}
-				if err, ok := v.(error); ok {
-					return nil, err
-				}
-
-				if v != nil {
-					if filter.Offset <= seq && seq < filter.Offset+filter.Limit {
-						// Need to keep map[string]interface{} format for view.
-						if reflect.ValueOf(v).Kind() != reflect.Map {
-							v = map[string]string{"": fmt.Sprintf("%v", v)}
-						}
-						logs = append(logs, &logData{Tag: log.Tag, Timestamp: log.Timestamp, Log: v})
-					}
-					seq++
-				}
-			}
-		} else {
-			if filter.Offset <= seq && seq < filter.Offset+filter.Limit {
-				logs = append(logs, log)
+		if v != nil {
+			// Need to keep map[string]interface{} format for view.
+			if reflect.ValueOf(v).Kind() != reflect.Map {
+				v = map[string]string{"": fmt.Sprintf("%v", v)}
 			}
-			seq++
+			logs = append(logs, &logData{Tag: log.Tag, Timestamp: log.Timestamp, Log: v})
 		}
 	}
 
-	dataSet := &logDataSet{
-		Logs:     logs,
-		Total:    total,
-		SubTotal: seq,
-		Tags:     tags.toList(),
-		Filter:   filter,
+	return logs, nil
+}
+
+// parseS3Path splits S3 path (e.g. s3://your-bucket/some/key) to bucket and key.
+func parseS3Path(s3path string) (string, string, error) {
+	s3arr := strings.Split(s3path, "/")
+	if len(s3arr) < 4 {
+		return "", "", fmt.Errorf("Invalid format of S3 path: %s", s3path)
 	}
-	Logger.WithField("dataSet", dataSet).Info("retrieved")
 
-	return dataSet, nil
+	return s3arr[2], strings.Join(s3arr[3:], "/"), nil
 }
 
-func getLogStream(region, s3path string) (chan *logQueue, error) {
+func getLogStream(s3client adaptor.S3Client, s3path string) (chan *logQueue, error) {
 	Logger.WithFields(logrus.Fields{
-		"region": region,
 		"s3path": s3path,
 	}).Debug("Download s3 object")
 
-	ssn := session.Must(session.NewSession(&aws.Config{Region: &region}))
-	s3client := s3.New(ssn)
-
-	s3arr := strings.Split(s3path, "/")
-	if len(s3arr) < 4 {
-		return nil, fmt.Errorf("Invalid format of S3 path: %s", s3path)
+	bucket, key, err := parseS3Path(s3path)
+	if err != nil {
+		return nil, err
 	}
 
 	output, err := s3client.GetObject(&s3.GetObjectInput{
-		Bucket: aws.String(s3arr[2]),
-		Key:    aws.String(strings.Join(s3arr[3:], "/")),
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
 	})
 	if err != nil {
 		return nil, errors.Wrapf(err, "Fail to download a result object on S3: %s", s3path)
@@ -266,6 +281,7 @@ func getLogStream(region, s3path string) (chan *logQueue, error) {
 	ch := make(chan *logQueue, 128)
 	go func() {
 		defer close(ch)
+		defer output.Body.Close()
 		csvReader := csv.NewReader(output.Body)
 
 		var seq int64
@@ -294,14 +310,15 @@ func getLogStream(region, s3path string) (chan *logQueue, error) {
 	return ch, nil
 }
 
-func loadLogs(region, s3path string, c *gin.Context) (*logDataSet, Error) {
-	filter, apiErr := buildLogFilter(c)
+func loadLogs(s3client adaptor.S3Client, id searchID, s3path string, fp filterParams, m *masker) (*logDataSet, Error) {
+	filter, apiErr := buildLogFilter(fp)
 	if apiErr != nil {
 		return nil, apiErr
 	}
+	filter.Masker = m
+	filter.SearchID = id
 
 	Logger.WithFields(logrus.Fields{
-		"region": region,
 		"s3path": s3path,
 		"filter": filter,
 	}).Debug("Download s3 object")
@@ -310,15 +327,44 @@ func loadLogs(region, s3path string, c *gin.Context) (*logDataSet, Error) {
 		return nil, newUserErrorf(400, "limit number is too big, must be under 10000")
 	}
 
-	ch, err := getLogStream(region, s3path)
+	cache, summary, err := loadResultCache(s3client, s3path)
 	if err != nil {
-		return nil, wrapSystemErrorf(err, 500, "Fail to get log stream: %s", s3path)
+		return nil, wrapSystemErrorf(err, 500, "Fail to load result cache: %s", s3path)
 	}
 
-	logSet, err := extractLogs(ch, *filter)
-	if err != nil {
+	logSet, err := cache.fetch(*filter, summary)
+	if err == errInvalidCursor {
+		return nil, wrapUserError(err, 400, "Invalid 'cursor' for the search and filter")
+	} else if err != nil {
 		return nil, wrapSystemErrorf(err, 500, "Fail to extract log data: %s", s3path)
 	}
 
 	return logSet, nil
 }
+
+// loadResultCache returns result cache of the Athena result. The cache is built if not exists.
+func loadResultCache(s3client adaptor.S3Client, s3path string) (*resultCache, *resultCacheSummary, error) {
+	cache, err := newResultCache(s3client, s3path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	summary, err := cache.loadSummary()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if summary == nil {
+		ch, err := getLogStream(s3client, s3path)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		summary, err = cache.build(ch)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return cache, summary, nil
+}
@@ -1,11 +1,21 @@
 package api_test
 
 import (
+	"bytes"
+	"encoding/csv"
 	"encoding/json"
+	"fmt"
 	"log"
+	"strconv"
+	"strings"
 	"testing"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/google/uuid"
 	"github.com/itchyny/gojq"
+	"github.com/m-mizutani/minerva/internal/adaptor"
+	"github.com/m-mizutani/minerva/internal/mock"
 	"github.com/m-mizutani/minerva/pkg/api"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -83,13 +93,13 @@ func newLogStream() chan *api.LogQueue {
 	return ch
 }
 
-func TestExtractLogsLimit(t *testing.T) {
+func TestFetchLogsLimit(t *testing.T) {
 	filter := api.LogFilter{
 		Offset: 0,
 		Limit:  3,
 	}
 
-	logSet, err := api.ExtractLogs(newLogStream(), filter)
+	logSet, err := api.FetchLogs(newLogStream(), filter)
 	require.NoError(t, err)
 	assert.Equal(t, 3, len(logSet.Logs))
 	assert.Equal(t, int64(8), logSet.Total)
@@ -100,14 +110,14 @@ func TestExtractLogsLimit(t *testing.T) {
 	assert.Equal(t, "Alice", logSet.Logs[2].Log.(map[string]interface{})["name"].(string))
 }
 
-func TestExtractLogsQuerySelect(t *testing.T) {
+func TestFetchLogsQuerySelect(t *testing.T) {
 	filter := api.LogFilter{
 		Offset: 0,
 		Limit:  3,
 		Query:  mustParseJQ(`select(.name == "Ao")`),
 	}
 
-	logSet, err := api.ExtractLogs(newLogStream(), filter)
+	logSet, err := api.FetchLogs(newLogStream(), filter)
 	require.NoError(t, err)
 	assert.Equal(t, 2, len(logSet.Logs))
 	assert.Equal(t, int64(8), logSet.Total)
@@ -121,14 +131,14 @@ func TestExtractLogsQuerySelect(t *testing.T) {
 	assert.Equal(t, "Ao", logSet.Logs[1].Log.(map[string]interface{})["name"].(string))
 }
 
-func TestExtractLogsQueryItem(t *testing.T) {
+func TestFetchLogsQueryItem(t *testing.T) {
 	filter := api.LogFilter{
 		Offset: 0,
 		Limit:  3,
 		Query:  mustParseJQ(`.target`),
 	}
 
-	logSet, err := api.ExtractLogs(newLogStream(), filter)
+	logSet, err := api.FetchLogs(newLogStream(), filter)
 	require.NoError(t, err)
 
 	// Exclude no value logs filtered by jq .xxx query
@@ -145,9 +155,9 @@ func TestExtractLogsQueryItem(t *testing.T) {
 	assert.Equal(t, "paper", logSet.Logs[1].Log.(map[string]string)[""])
 }
 
-func TestExtractLogsQueryItemLimit(t *testing.T) {
+func TestFetchLogsQueryItemLimit(t *testing.T) {
 	// Check if limit and offset work well with jq's query.
-	logSet1, err := api.ExtractLogs(newLogStream(), api.LogFilter{
+	logSet1, err := api.FetchLogs(newLogStream(), api.LogFilter{
 		Offset: 0,
 		Limit:  1,
 		Query:  mustParseJQ(`.target`),
@@ -156,7 +166,7 @@ func TestExtractLogsQueryItemLimit(t *testing.T) {
 	assert.Equal(t, 1, len(logSet1.Logs))
 	assert.Equal(t, "rock", logSet1.Logs[0].Log.(map[string]string)[""])
 
-	logSet2, err := api.ExtractLogs(newLogStream(), api.LogFilter{
+	logSet2, err := api.FetchLogs(newLogStream(), api.LogFilter{
 		Offset: 1,
 		Limit:  3,
 		Query:  mustParseJQ(`.target`),
@@ -165,3 +175,262 @@ func TestExtractLogsQueryItemLimit(t *testing.T) {
 	assert.Equal(t, 1, len(logSet2.Logs))
 	assert.Equal(t, "paper", logSet2.Logs[0].Log.(map[string]string)[""])
 }
+
+func putResultCSV(t *testing.T, client adaptor.S3Client, n int) string {
+	buf := &bytes.Buffer{}
+	w := csv.NewWriter(buf)
+	require.NoError(t, w.Write([]string{"tag", "timestamp", "message"}))
+	for i := 0; i < n; i++ {
+		tag := "test.user"
+		if i%2 == 1 {
+			tag = "test.action"
+		}
+		msg := mustToJSON(map[string]interface{}{"seq": i, "name": fmt.Sprintf("user%d", i)})
+		require.NoError(t, w.Write([]string{tag, fmt.Sprintf("%d", 1580000000+i), msg}))
+	}
+	w.Flush()
+
+	bucket := uuid.New().String()
+	_, err := client.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String("output/result.csv"),
+		Body:   bytes.NewReader(buf.Bytes()),
+	})
+	require.NoError(t, err)
+
+	return fmt.Sprintf("s3://%s/output/result.csv", bucket)
+}
+
+func logSeq(log *api.LogData) int {
+	// json.Number from result cache or int from jq query
+	seq, err := strconv.Atoi(fmt.Sprintf("%v", log.Log.(map[string]interface{})["seq"]))
+	if err != nil {
+		panic(err)
+	}
+	return seq
+}
+
+func TestLoadLogsWithCursor(t *testing.T) {
+	client := mock.NewS3Client("test")
+	s3path := putResultCSV(t, client, 10)
+
+	t.Run("Paginate by cursor", func(tt *testing.T) {
+		var seqList []int
+		params := map[string]string{"limit": "3"}
+		for i := 0; i < 10; i++ {
+			logSet, err := api.LoadLogs(client, "search-1", s3path, &api.FilterParams{Params: params})
+			require.NoError(tt, err)
+			assert.Equal(tt, int64(10), logSet.Total)
+			assert.Equal(tt, int64(10), logSet.SubTotal)
+			for _, log := range logSet.Logs {
+				seqList = append(seqList, logSeq(log))
+			}
+
+			if logSet.NextCursor == "" {
+				break
+			}
+			params = map[string]string{"limit": "3", "cursor": logSet.NextCursor}
+		}
+		assert.Equal(tt, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, seqList)
+	})
+
+	t.Run("Jump by offset", func(tt *testing.T) {
+		logSet, err := api.LoadLogs(client, "search-1", s3path, &api.FilterParams{
+			Params: map[string]string{"limit": "2", "offset": "7"},
+		})
+		require.NoError(tt, err)
+		require.Equal(tt, 2, len(logSet.Logs))
+		assert.Equal(tt, 7, logSeq(logSet.Logs[0]))
+		assert.Equal(tt, 8, logSeq(logSet.Logs[1]))
+		assert.NotEqual(tt, "", logSet.NextCursor)
+	})
+
+	t.Run("Paginate filtered logs by cursor", func(tt *testing.T) {
+		logSet1, err := api.LoadLogs(client, "search-1", s3path, &api.FilterParams{
+			Params: map[string]string{"limit": "2", "tags": "test.action"},
+		})
+		require.NoError(tt, err)
+		require.Equal(tt, 2, len(logSet1.Logs))
+		assert.Equal(tt, 1, logSeq(logSet1.Logs[0]))
+		assert.Equal(tt, 3, logSeq(logSet1.Logs[1]))
+		assert.Equal(tt, int64(5), logSet1.SubTotal)
+
+		logSet2, err := api.LoadLogs(client, "search-1", s3path, &api.FilterParams{
+			Params: map[string]string{"limit": "2", "tags": "test.action", "cursor": logSet1.NextCursor},
+		})
+		require.NoError(tt, err)
+		require.Equal(tt, 2, len(logSet2.Logs))
+		assert.Equal(tt, 5, logSeq(logSet2.Logs[0]))
+		assert.Equal(tt, 7, logSeq(logSet2.Logs[1]))
+		assert.Equal(tt, int64(2), logSet2.Filter.Offset)
+	})
+
+	t.Run("Jump by offset with tag filter", func(tt *testing.T) {
+		logSet, err := api.LoadLogs(client, "search-1", s3path, &api.FilterParams{
+			Params: map[string]string{"limit": "2", "offset": "3", "tags": "test.action"},
+		})
+		require.NoError(tt, err)
+		require.Equal(tt, 2, len(logSet.Logs))
+		assert.Equal(tt, 7, logSeq(logSet.Logs[0]))
+		assert.Equal(tt, 9, logSeq(logSet.Logs[1]))
+		assert.Equal(tt, int64(5), logSet.SubTotal)
+		assert.Equal(tt, "", logSet.NextCursor)
+
+		logSet, err = api.LoadLogs(client, "search-1", s3path, &api.FilterParams{
+			Params:  map[string]string{"limit": "2", "offset": "5"},
+			Headers: map[string]string{"x-permitted-tags": "test.action"},
+		})
+		require.NoError(tt, err)
+		assert.Equal(tt, 0, len(logSet.Logs))
+		assert.Equal(tt, int64(5), logSet.Total)
+	})
+
+	t.Run("Count sub total with query", func(tt *testing.T) {
+		params := map[string]string{"limit": "2", "query": "select(.seq >= 3)"}
+		var seqList []int
+		for i := 0; i < 10; i++ {
+			logSet, err := api.LoadLogs(client, "search-1", s3path, &api.FilterParams{Params: params})
+			require.NoError(tt, err)
+			assert.Equal(tt, int64(7), logSet.SubTotal)
+			for _, log := range logSet.Logs {
+				seqList = append(seqList, logSeq(log))
+			}
+
+			if logSet.NextCursor == "" {
+				break
+			}
+			params = map[string]string{"limit": "2", "query": "select(.seq >= 3)", "cursor": logSet.NextCursor}
+		}
+		assert.Equal(tt, []int{3, 4, 5, 6, 7, 8, 9}, seqList)
+	})
+
+	t.Run("Exclude not permitted tags", func(tt *testing.T) {
+		logSet, err := api.LoadLogs(client, "search-1", s3path, &api.FilterParams{
+			Params:  map[string]string{"limit": "100"},
+			Headers: map[string]string{"x-permitted-tags": "test.user"},
+		})
+		require.NoError(tt, err)
+		assert.Equal(tt, 5, len(logSet.Logs))
+		assert.Equal(tt, int64(5), logSet.Total)
+		assert.Equal(tt, []string{"test.user"}, logSet.Tags)
+		assert.Equal(tt, "", logSet.NextCursor)
+	})
+
+	t.Run("Invalid cursor", func(tt *testing.T) {
+		_, err := api.LoadLogs(client, "search-1", s3path, &api.FilterParams{
+			Params: map[string]string{"cursor": strings.Repeat("!", 8)},
+		})
+		require.Error(tt, err)
+	})
+
+	t.Run("Cursor of other filter or search is rejected", func(tt *testing.T) {
+		logSet, err := api.LoadLogs(client, "search-1", s3path, &api.FilterParams{
+			Params: map[string]string{"limit": "2", "tags": "test.action"},
+		})
+		require.NoError(tt, err)
+		require.NotEqual(tt, "", logSet.NextCursor)
+
+		_, err = api.LoadLogs(client, "search-1", s3path, &api.FilterParams{
+			Params: map[string]string{"limit": "2", "tags": "test.user", "cursor": logSet.NextCursor},
+		})
+		require.Error(tt, err)
+		assert.Equal(tt, 400, err.(api.Error).Code())
+
+		_, err = api.LoadLogs(client, "search-2", s3path, &api.FilterParams{
+			Params: map[string]string{"limit": "2", "tags": "test.action", "cursor": logSet.NextCursor},
+		})
+		require.Error(tt, err)
+
+		// Limit is not a part of filter
+		_, err = api.LoadLogs(client, "search-1", s3path, &api.FilterParams{
+			Params: map[string]string{"limit": "5", "tags": "test.action", "cursor": logSet.NextCursor},
+		})
+		require.NoError(tt, err)
+	})
+
+	t.Run("Limit must be positive", func(tt *testing.T) {
+		for _, limit := range []string{"0", "-1"} {
+			_, err := api.LoadLogs(client, "search-1", s3path, &api.FilterParams{
+				Params: map[string]string{"limit": limit},
+			})
+			require.Error(tt, err)
+			assert.Equal(tt, 400, err.(api.Error).Code())
+		}
+	})
+}
+
+func TestLoadLogsSubTotalCache(t *testing.T) {
+	client := mock.NewS3Client("test")
+	s3path := putResultCSV(t, client, 10)
+	bucket := strings.Split(s3path, "/")[2]
+
+	params := map[string]string{"limit": "2", "query": "select(.seq >= 3)"}
+	logSet, err := api.LoadLogs(client, "search-1", s3path, &api.FilterParams{Params: params})
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), logSet.SubTotal)
+
+	output, err := client.ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String("output/result.csv.cache/subtotals/"),
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(output.Contents))
+
+	// Next page uses saved sub total instead of reading all rows
+	_, err = client.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    output.Contents[0].Key,
+		Body:   strings.NewReader(`{"sub_total":100}`),
+	})
+	require.NoError(t, err)
+	params["cursor"] = logSet.NextCursor
+	logSet, err = api.LoadLogs(client, "search-1", s3path, &api.FilterParams{Params: params})
+	require.NoError(t, err)
+	assert.Equal(t, int64(100), logSet.SubTotal)
+	require.Equal(t, 2, len(logSet.Logs))
+	assert.Equal(t, 5, logSeq(logSet.Logs[0]))
+}
+
+func TestLoadLogsOffsetWithTagBlocks(t *testing.T) {
+	client := mock.NewS3Client("test")
+	s3path := putResultCSV(t, client, 10000)
+
+	for _, offset := range []int{0, 2047, 2048, 3000, 4999} {
+		logSet, err := api.LoadLogs(client, "search-1", s3path, &api.FilterParams{
+			Params: map[string]string{"limit": "1", "offset": fmt.Sprintf("%d", offset), "tags": "test.action"},
+		})
+		require.NoError(t, err)
+		require.Equal(t, 1, len(logSet.Logs))
+		assert.Equal(t, offset*2+1, logSeq(logSet.Logs[0]))
+	}
+
+	logSet, err := api.LoadLogs(client, "search-1", s3path, &api.FilterParams{
+		Params: map[string]string{"limit": "1", "offset": "5000", "tags": "test.action"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(logSet.Logs))
+}
+
+func TestHighlightLogs(t *testing.T) {
+	client := mock.NewS3Client("test")
+	s3path := putResultCSV(t, client, 4)
+
+	logSet, err := api.LoadLogs(client, "search-1", s3path, &api.FilterParams{
+		Params: map[string]string{"highlight": "true"},
+	})
+	require.NoError(t, err)
+	require.True(t, logSet.Filter.Highlight)
+
+	api.HighlightLogs(logSet.Logs, api.NewRequest([]string{"user2"}, "", "").Query)
+	require.Equal(t, 4, len(logSet.Logs))
+	assert.Equal(t, 0, len(logSet.Logs[0].Highlights))
+	require.Equal(t, 1, len(logSet.Logs[2].Highlights))
+	assert.Equal(t, "name", logSet.Logs[2].Highlights[0].Field)
+	assert.Equal(t, 0, logSet.Logs[2].Highlights[0].Begin)
+	assert.Equal(t, 5, logSet.Logs[2].Highlights[0].End)
+
+	// Number is matched as original text of JSON
+	api.HighlightLogs(logSet.Logs, api.NewRequest([]string{"3"}, "", "").Query)
+	require.Equal(t, 1, len(logSet.Logs[3].Highlights))
+	assert.Equal(t, "seq", logSet.Logs[3].Highlights[0].Field)
+}
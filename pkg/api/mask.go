@@ -0,0 +1,211 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// Mask actions
+const (
+	maskRedact  = "redact"
+	maskHash    = "hash"
+	maskPartial = "partial"
+
+	maskRedactedValue  = "[REDACTED]"
+	defaultPartialKeep = 4
+)
+
+// MaskRule specifies a field to be masked in search result.
+type MaskRule struct {
+	// Tag is glob pattern of tag, e.g. "aws.*"
+	Tag string `json:"tag"`
+	// Field is dot separated path of the field, e.g. "user.password". "*" matches any key of the level.
+	Field string `json:"field"`
+	// Action is one of "redact", "hash" and "partial"
+	Action string `json:"action"`
+	// Keep is number of trailing characters shown by "partial". Default is 4.
+	Keep int `json:"keep"`
+}
+
+// MaskConfig is configuration of field masking. It's JSON format.
+type MaskConfig struct {
+	Rules []MaskRule `json:"rules"`
+	// HashKey is HMAC key of "hash" action. Plain SHA256 is used if empty.
+	HashKey string `json:"hash_key"`
+	// UnmaskRoles and UnmaskPrincipals are allowed to see original values with unmask=true parameter.
+	UnmaskRoles      []string `json:"unmask_roles"`
+	UnmaskPrincipals []string `json:"unmask_principals"`
+}
+
+// ParseMaskConfig decodes and validates JSON of MaskConfig.
+func ParseMaskConfig(raw []byte) (*MaskConfig, error) {
+	var config MaskConfig
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, errors.Wrap(err, "Fail to parse mask config")
+	}
+
+	for i, rule := range config.Rules {
+		if rule.Tag == "" || rule.Field == "" {
+			return nil, fmt.Errorf("Both of 'tag' and 'field' are required in mask rule #%d", i)
+		}
+		if _, err := path.Match(rule.Tag, ""); err != nil {
+			return nil, fmt.Errorf("Invalid tag pattern in mask rule #%d: %s", i, rule.Tag)
+		}
+		switch rule.Action {
+		case maskRedact, maskHash, maskPartial:
+		default:
+			return nil, fmt.Errorf("Invalid action in mask rule #%d: %s", i, rule.Action)
+		}
+		if rule.Keep < 0 {
+			return nil, fmt.Errorf("'keep' must not be negative in mask rule #%d", i)
+		}
+	}
+
+	return &config, nil
+}
+
+func (x *MaskConfig) isPrivileged(principal *Principal) bool {
+	if principal == nil {
+		return false
+	}
+	for _, id := range x.UnmaskPrincipals {
+		if id == principal.ID {
+			return true
+		}
+	}
+	for _, role := range principal.Roles {
+		for _, r := range x.UnmaskRoles {
+			if role == r {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// masker replaces values of fields in logs by MaskRule.
+type masker struct {
+	rules   []MaskRule
+	hashKey []byte
+}
+
+func (x *masker) mask(tag string, log interface{}) {
+	for _, rule := range x.rules {
+		if matched, _ := path.Match(rule.Tag, tag); !matched {
+			continue
+		}
+		x.maskPath(log, strings.Split(rule.Field, "."), &rule)
+	}
+}
+
+func (x *masker) maskPath(v interface{}, keys []string, rule *MaskRule) {
+	switch node := v.(type) {
+	case []interface{}:
+		for _, item := range node {
+			x.maskPath(item, keys, rule)
+		}
+
+	case map[string]interface{}:
+		for k, child := range node {
+			if keys[0] != "*" && keys[0] != k {
+				continue
+			}
+			if len(keys) > 1 {
+				x.maskPath(child, keys[1:], rule)
+			} else {
+				node[k] = x.maskValue(child, rule)
+			}
+		}
+	}
+}
+
+func (x *masker) maskValue(v interface{}, rule *MaskRule) interface{} {
+	switch value := v.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		for i := range value {
+			value[i] = x.maskValue(value[i], rule)
+		}
+		return value
+	case map[string]interface{}:
+		// Object can not be masked partially
+		return maskRedactedValue
+	}
+
+	s := formatMaskValue(v)
+	switch rule.Action {
+	case maskHash:
+		var sum []byte
+		if len(x.hashKey) > 0 {
+			h := hmac.New(sha256.New, x.hashKey)
+			h.Write([]byte(s))
+			sum = h.Sum(nil)
+		} else {
+			d := sha256.Sum256([]byte(s))
+			sum = d[:]
+		}
+		return "sha256:" + hex.EncodeToString(sum)
+
+	case maskPartial:
+		keep := rule.Keep
+		if keep == 0 {
+			keep = defaultPartialKeep
+		}
+		runes := []rune(s)
+		// Show at most a half to avoid revealing short values
+		if keep > len(runes)/2 {
+			keep = len(runes) / 2
+		}
+		return strings.Repeat("*", len(runes)-keep) + string(runes[len(runes)-keep:])
+
+	default:
+		return maskRedactedValue
+	}
+}
+
+func formatMaskValue(v interface{}) string {
+	if f, ok := v.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// newMasker returns masker for the request. nil is returned if no masking is needed. Original values are shown only when unmask=true is requested by privileged principal, and then it's recorded in audit event.
+func (x *MinervaHandler) newMasker(c *gin.Context) (*masker, Error) {
+	unmask := false
+	if v := c.Query("unmask"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, wrapUserError(err, http.StatusBadRequest, "Fail to parse 'unmask', must be boolean")
+		}
+		unmask = b
+	}
+
+	if x.Masking == nil || len(x.Masking.Rules) == 0 {
+		return nil, nil
+	}
+
+	if unmask {
+		if !x.Masking.isPrivileged(getPrincipal(c)) {
+			return nil, newUserErrorf(http.StatusForbidden, "Not allowed to unmask")
+		}
+		setAuditUnmasked(c)
+		return nil, nil
+	}
+
+	return &masker{
+		rules:   x.Masking.Rules,
+		hashKey: []byte(x.Masking.HashKey),
+	}, nil
+}
@@ -0,0 +1,247 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/m-mizutani/minerva/internal/adaptor"
+	"github.com/m-mizutani/minerva/internal/mock"
+	"github.com/m-mizutani/minerva/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustParseMaskConfig(t *testing.T, raw string) *api.MaskConfig {
+	config, err := api.ParseMaskConfig([]byte(raw))
+	require.NoError(t, err)
+	return config
+}
+
+func mustDecodeLog(t *testing.T, raw string) map[string]interface{} {
+	var v map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(raw), &v))
+	return v
+}
+
+func TestParseMaskConfig(t *testing.T) {
+	_, err := api.ParseMaskConfig([]byte(`{"rules":[{"tag":"app.*","field":"password","action":"redact"}]}`))
+	assert.NoError(t, err)
+
+	invalid := []string{
+		`{"rules":[{"tag":"app.*","field":"password","action":"encrypt"}]}`,
+		`{"rules":[{"field":"password","action":"redact"}]}`,
+		`{"rules":[{"tag":"[","field":"password","action":"redact"}]}`,
+		`{"rules":[{"tag":"app","field":"card","action":"partial","keep":-1}]}`,
+		`{"rules":`,
+	}
+	for _, raw := range invalid {
+		_, err := api.ParseMaskConfig([]byte(raw))
+		assert.Error(t, err, raw)
+	}
+}
+
+func TestMaskLog(t *testing.T) {
+	t.Run("redact, hash and partial", func(tt *testing.T) {
+		config := mustParseMaskConfig(tt, `{"rules":[
+			{"tag":"app.*","field":"password","action":"redact"},
+			{"tag":"app.*","field":"email","action":"hash"},
+			{"tag":"app.*","field":"card","action":"partial"},
+			{"tag":"app.*","field":"pin","action":"partial","keep":4}
+		]}`)
+		log := mustDecodeLog(tt, `{"password":"p@ss","email":"a@example.com","card":"4111222233334444","pin":"1234","user":"alice"}`)
+		api.MaskLog(config, "app.login", log)
+
+		assert.Equal(tt, "[REDACTED]", log["password"])
+		assert.Equal(tt, "sha256:08168cd80dfd534ab0f10af10f1303fe00af2d43ab5c1432360d137f8197e17a", log["email"])
+		assert.Equal(tt, "************4444", log["card"])
+		assert.Equal(tt, "**34", log["pin"], "Only a half is shown for short value")
+		assert.Equal(tt, "alice", log["user"])
+	})
+
+	t.Run("HMAC is used if hash key is set", func(tt *testing.T) {
+		plain := mustParseMaskConfig(tt, `{"rules":[{"tag":"*","field":"email","action":"hash"}]}`)
+		keyed := mustParseMaskConfig(tt, `{"rules":[{"tag":"*","field":"email","action":"hash"}],"hash_key":"secret"}`)
+		log1 := mustDecodeLog(tt, `{"email":"a@example.com"}`)
+		log2 := mustDecodeLog(tt, `{"email":"a@example.com"}`)
+		log3 := mustDecodeLog(tt, `{"email":"a@example.com"}`)
+		api.MaskLog(plain, "app", log1)
+		api.MaskLog(keyed, "app", log2)
+		api.MaskLog(keyed, "app", log3)
+
+		assert.NotEqual(tt, log1["email"], log2["email"])
+		assert.Equal(tt, log2["email"], log3["email"], "Same value must be same hash to be correlated")
+	})
+
+	t.Run("nested path, array and wildcard", func(tt *testing.T) {
+		config := mustParseMaskConfig(tt, `{"rules":[
+			{"tag":"app.*","field":"user.token","action":"redact"},
+			{"tag":"app.*","field":"headers.*","action":"redact"},
+			{"tag":"app.*","field":"sessions.id","action":"redact"},
+			{"tag":"app.*","field":"secret","action":"partial"}
+		]}`)
+		log := mustDecodeLog(tt, `{
+			"user":{"name":"alice","token":"abcdef"},
+			"headers":{"cookie":"x","auth":"y"},
+			"sessions":[{"id":"s1","ip":"10.0.0.1"},{"id":"s2","ip":"10.0.0.2"}],
+			"secret":{"nested":"object"},
+			"token":"not-target"
+		}`)
+		api.MaskLog(config, "app.login", log)
+
+		user := log["user"].(map[string]interface{})
+		assert.Equal(tt, "alice", user["name"])
+		assert.Equal(tt, "[REDACTED]", user["token"])
+		assert.Equal(tt, map[string]interface{}{"cookie": "[REDACTED]", "auth": "[REDACTED]"}, log["headers"])
+		sessions := log["sessions"].([]interface{})
+		assert.Equal(tt, "[REDACTED]", sessions[0].(map[string]interface{})["id"])
+		assert.Equal(tt, "10.0.0.2", sessions[1].(map[string]interface{})["ip"])
+		assert.Equal(tt, "[REDACTED]", log["secret"], "Object is redacted even by partial")
+		assert.Equal(tt, "not-target", log["token"])
+	})
+
+	t.Run("tag not matched", func(tt *testing.T) {
+		config := mustParseMaskConfig(tt, `{"rules":[{"tag":"app.*","field":"password","action":"redact"}]}`)
+		log := mustDecodeLog(tt, `{"password":"p@ss"}`)
+		api.MaskLog(config, "sys.login", log)
+		assert.Equal(tt, "p@ss", log["password"])
+	})
+}
+
+func putMaskResultCSV(t *testing.T, client adaptor.S3Client) string {
+	buf := &bytes.Buffer{}
+	w := csv.NewWriter(buf)
+	require.NoError(t, w.Write([]string{"tag", "timestamp", "message"}))
+	for i := 0; i < 4; i++ {
+		msg := mustToJSON(map[string]interface{}{
+			"seq":      i,
+			"user":     fmt.Sprintf("user%d", i),
+			"password": fmt.Sprintf("secret%d", i),
+		})
+		require.NoError(t, w.Write([]string{"app.login", fmt.Sprintf("%d", 1580000000+i), msg}))
+	}
+	w.Flush()
+
+	bucket := uuid.New().String()
+	_, err := client.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String("output/result.csv"),
+		Body:   bytes.NewReader(buf.Bytes()),
+	})
+	require.NoError(t, err)
+
+	return fmt.Sprintf("s3://%s/output/result.csv", bucket)
+}
+
+func TestMaskSearchLogs(t *testing.T) {
+	client := mock.NewS3Client("test")
+	s3path := putMaskResultCSV(t, client)
+
+	tester := api.NewSchedulerTester(client)
+	tester.Handler.Admin = &api.AdminConfig{Roles: []string{"security"}}
+	tester.Handler.Masking = mustParseMaskConfig(t, `{
+		"rules":[{"tag":"app.*","field":"password","action":"redact"}],
+		"unmask_roles":["security"]
+	}`)
+	auth, err := api.NewAPIKeyAuthenticator([]api.APIKeyConfig{
+		{Name: "analyst", Key: "key-analyst", Tags: []string{"*"}},
+		{Name: "responder", Key: "key-responder", Tags: []string{"*"}, Roles: []string{"security"}},
+	})
+	require.NoError(t, err)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	v1 := r.Group("/api/v1")
+	v1.Use(api.AuditMiddleware(tester.Handler.AuditSink()))
+	v1.Use(api.AuthMiddleware(auth))
+	api.SetupRoute(v1, tester.Handler)
+
+	analyst := map[string]string{"x-api-key": "key-analyst"}
+	responder := map[string]string{"x-api-key": "key-responder"}
+
+	begin := time.Now().UTC().Add(-time.Minute)
+	body, err := json.Marshal(api.NewRequest([]string{"login"}, "2020-01-02T00:00:00", "2020-01-02T01:00:00"))
+	require.NoError(t, err)
+	w := doRequest(r, "POST", "/api/v1/search", analyst, body)
+	require.Equal(t, http.StatusCreated, w.Code)
+	var execResp api.ExecSearchResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &execResp))
+	tester.Athena.CompleteAll("SUCCEEDED", s3path)
+
+	getLogs := func(tt *testing.T, headers map[string]string, params url.Values) []map[string]interface{} {
+		w := doRequest(r, "GET", "/api/v1/search/"+string(execResp.SearchID)+"/logs?"+params.Encode(), headers, nil)
+		require.Equal(tt, http.StatusOK, w.Code, w.Body.String())
+
+		var resp struct {
+			Logs []struct {
+				Log map[string]interface{} `json:"log"`
+			} `json:"logs"`
+		}
+		require.NoError(tt, json.Unmarshal(w.Body.Bytes(), &resp))
+		var logs []map[string]interface{}
+		for _, log := range resp.Logs {
+			logs = append(logs, log.Log)
+		}
+		return logs
+	}
+
+	t.Run("masked by default", func(tt *testing.T) {
+		for _, headers := range []map[string]string{analyst, responder} {
+			logs := getLogs(tt, headers, url.Values{})
+			require.Equal(tt, 4, len(logs))
+			for _, log := range logs {
+				assert.Equal(tt, "[REDACTED]", log["password"])
+				assert.Contains(tt, log["user"], "user")
+			}
+		}
+	})
+
+	t.Run("jq query can not see original value", func(tt *testing.T) {
+		logs := getLogs(tt, analyst, url.Values{"query": {`select(.password == "secret1")`}})
+		assert.Equal(tt, 0, len(logs))
+	})
+
+	t.Run("unmask by privileged principal", func(tt *testing.T) {
+		logs := getLogs(tt, responder, url.Values{"unmask": {"true"}})
+		require.Equal(tt, 4, len(logs))
+		assert.Equal(tt, "secret0", logs[0]["password"])
+	})
+
+	t.Run("unmask is not allowed for others", func(tt *testing.T) {
+		w := doRequest(r, "GET", "/api/v1/search/"+string(execResp.SearchID)+"/logs?unmask=true", analyst, nil)
+		assert.Equal(tt, http.StatusForbidden, w.Code)
+		w = doRequest(r, "GET", "/api/v1/search/"+string(execResp.SearchID)+"/logs?unmask=maybe", responder, nil)
+		assert.Equal(tt, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("unmask is recorded in audit event", func(tt *testing.T) {
+		q := url.Values{
+			"start":     {begin.Format("2006-01-02T15:04:05")},
+			"end":       {time.Now().UTC().Add(time.Minute).Format("2006-01-02T15:04:05")},
+			"principal": {"apikey:responder"},
+		}
+		w := doRequest(r, "GET", "/api/v1/audit?"+q.Encode(), responder, nil)
+		require.Equal(tt, http.StatusOK, w.Code)
+		var resp api.GetAuditEventsResponse
+		require.NoError(tt, json.Unmarshal(w.Body.Bytes(), &resp))
+
+		var unmasked []*api.AuditEvent
+		for _, event := range resp.Events {
+			if event.Unmasked {
+				unmasked = append(unmasked, event)
+			}
+		}
+		require.Equal(tt, 1, len(unmasked))
+		assert.Equal(tt, string(execResp.SearchID), string(unmasked[0].SearchID))
+		assert.Equal(tt, http.StatusOK, unmasked[0].ResponseCode)
+	})
+}
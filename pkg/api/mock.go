@@ -8,6 +8,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/m-mizutani/minerva/internal/adaptor"
 )
 
 type searchMeta struct {
@@ -19,6 +20,8 @@ type MockHandler struct {
 	mapSearchID map[searchID]*searchMeta
 	LogTotal    int
 	LogLimit    int
+	// S3 stores result cache of random logs. It's required to get logs.
+	S3 adaptor.S3Client
 }
 
 func NewMockHandler() *MockHandler {
@@ -146,7 +149,7 @@ func (x *MockHandler) GetSearchLogs(c *gin.Context) (*Response, Error) {
 		}
 		Logger.WithField("filter", filter).Debug("Built filter")
 
-		logSet, err := extractLogs(newLogStream(x.LogTotal), *filter)
+		logSet, err := x.fetchLogs(id, filter)
 		if err != nil {
 			return nil, wrapSystemError(err, 500, "Fail to load logs")
 		}
@@ -164,6 +167,31 @@ func (x *MockHandler) GetSearchLogs(c *gin.Context) (*Response, Error) {
 	return &Response{200, &resp}, nil
 }
 
+// fetchLogs builds result cache of random logs on S3 at first access of the search.
+func (x *MockHandler) fetchLogs(id searchID, filter *logFilter) (*logDataSet, error) {
+	if x.S3 == nil {
+		return nil, fmt.Errorf("S3 client is not set to MockHandler")
+	}
+
+	cache, err := newResultCache(x.S3, fmt.Sprintf("s3://minerva-mock/%s.csv", id))
+	if err != nil {
+		return nil, err
+	}
+
+	summary, err := cache.loadSummary()
+	if err != nil {
+		return nil, err
+	}
+	if summary == nil {
+		if summary, err = cache.build(newLogStream(x.LogTotal)); err != nil {
+			return nil, err
+		}
+	}
+
+	filter.SearchID = id
+	return cache.fetch(*filter, summary)
+}
+
 func (x *MockHandler) GetSearchTimeSeries(c *gin.Context) (*Response, Error) {
 	return nil, nil
 }
@@ -171,3 +199,31 @@ func (x *MockHandler) GetSearchTimeSeries(c *gin.Context) (*Response, Error) {
 func (x *MockHandler) GetSearch(c *gin.Context) (*Response, Error) {
 	return nil, nil
 }
+
+func (x *MockHandler) PutSavedSearch(c *gin.Context) (*Response, Error) {
+	return nil, nil
+}
+
+func (x *MockHandler) GetSavedSearches(c *gin.Context) (*Response, Error) {
+	return nil, nil
+}
+
+func (x *MockHandler) GetSavedSearch(c *gin.Context) (*Response, Error) {
+	return nil, nil
+}
+
+func (x *MockHandler) DeleteSavedSearch(c *gin.Context) (*Response, Error) {
+	return nil, nil
+}
+
+func (x *MockHandler) GetSavedSearchRuns(c *gin.Context) (*Response, Error) {
+	return nil, nil
+}
+
+func (x *MockHandler) GetUsage(c *gin.Context) (*Response, Error) {
+	return nil, nil
+}
+
+func (x *MockHandler) GetAuditEvents(c *gin.Context) (*Response, Error) {
+	return nil, nil
+}
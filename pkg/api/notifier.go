@@ -0,0 +1,98 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/pkg/errors"
+)
+
+// SavedSearchAlert is sent by Notifier when hit count of a saved search crosses threshold.
+type SavedSearchAlert struct {
+	Name      string    `json:"name"`
+	SearchID  string    `json:"search_id"`
+	Query     []Query   `json:"query"`
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+	HitCount  int64     `json:"hit_count"`
+	Threshold int64     `json:"threshold"`
+}
+
+// Notifier is interface to send alert of saved search to external service.
+type Notifier interface {
+	Notify(alert *SavedSearchAlert) error
+}
+
+// WebhookNotifier posts alert as JSON to URL.
+type WebhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewWebhookNotifier is constructor of WebhookNotifier
+func NewWebhookNotifier(url string) *WebhookNotifier {
+	return &WebhookNotifier{
+		URL:    url,
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Notify of WebhookNotifier sends HTTP POST request
+func (x *WebhookNotifier) Notify(alert *SavedSearchAlert) error {
+	raw, err := json.Marshal(alert)
+	if err != nil {
+		return errors.Wrapf(err, "Fail to marshal alert: %v", alert)
+	}
+
+	resp, err := x.Client.Post(x.URL, "application/json", bytes.NewReader(raw))
+	if err != nil {
+		return errors.Wrapf(err, "Fail to post alert to webhook: %s", x.URL)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || 300 <= resp.StatusCode {
+		return fmt.Errorf("Webhook returned error status %d: %s", resp.StatusCode, x.URL)
+	}
+
+	return nil
+}
+
+// SNSNotifier publishes alert to SNS topic.
+type SNSNotifier struct {
+	Region   string
+	TopicARN string
+}
+
+// NewSNSNotifier is constructor of SNSNotifier
+func NewSNSNotifier(region, topicARN string) *SNSNotifier {
+	return &SNSNotifier{
+		Region:   region,
+		TopicARN: topicARN,
+	}
+}
+
+// Notify of SNSNotifier publishes alert as JSON message
+func (x *SNSNotifier) Notify(alert *SavedSearchAlert) error {
+	raw, err := json.Marshal(alert)
+	if err != nil {
+		return errors.Wrapf(err, "Fail to marshal alert: %v", alert)
+	}
+
+	ssn := session.Must(session.NewSession(&aws.Config{Region: aws.String(x.Region)}))
+	client := sns.New(ssn)
+	if _, err := client.Publish(&sns.PublishInput{
+		TopicArn: aws.String(x.TopicARN),
+		Subject:  aws.String("Minerva alert: " + alert.Name),
+		Message:  aws.String(string(raw)),
+	}); err != nil {
+		return errors.Wrapf(err, "Fail to publish alert to SNS: %s", x.TopicARN)
+	}
+
+	return nil
+}
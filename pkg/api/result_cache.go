@@ -0,0 +1,707 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/m-mizutani/minerva/internal/adaptor"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// resultCache is parsed Athena result stored next to the original CSV object on S3. It consists of following objects.
+//   - rows.jsonl: JSON lines of logData. Each line can be decoded independently.
+//   - offsets.bin: Byte offsets of each row in rows.jsonl as big endian uint64.
+//   - tagids.bin: Tag of each row as big endian uint16 index of summary's tag_ids. It's used to find a row by offset with tag filter without reading rows.
+//   - tagcounts.bin: Number of rows of each tag ID before every tag_block_rows rows as big endian uint32. It's used to find a block of tagids.bin to be read.
+//   - summary.json: Number of rows and tags. The object is put at last and indicates the cache is completed.
+//   - subtotals/<filter hash>.json: Number of logs matched with jq query or time range. It's put at first page of the filter.
+type resultCache struct {
+	client    adaptor.S3Client
+	bucket    string
+	keyPrefix string
+}
+
+const (
+	resultCacheOffsetSize = 8 // uint64
+	resultCacheTagIDSize  = 2 // uint16
+	resultCacheMaxTagIDs  = math.MaxUint16 + 1
+
+	// resultCacheTagBlockRows is number of rows of a block in tagcounts.bin
+	resultCacheTagBlockRows = 4096
+	// resultCacheMaxBlockTags is max number of tags to put tagcounts.bin. Size of tagcounts.bin is (rows / block rows) x tags x 4 bytes.
+	resultCacheMaxBlockTags = 256
+	resultCacheTagCountSize = 4 // uint32
+)
+
+type resultCacheSummary struct {
+	Total    int64            `json:"total"`
+	RowsSize int64            `json:"rows_size"`
+	Tags     map[string]int64 `json:"tags"`
+
+	// TagIDs is list of tags in order of tag ID in tagids.bin. It's empty if the cache has no tagids.bin because of too many tags.
+	TagIDs []string `json:"tag_ids,omitempty"`
+	// TagBlockRows is number of rows of a block in tagcounts.bin. Zero means no tagcounts.bin.
+	TagBlockRows int64 `json:"tag_block_rows,omitempty"`
+}
+
+// resultCacheRow is a row of rows.jsonl. Log is stored as raw JSON to avoid re-encoding.
+type resultCacheRow struct {
+	Tag       string          `json:"tag"`
+	Timestamp int64           `json:"timestamp"`
+	Log       json.RawMessage `json:"log"`
+}
+
+func newResultCache(client adaptor.S3Client, s3path string) (*resultCache, error) {
+	bucket, key, err := parseS3Path(s3path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &resultCache{
+		client:    client,
+		bucket:    bucket,
+		keyPrefix: key + ".cache/",
+	}, nil
+}
+
+func (x *resultCache) rowsKey() string    { return x.keyPrefix + "rows.jsonl" }
+func (x *resultCache) offsetsKey() string { return x.keyPrefix + "offsets.bin" }
+func (x *resultCache) tagIDsKey() string  { return x.keyPrefix + "tagids.bin" }
+func (x *resultCache) tagCountsKey() string {
+	return x.keyPrefix + "tagcounts.bin"
+}
+func (x *resultCache) summaryKey() string { return x.keyPrefix + "summary.json" }
+func (x *resultCache) subTotalKey(filterHash string) string {
+	return x.keyPrefix + "subtotals/" + filterHash + ".json"
+}
+
+func isNoSuchKeyErr(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == s3.ErrCodeNoSuchKey
+	}
+	return false
+}
+
+// loadSummary returns nil if the cache has not been built yet.
+func (x *resultCache) loadSummary() (*resultCacheSummary, error) {
+	output, err := x.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(x.bucket),
+		Key:    aws.String(x.summaryKey()),
+	})
+	if err != nil {
+		if isNoSuchKeyErr(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "Fail to get result cache summary: %s", x.summaryKey())
+	}
+	defer output.Body.Close()
+
+	raw, err := ioutil.ReadAll(output.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to read result cache summary: %s", x.summaryKey())
+	}
+
+	var summary resultCacheSummary
+	if err := json.Unmarshal(raw, &summary); err != nil {
+		return nil, errors.Wrapf(err, "Fail to unmarshal result cache summary: %s", x.summaryKey())
+	}
+
+	return &summary, nil
+}
+
+// build converts Athena result records to cache objects and uploads them.
+func (x *resultCache) build(ch chan *logQueue) (*resultCacheSummary, error) {
+	pr, pw := io.Pipe()
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+
+	var uploadErr error
+	go func() {
+		defer wg.Done()
+		if err := x.client.Upload(x.bucket, x.rowsKey(), pr, ""); err != nil {
+			uploadErr = errors.Wrapf(err, "Fail to upload result cache rows: %s", x.rowsKey())
+			pr.CloseWithError(uploadErr)
+		}
+	}()
+
+	summary := &resultCacheSummary{Tags: map[string]int64{}}
+	offsets := &bytes.Buffer{}
+	tagIDs := &bytes.Buffer{}
+	tagIDMap := map[string]uint16{}
+	overTagIDs := false
+	// tagCounts is number of rows of each tag ID so far, and tagBlocks is snapshot of it at beginning of each block
+	var tagCounts []uint32
+	var tagBlocks [][]uint32
+
+	writeRows := func() error {
+		for q := range ch {
+			if q.Error != nil {
+				return q.Error
+			}
+
+			row, err := recordToCacheRow(q.Record)
+			if err != nil {
+				return err
+			}
+			raw, err := json.Marshal(row)
+			if err != nil {
+				return errors.Wrapf(err, "Fail to marshal result cache row: %v", row)
+			}
+
+			if err := binary.Write(offsets, binary.BigEndian, uint64(summary.RowsSize)); err != nil {
+				return errors.Wrap(err, "Fail to write result cache offset")
+			}
+
+			if !overTagIDs {
+				id, ok := tagIDMap[row.Tag]
+				if !ok && len(summary.TagIDs) >= resultCacheMaxTagIDs {
+					overTagIDs = true
+				} else {
+					if !ok {
+						id = uint16(len(summary.TagIDs))
+						tagIDMap[row.Tag] = id
+						summary.TagIDs = append(summary.TagIDs, row.Tag)
+						tagCounts = append(tagCounts, 0)
+					}
+					if err := binary.Write(tagIDs, binary.BigEndian, id); err != nil {
+						return errors.Wrap(err, "Fail to write result cache tag ID")
+					}
+
+					if summary.Total%resultCacheTagBlockRows == 0 && len(tagCounts) <= resultCacheMaxBlockTags {
+						tagBlocks = append(tagBlocks, append([]uint32{}, tagCounts...))
+					}
+					tagCounts[id]++
+				}
+			}
+			n, err := pw.Write(append(raw, '\n'))
+			if err != nil {
+				return errors.Wrap(err, "Fail to write result cache row")
+			}
+
+			summary.RowsSize += int64(n)
+			summary.Total++
+			summary.Tags[row.Tag]++
+		}
+		return nil
+	}
+
+	if err := writeRows(); err != nil {
+		pw.CloseWithError(err)
+		wg.Wait()
+		// Drain channel to stop goroutine of getLogStream
+		for range ch {
+		}
+		return nil, err
+	}
+
+	pw.Close()
+	wg.Wait()
+	if uploadErr != nil {
+		return nil, uploadErr
+	}
+
+	if err := x.client.Upload(x.bucket, x.offsetsKey(), offsets, ""); err != nil {
+		return nil, errors.Wrapf(err, "Fail to upload result cache offsets: %s", x.offsetsKey())
+	}
+
+	if overTagIDs {
+		summary.TagIDs = nil
+	} else if err := x.client.Upload(x.bucket, x.tagIDsKey(), tagIDs, ""); err != nil {
+		return nil, errors.Wrapf(err, "Fail to upload result cache tag IDs: %s", x.tagIDsKey())
+	}
+
+	if !overTagIDs && len(summary.TagIDs) <= resultCacheMaxBlockTags {
+		tagCountsBuf := &bytes.Buffer{}
+		for _, block := range tagBlocks {
+			counts := make([]uint32, len(summary.TagIDs))
+			copy(counts, block)
+			if err := binary.Write(tagCountsBuf, binary.BigEndian, counts); err != nil {
+				return nil, errors.Wrap(err, "Fail to write result cache tag counts")
+			}
+		}
+		if err := x.client.Upload(x.bucket, x.tagCountsKey(), tagCountsBuf, ""); err != nil {
+			return nil, errors.Wrapf(err, "Fail to upload result cache tag counts: %s", x.tagCountsKey())
+		}
+		summary.TagBlockRows = resultCacheTagBlockRows
+	}
+
+	raw, err := json.Marshal(summary)
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to marshal result cache summary")
+	}
+	if err := x.client.Upload(x.bucket, x.summaryKey(), bytes.NewReader(raw), ""); err != nil {
+		return nil, errors.Wrapf(err, "Fail to upload result cache summary: %s", x.summaryKey())
+	}
+
+	Logger.WithFields(logrus.Fields{
+		"bucket":  x.bucket,
+		"prefix":  x.keyPrefix,
+		"summary": summary,
+	}).Info("Built result cache")
+
+	return summary, nil
+}
+
+func recordToCacheRow(record []string) (*resultCacheRow, error) {
+	ts, err := strconv.ParseInt(record[1], 10, 64)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid timestamp: %s", record[1])
+	}
+
+	// Compact also validates JSON and removes line breaks to keep JSON lines format.
+	buf := &bytes.Buffer{}
+	if err := json.Compact(buf, []byte(record[2])); err != nil {
+		return nil, errors.Wrap(err, "Invalid log JSON")
+	}
+
+	return &resultCacheRow{
+		Tag:       record[0],
+		Timestamp: ts,
+		Log:       buf.Bytes(),
+	}, nil
+}
+
+// decodeLog decodes JSON with UseNumber to keep numbers as original text for highlight as indexer does
+func decodeLog(raw []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+func (x *resultCache) getRange(key string, begin, end int64) (io.ReadCloser, error) {
+	rangeExpr := fmt.Sprintf("bytes=%d-", begin)
+	if end >= 0 {
+		rangeExpr = fmt.Sprintf("bytes=%d-%d", begin, end)
+	}
+
+	output, err := x.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(x.bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(rangeExpr),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to get result cache object: %s (%s)", key, rangeExpr)
+	}
+
+	return output.Body, nil
+}
+
+// rowOffset looks up byte offset of N-th row in rows.jsonl
+func (x *resultCache) rowOffset(row int64) (int64, error) {
+	begin := row * resultCacheOffsetSize
+	body, err := x.getRange(x.offsetsKey(), begin, begin+resultCacheOffsetSize-1)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+
+	var offset uint64
+	if err := binary.Read(body, binary.BigEndian, &offset); err != nil {
+		return 0, errors.Wrapf(err, "Fail to read row offset: %d", row)
+	}
+
+	return int64(offset), nil
+}
+
+// resultCursor indicates a position in result cache. It's opaque for clients.
+type resultCursor struct {
+	// Offset is byte offset of next row in rows.jsonl
+	Offset int64 `json:"o"`
+	// Seq is number of filtered logs before the row
+	Seq int64 `json:"s"`
+	// SearchID and Filter are search and hash of filter that issued the cursor. Seq is valid only for them.
+	SearchID searchID `json:"i"`
+	Filter   string   `json:"f"`
+}
+
+func (x *resultCursor) encode() string {
+	raw, err := json.Marshal(x)
+	if err != nil {
+		Logger.WithError(err).WithField("cursor", x).Fatal("Fail to marshal cursor")
+	}
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeResultCursor(s string) (*resultCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid cursor encoding")
+	}
+
+	var cursor resultCursor
+	if err := json.Unmarshal(raw, &cursor); err != nil {
+		return nil, errors.Wrap(err, "Invalid cursor format")
+	}
+	if cursor.Offset < 0 || cursor.Seq < 0 {
+		return nil, fmt.Errorf("Invalid cursor value: %v", cursor)
+	}
+
+	return &cursor, nil
+}
+
+// errInvalidCursor is returned if the cursor was issued by other search or filter
+var errInvalidCursor = fmt.Errorf("Cursor does not match with the search and filter")
+
+// hash returns hash of filter conditions that change which logs are returned. Limit, Offset, Cursor and Highlight are not included.
+func (x *logFilter) hash() string {
+	sortedKeys := func(m map[string]bool) []string {
+		if m == nil {
+			return nil
+		}
+		keys := []string{}
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+
+	v := struct {
+		Query         string   `json:"query,omitempty"`
+		TargetTags    []string `json:"target_tags"`
+		Begin         *int64   `json:"begin"`
+		End           *int64   `json:"end"`
+		PermittedTags []string `json:"permitted_tags"`
+		Masked        bool     `json:"masked"`
+	}{
+		TargetTags:    sortedKeys(x.TargetTags),
+		Begin:         x.Begin,
+		End:           x.End,
+		PermittedTags: sortedKeys(x.PermittedTags),
+		Masked:        x.Masker != nil,
+	}
+	if x.Query != nil {
+		v.Query = x.Query.String()
+	}
+
+	raw, err := json.Marshal(v)
+	if err != nil {
+		Logger.WithError(err).WithField("filter", x).Fatal("Fail to marshal filter")
+	}
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:8])
+}
+
+// hasLogFilter returns true if any filter can change number of logs per row.
+func (x *logFilter) hasLogFilter() bool {
+	return x.Query != nil || x.Begin != nil || x.End != nil
+}
+
+// hasTagFilter returns true if any filter can exclude rows by tag.
+func (x *logFilter) hasTagFilter() bool {
+	return x.PermittedTags != nil || x.TargetTags != nil
+}
+
+// matchTag checks both of permitted tags and target tags.
+func (x *logFilter) matchTag(tag string) bool {
+	if !x.isPermitted(tag) {
+		return false
+	}
+	if x.TargetTags != nil {
+		if _, ok := x.TargetTags[tag]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// findRow returns row number of the N-th log matched with tag filter by reading tagids.bin. It returns -1 if no such row. The filter must not have log filter because one row must be one log. Only a block of tagids.bin is read if the cache has tagcounts.bin.
+func (x *resultCache) findRow(filter logFilter, summary *resultCacheSummary, n int64) (int64, error) {
+	if !filter.hasTagFilter() {
+		if n >= summary.Total {
+			return -1, nil
+		}
+		return n, nil
+	}
+
+	matched := make([]bool, len(summary.TagIDs))
+	for i, tag := range summary.TagIDs {
+		matched[i] = filter.matchTag(tag)
+	}
+
+	var row, seq int64
+	if summary.TagBlockRows > 0 {
+		var err error
+		if row, seq, err = x.findTagBlock(matched, summary, n); err != nil {
+			return 0, err
+		}
+	}
+
+	body, err := x.getRange(x.tagIDsKey(), row*resultCacheTagIDSize, -1)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+
+	reader := bufio.NewReader(body)
+	for ; ; row++ {
+		var id uint16
+		if err := binary.Read(reader, binary.BigEndian, &id); err == io.EOF {
+			return -1, nil
+		} else if err != nil {
+			return 0, errors.Wrapf(err, "Fail to read tag ID: %d", row)
+		}
+		if int(id) >= len(matched) {
+			return 0, fmt.Errorf("Invalid tag ID %d at row %d", id, row)
+		}
+
+		if matched[id] {
+			if seq == n {
+				return row, nil
+			}
+			seq++
+		}
+	}
+}
+
+// findTagBlock returns first row of the block that has the N-th matched row and number of matched rows before the block
+func (x *resultCache) findTagBlock(matched []bool, summary *resultCacheSummary, n int64) (int64, int64, error) {
+	if summary.Total == 0 || len(summary.TagIDs) == 0 {
+		return 0, 0, nil
+	}
+
+	body, err := x.getRange(x.tagCountsKey(), 0, -1)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer body.Close()
+
+	raw, err := ioutil.ReadAll(body)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "Fail to read result cache tag counts: %s", x.tagCountsKey())
+	}
+
+	width := len(summary.TagIDs) * resultCacheTagCountSize
+	blocks := len(raw) / width
+	matchedBefore := func(b int) int64 {
+		var sum int64
+		for id, m := range matched {
+			if m {
+				sum += int64(binary.BigEndian.Uint32(raw[b*width+id*resultCacheTagCountSize:]))
+			}
+		}
+		return sum
+	}
+
+	// First block always has zero count, then b is 0 or more
+	b := sort.Search(blocks, func(b int) bool { return matchedBefore(b) > n }) - 1
+	if b < 0 {
+		return 0, 0, nil
+	}
+	return int64(b) * summary.TagBlockRows, matchedBefore(b), nil
+}
+
+// loadSubTotal returns number of logs matched with the filter. It's counted by reading all rows at first and saved to S3, then following pages do not read all rows.
+func (x *resultCache) loadSubTotal(filter logFilter, filterHash string) (int64, error) {
+	key := x.subTotalKey(filterHash)
+	output, err := x.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(x.bucket),
+		Key:    aws.String(key),
+	})
+	if err == nil {
+		defer output.Body.Close()
+		var v struct {
+			SubTotal int64 `json:"sub_total"`
+		}
+		if err := json.NewDecoder(output.Body).Decode(&v); err != nil {
+			return 0, errors.Wrapf(err, "Fail to read sub total: %s", key)
+		}
+		return v.SubTotal, nil
+	} else if !isNoSuchKeyErr(err) {
+		return 0, errors.Wrapf(err, "Fail to get sub total: %s", key)
+	}
+
+	var subTotal int64
+	if err := x.scan(func(row *resultCacheRow) error {
+		if !filter.isPermitted(row.Tag) {
+			return nil
+		}
+		log := logData{Tag: row.Tag, Timestamp: row.Timestamp}
+		if err := decodeLog(row.Log, &log.Log); err != nil {
+			return errors.Wrap(err, "Fail to unmarshal result cache log")
+		}
+		matched, err := filter.apply(&log)
+		if err != nil {
+			return err
+		}
+		subTotal += int64(len(matched))
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	raw, err := json.Marshal(map[string]int64{"sub_total": subTotal})
+	if err != nil {
+		return 0, errors.Wrap(err, "Fail to marshal sub total")
+	}
+	if err := x.client.Upload(x.bucket, key, bytes.NewReader(raw), ""); err != nil {
+		return 0, errors.Wrapf(err, "Fail to upload sub total: %s", key)
+	}
+
+	return subTotal, nil
+}
+
+// fetch reads a page of logs from the cache. Reading starts from cursor position if the filter has cursor. Otherwise row offset is used to skip leading rows when no filter can change number of logs. Then cost of a page does not depend on the page position. A page can have more logs than Limit when jq query returns multiple values from the last row. If the filter has jq query or time range, SubTotal is counted at first page of the filter and cached.
+func (x *resultCache) fetch(filter logFilter, summary *resultCacheSummary) (*logDataSet, error) {
+	tags := newTagSet()
+	var total, subTotal int64
+	for tag, count := range summary.Tags {
+		if !filter.isPermitted(tag) {
+			continue
+		}
+		tags.add(tag)
+		total += count
+
+		if filter.matchTag(tag) {
+			subTotal += count
+		}
+	}
+
+	dataSet := &logDataSet{
+		Total:    total,
+		SubTotal: subTotal,
+		Tags:     tags.toList(),
+		Filter:   filter,
+	}
+
+	if filter.Limit <= 0 {
+		return nil, fmt.Errorf("Limit must be positive: %d", filter.Limit)
+	}
+	filterHash := filter.hash()
+
+	var offset, seq, skip int64
+	switch {
+	case filter.Cursor != nil:
+		if filter.Cursor.SearchID != filter.SearchID || filter.Cursor.Filter != filterHash {
+			return nil, errInvalidCursor
+		}
+		offset, seq = filter.Cursor.Offset, filter.Cursor.Seq
+	case filter.Offset <= 0:
+		// Start from the first row
+	case !filter.hasLogFilter() && (!filter.hasTagFilter() || len(summary.TagIDs) > 0):
+		// One row is one log, then the offset can be converted to row number.
+		row, err := x.findRow(filter, summary, filter.Offset)
+		if err != nil {
+			return nil, err
+		}
+		if row < 0 {
+			dataSet.Filter.Offset = filter.Offset
+			return dataSet, nil
+		}
+		rowOffset, err := x.rowOffset(row)
+		if err != nil {
+			return nil, err
+		}
+		offset, seq = rowOffset, filter.Offset
+	default:
+		// Need to scan from the first row to count filtered logs
+		skip = filter.Offset
+	}
+	dataSet.Filter.Offset = seq + skip
+
+	if filter.hasLogFilter() {
+		n, err := x.loadSubTotal(filter, filterHash)
+		if err != nil {
+			return nil, err
+		}
+		dataSet.SubTotal = n
+	}
+
+	if offset >= summary.RowsSize {
+		return dataSet, nil
+	}
+
+	body, err := x.getRange(x.rowsKey(), offset, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	reader := bufio.NewReader(body)
+	for int64(len(dataSet.Logs)) < filter.Limit {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		} else if err != nil && err != io.EOF {
+			return nil, errors.Wrap(err, "Fail to read result cache rows")
+		}
+		offset += int64(len(line))
+
+		var log logData
+		if err := decodeLog(line, &log); err != nil {
+			return nil, errors.Wrap(err, "Fail to unmarshal result cache row")
+		}
+
+		if !filter.isPermitted(log.Tag) {
+			continue
+		}
+
+		matched, err := filter.apply(&log)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, m := range matched {
+			if skip > 0 {
+				skip--
+				continue
+			}
+			dataSet.Logs = append(dataSet.Logs, m)
+		}
+	}
+
+	if offset < summary.RowsSize {
+		next := resultCursor{
+			Offset:   offset,
+			Seq:      dataSet.Filter.Offset + int64(len(dataSet.Logs)),
+			SearchID: filter.SearchID,
+			Filter:   filterHash,
+		}
+		dataSet.NextCursor = next.encode()
+	}
+
+	return dataSet, nil
+}
+
+// scan reads all rows of the cache without filter.
+func (x *resultCache) scan(f func(row *resultCacheRow) error) error {
+	body, err := x.getRange(x.rowsKey(), 0, -1)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	reader := bufio.NewReader(body)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		} else if err != nil && err != io.EOF {
+			return errors.Wrap(err, "Fail to read result cache rows")
+		}
+
+		var row resultCacheRow
+		if err := json.Unmarshal(line, &row); err != nil {
+			return errors.Wrap(err, "Fail to unmarshal result cache row")
+		}
+		if err := f(&row); err != nil {
+			return err
+		}
+	}
+}
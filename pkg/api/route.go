@@ -26,4 +26,33 @@ func SetupRoute(r *gin.RouterGroup, handler Handler) {
 		resp, err := handler.GetSearchTimeSeries(c)
 		sendResponse(c, resp, err)
 	})
+
+	r.POST("/saved_search", func(c *gin.Context) {
+		resp, err := handler.PutSavedSearch(c)
+		sendResponse(c, resp, err)
+	})
+	r.GET("/saved_search", func(c *gin.Context) {
+		resp, err := handler.GetSavedSearches(c)
+		sendResponse(c, resp, err)
+	})
+	r.GET("/saved_search/:name", func(c *gin.Context) {
+		resp, err := handler.GetSavedSearch(c)
+		sendResponse(c, resp, err)
+	})
+	r.DELETE("/saved_search/:name", func(c *gin.Context) {
+		resp, err := handler.DeleteSavedSearch(c)
+		sendResponse(c, resp, err)
+	})
+	r.GET("/saved_search/:name/runs", func(c *gin.Context) {
+		resp, err := handler.GetSavedSearchRuns(c)
+		sendResponse(c, resp, err)
+	})
+	r.GET("/usage", func(c *gin.Context) {
+		resp, err := handler.GetUsage(c)
+		sendResponse(c, resp, err)
+	})
+	r.GET("/audit", func(c *gin.Context) {
+		resp, err := handler.GetAuditEvents(c)
+		sendResponse(c, resp, err)
+	})
 }
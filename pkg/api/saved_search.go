@@ -0,0 +1,278 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/gin-gonic/gin"
+	"github.com/guregu/dynamo"
+	"github.com/pkg/errors"
+)
+
+const (
+	savedSearchKey           = "saved_search"
+	savedSearchMinInterval   = 5 * 60 // 5 minutes
+	savedSearchRunRetention  = 90 * 24 * time.Hour
+	savedSearchRunListLimit  = 100
+	savedSearchRunTimeFormat = "2006-01-02T15:04:05Z"
+)
+
+var savedSearchNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.\-]{1,128}$`)
+
+// savedSearch is a search executed periodically by scheduler. It's stored in same table with searchItem.
+type savedSearch struct {
+	PK string `dynamo:"pk" json:"-"`
+	SK string `dynamo:"sk" json:"-"`
+
+	Name      string  `dynamo:"name" json:"name"`
+	Query     []Query `dynamo:"query" json:"query"`
+	Lookback  int64   `dynamo:"lookback" json:"lookback"`   // seconds
+	Interval  int64   `dynamo:"interval" json:"interval"`   // seconds
+	Threshold int64   `dynamo:"threshold" json:"threshold"` // minimum hit count to notify
+
+	// Owner is ID of principal created the saved search. Only owner and admin can change it.
+	Owner string `dynamo:"owner" json:"owner"`
+
+	CreatedAt time.Time  `dynamo:"created_at" json:"created_at"`
+	LastRunAt *time.Time `dynamo:"last_run_at" json:"last_run_at,omitempty"`
+	NextRunAt time.Time  `dynamo:"next_run_at" json:"next_run_at"`
+}
+
+func (x *savedSearch) validate() error {
+	if !savedSearchNamePattern.MatchString(x.Name) {
+		return fmt.Errorf("Invalid name, must match %s", savedSearchNamePattern.String())
+	}
+	if len(x.Query) == 0 {
+		return fmt.Errorf("No query. 'query' field is required")
+	}
+	if x.Lookback <= 0 {
+		return fmt.Errorf("'lookback' must be positive seconds")
+	}
+	if x.Interval < savedSearchMinInterval {
+		return fmt.Errorf("'interval' must be %d seconds or more", savedSearchMinInterval)
+	}
+	if x.Threshold <= 0 {
+		return fmt.Errorf("'threshold' must be positive number")
+	}
+
+	return nil
+}
+
+// newRequest builds ExecSearchRequest of a scheduled run. End of the time range is shifted back by searchIndexLag because recent logs may not be indexed and merged yet.
+func (x *savedSearch) newRequest(now time.Time) ExecSearchRequest {
+	inputFmt := "2006-01-02T15:04:05"
+	end := now.UTC().Add(-searchIndexLag)
+	start := end.Add(-time.Duration(x.Lookback) * time.Second)
+
+	return ExecSearchRequest{
+		Query:         x.Query,
+		StartDateTime: start.Format(inputFmt),
+		EndDateTime:   end.Format(inputFmt),
+	}
+}
+
+// savedSearchRun is a history of scheduled run of savedSearch
+type savedSearchRun struct {
+	PK        string `dynamo:"pk" json:"-"`
+	SK        string `dynamo:"sk" json:"-"`
+	ExpiresAt int64  `dynamo:"expires_at" json:"-"`
+
+	Name        string      `dynamo:"name" json:"name"`
+	SearchID    searchID    `dynamo:"search_id" json:"search_id"`
+	Status      queryStatus `dynamo:"status" json:"status"`
+	ScheduledAt time.Time   `dynamo:"scheduled_at" json:"scheduled_at"`
+	HitCount    int64       `dynamo:"hit_count" json:"hit_count"`
+	Notified    bool        `dynamo:"notified" json:"notified"`
+}
+
+func savedSearchRunToKey(name string) string {
+	return "saved_search_run:" + name
+}
+
+// ------------------------------------------------------------
+// DynamoDB implementation of savedSearch repository
+//
+
+func (x *searchRepoDynamoDB) table() dynamo.Table {
+	db := dynamo.New(session.New(), &aws.Config{Region: aws.String(x.region)})
+	return db.Table(x.tableName)
+}
+
+func (x *searchRepoDynamoDB) putSavedSearch(item *savedSearch) error {
+	item.PK = savedSearchKey
+	item.SK = item.Name
+	if err := x.table().Put(item).Run(); err != nil {
+		return errors.Wrapf(err, "Fail to put savedSearch: %v", *item)
+	}
+	return nil
+}
+
+func (x *searchRepoDynamoDB) getSavedSearch(name string) (*savedSearch, error) {
+	var item savedSearch
+	if err := x.table().Get("pk", savedSearchKey).Range("sk", dynamo.Equal, name).One(&item); err != nil {
+		if err == dynamo.ErrNotFound {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "Fail to get savedSearch: %s", name)
+	}
+	return &item, nil
+}
+
+func (x *searchRepoDynamoDB) listSavedSearches() ([]*savedSearch, error) {
+	var items []*savedSearch
+	if err := x.table().Get("pk", savedSearchKey).All(&items); err != nil {
+		return nil, errors.Wrap(err, "Fail to list savedSearch")
+	}
+	return items, nil
+}
+
+func (x *searchRepoDynamoDB) deleteSavedSearch(name string) error {
+	if err := x.table().Delete("pk", savedSearchKey).Range("sk", name).Run(); err != nil {
+		return errors.Wrapf(err, "Fail to delete savedSearch: %s", name)
+	}
+	return nil
+}
+
+func (x *searchRepoDynamoDB) putSavedSearchRun(run *savedSearchRun) error {
+	run.PK = savedSearchRunToKey(run.Name)
+	run.SK = run.ScheduledAt.UTC().Format(savedSearchRunTimeFormat) + "/" + string(run.SearchID)
+	run.ExpiresAt = run.ScheduledAt.Add(savedSearchRunRetention).Unix()
+	if err := x.table().Put(run).Run(); err != nil {
+		return errors.Wrapf(err, "Fail to put savedSearchRun: %v", *run)
+	}
+	return nil
+}
+
+// listSavedSearchRuns returns recent runs of the savedSearch, newest first.
+func (x *searchRepoDynamoDB) listSavedSearchRuns(name string) ([]*savedSearchRun, error) {
+	var runs []*savedSearchRun
+	query := x.table().Get("pk", savedSearchRunToKey(name)).Order(dynamo.Descending).Limit(savedSearchRunListLimit)
+	if err := query.All(&runs); err != nil {
+		return nil, errors.Wrapf(err, "Fail to list savedSearchRun: %s", name)
+	}
+	return runs, nil
+}
+
+// ------------------------------------------------------------
+// API handlers
+//
+
+// PutSavedSearch creates or updates a saved search.
+func (x *MinervaHandler) PutSavedSearch(c *gin.Context) (*Response, Error) {
+	var req savedSearch
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		return nil, wrapSystemError(err, 500, "Fail to read body")
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, wrapUserError(err, http.StatusBadRequest, "Fail to parse requested body")
+	}
+	if err := req.validate(); err != nil {
+		return nil, wrapUserError(err, http.StatusBadRequest, err.Error())
+	}
+
+	repo := x.newSearchRepo()
+	old, err := repo.getSavedSearch(req.Name)
+	if err != nil {
+		return nil, wrapSystemError(err, http.StatusInternalServerError, "Fail to get saved search")
+	}
+
+	now := time.Now().UTC()
+	item := &savedSearch{
+		Name:      req.Name,
+		Query:     req.Query,
+		Lookback:  req.Lookback,
+		Interval:  req.Interval,
+		Threshold: req.Threshold,
+		Owner:     principalID(c),
+		CreatedAt: now,
+		NextRunAt: now,
+	}
+	if old != nil {
+		if err := x.checkSavedSearchOwner(c, old); err != nil {
+			return nil, err
+		}
+		item.Owner = old.Owner
+		item.CreatedAt = old.CreatedAt
+		item.LastRunAt = old.LastRunAt
+		item.NextRunAt = old.NextRunAt
+	}
+
+	if err := repo.putSavedSearch(item); err != nil {
+		return nil, wrapSystemError(err, http.StatusInternalServerError, "Fail to put saved search")
+	}
+
+	return &Response{http.StatusCreated, item}, nil
+}
+
+// checkSavedSearchOwner rejects a request from neither owner of the saved search nor admin.
+func (x *MinervaHandler) checkSavedSearchOwner(c *gin.Context, item *savedSearch) Error {
+	principal := getPrincipal(c)
+	if item.Owner == principalID(c) || x.Admin.isAdmin(principal) {
+		return nil
+	}
+	return newUserErrorf(http.StatusForbidden, "Not allowed to change saved search of others: %s", item.Name)
+}
+
+// GetSavedSearches returns all saved searches.
+func (x *MinervaHandler) GetSavedSearches(c *gin.Context) (*Response, Error) {
+	items, err := x.newSearchRepo().listSavedSearches()
+	if err != nil {
+		return nil, wrapSystemError(err, http.StatusInternalServerError, "Fail to list saved searches")
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+
+	return &Response{http.StatusOK, gin.H{"saved_searches": items}}, nil
+}
+
+// GetSavedSearch returns a saved search specified by name.
+func (x *MinervaHandler) GetSavedSearch(c *gin.Context) (*Response, Error) {
+	name := c.Param("name")
+	item, err := x.newSearchRepo().getSavedSearch(name)
+	if err != nil {
+		return nil, wrapSystemError(err, http.StatusInternalServerError, "Fail to get saved search")
+	} else if item == nil {
+		return nil, newUserErrorf(http.StatusNotFound, "Saved search is not found: %s", name)
+	}
+
+	return &Response{http.StatusOK, item}, nil
+}
+
+// DeleteSavedSearch removes a saved search. Run history is kept until expiration.
+func (x *MinervaHandler) DeleteSavedSearch(c *gin.Context) (*Response, Error) {
+	name := c.Param("name")
+	repo := x.newSearchRepo()
+	item, err := repo.getSavedSearch(name)
+	if err != nil {
+		return nil, wrapSystemError(err, http.StatusInternalServerError, "Fail to get saved search")
+	} else if item == nil {
+		return nil, newUserErrorf(http.StatusNotFound, "Saved search is not found: %s", name)
+	}
+	if err := x.checkSavedSearchOwner(c, item); err != nil {
+		return nil, err
+	}
+
+	if err := repo.deleteSavedSearch(name); err != nil {
+		return nil, wrapSystemError(err, http.StatusInternalServerError, "Fail to delete saved search")
+	}
+
+	return &Response{http.StatusOK, gin.H{"name": name}}, nil
+}
+
+// GetSavedSearchRuns returns run history of a saved search.
+func (x *MinervaHandler) GetSavedSearchRuns(c *gin.Context) (*Response, Error) {
+	name := c.Param("name")
+	runs, err := x.newSearchRepo().listSavedSearchRuns(name)
+	if err != nil {
+		return nil, wrapSystemError(err, http.StatusInternalServerError, "Fail to list saved search runs")
+	}
+
+	return &Response{http.StatusOK, gin.H{"name": name, "runs": runs}}, nil
+}
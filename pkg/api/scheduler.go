@@ -0,0 +1,177 @@
+package api
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// schedulerPrincipal is recorded as principal of searches started by scheduler
+const schedulerPrincipal = "scheduler"
+
+// RunScheduledSearches is main procedure of scheduler. It should be invoked periodically. At first, it checks results of runs started by previous invocation and notifies alert if hit count reaches the threshold. Then it starts due saved searches through same path with ExecSearch. An error of a saved search does not stop others, and errors are returned together after all saved searches are processed.
+func (x *MinervaHandler) RunScheduledSearches(now time.Time) error {
+	repo := x.newSearchRepo()
+
+	savedSearches, err := repo.listSavedSearches()
+	if err != nil {
+		return err
+	}
+
+	var failed []string
+	var lastErr error
+	for _, saved := range savedSearches {
+		if err := x.runSavedSearch(saved, now); err != nil {
+			Logger.WithError(err).WithField("name", saved.Name).Error("Fail to run saved search")
+			failed = append(failed, saved.Name)
+			lastErr = err
+		}
+	}
+
+	if len(failed) > 0 {
+		return errors.Wrapf(lastErr, "Fail to run %d of %d saved searches: %v", len(failed), len(savedSearches), failed)
+	}
+
+	return nil
+}
+
+func (x *MinervaHandler) runSavedSearch(saved *savedSearch, now time.Time) error {
+	if err := x.checkSavedSearchRuns(saved); err != nil {
+		return errors.Wrapf(err, "Fail to check runs of saved search: %s", saved.Name)
+	}
+
+	if now.Before(saved.NextRunAt) {
+		return nil
+	}
+
+	if err := x.startSavedSearch(saved, now); err != nil {
+		return errors.Wrapf(err, "Fail to start saved search: %s", saved.Name)
+	}
+
+	return nil
+}
+
+func (x *MinervaHandler) startSavedSearch(saved *savedSearch, now time.Time) error {
+	repo := x.newSearchRepo()
+	req := saved.newRequest(now)
+
+	item, apiErr := x.execSearch(req, "scheduler:"+saved.Name, schedulerPrincipal)
+	if apiErr != nil {
+		return apiErr
+	}
+
+	run := &savedSearchRun{
+		Name:        saved.Name,
+		SearchID:    item.ID,
+		Status:      statusRunning,
+		ScheduledAt: now,
+	}
+	if err := repo.putSavedSearchRun(run); err != nil {
+		return err
+	}
+
+	saved.LastRunAt = &now
+	saved.NextRunAt = now.Add(time.Duration(saved.Interval) * time.Second)
+	if err := repo.putSavedSearch(saved); err != nil {
+		return err
+	}
+
+	Logger.WithFields(logrus.Fields{
+		"name":      saved.Name,
+		"search_id": item.ID,
+		"next":      saved.NextRunAt,
+	}).Info("Started saved search")
+
+	return nil
+}
+
+// checkSavedSearchRuns completes running runs and notifies alerts. A completed run is saved before notification, and the alert is sent (and retried by next invocation if failed) until Notified is saved. Then an alert can be duplicated only when saving Notified fails, and a receiver can use SearchID to dedupe it.
+func (x *MinervaHandler) checkSavedSearchRuns(saved *savedSearch) error {
+	repo := x.newSearchRepo()
+
+	runs, err := repo.listSavedSearchRuns(saved.Name)
+	if err != nil {
+		return err
+	}
+
+	for _, run := range runs {
+		if run.Status == statusRunning {
+			if err := x.completeSavedSearchRun(run); err != nil {
+				return err
+			}
+		}
+
+		if run.Status != statusSuccess || run.Notified || run.HitCount < saved.Threshold {
+			continue
+		}
+
+		meta, apiErr := x.getMetaData(run.SearchID)
+		if apiErr != nil {
+			return apiErr
+		}
+
+		alert := &SavedSearchAlert{
+			Name:      saved.Name,
+			SearchID:  string(run.SearchID),
+			Query:     meta.Query,
+			StartTime: time.Unix(meta.StartTime, 0).UTC(),
+			EndTime:   time.Unix(meta.EndTime, 0).UTC(),
+			HitCount:  run.HitCount,
+			Threshold: saved.Threshold,
+		}
+		if err := x.notify(alert); err != nil {
+			return err
+		}
+
+		run.Notified = true
+		if err := repo.putSavedSearchRun(run); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// completeSavedSearchRun saves status and hit count of the run if the query has been completed.
+func (x *MinervaHandler) completeSavedSearchRun(run *savedSearchRun) error {
+	meta, apiErr := x.getMetaData(run.SearchID)
+	if apiErr != nil {
+		return apiErr
+	}
+
+	if meta.Status == statusRunning {
+		return nil
+	}
+
+	if meta.Status == statusSuccess {
+		_, summary, err := loadResultCache(x.s3Client(), meta.outputPath)
+		if err != nil {
+			return err
+		}
+		run.HitCount = summary.Total
+	}
+
+	run.Status = meta.Status
+	if err := x.newSearchRepo().putSavedSearchRun(run); err != nil {
+		return err
+	}
+
+	Logger.WithField("run", run).Info("Completed saved search run")
+	return nil
+}
+
+func (x *MinervaHandler) notify(alert *SavedSearchAlert) error {
+	if len(x.Notifiers) == 0 {
+		Logger.WithField("alert", alert).Warn("No notifier is configured, alert is not sent")
+		return nil
+	}
+
+	for _, notifier := range x.Notifiers {
+		if err := notifier.Notify(alert); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
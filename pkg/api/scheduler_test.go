@@ -0,0 +1,246 @@
+package api_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/m-mizutani/minerva/internal/mock"
+	"github.com/m-mizutani/minerva/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type alertRecorder struct {
+	alerts []*api.SavedSearchAlert
+	// fail is number of notifications to be failed
+	fail int
+}
+
+func (x *alertRecorder) Notify(alert *api.SavedSearchAlert) error {
+	if x.fail > 0 {
+		x.fail--
+		return errors.New("notification failed")
+	}
+	x.alerts = append(x.alerts, alert)
+	return nil
+}
+
+func TestSavedSearchValidation(t *testing.T) {
+	tester := api.NewSchedulerTester(mock.NewS3Client("test"))
+	now := time.Now().UTC()
+	base := api.SavedSearch{
+		Name:      "my-search",
+		Terms:     []string{"mizutani"},
+		Lookback:  3600,
+		Interval:  600,
+		Threshold: 1,
+	}
+
+	assert.NoError(t, tester.PutSavedSearch(base, now))
+
+	invalidName := base
+	invalidName.Name = "my search/1"
+	assert.Error(t, tester.PutSavedSearch(invalidName, now))
+
+	noQuery := base
+	noQuery.Terms = nil
+	assert.Error(t, tester.PutSavedSearch(noQuery, now))
+
+	tooShort := base
+	tooShort.Interval = 60
+	assert.Error(t, tester.PutSavedSearch(tooShort, now))
+
+	noThreshold := base
+	noThreshold.Threshold = 0
+	assert.Error(t, tester.PutSavedSearch(noThreshold, now))
+}
+
+func TestSavedSearchOwner(t *testing.T) {
+	tester := api.NewSchedulerTester(mock.NewS3Client("test"))
+	tester.Handler.Admin = &api.AdminConfig{Roles: []string{"admin"}}
+	auth, err := api.NewAPIKeyAuthenticator([]api.APIKeyConfig{
+		{Name: "blue", Key: "key-blue", Tags: []string{"*"}},
+		{Name: "orange", Key: "key-orange", Tags: []string{"*"}},
+		{Name: "root", Key: "key-root", Tags: []string{"*"}, Roles: []string{"admin"}},
+	})
+	require.NoError(t, err)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	v1 := r.Group("/api/v1")
+	v1.Use(api.AuthMiddleware(auth))
+	api.SetupRoute(v1, tester.Handler)
+
+	blue := map[string]string{"x-api-key": "key-blue"}
+	orange := map[string]string{"x-api-key": "key-orange"}
+	root := map[string]string{"x-api-key": "key-root"}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"name":      "my-search",
+		"query":     []api.Query{{Term: "mizutani"}},
+		"lookback":  3600,
+		"interval":  600,
+		"threshold": 1,
+		"owner":     "apikey:orange",
+	})
+	require.NoError(t, err)
+
+	w := doRequest(r, "POST", "/api/v1/saved_search", blue, body)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var item struct {
+		Owner string `json:"owner"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &item))
+	assert.Equal(t, "apikey:blue", item.Owner, "owner in request body must be ignored")
+
+	t.Run("others can not overwrite or delete", func(tt *testing.T) {
+		w := doRequest(r, "POST", "/api/v1/saved_search", orange, body)
+		assert.Equal(tt, http.StatusForbidden, w.Code)
+		w = doRequest(r, "DELETE", "/api/v1/saved_search/my-search", orange, nil)
+		assert.Equal(tt, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("admin can overwrite without taking ownership", func(tt *testing.T) {
+		w := doRequest(r, "POST", "/api/v1/saved_search", root, body)
+		require.Equal(tt, http.StatusCreated, w.Code)
+		require.NoError(tt, json.Unmarshal(w.Body.Bytes(), &item))
+		assert.Equal(tt, "apikey:blue", item.Owner)
+	})
+
+	t.Run("owner can delete", func(tt *testing.T) {
+		w := doRequest(r, "DELETE", "/api/v1/saved_search/my-search", blue, nil)
+		assert.Equal(tt, http.StatusOK, w.Code)
+	})
+}
+
+func TestRunScheduledSearches(t *testing.T) {
+	client := mock.NewS3Client("test")
+	recorder := &alertRecorder{}
+	tester := api.NewSchedulerTester(client, recorder)
+
+	now := time.Date(2020, 1, 2, 3, 0, 0, 0, time.UTC)
+	require.NoError(t, tester.PutSavedSearch(api.SavedSearch{
+		Name:      "many",
+		Terms:     []string{"mizutani"},
+		Lookback:  3600,
+		Interval:  600,
+		Threshold: 5,
+	}, now))
+	require.NoError(t, tester.PutSavedSearch(api.SavedSearch{
+		Name:      "few",
+		Terms:     []string{"blue"},
+		Lookback:  3600,
+		Interval:  600,
+		Threshold: 100,
+	}, now))
+
+	t.Run("start due searches", func(tt *testing.T) {
+		require.NoError(tt, tester.Handler.RunScheduledSearches(now))
+		assert.Equal(tt, 2, len(tester.Athena.Queries))
+		assert.Contains(tt, tester.Athena.Queries[0]+tester.Athena.Queries[1], "2020-01-02-02")
+
+		for _, name := range []string{"many", "few"} {
+			runs := tester.Runs(name)
+			require.Equal(tt, 1, len(runs))
+			assert.Equal(tt, "RUNNING", runs[0].Status)
+			assert.Equal(tt, now.Add(10*time.Minute), tester.NextRunAt(name))
+		}
+	})
+
+	t.Run("not yet due and query is still running", func(tt *testing.T) {
+		require.NoError(tt, tester.Handler.RunScheduledSearches(now.Add(5*time.Minute)))
+		assert.Equal(tt, 2, len(tester.Athena.Queries))
+		assert.Equal(tt, 0, len(recorder.alerts))
+		assert.Equal(tt, "RUNNING", tester.Runs("many")[0].Status)
+	})
+
+	t.Run("notify when hit count reaches threshold", func(tt *testing.T) {
+		tester.Athena.CompleteAll("SUCCEEDED", putResultCSV(tt, client, 8))
+
+		next := now.Add(10 * time.Minute)
+		require.NoError(tt, tester.Handler.RunScheduledSearches(next))
+		assert.Equal(tt, 4, len(tester.Athena.Queries))
+
+		many := tester.Runs("many")
+		require.Equal(tt, 2, len(many))
+		assert.Equal(tt, "RUNNING", many[0].Status)
+		assert.Equal(tt, "SUCCEEDED", many[1].Status)
+		assert.Equal(tt, int64(8), many[1].HitCount)
+		assert.True(tt, many[1].Notified)
+
+		few := tester.Runs("few")
+		require.Equal(tt, 2, len(few))
+		assert.Equal(tt, "SUCCEEDED", few[1].Status)
+		assert.Equal(tt, int64(8), few[1].HitCount)
+		assert.False(tt, few[1].Notified)
+
+		require.Equal(tt, 1, len(recorder.alerts))
+		alert := recorder.alerts[0]
+		assert.Equal(tt, "many", alert.Name)
+		assert.Equal(tt, many[1].SearchID, alert.SearchID)
+		assert.Equal(tt, int64(8), alert.HitCount)
+		assert.Equal(tt, int64(5), alert.Threshold)
+		assert.Equal(tt, now.Add(-90*time.Minute), alert.StartTime)
+		assert.Equal(tt, now.Add(-30*time.Minute), alert.EndTime)
+	})
+
+	t.Run("failed query is recorded without alert", func(tt *testing.T) {
+		tester.Athena.CompleteAll("FAILED", "")
+		require.NoError(tt, tester.Handler.RunScheduledSearches(now.Add(15*time.Minute)))
+
+		assert.Equal(tt, "FAILED", tester.Runs("many")[0].Status)
+		assert.Equal(tt, 1, len(recorder.alerts))
+		assert.Equal(tt, 4, len(tester.Athena.Queries))
+	})
+}
+
+func TestScheduledSearchNotifyRetry(t *testing.T) {
+	client := mock.NewS3Client("test")
+	recorder := &alertRecorder{fail: 1}
+	tester := api.NewSchedulerTester(client, recorder)
+
+	now := time.Date(2020, 1, 2, 3, 0, 0, 0, time.UTC)
+	require.NoError(t, tester.PutSavedSearch(api.SavedSearch{
+		Name:      "many",
+		Terms:     []string{"mizutani"},
+		Lookback:  3600,
+		Interval:  600,
+		Threshold: 1,
+	}, now))
+	require.NoError(t, tester.Handler.RunScheduledSearches(now))
+	tester.Athena.CompleteAll("SUCCEEDED", putResultCSV(t, client, 3))
+
+	require.NoError(t, tester.PutSavedSearch(api.SavedSearch{
+		Name:      "other",
+		Terms:     []string{"blue"},
+		Lookback:  3600,
+		Interval:  600,
+		Threshold: 100,
+	}, now.Add(5*time.Minute)))
+
+	t.Run("failed notification does not stop other saved search", func(tt *testing.T) {
+		require.Error(tt, tester.Handler.RunScheduledSearches(now.Add(5*time.Minute)))
+		assert.Equal(tt, 0, len(recorder.alerts))
+		assert.Equal(tt, 2, len(tester.Athena.Queries))
+		require.Equal(tt, 1, len(tester.Runs("other")))
+
+		runs := tester.Runs("many")
+		require.Equal(tt, 1, len(runs))
+		assert.Equal(tt, "SUCCEEDED", runs[0].Status)
+		assert.Equal(tt, int64(3), runs[0].HitCount)
+		assert.False(tt, runs[0].Notified)
+	})
+
+	t.Run("notification is retried only once", func(tt *testing.T) {
+		require.NoError(tt, tester.Handler.RunScheduledSearches(now.Add(6*time.Minute)))
+		require.Equal(tt, 1, len(recorder.alerts))
+		assert.True(tt, tester.Runs("many")[0].Notified)
+
+		require.NoError(tt, tester.Handler.RunScheduledSearches(now.Add(7*time.Minute)))
+		assert.Equal(tt, 1, len(recorder.alerts))
+	})
+}
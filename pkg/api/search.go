@@ -19,6 +19,8 @@ type searchMetaData struct {
 	StartTime      int64       `json:"start_time"`
 	EndTime        int64       `json:"end_time"`
 	ScannedSize    int64       `json:"scanned_size"`
+	CachedFrom     searchID    `json:"cached_from,omitempty"`
+	Principal      string      `json:"principal,omitempty"`
 
 	outputPath string // S3 output path
 }
@@ -38,6 +40,10 @@ type searchItem struct {
 	RequestID     string      `dynamo:"request_id"`
 	OutputPath    string      `dynamo:"output_path"`
 	ScannedSize   int64       `dynamo:"scanned_size"`
+	QueryHash     string      `dynamo:"query_hash"`
+	CachedFrom    searchID    `dynamo:"cached_from"`
+	Principal     string      `dynamo:"principal"` // ID of authenticated requester
+	UsageRecorded bool        `dynamo:"usage_recorded,omitempty"`
 }
 
 func (x *searchItem) getElapsedSeconds() float64 {
@@ -54,6 +60,22 @@ func (x *searchItem) getElapsedSeconds() float64 {
 type searchRepository interface {
 	put(*searchItem) error
 	get(searchID) (*searchItem, error)
+	putQueryHash(hash string, id searchID, expiresAt time.Time) error
+	getQueryHash(hash string) (*searchID, error)
+	putAthenaQuery(queryID string, id searchID, expiresAt time.Time) error
+	getAthenaQuery(queryID string) (*searchID, error)
+
+	putSavedSearch(*savedSearch) error
+	getSavedSearch(name string) (*savedSearch, error)
+	listSavedSearches() ([]*savedSearch, error)
+	deleteSavedSearch(name string) error
+	putSavedSearchRun(*savedSearchRun) error
+	listSavedSearchRuns(name string) ([]*savedSearchRun, error)
+
+	markUsageRecorded(id searchID) (bool, error)
+	addUsage(period, principal string, size int64, expiresAt time.Time) error
+	getUsage(period, principal string) (int64, error)
+	listUsage(period string) ([]*usageItem, error)
 }
 
 type searchRepoDynamoDB struct {
@@ -65,6 +87,22 @@ func searchIDtoKey(id searchID) string {
 	return "search:" + string(id)
 }
 
+func queryHashToKey(hash string) string {
+	return "search_hash:" + hash
+}
+
+func athenaQueryToKey(queryID string) string {
+	return "search_athena_query:" + queryID
+}
+
+// searchRefItem refers searchItem by query hash or Athena query ID
+type searchRefItem struct {
+	PK        string   `dynamo:"pk"`
+	SK        string   `dynamo:"sk"`
+	ID        searchID `dynamo:"id"`
+	ExpiresAt int64    `dynamo:"expires_at"`
+}
+
 func newSearchRepoDynamoDB(region, tableName string) *searchRepoDynamoDB {
 	return &searchRepoDynamoDB{
 		region:    region,
@@ -102,3 +140,74 @@ func (x *searchRepoDynamoDB) get(id searchID) (*searchItem, error) {
 
 	return &item, nil
 }
+
+func (x *searchRepoDynamoDB) putQueryHash(hash string, id searchID, expiresAt time.Time) error {
+	db := dynamo.New(session.New(), &aws.Config{Region: aws.String(x.region)})
+	table := db.Table(x.tableName)
+
+	item := searchRefItem{
+		PK:        queryHashToKey(hash),
+		SK:        "@",
+		ID:        id,
+		ExpiresAt: expiresAt.Unix(),
+	}
+	if err := table.Put(item).Run(); err != nil {
+		return errors.Wrapf(err, "Fail to put searchRefItem: %v", item)
+	}
+
+	return nil
+}
+
+func (x *searchRepoDynamoDB) getQueryHash(hash string) (*searchID, error) {
+	db := dynamo.New(session.New(), &aws.Config{Region: aws.String(x.region)})
+	table := db.Table(x.tableName)
+
+	var item searchRefItem
+	if err := table.Get("pk", queryHashToKey(hash)).Range("sk", dynamo.Equal, "@").One(&item); err != nil {
+		if err == dynamo.ErrNotFound {
+			return nil, nil
+		}
+
+		return nil, errors.Wrapf(err, "Fail to get searchRefItem: %s", hash)
+	}
+
+	// DynamoDB TTL does not remove expired items immediately.
+	if item.ExpiresAt < time.Now().UTC().Unix() {
+		return nil, nil
+	}
+
+	return &item.ID, nil
+}
+
+func (x *searchRepoDynamoDB) putAthenaQuery(queryID string, id searchID, expiresAt time.Time) error {
+	db := dynamo.New(session.New(), &aws.Config{Region: aws.String(x.region)})
+	table := db.Table(x.tableName)
+
+	item := searchRefItem{
+		PK:        athenaQueryToKey(queryID),
+		SK:        "@",
+		ID:        id,
+		ExpiresAt: expiresAt.Unix(),
+	}
+	if err := table.Put(item).Run(); err != nil {
+		return errors.Wrapf(err, "Fail to put searchRefItem of Athena query: %v", item)
+	}
+
+	return nil
+}
+
+func (x *searchRepoDynamoDB) getAthenaQuery(queryID string) (*searchID, error) {
+	db := dynamo.New(session.New(), &aws.Config{Region: aws.String(x.region)})
+	table := db.Table(x.tableName)
+
+	var item searchRefItem
+	if err := table.Get("pk", athenaQueryToKey(queryID)).Range("sk", dynamo.Equal, "@").One(&item); err != nil {
+		if err == dynamo.ErrNotFound {
+			return nil, nil
+		}
+
+		return nil, errors.Wrapf(err, "Fail to get searchRefItem of Athena query: %s", queryID)
+	}
+
+	return &item.ID, nil
+}
@@ -0,0 +1,129 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// searchIndexLag is a margin to wait until all logs in a time range are indexed and merged. A cached search result is reused only when the search had been submitted after EndTime + searchIndexLag.
+const searchIndexLag = 30 * time.Minute
+
+// buildQueryHash returns a canonical hash of query terms and time range. Order and duplication of terms and surrounding spaces do not change the hash.
+func buildQueryHash(query []Query, start, end time.Time) string {
+	termSet := map[string]struct{}{}
+	for _, q := range query {
+		termSet[strings.TrimSpace(q.Term)] = struct{}{}
+	}
+
+	var terms []string
+	for t := range termSet {
+		terms = append(terms, t)
+	}
+	sort.Strings(terms)
+
+	h := sha256.New()
+	h.Write([]byte(start.UTC().Format(time.RFC3339) + "\n"))
+	h.Write([]byte(end.UTC().Format(time.RFC3339) + "\n"))
+	for _, t := range terms {
+		h.Write([]byte(t + "\n"))
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// buildRequestHash returns hash of query terms, tags and time range. It's same as buildQueryHash if no tag is given, then cached search before tags support is still reusable.
+func buildRequestHash(req ExecSearchRequest, start, end time.Time) string {
+	hash := buildQueryHash(req.Query, start, end)
+	if len(req.Tags) == 0 {
+		return hash
+	}
+
+	tagSet := map[string]struct{}{}
+	for _, tag := range req.Tags {
+		tagSet[tag] = struct{}{}
+	}
+	var tags []string
+	for tag := range tagSet {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	h := sha256.New()
+	h.Write([]byte(hash + "\n"))
+	for _, tag := range tags {
+		h.Write([]byte("tag:" + tag + "\n"))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// isReusableSearch checks if the search item can be a source of cached search result.
+func isReusableSearch(item *searchItem, now time.Time, ttl time.Duration) bool {
+	if item.Status != statusSuccess || item.CreatedAt == nil {
+		return false
+	}
+	if item.CreatedAt.Add(ttl).Before(now) {
+		return false
+	}
+
+	// Logs in the range might not be indexed yet when the search was submitted.
+	return !item.CreatedAt.Before(item.EndTime.Add(searchIndexLag))
+}
+
+// lookupCachedSearch finds recent succeeded search by query hash. It returns nil if no reusable search.
+func lookupCachedSearch(repo searchRepository, hash string, now time.Time, ttl time.Duration) (*searchItem, error) {
+	id, err := repo.getQueryHash(hash)
+	if err != nil {
+		return nil, err
+	} else if id == nil {
+		return nil, nil
+	}
+
+	item, err := repo.get(*id)
+	if err != nil {
+		return nil, err
+	} else if item == nil {
+		return nil, nil
+	}
+
+	if !isReusableSearch(item, now, ttl) {
+		Logger.WithFields(logrus.Fields{
+			"hash": hash,
+			"item": item,
+		}).Debug("Found search by query hash, but not reusable")
+		return nil, nil
+	}
+
+	return item, nil
+}
+
+// cloneSearch creates a new search item that refers a result of the source search. Athena query is not executed for the new search item then ScannedSize is 0.
+func cloneSearch(repo searchRepository, src *searchItem, requestID, principal string, now time.Time) (*searchItem, error) {
+	item := &searchItem{
+		ID:            searchID(uuid.New().String()),
+		Status:        src.Status,
+		Query:         src.Query,
+		StartTime:     src.StartTime,
+		EndTime:       src.EndTime,
+		CreatedAt:     &now,
+		CompletedAt:   &now,
+		AthenaQueryID: src.AthenaQueryID,
+		RequestID:     requestID,
+		Principal:     principal,
+		OutputPath:    src.OutputPath,
+		QueryHash:     src.QueryHash,
+		CachedFrom:    src.ID,
+	}
+
+	if err := repo.put(item); err != nil {
+		return nil, errors.Wrap(err, "Fail to put cloned searchItem")
+	}
+
+	return item, nil
+}
@@ -0,0 +1,298 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/gin-gonic/gin"
+	"github.com/guregu/dynamo"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	usageDailyFormat      = "2006-01-02"
+	usageMonthlyFormat    = "2006-01"
+	usageDailyRetention   = 40 * 24 * time.Hour
+	usageMonthlyRetention = 400 * 24 * time.Hour
+
+	// anonymousPrincipal is used for usage of search without authentication
+	anonymousPrincipal = "anonymous"
+)
+
+// usageItem is cumulative scanned size of a principal in a period. A period is day or month.
+type usageItem struct {
+	PK        string `dynamo:"pk" json:"-"`
+	SK        string `dynamo:"sk" json:"-"`
+	ExpiresAt int64  `dynamo:"expires_at" json:"-"`
+
+	Principal   string `dynamo:"principal" json:"principal"`
+	ScannedSize int64  `dynamo:"scanned_size" json:"scanned_size"`
+}
+
+func dailyUsagePeriod(t time.Time) string {
+	return "daily:" + t.UTC().Format(usageDailyFormat)
+}
+
+func monthlyUsagePeriod(t time.Time) string {
+	return "monthly:" + t.UTC().Format(usageMonthlyFormat)
+}
+
+func usagePeriodToKey(period string) string {
+	return "usage:" + period
+}
+
+func usagePrincipal(principal string) string {
+	if principal == "" {
+		return anonymousPrincipal
+	}
+	return principal
+}
+
+// recordUsage adds scanned size of completed search to daily and monthly usage of the principal. The search is marked at first to avoid double counting by both of Athena query state change event and status check.
+func recordUsage(repo searchRepository, item *searchItem) error {
+	if item.ScannedSize <= 0 || item.CreatedAt == nil {
+		return nil
+	}
+
+	marked, err := repo.markUsageRecorded(item.ID)
+	if err != nil {
+		return err
+	} else if !marked {
+		return nil // Already recorded
+	}
+	item.UsageRecorded = true
+
+	principal := usagePrincipal(item.Principal)
+	at := *item.CreatedAt
+	if err := repo.addUsage(dailyUsagePeriod(at), principal, item.ScannedSize, at.Add(usageDailyRetention)); err != nil {
+		return err
+	}
+	if err := repo.addUsage(monthlyUsagePeriod(at), principal, item.ScannedSize, at.Add(usageMonthlyRetention)); err != nil {
+		return err
+	}
+
+	Logger.WithFields(logrus.Fields{
+		"principal":    principal,
+		"search_id":    item.ID,
+		"scanned_size": item.ScannedSize,
+	}).Debug("Recorded usage")
+
+	return nil
+}
+
+// checkQuota returns error with 429 if usage of the principal exceeds daily or monthly quota.
+func (x *MinervaHandler) checkQuota(principal string, now time.Time) Error {
+	if x.DailyScanQuota <= 0 && x.MonthlyScanQuota <= 0 {
+		return nil
+	}
+
+	repo := x.newSearchRepo()
+	principal = usagePrincipal(principal)
+
+	quotas := []struct {
+		name   string
+		period string
+		quota  int64
+	}{
+		{"daily", dailyUsagePeriod(now), x.DailyScanQuota},
+		{"monthly", monthlyUsagePeriod(now), x.MonthlyScanQuota},
+	}
+
+	for _, q := range quotas {
+		if q.quota <= 0 {
+			continue
+		}
+
+		used, err := repo.getUsage(q.period, principal)
+		if err != nil {
+			return wrapSystemError(err, http.StatusInternalServerError, "Fail to get usage")
+		}
+		if used >= q.quota {
+			return newUserErrorf(http.StatusTooManyRequests,
+				"Exceeded %s quota of scanned size: %d / %d bytes", q.name, used, q.quota)
+		}
+	}
+
+	return nil
+}
+
+var byteSizeUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"TB", 1 << 40},
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+// ParseByteSize parses size such as "500GB", "1TB" or "1024". Units are binary (1KB = 1024 bytes).
+func ParseByteSize(s string) (int64, error) {
+	v := strings.ToUpper(strings.TrimSpace(s))
+	unit := int64(1)
+	for _, u := range byteSizeUnits {
+		if strings.HasSuffix(v, u.suffix) {
+			v = strings.TrimSpace(strings.TrimSuffix(v, u.suffix))
+			unit = u.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid byte size: %s", s)
+	}
+	return n * unit, nil
+}
+
+// ------------------------------------------------------------
+// DynamoDB implementation of usage repository
+//
+
+func isConditionalCheckErr(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+	}
+	return false
+}
+
+// markUsageRecorded sets usage_recorded only if it's not true. The attribute is omitted by put while it's false, but both of not existing and false are accepted.
+func (x *searchRepoDynamoDB) markUsageRecorded(id searchID) (bool, error) {
+	err := x.table().Update("pk", searchIDtoKey(id)).Range("sk", "@").
+		Set("usage_recorded", true).
+		If("attribute_exists(pk) AND (attribute_not_exists(usage_recorded) OR usage_recorded <> ?)", true).
+		Run()
+	if err != nil {
+		if isConditionalCheckErr(err) {
+			return false, nil
+		}
+		return false, errors.Wrapf(err, "Fail to mark usage recorded: %s", id)
+	}
+	return true, nil
+}
+
+func (x *searchRepoDynamoDB) addUsage(period, principal string, size int64, expiresAt time.Time) error {
+	err := x.table().Update("pk", usagePeriodToKey(period)).Range("sk", principal).
+		Add("scanned_size", size).
+		Set("principal", principal).
+		Set("expires_at", expiresAt.Unix()).
+		Run()
+	if err != nil {
+		return errors.Wrapf(err, "Fail to add usage: %s %s", period, principal)
+	}
+	return nil
+}
+
+func (x *searchRepoDynamoDB) getUsage(period, principal string) (int64, error) {
+	var item usageItem
+	if err := x.table().Get("pk", usagePeriodToKey(period)).Range("sk", dynamo.Equal, principal).One(&item); err != nil {
+		if err == dynamo.ErrNotFound {
+			return 0, nil
+		}
+		return 0, errors.Wrapf(err, "Fail to get usage: %s %s", period, principal)
+	}
+	return item.ScannedSize, nil
+}
+
+func (x *searchRepoDynamoDB) listUsage(period string) ([]*usageItem, error) {
+	var items []*usageItem
+	if err := x.table().Get("pk", usagePeriodToKey(period)).All(&items); err != nil {
+		return nil, errors.Wrapf(err, "Fail to list usage: %s", period)
+	}
+	return items, nil
+}
+
+// ------------------------------------------------------------
+// API handler
+//
+
+func filterUsage(items []*usageItem, principal string) []*usageItem {
+	var filtered []*usageItem
+	for _, item := range items {
+		if item.Principal == principal {
+			filtered = append(filtered, item)
+		}
+	}
+	return filtered
+}
+
+// UserUsage is scanned size of a principal in the day and the month
+type UserUsage struct {
+	Principal          string `json:"principal"`
+	DailyScannedSize   int64  `json:"daily_scanned_size"`
+	MonthlyScannedSize int64  `json:"monthly_scanned_size"`
+}
+
+// GetUsageResponse is response of GetUsage
+type GetUsageResponse struct {
+	Date         string       `json:"date"`
+	Month        string       `json:"month"`
+	DailyQuota   int64        `json:"daily_quota"`
+	MonthlyQuota int64        `json:"monthly_quota"`
+	Users        []*UserUsage `json:"users"`
+}
+
+// GetUsage reports scanned size of each principal. Date can be specified by 'date' query (YYYY-MM-DD), default is today. Admin can see usage of all principals, others see only own usage.
+func (x *MinervaHandler) GetUsage(c *gin.Context) (*Response, Error) {
+	at := time.Now().UTC()
+	if v := c.Query("date"); v != "" {
+		t, err := time.Parse(usageDailyFormat, v)
+		if err != nil {
+			return nil, wrapUserError(err, http.StatusBadRequest, "Fail to parse 'date', must be YYYY-MM-DD")
+		}
+		at = t
+	}
+
+	repo := x.newSearchRepo()
+	daily, err := repo.listUsage(dailyUsagePeriod(at))
+	if err != nil {
+		return nil, wrapSystemError(err, http.StatusInternalServerError, "Fail to list daily usage")
+	}
+	monthly, err := repo.listUsage(monthlyUsagePeriod(at))
+	if err != nil {
+		return nil, wrapSystemError(err, http.StatusInternalServerError, "Fail to list monthly usage")
+	}
+
+	if !x.Admin.isAdmin(getPrincipal(c)) {
+		daily = filterUsage(daily, principalID(c))
+		monthly = filterUsage(monthly, principalID(c))
+	}
+
+	users := map[string]*UserUsage{}
+	getUser := func(principal string) *UserUsage {
+		if _, ok := users[principal]; !ok {
+			users[principal] = &UserUsage{Principal: principal}
+		}
+		return users[principal]
+	}
+	for _, item := range daily {
+		getUser(item.Principal).DailyScannedSize = item.ScannedSize
+	}
+	for _, item := range monthly {
+		getUser(item.Principal).MonthlyScannedSize = item.ScannedSize
+	}
+
+	resp := &GetUsageResponse{
+		Date:         at.Format(usageDailyFormat),
+		Month:        at.Format(usageMonthlyFormat),
+		DailyQuota:   x.DailyScanQuota,
+		MonthlyQuota: x.MonthlyScanQuota,
+		Users:        []*UserUsage{},
+	}
+	for _, user := range users {
+		resp.Users = append(resp.Users, user)
+	}
+	sort.Slice(resp.Users, func(i, j int) bool {
+		return resp.Users[i].Principal < resp.Users[j].Principal
+	})
+
+	return &Response{http.StatusOK, resp}, nil
+}
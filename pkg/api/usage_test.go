@@ -0,0 +1,168 @@
+package api_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/m-mizutani/minerva/internal/mock"
+	"github.com/m-mizutani/minerva/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseByteSize(t *testing.T) {
+	testCases := []struct {
+		input  string
+		expect int64
+		isErr  bool
+	}{
+		{"1024", 1024, false},
+		{"10B", 10, false},
+		{"2KB", 2048, false},
+		{"500GB", 500 << 30, false},
+		{"1tb", 1 << 40, false},
+		{" 3 MB ", 3 << 20, false},
+		{"", 0, true},
+		{"-1GB", 0, true},
+		{"1.5GB", 0, true},
+		{"GB", 0, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.input, func(tt *testing.T) {
+			size, err := api.ParseByteSize(tc.input)
+			if tc.isErr {
+				assert.Error(tt, err)
+			} else {
+				require.NoError(tt, err)
+				assert.Equal(tt, tc.expect, size)
+			}
+		})
+	}
+}
+
+func TestScanQuota(t *testing.T) {
+	tester := api.NewSchedulerTester(mock.NewS3Client("test"))
+	tester.Handler.DailyScanQuota = 100
+	tester.Handler.MonthlyScanQuota = 1000
+	tester.Handler.Admin = &api.AdminConfig{Principals: []string{"apikey:admin"}}
+
+	auth, err := api.NewAPIKeyAuthenticator([]api.APIKeyConfig{
+		{Name: "blue", Key: "key-blue", Tags: []string{"*"}},
+		{Name: "orange", Key: "key-orange", Tags: []string{"*"}},
+		{Name: "admin", Key: "key-admin", Tags: []string{"*"}},
+	})
+	require.NoError(t, err)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	v1 := r.Group("/api/v1")
+	v1.Use(api.AuthMiddleware(auth))
+	api.SetupRoute(v1, tester.Handler)
+
+	body, err := json.Marshal(api.NewRequest([]string{"mizutani"}, "2020-01-02T00:00:00", "2020-01-02T01:00:00"))
+	require.NoError(t, err)
+
+	execSearch := func(tt *testing.T, key string, code int) string {
+		w := doRequest(r, "POST", "/api/v1/search", map[string]string{"x-api-key": key}, body)
+		require.Equal(tt, code, w.Code, w.Body.String())
+		var resp api.ExecSearchResponse
+		require.NoError(tt, json.Unmarshal(w.Body.Bytes(), &resp))
+		return string(resp.SearchID)
+	}
+	getSearch := func(tt *testing.T, key, id string) {
+		w := doRequest(r, "GET", "/api/v1/search/"+id, map[string]string{"x-api-key": key}, nil)
+		require.Equal(tt, http.StatusOK, w.Code, w.Body.String())
+	}
+	getUsageOf := func(tt *testing.T, key string) *api.GetUsageResponse {
+		w := doRequest(r, "GET", "/api/v1/usage", map[string]string{"x-api-key": key}, nil)
+		require.Equal(tt, http.StatusOK, w.Code, w.Body.String())
+		var resp api.GetUsageResponse
+		require.NoError(tt, json.Unmarshal(w.Body.Bytes(), &resp))
+		return &resp
+	}
+	getUsage := func(tt *testing.T) *api.GetUsageResponse {
+		return getUsageOf(tt, "key-admin")
+	}
+
+	tester.Athena.ScannedSize = 60
+
+	t.Run("usage is recorded once when search is completed", func(tt *testing.T) {
+		id := execSearch(tt, "key-blue", http.StatusCreated)
+		getSearch(tt, "key-blue", id)
+		assert.Equal(tt, 0, len(getUsage(tt).Users))
+
+		tester.Athena.CompleteAll("SUCCEEDED", "s3://test-bucket/output/1.csv")
+		getSearch(tt, "key-blue", id)
+		getSearch(tt, "key-blue", id)
+
+		usage := getUsage(tt)
+		require.Equal(tt, 1, len(usage.Users))
+		assert.Equal(tt, "apikey:blue", usage.Users[0].Principal)
+		assert.Equal(tt, int64(60), usage.Users[0].DailyScannedSize)
+		assert.Equal(tt, int64(60), usage.Users[0].MonthlyScannedSize)
+		assert.Equal(tt, int64(100), usage.DailyQuota)
+		assert.Equal(tt, int64(1000), usage.MonthlyQuota)
+	})
+
+	t.Run("search is rejected after exceeding quota", func(tt *testing.T) {
+		id := execSearch(tt, "key-blue", http.StatusCreated)
+		tester.Athena.CompleteAll("SUCCEEDED", "s3://test-bucket/output/2.csv")
+		getSearch(tt, "key-blue", id)
+
+		w := doRequest(r, "POST", "/api/v1/search", map[string]string{"x-api-key": "key-blue"}, body)
+		assert.Equal(tt, http.StatusTooManyRequests, w.Code)
+		assert.Contains(tt, w.Body.String(), "daily quota")
+	})
+
+	t.Run("quota is per principal", func(tt *testing.T) {
+		id := execSearch(tt, "key-orange", http.StatusCreated)
+		tester.Athena.CompleteAll("SUCCEEDED", "s3://test-bucket/output/3.csv")
+		getSearch(tt, "key-orange", id)
+
+		usage := getUsage(tt)
+		require.Equal(tt, 2, len(usage.Users))
+		assert.Equal(tt, "apikey:blue", usage.Users[0].Principal)
+		assert.Equal(tt, int64(120), usage.Users[0].DailyScannedSize)
+		assert.Equal(tt, "apikey:orange", usage.Users[1].Principal)
+		assert.Equal(tt, int64(60), usage.Users[1].DailyScannedSize)
+	})
+
+	t.Run("non-admin can see only own usage", func(tt *testing.T) {
+		usage := getUsageOf(tt, "key-orange")
+		require.Equal(tt, 1, len(usage.Users))
+		assert.Equal(tt, "apikey:orange", usage.Users[0].Principal)
+		assert.Equal(tt, int64(60), usage.Users[0].DailyScannedSize)
+	})
+
+	t.Run("usage is recorded by Athena query event without status check", func(tt *testing.T) {
+		id := execSearch(tt, "key-orange", http.StatusCreated)
+		tester.Athena.CompleteAll("SUCCEEDED", "s3://test-bucket/output/4.csv")
+		queryID := fmt.Sprintf("query-%d", len(tester.Athena.Queries)-1)
+		require.NoError(tt, tester.Handler.CompleteAthenaQuery(queryID))
+		require.NoError(tt, tester.Handler.CompleteAthenaQuery(queryID))
+		require.NoError(tt, tester.Handler.CompleteAthenaQuery("not-minerva-query"))
+
+		usage := getUsage(tt)
+		require.Equal(tt, 2, len(usage.Users))
+		assert.Equal(tt, int64(120), usage.Users[1].DailyScannedSize)
+
+		getSearch(tt, "key-orange", id)
+		assert.Equal(tt, int64(120), getUsage(tt).Users[1].DailyScannedSize)
+	})
+
+	t.Run("usage of other date", func(tt *testing.T) {
+		w := doRequest(r, "GET", "/api/v1/usage?date=2020-01-02", map[string]string{"x-api-key": "key-blue"}, nil)
+		require.Equal(tt, http.StatusOK, w.Code)
+		var resp api.GetUsageResponse
+		require.NoError(tt, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(tt, "2020-01-02", resp.Date)
+		assert.Equal(tt, 0, len(resp.Users))
+
+		w = doRequest(r, "GET", "/api/v1/usage?date=20200102", map[string]string{"x-api-key": "key-blue"}, nil)
+		assert.Equal(tt, http.StatusBadRequest, w.Code)
+	})
+}
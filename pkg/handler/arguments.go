@@ -17,12 +17,14 @@ type Arguments struct {
 	EnvVars
 	Event interface{}
 
-	NewS3      adaptor.S3ClientFactory    `json:"-"`
-	NewSQS     adaptor.SQSClientFactory   `json:"-"`
-	ChunkRepo  repository.ChunkRepository `json:"-"`
-	MetaRepo   repository.MetaRepository  `json:"-"`
-	NewEncoder adaptor.EncoderFactory     `json:"-"`
-	NewDecoder adaptor.DecoderFactory     `json:"-"`
+	NewS3         adaptor.S3ClientFactory         `json:"-"`
+	NewSQS        adaptor.SQSClientFactory        `json:"-"`
+	NewGlue       adaptor.GlueClientFactory       `json:"-"`
+	NewCloudWatch adaptor.CloudWatchClientFactory `json:"-"`
+	ChunkRepo     repository.ChunkRepository      `json:"-"`
+	MetaRepo      repository.MetaRepository       `json:"-"`
+	NewEncoder    adaptor.EncoderFactory          `json:"-"`
+	NewDecoder    adaptor.DecoderFactory          `json:"-"`
 
 	// Only required for indexer
 	Reader *rlogs.Reader
@@ -89,11 +91,32 @@ func (x *Arguments) S3Service() *service.S3Service {
 	return service.NewS3Service(x.newS3())
 }
 
+// S3Client provides S3 client of S3Region for direct access such as listing and deleting objects
+func (x *Arguments) S3Client() adaptor.S3Client {
+	return x.newS3()(x.S3Region)
+}
+
 // SQSService provides service.SQSService with SQS adaptor
 func (x *Arguments) SQSService() *service.SQSService {
 	return service.NewSQSService(x.newSQS())
 }
 
+// GlueClient provides Glue Data Catalog client of AwsRegion
+func (x *Arguments) GlueClient() adaptor.GlueClient {
+	if x.NewGlue != nil {
+		return x.NewGlue(x.AwsRegion)
+	}
+	return adaptor.NewGlueClient(x.AwsRegion)
+}
+
+// CloudWatchClient provides CloudWatch client of AwsRegion to put custom metrics
+func (x *Arguments) CloudWatchClient() adaptor.CloudWatchClient {
+	if x.NewCloudWatch != nil {
+		return x.NewCloudWatch(x.AwsRegion)
+	}
+	return adaptor.NewCloudWatchClient(x.AwsRegion)
+}
+
 // RecordService provides encode/decode logic and S3 access for normalized log data
 func (x *Arguments) RecordService() *service.RecordService {
 	return service.NewRecordService(x.newS3(), x.newEncoder(), x.newDecoder())
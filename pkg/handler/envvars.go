@@ -12,6 +12,33 @@ type EnvVars struct {
 	SentryDSN    string `env:"SENTRY_DSN"`
 	SentryEnv    string `env:"SENTRY_ENVIRONMENT"`
 	LogLevel     string `env:"LOG_LEVEL"`
+	TagPartition string `env:"TAG_PARTITION"`
+	// PartitionGranularity is "hourly" (default) or "daily"
+	PartitionGranularity string `env:"PARTITION_GRANULARITY"`
+	// PartitionProjection means Athena tables use partition projection, then partitioner is not required
+	PartitionProjection bool `env:"PARTITION_PROJECTION"`
+
+	// Only for indexer
+	RedactConfig string `env:"REDACT_CONFIG"`
+	EnrichConfig string `env:"ENRICH_CONFIG"`
+	IOCConfig    string `env:"IOC_CONFIG"`
+
+	// Only for merger and compactor. MergeSortRecords sorts records in merged objects for pruning row groups by statistics.
+	MergeSortRecords bool `env:"MERGE_SORT_RECORDS"`
+	// MergeStreaming uploads merged object by S3 multipart upload without temp file
+	MergeStreaming bool `env:"MERGE_STREAMING"`
+	// ParquetConfig is JSON of merger.ParquetConfig to configure compression, row group size, page size, parallelism and encodings of merged objects
+	ParquetConfig string `env:"PARQUET_CONFIG"`
+
+	// Only for retention
+	RetentionConfig string `env:"RETENTION_CONFIG"`
+
+	// Only for compactor. CompactionMinAge is duration such as "24h", partitions older than it are compacted.
+	CompactionMinAge string `env:"COMPACTION_MIN_AGE"`
+
+	// Only for sweeper. SweeperMinAge is duration such as "24h", raw objects older than it are checked. SweeperRequeue sends orphan raw objects to compose queue.
+	SweeperMinAge  string `env:"SWEEPER_MIN_AGE"`
+	SweeperRequeue bool   `env:"SWEEPER_REQUEUE"`
 
 	// From resource
 	MetaTableName     string `env:"META_TABLE_NAME"`
@@ -19,6 +46,7 @@ type EnvVars struct {
 	PartitionQueueURL string `env:"PARTITION_QUEUE_URL"`
 	ComposeQueueURL   string `env:"COMPOSE_QUEUE_URL"`
 	MergeQueueURL     string `env:"MERGE_QUEUE_URL"`
+	MergeDLQURL       string `env:"MERGE_DLQ_URL"`
 
 	// From AWS Lambda
 	AwsRegion string `env:"AWS_REGION"`
@@ -0,0 +1,320 @@
+package indexer
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/m-mizutani/minerva/internal/mmdb"
+	"github.com/m-mizutani/minerva/pkg/models"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultAssetKey = "id"
+
+	geoFieldSuffix   = "_geo"
+	asnFieldSuffix   = "_asn"
+	assetFieldSuffix = "_asset"
+)
+
+// EnrichRule specifies source fields of enrichment for tag.
+type EnrichRule struct {
+	// Tag is glob pattern of tag, e.g. "aws.vpcflow"
+	Tag string `json:"tag"`
+	// IPField is dot separated path of IP address field for GeoIP and ASN lookup
+	IPField string `json:"ip_field"`
+	// AssetField is dot separated path of asset key field, e.g. instance ID
+	AssetField string `json:"asset_field"`
+	// Prefix is added to name of derived fields. E.g. "src" makes "src_geo.country". Default is no prefix ("_geo.country").
+	Prefix string `json:"prefix"`
+}
+
+// EnrichConfig is configuration of enrichment at ingest time. It's JSON format and given by ENRICH_CONFIG.
+type EnrichConfig struct {
+	// GeoIPDB is path of MaxMind DB for country and city, e.g. GeoLite2-City.mmdb
+	GeoIPDB string `json:"geoip_db"`
+	// ASNDB is path of MaxMind DB for AS, e.g. GeoLite2-ASN.mmdb
+	ASNDB string `json:"asn_db"`
+	// AssetInventory is path of CSV (with header) or JSON (array of objects) file.
+	AssetInventory string `json:"asset_inventory"`
+	// AssetKey is column name of key in AssetInventory. Default is "id".
+	AssetKey string `json:"asset_key"`
+
+	Rules []EnrichRule `json:"rules"`
+}
+
+// enricher adds derived fields to LogQueue before making records.
+type enricher struct {
+	rules  []EnrichRule
+	geoIP  *mmdb.Reader
+	asn    *mmdb.Reader
+	assets map[string]map[string]interface{}
+}
+
+var enricherCache struct {
+	mutex    sync.Mutex
+	config   string
+	enricher *enricher
+}
+
+// getEnricher returns enricher of the config. It's cached because databases are large and Lambda instance is reused.
+func getEnricher(raw string) (*enricher, error) {
+	if raw == "" {
+		return nil, nil
+	}
+
+	enricherCache.mutex.Lock()
+	defer enricherCache.mutex.Unlock()
+
+	if enricherCache.enricher != nil && enricherCache.config == raw {
+		return enricherCache.enricher, nil
+	}
+
+	e, err := newEnricher(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	enricherCache.config = raw
+	enricherCache.enricher = e
+	return e, nil
+}
+
+func newEnricher(raw string) (*enricher, error) {
+	var config EnrichConfig
+	if err := json.Unmarshal([]byte(raw), &config); err != nil {
+		return nil, errors.Wrap(err, "Fail to parse enrich config")
+	}
+
+	e := &enricher{rules: config.Rules}
+	for i, rule := range config.Rules {
+		if rule.Tag == "" {
+			return nil, fmt.Errorf("'tag' is required in enrich rule #%d", i)
+		}
+		if _, err := path.Match(rule.Tag, ""); err != nil {
+			return nil, fmt.Errorf("Invalid tag pattern in enrich rule #%d: %s", i, rule.Tag)
+		}
+		if rule.IPField == "" && rule.AssetField == "" {
+			return nil, fmt.Errorf("Either of 'ip_field' and 'asset_field' is required in enrich rule #%d", i)
+		}
+		if rule.IPField != "" && config.GeoIPDB == "" && config.ASNDB == "" {
+			return nil, fmt.Errorf("'ip_field' requires 'geoip_db' or 'asn_db' in enrich rule #%d", i)
+		}
+		if rule.AssetField != "" && config.AssetInventory == "" {
+			return nil, fmt.Errorf("'asset_field' requires 'asset_inventory' in enrich rule #%d", i)
+		}
+	}
+
+	var err error
+	if config.GeoIPDB != "" {
+		if e.geoIP, err = mmdb.Open(config.GeoIPDB); err != nil {
+			return nil, err
+		}
+	}
+	if config.ASNDB != "" {
+		if e.asn, err = mmdb.Open(config.ASNDB); err != nil {
+			return nil, err
+		}
+	}
+	if config.AssetInventory != "" {
+		key := config.AssetKey
+		if key == "" {
+			key = defaultAssetKey
+		}
+		if e.assets, err = loadAssetInventory(config.AssetInventory, key); err != nil {
+			return nil, err
+		}
+	}
+
+	return e, nil
+}
+
+func loadAssetInventory(fpath, key string) (map[string]map[string]interface{}, error) {
+	fd, err := os.Open(fpath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to open asset inventory: %s", fpath)
+	}
+	defer fd.Close()
+
+	var records []map[string]interface{}
+	if strings.ToLower(filepath.Ext(fpath)) == ".json" {
+		if err := json.NewDecoder(fd).Decode(&records); err != nil {
+			return nil, errors.Wrapf(err, "Fail to decode asset inventory: %s", fpath)
+		}
+	} else {
+		reader := csv.NewReader(fd)
+		header, err := reader.Read()
+		if err != nil {
+			return nil, errors.Wrapf(err, "Fail to read header of asset inventory: %s", fpath)
+		}
+		for {
+			row, err := reader.Read()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, errors.Wrapf(err, "Fail to read asset inventory: %s", fpath)
+			}
+
+			record := map[string]interface{}{}
+			for i, col := range header {
+				if i < len(row) {
+					record[col] = row[i]
+				}
+			}
+			records = append(records, record)
+		}
+	}
+
+	assets := map[string]map[string]interface{}{}
+	for _, record := range records {
+		k, ok := record[key]
+		if !ok {
+			return nil, fmt.Errorf("Asset key '%s' is not found in asset inventory: %v", key, record)
+		}
+		attrs := map[string]interface{}{}
+		for col, v := range record {
+			if col != key {
+				attrs[col] = v
+			}
+		}
+		assets[fmt.Sprintf("%v", k)] = attrs
+	}
+
+	return assets, nil
+}
+
+// enrich adds "_geo", "_asn" and "_asset" fields to top level of log. Both of index terms and message have them because they are made from q after enrichment.
+func (x *enricher) enrich(q *models.LogQueue) error {
+	var rules []EnrichRule
+	for _, rule := range x.rules {
+		if matched, _ := path.Match(rule.Tag, q.Tag); matched {
+			rules = append(rules, rule)
+		}
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+
+	value, err := decodeLogMessage(q)
+	if err != nil {
+		return err
+	}
+	log, ok := value.(map[string]interface{})
+	if !ok {
+		return nil // Not object, nowhere to add fields
+	}
+
+	modified := false
+	for _, rule := range rules {
+		if rule.IPField != "" {
+			if addr := lookupField(log, rule.IPField); addr != "" {
+				geo, asn, err := x.lookupIP(addr)
+				if err != nil {
+					return err
+				}
+				if geo != nil {
+					log[rule.Prefix+geoFieldSuffix] = geo
+					modified = true
+				}
+				if asn != nil {
+					log[rule.Prefix+asnFieldSuffix] = asn
+					modified = true
+				}
+			}
+		}
+
+		if rule.AssetField != "" {
+			if key := lookupField(log, rule.AssetField); key != "" {
+				if asset, ok := x.assets[key]; ok {
+					log[rule.Prefix+assetFieldSuffix] = asset
+					modified = true
+				}
+			}
+		}
+	}
+
+	if !modified {
+		return nil
+	}
+	return setLogMessage(q, log)
+}
+
+func (x *enricher) lookupIP(addr string) (map[string]interface{}, map[string]interface{}, error) {
+	var geo, asn map[string]interface{}
+
+	if x.geoIP != nil {
+		v, err := x.geoIP.LookupString(addr)
+		if err != nil {
+			return nil, nil, err
+		}
+		if data, ok := v.(map[string]interface{}); ok {
+			geo = map[string]interface{}{}
+			if s, ok := dig(data, "country", "iso_code").(string); ok {
+				geo["country"] = s
+			}
+			if s, ok := dig(data, "city", "names", "en").(string); ok {
+				geo["city"] = s
+			}
+			if f, ok := dig(data, "location", "latitude").(float64); ok {
+				geo["lat"] = f
+			}
+			if f, ok := dig(data, "location", "longitude").(float64); ok {
+				geo["lon"] = f
+			}
+			if len(geo) == 0 {
+				geo = nil
+			}
+		}
+	}
+
+	if x.asn != nil {
+		v, err := x.asn.LookupString(addr)
+		if err != nil {
+			return nil, nil, err
+		}
+		if data, ok := v.(map[string]interface{}); ok {
+			asn = map[string]interface{}{}
+			if n, ok := data["autonomous_system_number"].(uint64); ok {
+				asn["number"] = n
+			}
+			if s, ok := data["autonomous_system_organization"].(string); ok {
+				asn["org"] = s
+			}
+			if len(asn) == 0 {
+				asn = nil
+			}
+		}
+	}
+
+	return geo, asn, nil
+}
+
+func dig(v interface{}, keys ...string) interface{} {
+	for _, key := range keys {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[key]
+	}
+	return v
+}
+
+// lookupField returns string of field by dot separated path. Empty string is returned if not found or not scalar.
+func lookupField(log map[string]interface{}, field string) string {
+	switch v := dig(log, strings.Split(field, ".")...).(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,121 @@
+package indexer_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/m-mizutani/minerva/internal/transform"
+	"github.com/m-mizutani/minerva/pkg/indexer"
+	"github.com/m-mizutani/minerva/pkg/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type flowLog struct {
+	SrcAddr    string `json:"srcaddr"`
+	DstAddr    string `json:"dstaddr"`
+	InstanceID string `json:"instance_id"`
+}
+
+// setupEnrichFixtures creates asset files. MaxMind DB files are in testdata, generated by test of internal/mmdb.
+func setupEnrichFixtures(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "enrich")
+	require.NoError(t, err)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "assets.csv"),
+		[]byte("id,owner,env\ni-0123456789,blue-team,prod\ni-9999999999,red-team,dev\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "assets.json"),
+		[]byte(`[{"instance":"i-0123456789","owner":"green-team"}]`), 0644))
+
+	return dir
+}
+
+// indexTerms returns set of "field=term"
+func indexTerms(t *testing.T, q *models.LogQueue) map[string]bool {
+	records, err := transform.LogToIndexRecord(q, 1)
+	require.NoError(t, err)
+	terms := map[string]bool{}
+	for _, r := range records {
+		rec := r.(models.IndexRecord)
+		terms[rec.Field+"="+rec.Term] = true
+	}
+	return terms
+}
+
+func TestEnrich(t *testing.T) {
+	dir := setupEnrichFixtures(t)
+	defer os.RemoveAll(dir)
+
+	log := &flowLog{SrcAddr: "192.0.2.5", DstAddr: "198.51.100.7", InstanceID: "i-0123456789"}
+
+	t.Run("GeoIP, ASN and asset", func(tt *testing.T) {
+		config := fmt.Sprintf(`{
+			"geoip_db": "%s", "asn_db": "%s", "asset_inventory": "%s",
+			"rules": [
+				{"tag": "aws.vpcflow", "ip_field": "srcaddr", "asset_field": "instance_id"},
+				{"tag": "aws.vpcflow", "ip_field": "dstaddr", "prefix": "dst"}
+			]
+		}`, filepath.Join("testdata", "city.mmdb"), filepath.Join("testdata", "asn.mmdb"), filepath.Join(dir, "assets.csv"))
+
+		q := newLogQueue(tt, "aws.vpcflow", log)
+		require.NoError(tt, indexer.Enrich(config, q))
+
+		var msg map[string]interface{}
+		require.NoError(tt, json.Unmarshal([]byte(q.Message), &msg))
+		assert.Equal(tt, map[string]interface{}{"country": "JP", "city": "Tokyo", "lat": 35.6, "lon": 139.7}, msg["_geo"])
+		assert.Equal(tt, map[string]interface{}{"number": float64(64500), "org": "Example Net"}, msg["_asn"])
+		assert.Equal(tt, map[string]interface{}{"owner": "blue-team", "env": "prod"}, msg["_asset"])
+		assert.Equal(tt, map[string]interface{}{"country": "US"}, msg["dst_geo"])
+		assert.Nil(tt, msg["dst_asn"])
+		assert.Equal(tt, "192.0.2.5", msg["srcaddr"])
+
+		terms := indexTerms(tt, q)
+		assert.True(tt, terms["_geo.country=JP"])
+		assert.True(tt, terms["_geo.city=Tokyo"])
+		assert.True(tt, terms["_asn.org=Example"])
+		assert.True(tt, terms["_asn.number=64500"])
+		assert.True(tt, terms["_asset.owner=blue-team"])
+		assert.True(tt, terms["dst_geo.country=US"])
+	})
+
+	t.Run("JSON asset inventory with key", func(tt *testing.T) {
+		config := fmt.Sprintf(`{
+			"asset_inventory": "%s", "asset_key": "instance",
+			"rules": [{"tag": "aws.*", "asset_field": "instance_id"}]
+		}`, filepath.Join(dir, "assets.json"))
+
+		q := newLogQueue(tt, "aws.vpcflow", log)
+		require.NoError(tt, indexer.Enrich(config, q))
+		assert.True(tt, indexTerms(tt, q)["_asset.owner=green-team"])
+	})
+
+	t.Run("no match", func(tt *testing.T) {
+		config := fmt.Sprintf(`{
+			"geoip_db": "%s",
+			"rules": [{"tag": "aws.vpcflow", "ip_field": "srcaddr"}]
+		}`, filepath.Join("testdata", "city.mmdb"))
+
+		q := newLogQueue(tt, "aws.cloudtrail", log)
+		msg := q.Message
+		require.NoError(tt, indexer.Enrich(config, q))
+		assert.Equal(tt, msg, q.Message)
+
+		q = newLogQueue(tt, "aws.vpcflow", &flowLog{SrcAddr: "203.0.113.1"})
+		msg = q.Message
+		require.NoError(tt, indexer.Enrich(config, q))
+		assert.Equal(tt, msg, q.Message)
+	})
+
+	t.Run("invalid config", func(tt *testing.T) {
+		q := newLogQueue(tt, "aws.vpcflow", log)
+		assert.Error(tt, indexer.Enrich(`{"rules":[{"tag":"aws.*","ip_field":"srcaddr"}]}`, q))
+		assert.Error(tt, indexer.Enrich(`{"rules":[{"tag":"aws.*"}]}`, q))
+		assert.Error(tt, indexer.Enrich(`{"geoip_db":"/not/found.mmdb","rules":[]}`, q))
+		assert.Error(tt, indexer.Enrich(fmt.Sprintf(`{"asset_inventory":"%s","asset_key":"none","rules":[]}`,
+			filepath.Join(dir, "assets.csv")), q))
+	})
+}
@@ -0,0 +1,54 @@
+package indexer
+
+import (
+	"time"
+
+	"github.com/m-mizutani/minerva/pkg/handler"
+	"github.com/m-mizutani/minerva/pkg/models"
+)
+
+func Redact(config string, q *models.LogQueue) error {
+	r, err := newRedactor(config)
+	if err != nil {
+		return err
+	}
+	return r.redact(q)
+}
+
+func Enrich(config string, q *models.LogQueue) error {
+	e, err := newEnricher(config)
+	if err != nil {
+		return err
+	}
+	return e.enrich(q)
+}
+
+func NewIOCMatcher(args handler.Arguments) (*iocMatcher, error) {
+	return newIOCMatcher(args)
+}
+
+func (x *iocMatcher) Match(q *models.LogQueue, objectID int64) ([]*models.DetectionEvent, error) {
+	return x.match(q, objectID)
+}
+
+func (x *iocMatcher) Emit(args handler.Arguments, events []*models.DetectionEvent) error {
+	return x.emit(args, events)
+}
+
+func (x *iocMatcher) EmitOrCount(args handler.Arguments, events []*models.DetectionEvent) {
+	x.emitOrCount(args, events)
+}
+
+func GetIOCMatcher(args handler.Arguments) (*iocMatcher, error) {
+	return getIOCMatcher(args)
+}
+
+// ExpireIOCMatcher makes cached matcher older than reload interval.
+func ExpireIOCMatcher() {
+	iocMatcherCache.mutex.Lock()
+	defer iocMatcherCache.mutex.Unlock()
+	if iocMatcherCache.matcher != nil {
+		iocMatcherCache.matcher.loadedAt = iocMatcherCache.matcher.loadedAt.Add(-iocReloadInterval)
+	}
+	iocMatcherCache.retryAt = time.Time{}
+}
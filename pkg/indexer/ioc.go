@@ -0,0 +1,415 @@
+package indexer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/m-mizutani/minerva/internal/transform"
+	"github.com/m-mizutani/minerva/pkg/handler"
+	"github.com/m-mizutani/minerva/pkg/models"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Indicator types
+const (
+	iocTypeIP     = "ip"
+	iocTypeDomain = "domain"
+	iocTypeHash   = "hash"
+
+	iocFlagField              = "_ioc"
+	iocReloadInterval         = 10 * time.Minute
+	iocRetryInterval          = time.Minute
+	defaultMaxEventsPerObject = 1000
+
+	iocMetricNamespace   = "Minerva"
+	iocEmitFailureMetric = "FailedDetectionEvents"
+)
+
+// IOCFeed is a list of indicators. File has one indicator per line, and only first column is used if line is CSV. Empty line and line starting with "#" are ignored.
+type IOCFeed struct {
+	Name string `json:"name"`
+	// Type is one of "ip", "domain" and "hash"
+	Type string `json:"type"`
+	// Path is local file path or S3 path such as s3://bucket/key
+	Path string `json:"path"`
+	// Region is region of S3 bucket. Default is AWS_REGION.
+	Region string `json:"region"`
+}
+
+// IOCConfig is configuration of indicator matching at ingest time. It's JSON format and given by IOC_CONFIG.
+type IOCConfig struct {
+	Feeds []IOCFeed `json:"feeds"`
+	// Tags is glob patterns of target tag. All tags are target if empty.
+	Tags []string `json:"tags"`
+	// QueueURL and WebhookURL are destinations of DetectionEvent. Both are optional.
+	QueueURL   string `json:"queue_url"`
+	WebhookURL string `json:"webhook_url"`
+	// MaxEventsPerObject limits number of events for one S3 object to avoid flood by noisy indicator. Default is 1000.
+	MaxEventsPerObject int `json:"max_events_per_object"`
+}
+
+type indicator struct {
+	value   string
+	iocType string
+	feed    string
+}
+
+// iocMatcher checks terms of log with indicators and flags matched log by "_ioc" field.
+type iocMatcher struct {
+	config   IOCConfig
+	terms    map[string]*indicator
+	termSet  map[string]bool
+	domains  map[string]*indicator
+	loadedAt time.Time
+	client   *http.Client
+}
+
+var iocMatcherCache struct {
+	mutex   sync.Mutex
+	config  string
+	matcher *iocMatcher
+	retryAt time.Time
+}
+
+// getIOCMatcher returns cached matcher. Indicators are reloaded periodically because feeds are updated. If reload fails, stale matcher is used and reload is retried after iocRetryInterval not to stop indexing by failure of feed.
+func getIOCMatcher(args handler.Arguments) (*iocMatcher, error) {
+	if args.IOCConfig == "" {
+		return nil, nil
+	}
+
+	iocMatcherCache.mutex.Lock()
+	defer iocMatcherCache.mutex.Unlock()
+
+	cached := iocMatcherCache.matcher
+	if cached != nil && iocMatcherCache.config != args.IOCConfig {
+		cached = nil
+	}
+	if cached != nil && (time.Since(cached.loadedAt) < iocReloadInterval || time.Now().Before(iocMatcherCache.retryAt)) {
+		return cached, nil
+	}
+
+	matcher, err := newIOCMatcher(args)
+	if err != nil {
+		if cached == nil {
+			return nil, err
+		}
+		logger.WithError(err).WithField("loadedAt", cached.loadedAt).Warn("Fail to reload IOC feeds, stale indicators are used")
+		iocMatcherCache.retryAt = time.Now().Add(iocRetryInterval)
+		return cached, nil
+	}
+
+	iocMatcherCache.config = args.IOCConfig
+	iocMatcherCache.matcher = matcher
+	iocMatcherCache.retryAt = time.Time{}
+	return matcher, nil
+}
+
+func newIOCMatcher(args handler.Arguments) (*iocMatcher, error) {
+	var config IOCConfig
+	if err := json.Unmarshal([]byte(args.IOCConfig), &config); err != nil {
+		return nil, errors.Wrap(err, "Fail to parse IOC config")
+	}
+	for _, tag := range config.Tags {
+		if _, err := path.Match(tag, ""); err != nil {
+			return nil, fmt.Errorf("Invalid tag pattern in IOC config: %s", tag)
+		}
+	}
+	if config.MaxEventsPerObject <= 0 {
+		config.MaxEventsPerObject = defaultMaxEventsPerObject
+	}
+
+	matcher := &iocMatcher{
+		config:   config,
+		terms:    map[string]*indicator{},
+		termSet:  map[string]bool{},
+		domains:  map[string]*indicator{},
+		loadedAt: time.Now(),
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+
+	for i, feed := range config.Feeds {
+		switch feed.Type {
+		case iocTypeIP, iocTypeDomain, iocTypeHash:
+		default:
+			return nil, fmt.Errorf("Invalid type of IOC feed #%d: %s", i, feed.Type)
+		}
+		if feed.Path == "" {
+			return nil, fmt.Errorf("'path' is required in IOC feed #%d", i)
+		}
+		if feed.Name == "" {
+			feed.Name = feed.Path
+		}
+
+		if err := matcher.loadFeed(args, feed); err != nil {
+			return nil, err
+		}
+	}
+
+	logger.WithFields(logrus.Fields{
+		"terms":   len(matcher.terms),
+		"domains": len(matcher.domains),
+	}).Info("Loaded IOC feeds")
+
+	return matcher, nil
+}
+
+func openFeed(args handler.Arguments, feed IOCFeed) (io.ReadCloser, error) {
+	if !strings.HasPrefix(feed.Path, "s3://") {
+		fd, err := os.Open(feed.Path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Fail to open IOC feed: %s", feed.Path)
+		}
+		return fd, nil
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(feed.Path, "s3://"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("Invalid S3 path of IOC feed: %s", feed.Path)
+	}
+	region := feed.Region
+	if region == "" {
+		region = args.AwsRegion
+	}
+
+	return args.S3Service().AsyncDownload(models.NewS3Object(region, parts[0], parts[1]))
+}
+
+func (x *iocMatcher) loadFeed(args handler.Arguments, feed IOCFeed) error {
+	body, err := openFeed(args, feed)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		value := strings.TrimSpace(strings.Split(line, ",")[0])
+
+		switch feed.Type {
+		case iocTypeIP:
+			ip := net.ParseIP(value)
+			if ip == nil {
+				logger.WithFields(logrus.Fields{"feed": feed.Name, "value": value}).Warn("Invalid IP address in IOC feed")
+				continue
+			}
+			x.addTerm(&indicator{value: ip.String(), iocType: feed.Type, feed: feed.Name})
+
+		case iocTypeHash:
+			x.addTerm(&indicator{value: strings.ToLower(value), iocType: feed.Type, feed: feed.Name})
+
+		case iocTypeDomain:
+			domain := strings.TrimSuffix(strings.ToLower(value), ".")
+			x.domains[domain] = &indicator{value: domain, iocType: feed.Type, feed: feed.Name}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.Wrapf(err, "Fail to read IOC feed: %s", feed.Path)
+	}
+
+	return nil
+}
+
+func (x *iocMatcher) addTerm(ioc *indicator) {
+	x.terms[ioc.value] = ioc
+	x.termSet[ioc.value] = true
+	// Hash can be upper case in log
+	x.termSet[strings.ToUpper(ioc.value)] = true
+}
+
+func (x *iocMatcher) isTarget(tag string) bool {
+	if len(x.config.Tags) == 0 {
+		return true
+	}
+	for _, ptn := range x.config.Tags {
+		if matched, _ := path.Match(ptn, tag); matched {
+			return true
+		}
+	}
+	return false
+}
+
+var domainPattern = regexp.MustCompile(`(?i)[a-z0-9](?:[a-z0-9-]*[a-z0-9])?(?:\.[a-z0-9](?:[a-z0-9-]*[a-z0-9])?)+`)
+
+// lookupDomain checks the domain and its parent domains, e.g. "a.evil.example" matches with "evil.example".
+func (x *iocMatcher) lookupDomain(domain string) *indicator {
+	domain = strings.ToLower(domain)
+	for {
+		if ioc, ok := x.domains[domain]; ok {
+			return ioc
+		}
+		idx := strings.Index(domain, ".")
+		if idx < 0 {
+			return nil
+		}
+		domain = domain[idx+1:]
+	}
+}
+
+// match returns detection events of the log and adds "_ioc" field to the log if matched. IP address and hash are matched with index terms, and domain is matched with domain name in field value because domain is split by tokenizer.
+func (x *iocMatcher) match(q *models.LogQueue, objectID int64) ([]*models.DetectionEvent, error) {
+	if !x.isTarget(q.Tag) {
+		return nil, nil
+	}
+
+	type hit struct {
+		field string
+		ioc   *indicator
+	}
+	var hits []hit
+	found := map[hit]bool{}
+	add := func(h hit) {
+		if !found[h] {
+			found[h] = true
+			hits = append(hits, h)
+		}
+	}
+
+	if len(x.termSet) > 0 {
+		for _, m := range transform.MatchTerms(q.Value, x.termSet) {
+			if ioc, ok := x.terms[strings.ToLower(m.Term)]; ok {
+				add(hit{field: m.Field, ioc: ioc})
+			}
+		}
+	}
+
+	if len(x.terms) > 0 || len(x.domains) > 0 {
+		for _, fv := range transform.FlattenLog(q.Value) {
+			// IPv6 address is split by tokenizer, then whole value is checked
+			if ip := net.ParseIP(fv.Value); ip != nil {
+				if ioc, ok := x.terms[ip.String()]; ok {
+					add(hit{field: fv.Field, ioc: ioc})
+				}
+			}
+			for _, domain := range domainPattern.FindAllString(fv.Value, -1) {
+				if ioc := x.lookupDomain(domain); ioc != nil {
+					add(hit{field: fv.Field, ioc: ioc})
+				}
+			}
+		}
+	}
+
+	if len(hits) == 0 {
+		return nil, nil
+	}
+
+	var events []*models.DetectionEvent
+	var flags []interface{}
+	for _, h := range hits {
+		events = append(events, &models.DetectionEvent{
+			Tag:           q.Tag,
+			Timestamp:     q.Timestamp.Unix(),
+			ObjectID:      objectID,
+			Seq:           q.Seq,
+			Src:           q.Src,
+			Field:         h.field,
+			Indicator:     h.ioc.value,
+			IndicatorType: h.ioc.iocType,
+			Feed:          h.ioc.feed,
+		})
+		flags = append(flags, map[string]interface{}{
+			"field":     h.field,
+			"indicator": h.ioc.value,
+			"type":      h.ioc.iocType,
+			"feed":      h.ioc.feed,
+		})
+	}
+
+	value, err := decodeLogMessage(q)
+	if err != nil {
+		return nil, err
+	}
+	if log, ok := value.(map[string]interface{}); ok {
+		log[iocFlagField] = flags
+		if err := setLogMessage(q, log); err != nil {
+			return nil, err
+		}
+	}
+
+	return events, nil
+}
+
+type detectionWebhookBody struct {
+	Events []*models.DetectionEvent `json:"events"`
+}
+
+// emit sends detection events of an object to SQS queue (one message per event) and webhook (all events in one request).
+// emitOrCount emits detection events. Logs are already indexed when it's called, then failure is logged and counted by metric instead of returning error. Retry of indexer would make duplicated records.
+func (x *iocMatcher) emitOrCount(args handler.Arguments, events []*models.DetectionEvent) {
+	err := x.emit(args, events)
+	if err == nil {
+		return
+	}
+
+	logger.WithError(err).WithField("events", len(events)).Error("Fail to emit detection events")
+	if _, err := args.CloudWatchClient().PutMetricData(&cloudwatch.PutMetricDataInput{
+		Namespace: aws.String(iocMetricNamespace),
+		MetricData: []*cloudwatch.MetricDatum{
+			{
+				MetricName: aws.String(iocEmitFailureMetric),
+				Value:      aws.Float64(float64(len(events))),
+				Unit:       aws.String(cloudwatch.StandardUnitCount),
+			},
+		},
+	}); err != nil {
+		logger.WithError(err).Error("Fail to put metric of detection events")
+	}
+}
+
+func (x *iocMatcher) emit(args handler.Arguments, events []*models.DetectionEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	if len(events) > x.config.MaxEventsPerObject {
+		logger.WithFields(logrus.Fields{
+			"events": len(events),
+			"max":    x.config.MaxEventsPerObject,
+		}).Warn("Too many detection events, truncated")
+		events = events[:x.config.MaxEventsPerObject]
+	}
+
+	if x.config.QueueURL != "" {
+		sqsService := args.SQSService()
+		for _, event := range events {
+			if err := sqsService.SendSQS(event, x.config.QueueURL); err != nil {
+				return errors.Wrap(err, "Fail to send detection event")
+			}
+		}
+	}
+
+	if x.config.WebhookURL != "" {
+		raw, err := json.Marshal(detectionWebhookBody{Events: events})
+		if err != nil {
+			return errors.Wrap(err, "Fail to marshal detection events")
+		}
+		resp, err := x.client.Post(x.config.WebhookURL, "application/json", bytes.NewReader(raw))
+		if err != nil {
+			return errors.Wrapf(err, "Fail to post detection events to webhook: %s", x.config.WebhookURL)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("Webhook of detection events returned error status %d: %s", resp.StatusCode, x.config.WebhookURL)
+		}
+	}
+
+	logger.WithField("events", len(events)).Info("Emitted detection events")
+	return nil
+}
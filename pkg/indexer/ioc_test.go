@@ -0,0 +1,239 @@
+package indexer_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/google/uuid"
+	"github.com/m-mizutani/minerva/internal/adaptor"
+	"github.com/m-mizutani/minerva/internal/mock"
+	"github.com/m-mizutani/minerva/pkg/handler"
+	"github.com/m-mizutani/minerva/pkg/indexer"
+	"github.com/m-mizutani/minerva/pkg/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type accessLog struct {
+	ClientIP string `json:"client_ip"`
+	URL      string `json:"url"`
+	FileHash string `json:"file_hash"`
+	Message  string `json:"message"`
+}
+
+func setupIOCFeeds(t *testing.T) (string, string) {
+	dir, err := ioutil.TempDir("", "ioc")
+	require.NoError(t, err)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "ip.txt"),
+		[]byte("# bad IP list\n192.0.2.66\n2001:db8::bad\n\nnot-ip\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "hash.csv"),
+		[]byte("44d88612fea8a8f36de82e1278abb02f,eicar\n"), 0644))
+
+	// Domain feed is in S3
+	bucket := uuid.New().String()
+	_, err = mock.NewS3Client("test").PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String("feeds/domain.txt"),
+		Body:   bytes.NewReader([]byte("evil.example\nEXAMPLE.org.\n")),
+	})
+	require.NoError(t, err)
+
+	return dir, fmt.Sprintf("s3://%s/feeds/domain.txt", bucket)
+}
+
+func TestIOCMatcher(t *testing.T) {
+	dir, domainFeed := setupIOCFeeds(t)
+	defer os.RemoveAll(dir)
+
+	var webhookBody []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		webhookBody, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	sqsClient := mock.NewSQSClient("ap-northeast-1").(*mock.SQSClient)
+	args := handler.Arguments{
+		NewS3:  mock.NewS3Client,
+		NewSQS: func(region string) adaptor.SQSClient { return sqsClient },
+	}
+	args.AwsRegion = "ap-northeast-1"
+	config := map[string]interface{}{
+		"feeds": []map[string]string{
+			{"name": "bad-ip", "type": "ip", "path": filepath.Join(dir, "ip.txt")},
+			{"name": "malware", "type": "hash", "path": filepath.Join(dir, "hash.csv")},
+			{"name": "bad-domain", "type": "domain", "path": domainFeed},
+		},
+		"tags":        []string{"web.*"},
+		"queue_url":   "https://sqs.ap-northeast-1.amazonaws.com/123456789012/detection",
+		"webhook_url": server.URL,
+	}
+	raw, err := json.Marshal(config)
+	require.NoError(t, err)
+	args.IOCConfig = string(raw)
+
+	matcher, err := indexer.NewIOCMatcher(args)
+	require.NoError(t, err)
+
+	t.Run("match IP, hash and domain", func(tt *testing.T) {
+		q := newLogQueue(tt, "web.access", &accessLog{
+			ClientIP: "192.0.2.66",
+			URL:      "https://login.evil.example/path?x=1",
+			FileHash: "44D88612FEA8A8F36DE82E1278ABB02F",
+			Message:  "from 2001:db8::1 to www.example.org",
+		})
+		q.Src = models.NewS3Object("ap-northeast-1", "src-bucket", "logs/1.json")
+
+		events, err := matcher.Match(q, 5)
+		require.NoError(tt, err)
+		require.Equal(tt, 4, len(events))
+
+		found := map[string]*models.DetectionEvent{}
+		for _, ev := range events {
+			found[ev.Indicator] = ev
+			assert.Equal(tt, "web.access", ev.Tag)
+			assert.Equal(tt, int64(5), ev.ObjectID)
+			assert.Equal(tt, int32(1), ev.Seq)
+			assert.Equal(tt, "logs/1.json", ev.Src.Key)
+		}
+		require.Contains(tt, found, "192.0.2.66")
+		assert.Equal(tt, "client_ip", found["192.0.2.66"].Field)
+		assert.Equal(tt, "bad-ip", found["192.0.2.66"].Feed)
+		require.Contains(tt, found, "44d88612fea8a8f36de82e1278abb02f")
+		assert.Equal(tt, "hash", found["44d88612fea8a8f36de82e1278abb02f"].IndicatorType)
+		require.Contains(tt, found, "evil.example")
+		assert.Equal(tt, "url", found["evil.example"].Field)
+		require.Contains(tt, found, "example.org")
+		assert.Equal(tt, "message", found["example.org"].Field)
+
+		// Log is flagged, and then flag is also indexed
+		var msg map[string]interface{}
+		require.NoError(tt, json.Unmarshal([]byte(q.Message), &msg))
+		assert.Equal(tt, 4, len(msg["_ioc"].([]interface{})))
+		terms := indexTerms(tt, q)
+		flagged := false
+		for i := 0; i < 4; i++ {
+			flagged = flagged || terms[fmt.Sprintf("_ioc.%d.feed=bad-ip", i)]
+		}
+		assert.True(tt, flagged)
+
+		require.NoError(tt, matcher.Emit(args, events))
+		assert.Equal(tt, 4, len(sqsClient.Input))
+		var sent models.DetectionEvent
+		require.NoError(tt, json.Unmarshal([]byte(*sqsClient.Input[0].MessageBody), &sent))
+		assert.Equal(tt, *events[0], sent)
+
+		var body struct {
+			Events []*models.DetectionEvent `json:"events"`
+		}
+		require.NoError(tt, json.Unmarshal(webhookBody, &body))
+		assert.Equal(tt, 4, len(body.Events))
+	})
+
+	t.Run("IPv6 indicator", func(tt *testing.T) {
+		q := newLogQueue(tt, "web.access", &accessLog{ClientIP: "2001:DB8:0:0::BAD"})
+		events, err := matcher.Match(q, 1)
+		require.NoError(tt, err)
+		require.Equal(tt, 1, len(events))
+		assert.Equal(tt, "2001:db8::bad", events[0].Indicator)
+	})
+
+	t.Run("no match", func(tt *testing.T) {
+		q := newLogQueue(tt, "web.access", &accessLog{
+			ClientIP: "192.0.2.67",
+			URL:      "https://notevil.example/",
+			Message:  "example.org.jp",
+		})
+		msg := q.Message
+		events, err := matcher.Match(q, 1)
+		require.NoError(tt, err)
+		assert.Equal(tt, 0, len(events))
+		assert.Equal(tt, msg, q.Message)
+	})
+
+	t.Run("not target tag", func(tt *testing.T) {
+		q := newLogQueue(tt, "app.access", &accessLog{ClientIP: "192.0.2.66"})
+		events, err := matcher.Match(q, 1)
+		require.NoError(tt, err)
+		assert.Equal(tt, 0, len(events))
+	})
+
+	t.Run("emit failure is counted without error", func(tt *testing.T) {
+		failServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer failServer.Close()
+
+		cw := &mock.CloudWatchClient{}
+		a := args
+		a.NewCloudWatch = func(string) adaptor.CloudWatchClient { return cw }
+		a.IOCConfig = fmt.Sprintf(`{"feeds":[{"type":"ip","path":"%s"}],"webhook_url":"%s"}`,
+			filepath.Join(dir, "ip.txt"), failServer.URL)
+		m, err := indexer.NewIOCMatcher(a)
+		require.NoError(tt, err)
+
+		q := newLogQueue(tt, "web.access", &accessLog{ClientIP: "192.0.2.66"})
+		events, err := m.Match(q, 1)
+		require.NoError(tt, err)
+		require.Error(tt, m.Emit(a, events))
+
+		m.EmitOrCount(a, events)
+		v, ok := cw.Metric("Minerva", "FailedDetectionEvents")
+		require.True(tt, ok)
+		assert.Equal(tt, float64(1), v)
+	})
+
+	t.Run("invalid config", func(tt *testing.T) {
+		for _, c := range []string{
+			`{"feeds":[{"type":"url","path":"x"}]}`,
+			`{"feeds":[{"type":"ip"}]}`,
+			`{"feeds":[{"type":"ip","path":"/not/found"}]}`,
+			`{"feeds":[{"type":"ip","path":"s3://bucket-only"}]}`,
+			`{"tags":["["]}`,
+		} {
+			a := args
+			a.IOCConfig = c
+			_, err := indexer.NewIOCMatcher(a)
+			assert.Error(tt, err, c)
+		}
+	})
+}
+
+func TestIOCMatcherReloadFailure(t *testing.T) {
+	dir, _ := setupIOCFeeds(t)
+	defer os.RemoveAll(dir)
+
+	args := handler.Arguments{NewS3: mock.NewS3Client}
+	args.IOCConfig = fmt.Sprintf(`{"feeds":[{"type":"ip","path":"%s"}]}`, filepath.Join(dir, "ip.txt"))
+
+	matcher, err := indexer.GetIOCMatcher(args)
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(filepath.Join(dir, "ip.txt")))
+
+	t.Run("stale matcher is used if reload fails", func(tt *testing.T) {
+		indexer.ExpireIOCMatcher()
+		stale, err := indexer.GetIOCMatcher(args)
+		require.NoError(tt, err)
+		assert.Equal(tt, matcher, stale)
+
+		events, err := stale.Match(newLogQueue(tt, "web.access", &accessLog{ClientIP: "192.0.2.66"}), 1)
+		require.NoError(tt, err)
+		assert.Equal(tt, 1, len(events))
+	})
+
+	t.Run("no fallback for changed config", func(tt *testing.T) {
+		a := args
+		a.IOCConfig = fmt.Sprintf(`{"feeds":[{"type":"ip","path":"%s"}],"tags":["web.*"]}`, filepath.Join(dir, "ip.txt"))
+		_, err := indexer.GetIOCMatcher(a)
+		assert.Error(tt, err)
+	})
+}
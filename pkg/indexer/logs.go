@@ -2,6 +2,7 @@ package indexer
 
 import (
 	"encoding/json"
+	"strings"
 
 	"github.com/m-mizutani/minerva/pkg/models"
 	"github.com/m-mizutani/rlogs"
@@ -54,3 +55,26 @@ func makeLogChannel(src models.S3Object, reader *rlogs.Reader) chan *models.LogQ
 
 	return ch
 }
+
+// decodeLogMessage converts message of q to generic JSON value to be modified regardless of log parser. UseNumber keeps large integer such as ID as it is.
+func decodeLogMessage(q *models.LogQueue) (interface{}, error) {
+	var value interface{}
+	decoder := json.NewDecoder(strings.NewReader(q.Message))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return nil, errors.Wrapf(err, "Fail to decode log message: %s", q.Tag)
+	}
+	return value, nil
+}
+
+// setLogMessage replaces both of Value and Message of q because index terms are made from Value and message record is made from Message.
+func setLogMessage(q *models.LogQueue, value interface{}) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return errors.Wrapf(err, "Fail to encode log message: %s", q.Tag)
+	}
+
+	q.Value = value
+	q.Message = string(raw)
+	return nil
+}
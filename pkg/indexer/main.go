@@ -92,8 +92,32 @@ func MakeIndex(args handler.Arguments, record events.S3EventRecord) error {
 		return errors.Wrap(err, "Failed GetObjectID")
 	}
 
+	enrichment, err := getEnricher(args.EnrichConfig)
+	if err != nil {
+		return errors.Wrap(err, "Invalid ENRICH_CONFIG")
+	}
+	redaction, err := newRedactor(args.RedactConfig)
+	if err != nil {
+		return errors.Wrap(err, "Invalid REDACT_CONFIG")
+	}
+	matcher, err := getIOCMatcher(args)
+	if err != nil {
+		return errors.Wrap(err, "Invalid IOC_CONFIG")
+	}
+	tagPartition, err := models.ParseTagPartition(args.TagPartition)
+	if err != nil {
+		return errors.Wrap(err, "Invalid TAG_PARTITION")
+	}
+	granularity, err := models.ParseDTGranularity(args.PartitionGranularity)
+	if err != nil {
+		return errors.Wrap(err, "Invalid PARTITION_GRANULARITY")
+	}
+	var detections []*models.DetectionEvent
+
 	dstBase := models.NewS3Object(args.S3Region, args.S3Bucket, args.S3Prefix)
 	recordService := args.RecordService()
+	recordService.TagPartition = tagPartition
+	recordService.DTGranularity = granularity
 
 	for q := range makeLogChannel(srcObject, args.Reader) {
 		if q.Err != nil {
@@ -101,6 +125,27 @@ func MakeIndex(args handler.Arguments, record events.S3EventRecord) error {
 			return q.Err
 		}
 
+		// Enrichment and redaction must be done before Dump because both of index terms and message are made from q.
+		// Redaction is after enrichment to be able to redact also derived fields.
+		if enrichment != nil {
+			if err := enrichment.enrich(q); err != nil {
+				return err
+			}
+		}
+		if redaction != nil {
+			if err := redaction.redact(q); err != nil {
+				return err
+			}
+		}
+		// IOC matching is after redaction not to leak redacted value by "_ioc" field
+		if matcher != nil {
+			events, err := matcher.match(q, objectID)
+			if err != nil {
+				return err
+			}
+			detections = append(detections, events...)
+		}
+
 		if err := recordService.Dump(q, objectID, &dstBase); err != nil {
 			logger.WithField("q", q).WithError(err).Error("Failed to dump logs")
 			return err
@@ -130,14 +175,17 @@ func MakeIndex(args handler.Arguments, record events.S3EventRecord) error {
 	for seq, obj := range rawObjects {
 		recordID := fmt.Sprintf("%d/%d", objectID, seq)
 
-		partQueue := models.PartitionQueue{
-			Location:  obj.PartitionPath(),
-			TableName: obj.TableName(),
-			Keys:      obj.PartitionKeys(),
-		}
-		logger.WithField("q", partQueue).Info("Partition queue")
-		if err := sqsService.SendSQS(&partQueue, args.PartitionQueueURL); err != nil {
-			return errors.Wrap(err, "Fail to send parition queue")
+		// Partition is available without DDL in partition projection mode
+		if !args.PartitionProjection {
+			partQueue := models.PartitionQueue{
+				Location:  obj.PartitionPath(),
+				TableName: obj.TableName(),
+				Keys:      obj.PartitionKeys(),
+			}
+			logger.WithField("q", partQueue).Info("Partition queue")
+			if err := sqsService.SendSQS(&partQueue, args.PartitionQueueURL); err != nil {
+				return errors.Wrap(err, "Fail to send parition queue")
+			}
 		}
 
 		composeQueue := models.ComposeQueue{
@@ -153,6 +201,11 @@ func MakeIndex(args handler.Arguments, record events.S3EventRecord) error {
 		}
 	}
 
+	// Detection events are emitted after all steps succeeded because failed MakeIndex is retried and emits same events again.
+	if matcher != nil {
+		matcher.emitOrCount(args, detections)
+	}
+
 	return nil
 }
 
@@ -169,7 +222,7 @@ func validateArguments(args handler.Arguments) error {
 	if args.MetaTableName == "" {
 		return errors.New("META_TABLE_NAME is not set")
 	}
-	if args.PartitionQueueURL == "" {
+	if args.PartitionQueueURL == "" && !args.PartitionProjection {
 		return errors.New("PARTITION_QUEUE_URL is not set")
 	}
 	if args.ComposeQueueURL == "" {
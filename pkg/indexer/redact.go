@@ -0,0 +1,236 @@
+package indexer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/m-mizutani/minerva/pkg/models"
+	"github.com/pkg/errors"
+)
+
+// Redaction actions
+const (
+	redactDrop = "drop"
+	redactHash = "hash"
+
+	redactedValue = "[REDACTED]"
+)
+
+// RedactRule specifies fields and values that must not be stored in indices and messages.
+type RedactRule struct {
+	// Tag is glob pattern of tag, e.g. "aws.*"
+	Tag string `json:"tag"`
+	// Fields are dot separated paths of field, e.g. "request.cookie". "*" matches any key of the level.
+	Fields []string `json:"fields"`
+	// Patterns are regular expressions of value, e.g. credit card number. Matched part of string value, number and key is redacted in all fields. Matched number becomes string.
+	Patterns []string `json:"patterns"`
+	// Action is "drop" (default) or "hash". Field is removed and matched part is replaced with "[REDACTED]" by "drop".
+	Action string `json:"action"`
+}
+
+// RedactConfig is configuration of redaction at ingest time. It's JSON format and given by REDACT_CONFIG.
+type RedactConfig struct {
+	Rules []RedactRule `json:"rules"`
+	// HashKey is HMAC key of "hash" action. Plain SHA256 is used if empty.
+	HashKey string `json:"hash_key"`
+}
+
+type redactRule struct {
+	tag      string
+	fields   [][]string
+	patterns []*regexp.Regexp
+	action   string
+}
+
+// redactor removes or hashes sensitive values in LogQueue before making records.
+type redactor struct {
+	rules   []*redactRule
+	hashKey []byte
+}
+
+// newRedactor parses RedactConfig JSON. nil is returned if raw is empty.
+func newRedactor(raw string) (*redactor, error) {
+	if raw == "" {
+		return nil, nil
+	}
+
+	var config RedactConfig
+	if err := json.Unmarshal([]byte(raw), &config); err != nil {
+		return nil, errors.Wrap(err, "Fail to parse redact config")
+	}
+
+	r := &redactor{hashKey: []byte(config.HashKey)}
+	for i, rule := range config.Rules {
+		if rule.Tag == "" {
+			return nil, fmt.Errorf("'tag' is required in redact rule #%d", i)
+		}
+		if _, err := path.Match(rule.Tag, ""); err != nil {
+			return nil, fmt.Errorf("Invalid tag pattern in redact rule #%d: %s", i, rule.Tag)
+		}
+
+		compiled := &redactRule{tag: rule.Tag, action: rule.Action}
+		switch rule.Action {
+		case "":
+			compiled.action = redactDrop
+		case redactDrop, redactHash:
+		default:
+			return nil, fmt.Errorf("Invalid action in redact rule #%d: %s", i, rule.Action)
+		}
+
+		for _, field := range rule.Fields {
+			compiled.fields = append(compiled.fields, strings.Split(field, "."))
+		}
+		for _, p := range rule.Patterns {
+			ptn, err := regexp.Compile(p)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Invalid pattern in redact rule #%d", i)
+			}
+			compiled.patterns = append(compiled.patterns, ptn)
+		}
+
+		r.rules = append(r.rules, compiled)
+	}
+
+	return r, nil
+}
+
+// redact modifies Value and Message of q. Value is converted to generic JSON object if any rule is applied because structure of value depends on log parser.
+func (x *redactor) redact(q *models.LogQueue) error {
+	var rules []*redactRule
+	for _, rule := range x.rules {
+		if matched, _ := path.Match(rule.tag, q.Tag); matched {
+			rules = append(rules, rule)
+		}
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+
+	value, err := decodeLogMessage(q)
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range rules {
+		for _, keys := range rule.fields {
+			x.redactPath(value, keys, rule)
+		}
+		if len(rule.patterns) > 0 {
+			value = x.redactPatterns(value, rule)
+		}
+	}
+
+	return setLogMessage(q, value)
+}
+
+func (x *redactor) redactPath(v interface{}, keys []string, rule *redactRule) {
+	switch node := v.(type) {
+	case []interface{}:
+		for _, item := range node {
+			x.redactPath(item, keys, rule)
+		}
+
+	case map[string]interface{}:
+		for k, child := range node {
+			if keys[0] != "*" && keys[0] != k {
+				continue
+			}
+			if len(keys) > 1 {
+				x.redactPath(child, keys[1:], rule)
+			} else if rule.action == redactHash {
+				node[k] = x.hashValue(child)
+			} else {
+				delete(node, k)
+			}
+		}
+	}
+}
+
+func (x *redactor) redactPatterns(v interface{}, rule *redactRule) interface{} {
+	switch node := v.(type) {
+	case []interface{}:
+		for i := range node {
+			node[i] = x.redactPatterns(node[i], rule)
+		}
+		return node
+
+	case map[string]interface{}:
+		keys := make([]string, 0, len(node))
+		for k := range node {
+			keys = append(keys, k)
+		}
+		// Sensitive value can be also in key, e.g. {"4111-2222-3333-4444": "ok"}
+		for _, k := range keys {
+			child := x.redactPatterns(node[k], rule)
+			if replaced := x.replacePatterns(k, rule); replaced != k {
+				delete(node, k)
+				k = replaced
+			}
+			node[k] = child
+		}
+		return node
+
+	case string:
+		return x.replacePatterns(node, rule)
+
+	case json.Number:
+		// Number is decoded as json.Number by UseNumber, e.g. card number without separator. It's replaced with string if matched.
+		s := node.String()
+		if replaced := x.replacePatterns(s, rule); replaced != s {
+			return replaced
+		}
+		return node
+
+	default:
+		return v
+	}
+}
+
+func (x *redactor) replacePatterns(s string, rule *redactRule) string {
+	for _, ptn := range rule.patterns {
+		s = ptn.ReplaceAllStringFunc(s, func(matched string) string {
+			if rule.action == redactHash {
+				return x.hash(matched)
+			}
+			return redactedValue
+		})
+	}
+	return s
+}
+
+func (x *redactor) hashValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		for i := range value {
+			value[i] = x.hashValue(value[i])
+		}
+		return value
+	case string:
+		return x.hash(value)
+	default:
+		// Number, boolean and object are hashed as JSON text
+		raw, _ := json.Marshal(value)
+		return x.hash(string(raw))
+	}
+}
+
+func (x *redactor) hash(s string) string {
+	var sum []byte
+	if len(x.hashKey) > 0 {
+		h := hmac.New(sha256.New, x.hashKey)
+		h.Write([]byte(s))
+		sum = h.Sum(nil)
+	} else {
+		d := sha256.Sum256([]byte(s))
+		sum = d[:]
+	}
+	return "sha256:" + hex.EncodeToString(sum)
+}
@@ -0,0 +1,138 @@
+package indexer_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/minerva/internal/transform"
+	"github.com/m-mizutani/minerva/pkg/indexer"
+	"github.com/m-mizutani/minerva/pkg/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type webLog struct {
+	User    string            `json:"user"`
+	Card    string            `json:"card"`
+	Cookies map[string]string `json:"cookies"`
+	Comment string            `json:"comment"`
+	OrderID int64             `json:"order_id"`
+}
+
+func newLogQueue(t *testing.T, tag string, v interface{}) *models.LogQueue {
+	raw, err := json.Marshal(v)
+	require.NoError(t, err)
+	return &models.LogQueue{
+		Tag:       tag,
+		Timestamp: time.Unix(1580000000, 0),
+		Message:   string(raw),
+		Value:     v,
+		Seq:       1,
+	}
+}
+
+func newWebLog() *webLog {
+	return &webLog{
+		User:    "alice",
+		Card:    "4111-2222-3333-4444",
+		Cookies: map[string]string{"session": "s3cr3t-session", "lang": "ja"},
+		Comment: "paid by 4111-2222-3333-4444 today",
+		OrderID: 9007199254740993,
+	}
+}
+
+func recordTerms(t *testing.T, q *models.LogQueue) string {
+	records, err := transform.LogToIndexRecord(q, 1)
+	require.NoError(t, err)
+	var terms []string
+	for _, r := range records {
+		terms = append(terms, r.(models.IndexRecord).Term)
+	}
+	return strings.Join(terms, " ")
+}
+
+func TestRedact(t *testing.T) {
+	t.Run("drop fields and patterns", func(tt *testing.T) {
+		config := `{"rules":[{
+			"tag":"web.*",
+			"fields":["card","cookies.session"],
+			"patterns":["\\d{4}-\\d{4}-\\d{4}-\\d{4}"]
+		}]}`
+		q := newLogQueue(tt, "web.access", newWebLog())
+		require.NoError(tt, indexer.Redact(config, q))
+
+		assert.NotContains(tt, q.Message, "4111")
+		assert.NotContains(tt, q.Message, "s3cr3t")
+		assert.Contains(tt, q.Message, `"comment":"paid by [REDACTED] today"`)
+		assert.Contains(tt, q.Message, `"lang":"ja"`)
+		assert.Contains(tt, q.Message, `"order_id":9007199254740993`)
+		assert.NotContains(tt, q.Message, `"card"`)
+
+		terms := recordTerms(tt, q)
+		assert.Contains(tt, terms, "alice")
+		assert.NotContains(tt, terms, "4111")
+		assert.NotContains(tt, terms, "s3cr3t")
+		assert.Contains(tt, terms, "9007199254740993")
+
+		records, err := transform.LogToMessageRecord(q, 1)
+		require.NoError(tt, err)
+		assert.NotContains(tt, records[0].(models.MessageRecord).Message, "4111")
+	})
+
+	t.Run("hash fields and patterns", func(tt *testing.T) {
+		config := `{"rules":[{
+			"tag":"web.*",
+			"fields":["cookies.*"],
+			"patterns":["\\d{4}-\\d{4}-\\d{4}-\\d{4}"],
+			"action":"hash"
+		}],"hash_key":"k"}`
+		q1 := newLogQueue(tt, "web.access", newWebLog())
+		q2 := newLogQueue(tt, "web.access", newWebLog())
+		require.NoError(tt, indexer.Redact(config, q1))
+		require.NoError(tt, indexer.Redact(config, q2))
+
+		assert.NotContains(tt, q1.Message, "4111")
+		assert.NotContains(tt, q1.Message, "s3cr3t")
+		assert.NotContains(tt, q1.Message, `"ja"`)
+		assert.Equal(tt, q1.Message, q2.Message, "Same value must be same hash")
+
+		v := q1.Value.(map[string]interface{})
+		assert.True(tt, strings.HasPrefix(v["card"].(string), "sha256:"))
+		assert.Equal(tt, "alice", v["user"])
+	})
+
+	t.Run("numeric value and key", func(tt *testing.T) {
+		config := `{"rules":[{"tag":"web.*","patterns":["\\d{16}"]}]}`
+		q := newLogQueue(tt, "web.access", map[string]interface{}{
+			"pan":      4111222233334444,
+			"amount":   1200,
+			"receipts": map[string]interface{}{"4111222233335555": "ok"},
+		})
+		require.NoError(tt, indexer.Redact(config, q))
+
+		assert.NotContains(tt, q.Message, "4111")
+		assert.Contains(tt, q.Message, `"pan":"[REDACTED]"`)
+		assert.Contains(tt, q.Message, `"amount":1200`)
+		assert.Contains(tt, q.Message, `"receipts":{"[REDACTED]":"ok"}`)
+		assert.NotContains(tt, recordTerms(tt, q), "4111")
+	})
+
+	t.Run("not matched tag", func(tt *testing.T) {
+		config := `{"rules":[{"tag":"web.*","fields":["card"]}]}`
+		q := newLogQueue(tt, "app.access", newWebLog())
+		msg := q.Message
+		require.NoError(tt, indexer.Redact(config, q))
+		assert.Equal(tt, msg, q.Message)
+		assert.Contains(tt, recordTerms(tt, q), "4111")
+	})
+
+	t.Run("invalid config", func(tt *testing.T) {
+		q := newLogQueue(tt, "web.access", newWebLog())
+		assert.Error(tt, indexer.Redact(`{"rules":[{"fields":["card"]}]}`, q))
+		assert.Error(tt, indexer.Redact(`{"rules":[{"tag":"web","action":"encrypt"}]}`, q))
+		assert.Error(tt, indexer.Redact(`{"rules":[{"tag":"web","patterns":["("]}]}`, q))
+		assert.Error(tt, indexer.Redact(`{"rules":`, q))
+	})
+}
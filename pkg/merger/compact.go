@@ -0,0 +1,812 @@
+package merger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/glue"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/google/uuid"
+	"github.com/m-mizutani/minerva/internal/adaptor"
+	"github.com/m-mizutani/minerva/internal/service"
+	"github.com/m-mizutani/minerva/pkg/models"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+const (
+	defaultSmallObjectSize   = 32 * 1024 * 1024  // 32MB
+	defaultCompactTargetSize = 256 * 1024 * 1024 // 256MB
+
+	// Athena ignores files that start with "_", then manifest in staging location is not searched
+	compactionManifestName = "_compaction.json"
+	compactionReadBatch    = 512
+)
+
+var compactionSchemaMap = map[string]models.ParquetSchemaName{
+	string(models.AthenaTableIndex): models.ParquetSchemaIndex,
+	models.AthenaTableMessage:       models.ParquetSchemaMessage,
+}
+
+// Compactor re-merges small merged objects in each partition into larger objects. Objects are switched via partition location in Glue Data Catalog to avoid that search sees both (duplicates) or neither (gaps) of small and compacted objects:
+//  1. Put compacted objects to staging location
+//  2. List objects in original location again and copy objects other than small ones to staging location
+//  3. Switch partition location to staging location
+//  4. Put compacted objects and delete small objects and their merge manifests in original location
+//  5. Switch partition location back to original location and delete staging objects
+//
+// Objects are listed in 2 just before switching, then merged objects that are put into original location while 1 are also searched. Merged objects that are put into original location between 2 and 5 are not searched until 5, and it's usually a few seconds unless compaction is interrupted. Tables with partition projection can not be compacted because location of partition can not be switched.
+//
+// Partition is locked by MetaService.LockPartition from 1 to 4 because retention and purge also modify objects of the partition. Partition locked by them is skipped and compacted in next run.
+type Compactor struct {
+	S3       adaptor.S3Client
+	Glue     adaptor.GlueClient
+	Meta     *service.MetaService
+	Bucket   string
+	Prefix   string
+	Database string
+	// Tables is target Athena tables. Default is indices and messages.
+	Tables []string
+	// SmallObjectSize is threshold of merged object to be compacted. Default is 32MB.
+	SmallObjectSize int64
+	// TargetSize is max total size of source objects for one compacted object. Default is 256MB.
+	TargetSize int64
+	// SortRecords sorts records of compacted objects as MergeOptions.SortRecords.
+	SortRecords bool
+	// Parquet is writer settings of compacted objects. nil means default.
+	Parquet *ParquetConfig
+	// DryRun only returns planned compactions.
+	DryRun bool
+}
+
+// Compaction is result of compaction of a partition. It's also saved in staging location as manifest to resume when compaction is interrupted.
+type Compaction struct {
+	Table    string   `json:"table"`
+	Values   []string `json:"values"`
+	Location string   `json:"location"`
+	Staging  string   `json:"staging"`
+	// Sources are S3 keys of compacted objects
+	Sources []string `json:"sources"`
+	// Outputs are file names of compacted objects in both of staging and original location
+	Outputs []string `json:"outputs"`
+	// Manifests are file names of merge manifests of compacted objects. Compacted object has no manifest if a source has no manifest, e.g. merged before merge manifest was introduced.
+	Manifests []string `json:"manifests,omitempty"`
+	Rows      int64    `json:"rows"`
+
+	partition *glue.Partition
+}
+
+// Compact compacts partitions that have "dt" between begin and end. Partition that is switched to staging location by interrupted compaction is finished regardless of begin and end.
+func (x *Compactor) Compact(begin, end time.Time) ([]*Compaction, error) {
+	tables := x.Tables
+	if len(tables) == 0 {
+		tables = []string{string(models.AthenaTableIndex), models.AthenaTableMessage}
+	}
+
+	owner := "compaction:" + uuid.New().String()
+	var results []*Compaction
+	for _, table := range tables {
+		schema, ok := compactionSchemaMap[table]
+		if !ok {
+			return nil, fmt.Errorf("Unsupported table for compaction: %s", table)
+		}
+
+		dtIndex, err := x.dtIndex(table)
+		if err != nil {
+			return nil, err
+		}
+
+		partitions, err := x.getPartitions(table)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, p := range partitions {
+			location := aws.StringValue(p.StorageDescriptor.Location)
+			if strings.HasPrefix(location, x.stagingRoot()) {
+				c, err := x.resume(table, p, owner)
+				if err != nil {
+					return nil, err
+				}
+				if c != nil {
+					results = append(results, c)
+				}
+				continue
+			}
+
+			values := aws.StringValueSlice(p.Values)
+			if len(values) <= dtIndex {
+				continue
+			}
+			from, to, ok := models.DTSpan(values[dtIndex])
+			if !ok || from.Before(begin) || to.After(end) {
+				continue
+			}
+
+			c, err := x.compactPartition(table, schema, p, owner)
+			if err != nil {
+				return nil, err
+			}
+			if c != nil {
+				results = append(results, c)
+			}
+		}
+	}
+
+	return results, nil
+}
+
+func (x *Compactor) smallObjectSize() int64 {
+	if x.SmallObjectSize > 0 {
+		return x.SmallObjectSize
+	}
+	return defaultSmallObjectSize
+}
+
+func (x *Compactor) targetSize() int64 {
+	if x.TargetSize > 0 {
+		return x.TargetSize
+	}
+	return defaultCompactTargetSize
+}
+
+func (x *Compactor) stagingRoot() string {
+	return fmt.Sprintf("s3://%s/%s%s", x.Bucket, x.Prefix, models.CompactionStagingDir)
+}
+
+// keyOf converts S3 URL of location to S3 key prefix
+func (x *Compactor) keyOf(location string) (string, error) {
+	key := strings.TrimPrefix(location, fmt.Sprintf("s3://%s/", x.Bucket))
+	if key == location || key == "" {
+		return "", fmt.Errorf("Location is not in bucket %s: %s", x.Bucket, location)
+	}
+	if !strings.HasSuffix(key, "/") {
+		key += "/"
+	}
+	return key, nil
+}
+
+// dtIndex returns index of "dt" in partition keys of the table
+func (x *Compactor) dtIndex(table string) (int, error) {
+	output, err := x.Glue.GetTable(&glue.GetTableInput{
+		DatabaseName: aws.String(x.Database),
+		Name:         aws.String(table),
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "Fail to get table: %s.%s", x.Database, table)
+	}
+
+	for i, key := range output.Table.PartitionKeys {
+		if aws.StringValue(key.Name) == "dt" {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("Table %s.%s has no dt partition key", x.Database, table)
+}
+
+// lock acquires or extends lock of the partition. It returns false if other job has the lock.
+func (x *Compactor) lock(location, owner string) (bool, error) {
+	locked, err := x.Meta.LockPartition(location, owner)
+	if err != nil {
+		return false, err
+	}
+	if !locked {
+		logger.WithField("location", location).Warn("Partition is locked by other job, skip compaction")
+	}
+	return locked, nil
+}
+
+func (x *Compactor) unlock(location, owner string) {
+	if err := x.Meta.UnlockPartition(location, owner); err != nil {
+		logger.WithError(err).WithField("location", location).Error("Fail to unlock partition")
+	}
+}
+
+func (x *Compactor) getPartitions(table string) ([]*glue.Partition, error) {
+	var partitions []*glue.Partition
+	input := &glue.GetPartitionsInput{
+		DatabaseName: aws.String(x.Database),
+		TableName:    aws.String(table),
+	}
+
+	for {
+		output, err := x.Glue.GetPartitions(input)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Fail to get partitions: %s.%s", x.Database, table)
+		}
+		for _, p := range output.Partitions {
+			if len(p.Values) > 0 && p.StorageDescriptor != nil {
+				partitions = append(partitions, p)
+			}
+		}
+
+		if output.NextToken == nil {
+			break
+		}
+		input.NextToken = output.NextToken
+	}
+
+	return partitions, nil
+}
+
+// planGroups splits small merged objects into groups of TargetSize. Group that has only one object is not compacted.
+func (x *Compactor) planGroups(objects []*s3.Object) [][]*s3.Object {
+	var small []*s3.Object
+	for _, obj := range objects {
+		name := path.Base(aws.StringValue(obj.Key))
+		if matched, _ := path.Match("merged-*.parquet", name); !matched {
+			continue
+		}
+		if aws.Int64Value(obj.Size) < x.smallObjectSize() {
+			small = append(small, obj)
+		}
+	}
+	sort.Slice(small, func(i, j int) bool {
+		return aws.StringValue(small[i].Key) < aws.StringValue(small[j].Key)
+	})
+
+	var groups [][]*s3.Object
+	var current []*s3.Object
+	var size int64
+	for _, obj := range small {
+		if len(current) > 0 && size+aws.Int64Value(obj.Size) > x.targetSize() {
+			groups = append(groups, current)
+			current, size = nil, 0
+		}
+		current = append(current, obj)
+		size += aws.Int64Value(obj.Size)
+	}
+	groups = append(groups, current)
+
+	var results [][]*s3.Object
+	for _, g := range groups {
+		if len(g) > 1 {
+			results = append(results, g)
+		}
+	}
+	return results
+}
+
+func (x *Compactor) compactPartition(table string, schema models.ParquetSchemaName, p *glue.Partition, owner string) (*Compaction, error) {
+	location := aws.StringValue(p.StorageDescriptor.Location)
+	prefix, err := x.keyOf(location)
+	if err != nil {
+		return nil, err
+	}
+
+	objects, err := x.listObjects(prefix)
+	if err != nil {
+		return nil, err
+	}
+	groups := x.planGroups(objects)
+	if len(groups) == 0 {
+		return nil, nil
+	}
+
+	// Partition is locked only if it has objects to be compacted to reduce writes to meta table
+	if !x.DryRun {
+		if locked, err := x.lock(location, owner); err != nil || !locked {
+			return nil, err
+		}
+		defer x.unlock(location, owner)
+
+		// Objects may be changed by other job before the lock
+		if objects, err = x.listObjects(prefix); err != nil {
+			return nil, err
+		}
+		if groups = x.planGroups(objects); len(groups) == 0 {
+			return nil, nil
+		}
+	}
+
+	c := &Compaction{
+		Table:     table,
+		Values:    aws.StringValueSlice(p.Values),
+		Location:  location,
+		Staging:   x.stagingRoot() + uuid.New().String() + "/" + strings.TrimPrefix(prefix, x.Prefix),
+		partition: p,
+	}
+	for _, g := range groups {
+		for _, obj := range g {
+			c.Sources = append(c.Sources, aws.StringValue(obj.Key))
+		}
+	}
+
+	logger.WithFields(logrus.Fields{
+		"location": location,
+		"sources":  len(c.Sources),
+		"outputs":  len(groups),
+		"dryrun":   x.DryRun,
+	}).Info("Compact partition")
+
+	if x.DryRun {
+		return c, nil
+	}
+
+	stagingKey, err := x.keyOf(c.Staging)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := x.stage(c, schema, groups, stagingKey); err != nil {
+		// Partition location is not switched yet, then staging objects can be removed safely
+		if e := x.deleteAll(stagingKey); e != nil {
+			logger.WithError(e).WithField("staging", c.Staging).Error("Fail to clean up staging objects")
+		}
+		return nil, err
+	}
+
+	// Extend the lock because staging can take long time
+	if locked, err := x.lock(location, owner); err != nil || !locked {
+		if e := x.deleteAll(stagingKey); e != nil {
+			logger.WithError(e).WithField("staging", c.Staging).Error("Fail to clean up staging objects")
+		}
+		if err == nil {
+			err = fmt.Errorf("Lock of partition is taken by other job while staging: %s", location)
+		}
+		return nil, err
+	}
+
+	// Objects can be put into original location while staging, e.g. by merger
+	if err := x.copyOthers(c, stagingKey); err != nil {
+		if e := x.deleteAll(stagingKey); e != nil {
+			logger.WithError(e).WithField("staging", c.Staging).Error("Fail to clean up staging objects")
+		}
+		return nil, err
+	}
+
+	if err := x.switchLocation(c, c.Staging); err != nil {
+		return nil, err
+	}
+
+	if err := x.finish(c); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// stage puts compacted objects and manifest to staging location
+func (x *Compactor) stage(c *Compaction, schema models.ParquetSchemaName, groups [][]*s3.Object, stagingKey string) error {
+	prefix, err := x.keyOf(c.Location)
+	if err != nil {
+		return err
+	}
+
+	for _, g := range groups {
+		var keys []string
+		for _, obj := range g {
+			keys = append(keys, aws.StringValue(obj.Key))
+		}
+
+		filePath, rows, err := x.mergeObjects(keys, schema)
+		if err != nil {
+			return err
+		}
+
+		name := fmt.Sprintf("merged-%s.parquet", uuid.New().String())
+		err = x.putFile(filePath, stagingKey+name)
+		os.Remove(filePath)
+		if err != nil {
+			return err
+		}
+
+		c.Outputs = append(c.Outputs, name)
+		c.Rows += rows
+
+		manifest, err := x.compactManifest(keys, prefix+name, schema, rows)
+		if err != nil {
+			return err
+		}
+		if manifest != nil {
+			manifestName := path.Base(models.BuildMergeManifestKey(name))
+			if err := x.putManifest(manifest, stagingKey+manifestName); err != nil {
+				return err
+			}
+			c.Manifests = append(c.Manifests, manifestName)
+		}
+	}
+
+	raw, err := json.Marshal(c)
+	if err != nil {
+		return errors.Wrap(err, "Fail to marshal compaction manifest")
+	}
+	if _, err := x.S3.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(x.Bucket),
+		Key:    aws.String(stagingKey + compactionManifestName),
+		Body:   bytes.NewReader(raw),
+	}); err != nil {
+		return errors.Wrapf(err, "Fail to put compaction manifest: %s", c.Staging)
+	}
+
+	return nil
+}
+
+// copyOthers copies objects in original location except sources and their merge manifests to staging location
+func (x *Compactor) copyOthers(c *Compaction, stagingKey string) error {
+	prefix, err := x.keyOf(c.Location)
+	if err != nil {
+		return err
+	}
+	objects, err := x.listObjects(prefix)
+	if err != nil {
+		return err
+	}
+
+	sources := c.sourceSet()
+	svc := x.s3Service()
+	for _, obj := range objects {
+		key := aws.StringValue(obj.Key)
+		if sources[key] {
+			continue
+		}
+		if err := svc.CopyS3Object(x.object(key), x.object(stagingKey+path.Base(key))); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sourceSet returns set of S3 keys of sources and their merge manifests
+func (x *Compaction) sourceSet() map[string]bool {
+	sources := map[string]bool{}
+	for _, key := range x.Sources {
+		sources[key] = true
+		sources[models.BuildMergeManifestKey(key)] = true
+	}
+	return sources
+}
+
+// finish replaces objects in original location and switches partition location back. It's idempotent to resume interrupted compaction.
+func (x *Compactor) finish(c *Compaction) error {
+	prefix, err := x.keyOf(c.Location)
+	if err != nil {
+		return err
+	}
+	stagingKey, err := x.keyOf(c.Staging)
+	if err != nil {
+		return err
+	}
+
+	svc := x.s3Service()
+	for _, name := range append(c.Outputs, c.Manifests...) {
+		if err := svc.CopyS3Object(x.object(stagingKey+name), x.object(prefix+name)); err != nil {
+			return err
+		}
+	}
+
+	objects, err := x.listObjects(prefix)
+	if err != nil {
+		return err
+	}
+	// Merge manifests of sources are deleted after sources. Sources of them are in manifest of compacted object if all sources have manifest.
+	sources := c.sourceSet()
+	var remains, manifests []string
+	for _, obj := range objects {
+		key := aws.StringValue(obj.Key)
+		if !sources[key] {
+			continue
+		}
+		if strings.HasSuffix(key, ".manifest.json") {
+			manifests = append(manifests, key)
+		} else {
+			remains = append(remains, key)
+		}
+	}
+	if err := svc.DeleteS3Keys("", x.Bucket, remains); err != nil {
+		return err
+	}
+	if err := svc.DeleteS3Keys("", x.Bucket, manifests); err != nil {
+		return err
+	}
+
+	if err := x.switchLocation(c, c.Location); err != nil {
+		return err
+	}
+
+	return x.deleteAll(stagingKey)
+}
+
+// resume finishes compaction of partition that has staging location. It returns nil if the partition is locked by other job.
+func (x *Compactor) resume(table string, p *glue.Partition, owner string) (*Compaction, error) {
+	location := aws.StringValue(p.StorageDescriptor.Location)
+	stagingKey, err := x.keyOf(location)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := x.S3.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(x.Bucket),
+		Key:    aws.String(stagingKey + compactionManifestName),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to get compaction manifest: %s", location)
+	}
+	defer resp.Body.Close()
+
+	var c Compaction
+	if err := json.NewDecoder(resp.Body).Decode(&c); err != nil {
+		return nil, errors.Wrapf(err, "Fail to decode compaction manifest: %s", location)
+	}
+	c.partition = p
+
+	logger.WithFields(logrus.Fields{
+		"location": c.Location,
+		"staging":  c.Staging,
+		"dryrun":   x.DryRun,
+	}).Warn("Resume interrupted compaction")
+
+	if x.DryRun {
+		return &c, nil
+	}
+
+	if locked, err := x.lock(c.Location, owner); err != nil || !locked {
+		return nil, err
+	}
+	defer x.unlock(c.Location, owner)
+
+	if err := x.finish(&c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (x *Compactor) switchLocation(c *Compaction, location string) error {
+	sd := *c.partition.StorageDescriptor
+	sd.Location = aws.String(location)
+
+	if _, err := x.Glue.UpdatePartition(&glue.UpdatePartitionInput{
+		DatabaseName:       aws.String(x.Database),
+		TableName:          aws.String(c.Table),
+		PartitionValueList: aws.StringSlice(c.Values),
+		PartitionInput: &glue.PartitionInput{
+			Values:            aws.StringSlice(c.Values),
+			Parameters:        c.partition.Parameters,
+			StorageDescriptor: &sd,
+		},
+	}); err != nil {
+		return errors.Wrapf(err, "Fail to switch partition location to %s", location)
+	}
+
+	c.partition.StorageDescriptor = &sd
+	return nil
+}
+
+// mergeObjects loads rows of merged objects and dumps them to one local parquet file by dumpParquet as same as MergeChunk. Number of rows is verified.
+func (x *Compactor) mergeObjects(keys []string, schema models.ParquetSchemaName) (string, int64, error) {
+	var sorter *recordSorter
+	if x.SortRecords {
+		s, err := newRecordSorter(schema, 0)
+		if err != nil {
+			return "", 0, err
+		}
+		sorter = s
+		defer sorter.close()
+	}
+
+	ch := make(chan *models.RecordQueue, 4)
+	var rows int64
+
+	go func() {
+		defer close(ch)
+		for _, key := range keys {
+			n, err := x.loadParquet(key, schema, ch)
+			if err != nil {
+				ch <- &models.RecordQueue{Err: err}
+				return
+			}
+			rows += n
+		}
+	}()
+
+	filePath, err := dumpParquet(ch, schema, sorter, x.Parquet)
+	if err != nil {
+		go func() {
+			for range ch {
+			}
+		}()
+		return "", 0, err
+	}
+
+	written, err := countParquetRows(*filePath, schema)
+	if err != nil {
+		os.Remove(*filePath)
+		return "", 0, err
+	}
+	if written != rows {
+		os.Remove(*filePath)
+		return "", 0, fmt.Errorf("Number of compacted rows %d does not match with source rows %d", written, rows)
+	}
+
+	return *filePath, rows, nil
+}
+
+func readRecords(pr *reader.ParquetReader, schema models.ParquetSchemaName, n int) ([]models.Record, error) {
+	var records []models.Record
+	switch schema {
+	case models.ParquetSchemaIndex:
+		rows := make([]models.IndexRecord, n)
+		if err := pr.Read(&rows); err != nil {
+			return nil, err
+		}
+		for i := range rows {
+			records = append(records, &rows[i])
+		}
+	case models.ParquetSchemaMessage:
+		rows := make([]models.MessageRecord, n)
+		if err := pr.Read(&rows); err != nil {
+			return nil, err
+		}
+		for i := range rows {
+			records = append(records, &rows[i])
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported schema: %s", schema)
+	}
+	return records, nil
+}
+
+func (x *Compactor) loadParquet(key string, schema models.ParquetSchemaName, ch chan *models.RecordQueue) (int64, error) {
+	downloaded, err := x.s3Service().DownloadS3Object(x.object(key))
+	if err != nil {
+		return 0, err
+	}
+	if downloaded == nil {
+		return 0, fmt.Errorf("Merged object is not found: s3://%s/%s", x.Bucket, key)
+	}
+	filePath := *downloaded
+	defer os.Remove(filePath)
+
+	fr, err := local.NewLocalFileReader(filePath)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Fail to open parquet file: %s", key)
+	}
+	defer fr.Close()
+
+	pr, err := reader.NewParquetReader(fr, newRecordMap[schema](), 1)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Fail to create parquet reader: %s", key)
+	}
+	defer pr.ReadStop()
+
+	num := pr.GetNumRows()
+	for i := int64(0); i < num; i += compactionReadBatch {
+		n := compactionReadBatch
+		if num-i < int64(n) {
+			n = int(num - i)
+		}
+
+		records, err := readRecords(pr, schema, n)
+		if err != nil {
+			return 0, errors.Wrapf(err, "Fail to read parquet rows: %s", key)
+		}
+		ch <- &models.RecordQueue{Records: records}
+	}
+
+	return num, nil
+}
+
+func countParquetRows(filePath string, schema models.ParquetSchemaName) (int64, error) {
+	fr, err := local.NewLocalFileReader(filePath)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Fail to open parquet file: %s", filePath)
+	}
+	defer fr.Close()
+
+	pr, err := reader.NewParquetReader(fr, newRecordMap[schema](), 1)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Fail to create parquet reader: %s", filePath)
+	}
+	defer pr.ReadStop()
+
+	return pr.GetNumRows(), nil
+}
+
+func (x *Compactor) putFile(filePath, key string) error {
+	fd, err := os.Open(filePath)
+	if err != nil {
+		return errors.Wrapf(err, "Fail to open compacted parquet file: %s", filePath)
+	}
+	defer fd.Close()
+
+	if _, err := x.S3.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(x.Bucket),
+		Key:    aws.String(key),
+		Body:   fd,
+	}); err != nil {
+		return errors.Wrapf(err, "Fail to put compacted object: s3://%s/%s", x.Bucket, key)
+	}
+	return nil
+}
+
+// compactManifest creates merge manifest of compacted object from manifests of source objects. It returns nil if a source has no manifest because sources of the compacted object can not be known.
+func (x *Compactor) compactManifest(keys []string, dst string, schema models.ParquetSchemaName, rows int64) (*models.MergeManifest, error) {
+	manifest := &models.MergeManifest{
+		Schema:   schema,
+		Rows:     rows,
+		MergedAt: time.Now().UTC(),
+	}
+
+	for _, key := range keys {
+		manifestKey := models.BuildMergeManifestKey(key)
+		output, err := x.S3.GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(x.Bucket),
+			Key:    aws.String(manifestKey),
+		})
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+				logger.WithField("key", key).Debug("Source has no merge manifest, compacted object has no manifest")
+				return nil, nil
+			}
+			return nil, errors.Wrapf(err, "Fail to get merge manifest: s3://%s/%s", x.Bucket, manifestKey)
+		}
+		raw, err := ioutil.ReadAll(output.Body)
+		output.Body.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "Fail to read merge manifest: s3://%s/%s", x.Bucket, manifestKey)
+		}
+
+		var src models.MergeManifest
+		if err := json.Unmarshal(raw, &src); err != nil {
+			return nil, errors.Wrapf(err, "Fail to parse merge manifest: s3://%s/%s", x.Bucket, manifestKey)
+		}
+		manifest.Object = models.NewS3Object(src.Object.Region, x.Bucket, dst)
+		manifest.Sources = append(manifest.Sources, src.Sources...)
+	}
+
+	return manifest, nil
+}
+
+func (x *Compactor) putManifest(manifest *models.MergeManifest, key string) error {
+	raw, err := json.Marshal(manifest)
+	if err != nil {
+		return errors.Wrap(err, "Fail to marshal merge manifest")
+	}
+	if _, err := x.S3.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(x.Bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(raw),
+	}); err != nil {
+		return errors.Wrapf(err, "Fail to put merge manifest: s3://%s/%s", x.Bucket, key)
+	}
+	return nil
+}
+
+func (x *Compactor) s3Service() *service.S3Service {
+	return service.NewS3ServiceWithClient(x.S3)
+}
+
+func (x *Compactor) object(key string) models.S3Object {
+	return models.NewS3Object("", x.Bucket, key)
+}
+
+// listObjects returns objects directly under prefix
+func (x *Compactor) listObjects(prefix string) ([]*s3.Object, error) {
+	return x.s3Service().ListS3Objects(x.object(prefix), true)
+}
+
+// deleteAll deletes all objects in staging location
+func (x *Compactor) deleteAll(prefix string) error {
+	objects, err := x.listObjects(prefix)
+	if err != nil {
+		return err
+	}
+
+	var keys []string
+	for _, obj := range objects {
+		keys = append(keys, aws.StringValue(obj.Key))
+	}
+	return x.s3Service().DeleteS3Keys("", x.Bucket, keys)
+}
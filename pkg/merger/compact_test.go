@@ -0,0 +1,404 @@
+package merger_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/glue"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/google/uuid"
+	"github.com/m-mizutani/minerva/internal/adaptor"
+	"github.com/m-mizutani/minerva/internal/mock"
+	"github.com/m-mizutani/minerva/internal/service"
+	"github.com/m-mizutani/minerva/internal/util"
+	"github.com/m-mizutani/minerva/pkg/merger"
+	"github.com/m-mizutani/minerva/pkg/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+const compactDir = "prefix/indices/dt=2020-01-02-03/"
+
+func location(bucket, dir string) string {
+	return "s3://" + bucket + "/" + dir
+}
+
+// newCompactor creates bucket that has 3 small merged objects and a large one in compactDir, and returns Compactor of the bucket with Glue catalog mock.
+func newCompactor(t *testing.T, client *mock.FaultS3Client) *merger.Compactor {
+	bucket := "compact-" + uuid.New().String()
+	catalog := mock.NewGlueCatalog()
+	catalog.PutTable("db", "indices", "s3://"+bucket+"/prefix/indices/", "dt")
+	catalog.PutPartition("db", "indices", location(bucket, compactDir), "2020-01-02-03")
+
+	var seq int32
+	newRecords := func(n int) []interface{} {
+		var records []interface{}
+		for i := 0; i < n; i++ {
+			seq++
+			records = append(records, &models.IndexRecord{
+				Tag: "app", Timestamp: 100, Field: "f", Term: fmt.Sprintf("term-%d", seq), ObjectID: 1, Seq: seq,
+			})
+		}
+		return records
+	}
+
+	for name, n := range map[string]int{"a": 2, "b": 3, "c": 1, "large": 2000} {
+		require.NoError(t, mock.PutParquet(client.S3Client, bucket, compactDir+"merged-"+name+".parquet", new(models.IndexRecord), newRecords(n)...))
+	}
+
+	var small int64
+	sizes := objectSizes(t, client, bucket, compactDir)
+	for _, name := range []string{"merged-a.parquet", "merged-b.parquet", "merged-c.parquet"} {
+		if sizes[name] > small {
+			small = sizes[name]
+		}
+	}
+	require.True(t, sizes["merged-large.parquet"] > small+1)
+
+	return &merger.Compactor{
+		S3:              client,
+		Glue:            catalog,
+		Meta:            service.NewMetaService(mock.NewMetaRepository(), util.NewExpRetryTimer),
+		Bucket:          bucket,
+		Prefix:          "prefix/",
+		Database:        "db",
+		Tables:          []string{"indices"},
+		SmallObjectSize: small + 1,
+	}
+}
+
+// putMergeManifest puts manifest of merged-<name>.parquet that has raw/<name>.log.gz as source
+func putMergeManifest(t *testing.T, client adaptor.S3Client, bucket, name string) {
+	raw, err := json.Marshal(&models.MergeManifest{
+		Object: models.NewS3Object("ap-northeast-1", bucket, compactDir+"merged-"+name+".parquet"),
+		Schema: models.ParquetSchemaIndex,
+		Sources: []*models.MergeManifestEntry{
+			{Object: models.NewS3Object("ap-northeast-1", bucket, "raw/"+name+".log.gz"), Records: 1},
+		},
+	})
+	require.NoError(t, err)
+	_, err = client.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(models.BuildMergeManifestKey(compactDir + "merged-" + name + ".parquet")),
+		Body:   bytes.NewReader(raw),
+	})
+	require.NoError(t, err)
+}
+
+// objectSizes returns size of objects directly under dir by file name
+func objectSizes(t *testing.T, client adaptor.S3Client, bucket, dir string) map[string]int64 {
+	output, err := client.ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket:    aws.String(bucket),
+		Prefix:    aws.String(dir),
+		Delimiter: aws.String("/"),
+	})
+	require.NoError(t, err)
+
+	sizes := map[string]int64{}
+	for _, obj := range output.Contents {
+		sizes[path.Base(aws.StringValue(obj.Key))] = aws.Int64Value(obj.Size)
+	}
+	return sizes
+}
+
+// visibleTerms returns terms of all rows in location like Athena, files starting with "_" are ignored.
+func visibleTerms(t *testing.T, client adaptor.S3Client, bucket, location string) []string {
+	dir := strings.TrimPrefix(location, "s3://"+bucket+"/")
+	var terms []string
+	for name := range objectSizes(t, client, bucket, dir) {
+		if strings.HasPrefix(name, "_") {
+			continue
+		}
+
+		output, err := client.GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(dir + name),
+		})
+		require.NoError(t, err)
+		raw, err := ioutil.ReadAll(output.Body)
+		require.NoError(t, err)
+
+		fd, err := ioutil.TempFile("", "*.parquet")
+		require.NoError(t, err)
+		_, err = fd.Write(raw)
+		require.NoError(t, err)
+		fd.Close()
+
+		fr, err := local.NewLocalFileReader(fd.Name())
+		require.NoError(t, err)
+		pr, err := reader.NewParquetReader(fr, new(models.IndexRecord), 1)
+		require.NoError(t, err)
+		rows := make([]models.IndexRecord, pr.GetNumRows())
+		require.NoError(t, pr.Read(&rows))
+		pr.ReadStop()
+		fr.Close()
+		os.Remove(fd.Name())
+
+		for _, row := range rows {
+			terms = append(terms, row.Term)
+		}
+	}
+
+	sort.Strings(terms)
+	return terms
+}
+
+func partitionLocation(compactor *merger.Compactor) string {
+	catalog := compactor.Glue.(*mock.GlueCatalog)
+	return aws.StringValue(catalog.Partition("db", "indices", "2020-01-02-03").StorageDescriptor.Location)
+}
+
+func TestCompact(t *testing.T) {
+	begin := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC)
+
+	t.Run("compact small objects without duplicates or gaps", func(tt *testing.T) {
+		client := mock.NewFaultS3Client("ap-northeast-1", nil)
+		compactor := newCompactor(tt, client)
+		bucket := compactor.Bucket
+		expected := visibleTerms(tt, client, bucket, location(bucket, compactDir))
+		require.Equal(tt, 2006, len(expected))
+
+		var switched []string
+		compactor.Glue.(*mock.GlueCatalog).OnUpdatePartition = func(input *glue.UpdatePartitionInput) {
+			location := aws.StringValue(input.PartitionInput.StorageDescriptor.Location)
+			switched = append(switched, location)
+			assert.Equal(tt, expected, visibleTerms(tt, client, bucket, location))
+		}
+
+		results, err := compactor.Compact(begin, end)
+		require.NoError(tt, err)
+		require.Equal(tt, 1, len(results))
+		assert.Equal(tt, int64(6), results[0].Rows)
+		assert.Equal(tt, 3, len(results[0].Sources))
+		require.Equal(tt, 1, len(results[0].Outputs))
+
+		require.Equal(tt, 2, len(switched))
+		assert.True(tt, strings.HasPrefix(switched[0], "s3://"+bucket+"/prefix/compaction/"))
+		assert.Equal(tt, location(bucket, compactDir), switched[1])
+		assert.Equal(tt, location(bucket, compactDir), partitionLocation(compactor))
+
+		sizes := objectSizes(tt, client, bucket, compactDir)
+		assert.Equal(tt, 2, len(sizes))
+		assert.Contains(tt, sizes, "merged-large.parquet")
+		assert.Contains(tt, sizes, results[0].Outputs[0])
+		assert.Equal(tt, expected, visibleTerms(tt, client, bucket, location(bucket, compactDir)))
+
+		// Staging objects are removed
+		assert.Empty(tt, client.Keys(bucket, strings.TrimPrefix(results[0].Staging, "s3://"+bucket+"/")))
+
+		// Nothing to do in second run
+		results, err = compactor.Compact(begin, end)
+		require.NoError(tt, err)
+		assert.Equal(tt, 0, len(results))
+
+		// Lock is released
+		locked, err := compactor.Meta.LockPartition(location(bucket, compactDir), "other")
+		require.NoError(tt, err)
+		assert.True(tt, locked)
+	})
+
+	t.Run("merged object put while staging is searched in staging location", func(tt *testing.T) {
+		client := mock.NewFaultS3Client("ap-northeast-1", nil)
+		compactor := newCompactor(tt, client)
+		bucket := compactor.Bucket
+		putMergeManifest(tt, client, bucket, "d")
+
+		// Merger puts an object when compactor puts compaction manifest, i.e. after merging sources
+		newKey := compactDir + "merged-d.parquet"
+		client.Fault = func(op, key string) error {
+			if op == "PutObject" && strings.HasSuffix(key, "/_compaction.json") {
+				require.NoError(tt, mock.PutParquet(client.S3Client, bucket, newKey, new(models.IndexRecord),
+					&models.IndexRecord{Tag: "app", Timestamp: 100, Field: "f", Term: "new-term", ObjectID: 2, Seq: 1},
+				))
+			}
+			return nil
+		}
+
+		compactor.Glue.(*mock.GlueCatalog).OnUpdatePartition = func(input *glue.UpdatePartitionInput) {
+			location := aws.StringValue(input.PartitionInput.StorageDescriptor.Location)
+			assert.Contains(tt, visibleTerms(tt, client, bucket, location), "new-term")
+		}
+
+		results, err := compactor.Compact(begin, end)
+		require.NoError(tt, err)
+		require.Equal(tt, 1, len(results))
+		assert.NotContains(tt, results[0].Sources, newKey)
+		assert.Contains(tt, objectSizes(tt, client, bucket, compactDir), "merged-d.parquet")
+		assert.Contains(tt, objectSizes(tt, client, bucket, compactDir), "_merged-d.manifest.json")
+		assert.Equal(tt, 2007, len(visibleTerms(tt, client, bucket, location(bucket, compactDir))))
+	})
+
+	t.Run("compacted object has merge manifest of all sources", func(tt *testing.T) {
+		client := mock.NewFaultS3Client("ap-northeast-1", nil)
+		compactor := newCompactor(tt, client)
+		bucket := compactor.Bucket
+		for _, name := range []string{"a", "b", "c", "large"} {
+			putMergeManifest(tt, client, bucket, name)
+		}
+
+		var staged map[string]int64
+		compactor.Glue.(*mock.GlueCatalog).OnUpdatePartition = func(input *glue.UpdatePartitionInput) {
+			if staged == nil {
+				location := aws.StringValue(input.PartitionInput.StorageDescriptor.Location)
+				staged = objectSizes(tt, client, bucket, strings.TrimPrefix(location, "s3://"+bucket+"/"))
+			}
+		}
+
+		results, err := compactor.Compact(begin, end)
+		require.NoError(tt, err)
+		require.Equal(tt, 1, len(results))
+		require.Equal(tt, 1, len(results[0].Manifests))
+
+		output, err := client.GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(compactDir + results[0].Manifests[0]),
+		})
+		require.NoError(tt, err)
+		var manifest models.MergeManifest
+		require.NoError(tt, json.NewDecoder(output.Body).Decode(&manifest))
+		assert.Equal(tt, compactDir+results[0].Outputs[0], manifest.Object.Key)
+		assert.Equal(tt, int64(6), manifest.Rows)
+		var sources []string
+		for _, src := range manifest.Sources {
+			sources = append(sources, src.Object.Key)
+		}
+		assert.Equal(tt, []string{"raw/a.log.gz", "raw/b.log.gz", "raw/c.log.gz"}, sources)
+
+		// Manifests of compacted sources are deleted and not copied to staging location, but other manifest is kept
+		sizes := objectSizes(tt, client, bucket, compactDir)
+		assert.NotContains(tt, sizes, "_merged-a.manifest.json")
+		assert.Contains(tt, sizes, "_merged-large.manifest.json")
+		assert.Equal(tt, 4, len(sizes))
+		assert.NotContains(tt, staged, "_merged-a.manifest.json")
+		assert.Contains(tt, staged, "_merged-large.manifest.json")
+	})
+
+	t.Run("no merge manifest if a source has no manifest", func(tt *testing.T) {
+		client := mock.NewFaultS3Client("ap-northeast-1", nil)
+		compactor := newCompactor(tt, client)
+		bucket := compactor.Bucket
+		putMergeManifest(tt, client, bucket, "a")
+		putMergeManifest(tt, client, bucket, "b")
+
+		results, err := compactor.Compact(begin, end)
+		require.NoError(tt, err)
+		require.Equal(tt, 1, len(results))
+		assert.Equal(tt, 0, len(results[0].Manifests))
+		sizes := objectSizes(tt, client, bucket, compactDir)
+		assert.NotContains(tt, sizes, path.Base(models.BuildMergeManifestKey(results[0].Outputs[0])))
+		assert.NotContains(tt, sizes, "_merged-a.manifest.json")
+	})
+
+	t.Run("partition locked by other job is skipped", func(tt *testing.T) {
+		client := mock.NewFaultS3Client("ap-northeast-1", nil)
+		compactor := newCompactor(tt, client)
+		bucket := compactor.Bucket
+		locked, err := compactor.Meta.LockPartition(location(bucket, compactDir), "purge:test")
+		require.NoError(tt, err)
+		require.True(tt, locked)
+
+		results, err := compactor.Compact(begin, end)
+		require.NoError(tt, err)
+		assert.Equal(tt, 0, len(results))
+		assert.Equal(tt, 4, len(objectSizes(tt, client, bucket, compactDir)))
+		assert.Equal(tt, location(bucket, compactDir), partitionLocation(compactor))
+
+		require.NoError(tt, compactor.Meta.UnlockPartition(location(bucket, compactDir), "purge:test"))
+		results, err = compactor.Compact(begin, end)
+		require.NoError(tt, err)
+		assert.Equal(tt, 1, len(results))
+	})
+
+	t.Run("dt is looked up from partition keys", func(tt *testing.T) {
+		client := mock.NewFaultS3Client("ap-northeast-1", nil)
+		compactor := newCompactor(tt, client)
+		bucket := compactor.Bucket
+		catalog := compactor.Glue.(*mock.GlueCatalog)
+		catalog.PutTable("db", "indices", "s3://"+bucket+"/prefix/indices/", "tag_group", "dt")
+		catalog.PutPartition("db", "indices", location(bucket, compactDir), "aws", "2020-01-02-03")
+
+		results, err := compactor.Compact(begin, time.Date(2020, 1, 2, 3, 30, 0, 0, time.UTC))
+		require.NoError(tt, err)
+		assert.Equal(tt, 0, len(results))
+
+		results, err = compactor.Compact(begin, end)
+		require.NoError(tt, err)
+		require.Equal(tt, 1, len(results))
+		assert.Equal(tt, []string{"aws", "2020-01-02-03"}, results[0].Values)
+	})
+
+	t.Run("dry run does not change objects", func(tt *testing.T) {
+		client := mock.NewFaultS3Client("ap-northeast-1", nil)
+		compactor := newCompactor(tt, client)
+		compactor.DryRun = true
+
+		results, err := compactor.Compact(begin, end)
+		require.NoError(tt, err)
+		require.Equal(tt, 1, len(results))
+		assert.Equal(tt, 3, len(results[0].Sources))
+		assert.Equal(tt, 4, len(objectSizes(tt, client, compactor.Bucket, compactDir)))
+		assert.Equal(tt, location(compactor.Bucket, compactDir), partitionLocation(compactor))
+	})
+
+	t.Run("partition out of range is not compacted", func(tt *testing.T) {
+		client := mock.NewFaultS3Client("ap-northeast-1", nil)
+		compactor := newCompactor(tt, client)
+		results, err := compactor.Compact(begin, time.Date(2020, 1, 2, 3, 30, 0, 0, time.UTC))
+		require.NoError(tt, err)
+		assert.Equal(tt, 0, len(results))
+		assert.Equal(tt, 4, len(objectSizes(tt, client, compactor.Bucket, compactDir)))
+	})
+
+	t.Run("resume interrupted compaction", func(tt *testing.T) {
+		client := mock.NewFaultS3Client("ap-northeast-1", nil)
+		compactor := newCompactor(tt, client)
+		bucket := compactor.Bucket
+		catalog := compactor.Glue.(*mock.GlueCatalog)
+		expected := visibleTerms(tt, client, bucket, location(bucket, compactDir))
+
+		catalog.OnUpdatePartition = func(input *glue.UpdatePartitionInput) {
+			location := aws.StringValue(input.PartitionInput.StorageDescriptor.Location)
+			assert.Equal(tt, expected, visibleTerms(tt, client, bucket, location))
+			// fail after switching to staging
+			client.Fault = func(op, key string) error {
+				if op == "DeleteObjects" {
+					return errors.New("injected failure")
+				}
+				return nil
+			}
+		}
+		_, err := compactor.Compact(begin, end)
+		require.Error(tt, err)
+
+		staging := partitionLocation(compactor)
+		require.True(tt, strings.HasPrefix(staging, "s3://"+bucket+"/prefix/compaction/"))
+		assert.Equal(tt, expected, visibleTerms(tt, client, bucket, staging))
+
+		client.Fault = nil
+		catalog.OnUpdatePartition = func(input *glue.UpdatePartitionInput) {
+			location := aws.StringValue(input.PartitionInput.StorageDescriptor.Location)
+			assert.Equal(tt, expected, visibleTerms(tt, client, bucket, location))
+		}
+		// Out of range, but interrupted compaction is resumed
+		results, err := compactor.Compact(begin, begin)
+		require.NoError(tt, err)
+		require.Equal(tt, 1, len(results))
+		assert.Equal(tt, staging, results[0].Staging)
+		assert.Equal(tt, location(bucket, compactDir), partitionLocation(compactor))
+		assert.Equal(tt, 2, len(objectSizes(tt, client, bucket, compactDir)))
+		assert.Equal(tt, expected, visibleTerms(tt, client, bucket, location(bucket, compactDir)))
+	})
+}
@@ -0,0 +1,65 @@
+package merger
+
+import (
+	"github.com/m-mizutani/minerva/internal/service"
+	"github.com/m-mizutani/minerva/pkg/models"
+)
+
+// DumpParquet writes records to a local parquet file by dumpParquet. Records are sorted if sortBufferSize is not zero.
+func DumpParquet(records []models.Record, schema models.ParquetSchemaName, sortBufferSize int) (string, error) {
+	var sorter *recordSorter
+	if sortBufferSize > 0 {
+		s, err := newRecordSorter(schema, sortBufferSize)
+		if err != nil {
+			return "", err
+		}
+		sorter = s
+		defer sorter.close()
+	}
+
+	ch := make(chan *models.RecordQueue, 1)
+	go func() {
+		defer close(ch)
+		for i := 0; i < len(records); i += 512 {
+			end := i + 512
+			if end > len(records) {
+				end = len(records)
+			}
+			ch <- &models.RecordQueue{Records: records[i:end]}
+		}
+	}()
+
+	filePath, err := dumpParquet(ch, schema, sorter, nil)
+	if err != nil {
+		return "", err
+	}
+	return *filePath, nil
+}
+
+// UploadParquet writes records to dst by uploadParquet. loadErr is sent after records as load failure if not nil.
+func UploadParquet(s3Service *service.S3Service, dst models.S3Object, partSize int, records []models.Record, schema models.ParquetSchemaName, loadErr error) error {
+	ch := make(chan *models.RecordQueue, 1)
+	go func() {
+		defer close(ch)
+		for i := 0; i < len(records); i += 512 {
+			end := i + 512
+			if end > len(records) {
+				end = len(records)
+			}
+			ch <- &models.RecordQueue{Records: records[i:end]}
+		}
+		if loadErr != nil {
+			ch <- &models.RecordQueue{Err: loadErr}
+		}
+	}()
+
+	err := uploadParquet(s3Service, dst, partSize, ch, schema, nil, nil)
+	for range ch {
+	}
+	return err
+}
+
+// VerifyMerged compares rows of dst with rows by verifyMerged
+func VerifyMerged(s3Service *service.S3Service, dst models.S3Object, rows int64) error {
+	return verifyMerged(s3Service, dst, &models.MergeManifest{Object: dst, Rows: rows})
+}
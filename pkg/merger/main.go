@@ -7,12 +7,12 @@ import (
 	"runtime"
 	"sync"
 
+	"github.com/m-mizutani/minerva/internal/service"
 	"github.com/m-mizutani/minerva/pkg/handler"
 	"github.com/m-mizutani/minerva/pkg/models"
 	"github.com/pkg/errors"
 	"github.com/xitongsys/parquet-go-source/local"
-	"github.com/xitongsys/parquet-go/parquet"
-	"github.com/xitongsys/parquet-go/writer"
+	"github.com/xitongsys/parquet-go/source"
 )
 
 var logger = handler.Logger
@@ -23,6 +23,14 @@ const s3DownloadConcurrency = 16
 type MergeOptions struct {
 	DoNotRemoveSrc     bool
 	DoNotRemoveParquet bool
+	// SortRecords sorts index records by (term, field) and message records by (object_id, seq) before writing. Then min/max statistics of parquet can prune row groups. MERGE_SORT_RECORDS also enables it.
+	SortRecords bool
+	// SortBufferSize is number of records sorted on memory. Records exceeding it are spilled to temp files. Default is 500,000.
+	SortBufferSize int
+	// Streaming writes merged parquet to S3 multipart upload directly instead of a temp file. MERGE_STREAMING also enables it. DoNotRemoveParquet is ignored.
+	Streaming bool
+	// StreamPartSize is part size of multipart upload in streaming mode. Default is service.DefaultMultipartPartSize.
+	StreamPartSize int
 }
 
 // MergeChunk merges S3 objects to one parquet file
@@ -36,26 +44,35 @@ func MergeChunk(args handler.Arguments, q *models.MergeQueue, opt *MergeOptions)
 	recordService := args.RecordService()
 
 	ch := make(chan *models.RecordQueue)
-	newRecordMap := map[models.ParquetSchemaName]newRecord{
-		models.ParquetSchemaIndex:   newIndexRecord,
-		models.ParquetSchemaMessage: newMessageRecord,
-	}
 	s3Service := args.S3Service()
 
+	// DstObject exists if previous attempt was failed after uploading. It's completed only if merge manifest exists (verified).
+	verified := false
 	if exists, err := s3Service.HeadObject(q.DstObject); err != nil {
 		return errors.Wrap(err, "Failed to HeadObject")
 	} else if exists {
-		logger.WithField("dst", q.DstObject).Warn("DstObject already exists, skip")
-		return nil
+		manifestObj := models.NewS3Object(q.DstObject.Region, q.DstObject.Bucket, models.BuildMergeManifestKey(q.DstObject.Key))
+		if verified, err = s3Service.HeadObject(manifestObj); err != nil {
+			return errors.Wrap(err, "Failed to HeadObject of merge manifest")
+		}
+
+		if !verified {
+			logger.WithField("dst", q.DstObject).Warn("DstObject already exists but not verified, merge again")
+			if err := s3Service.DeleteS3Objects([]*models.S3Object{&q.DstObject}); err != nil {
+				return err
+			}
+		}
 	}
 
-	newRec, ok := newRecordMap[q.Schema]
-	if !ok {
+	if _, ok := newRecordMap[q.Schema]; !ok {
 		logger.WithField("queue", q).Errorf("Unsupported schema: %s", q.Schema)
 		return fmt.Errorf("Unsupported schema: %s", q.Schema)
 	}
 
-	var mergedFile *string
+	parquetConfig, err := ParseParquetConfig(args.ParquetConfig)
+	if err != nil {
+		return err
+	}
 
 	metaService := args.MetaService()
 	srcObjects, err := metaService.GetObjects(q.RecordIDs, models.ParquetSchemaName(q.Schema))
@@ -63,13 +80,32 @@ func MergeChunk(args handler.Arguments, q *models.MergeQueue, opt *MergeOptions)
 		return err
 	}
 
+	if verified {
+		logger.WithField("dst", q.DstObject).Warn("DstObject already exists and verified, delete only source objects")
+		if opt.DoNotRemoveSrc {
+			return nil
+		}
+		return s3Service.DeleteS3Objects(srcObjects)
+	}
+
+	var sorter *recordSorter
+	if opt.SortRecords || args.MergeSortRecords {
+		if sorter, err = newRecordSorter(q.Schema, opt.SortBufferSize); err != nil {
+			return err
+		}
+		defer sorter.close()
+	}
+
 	logger.WithField("len(srcObjects)", len(srcObjects)).Trace("Start downloading")
-	objQueue := make(chan *models.S3Object, len(srcObjects))
-	for _, q := range srcObjects {
-		objQueue <- q
+	idxQueue := make(chan int, len(srcObjects))
+	for i := range srcObjects {
+		idxQueue <- i
 	}
-	close(objQueue)
+	close(idxQueue)
 
+	// counts is number of loaded records for each source object. Each index is written by only one loader.
+	counts := make([]int64, len(srcObjects))
+	aborted := make(chan struct{})
 	wg := &sync.WaitGroup{}
 
 	wg.Add(1)
@@ -85,12 +121,21 @@ func MergeChunk(args handler.Arguments, q *models.MergeQueue, opt *MergeOptions)
 		go func(idx int) {
 			defer wg.Done()
 
-			for src := range objQueue {
+			for i := range idxQueue {
+				select {
+				case <-aborted:
+					return
+				default:
+				}
+
+				src := srcObjects[i]
 				logger.WithField("src", src).Trace("Download raw object")
-				if err := recordService.Load(src, q.Schema, ch); err != nil {
-					logger.WithError(err).WithField("src", src).Fatal("Failed to load records")
+				n, err := recordService.Load(src, q.Schema, ch)
+				if err != nil {
+					ch <- &models.RecordQueue{Err: errors.Wrapf(err, "Fail to load records: %s/%s", src.Bucket, src.Key)}
 					return
 				}
+				counts[i] = int64(n)
 				logger.WithField("src", src).Trace("Downloaded")
 			}
 			logger.WithField("Thread No", idx).Trace("Exit")
@@ -98,26 +143,47 @@ func MergeChunk(args handler.Arguments, q *models.MergeQueue, opt *MergeOptions)
 	}
 	wg.Done()
 
-	mergedFile, err = dumpParquet(ch, newRec)
-	if err != nil {
-		return err
-	}
-	if mergedFile == nil {
-		logger.Warn("No available merged file")
-		return nil
+	// drain stops loaders and consumes remaining records not to leak goroutines when writing is failed
+	drain := func() {
+		close(aborted)
+		for range ch {
+		}
 	}
 
-	logger.WithField("mergedFile", *mergedFile).Debug("Merged records")
-	if !opt.DoNotRemoveParquet {
-		defer os.Remove(*mergedFile)
+	dst := models.NewS3Object(q.DstObject.Region, q.DstObject.Bucket, q.DstObject.Key)
+	if opt.Streaming || args.MergeStreaming {
+		if err := uploadParquet(s3Service, dst, opt.StreamPartSize, ch, q.Schema, sorter, parquetConfig); err != nil {
+			drain()
+			return err
+		}
+	} else {
+		mergedFile, err := dumpParquet(ch, q.Schema, sorter, parquetConfig)
+		if err != nil {
+			drain()
+			return err
+		}
+
+		logger.WithField("mergedFile", *mergedFile).Debug("Merged records")
+		if !opt.DoNotRemoveParquet {
+			defer os.Remove(*mergedFile)
+		}
+
+		if err := s3Service.UploadFileToS3(*mergedFile, dst); err != nil {
+			return err
+		}
 	}
 
-	dst := models.NewS3Object(q.DstObject.Region, q.DstObject.Bucket, q.DstObject.Key)
-	if err := s3Service.UploadFileToS3(*mergedFile, dst); err != nil {
+	logger.WithField("dst", q.DstObject).Debug("Uploaded merged parquet file")
+
+	manifest := newMergeManifest(dst, q.Schema, srcObjects, counts)
+	if err := verifyMerged(s3Service, dst, manifest); err != nil {
+		return err
+	}
+	if err := putMergeManifest(s3Service, manifest); err != nil {
 		return err
 	}
+	logger.WithField("manifest", models.BuildMergeManifestKey(dst.Key)).WithField("rows", manifest.Rows).Debug("Verified merged object")
 
-	logger.WithField("dst", q.DstObject).Debug("Uploaded merged parquet file")
 	if !opt.DoNotRemoveSrc {
 		if err := s3Service.DeleteS3Objects(srcObjects); err != nil {
 			return err
@@ -127,7 +193,8 @@ func MergeChunk(args handler.Arguments, q *models.MergeQueue, opt *MergeOptions)
 	return nil
 }
 
-func dumpParquet(ch chan *models.RecordQueue, newRec newRecord) (*string, error) {
+// dumpParquet writes records from ch to a local parquet file with cfg. Records are written in sorted order if sorter is not nil.
+func dumpParquet(ch chan *models.RecordQueue, schema models.ParquetSchemaName, sorter *recordSorter, cfg *ParquetConfig) (*string, error) {
 	fd, err := ioutil.TempFile("", "*.parquet")
 	if err != nil {
 		return nil, errors.Wrap(err, "Fail to create a temp parquet file")
@@ -139,43 +206,75 @@ func dumpParquet(ch chan *models.RecordQueue, newRec newRecord) (*string, error)
 	if err != nil {
 		return nil, errors.Wrap(err, "Fail to create a parquet file")
 	}
-	defer func() {
-		logger.Debug("Closing parquet writer...")
-		if err := fw.Close(); err != nil {
-			logger.WithError(err).Error("Fail to close parquet writer")
-		}
-		fw = nil
-		runtime.GC()
-	}()
 
-	pw, err := writer.NewParquetWriter(fw, newRec(), 1)
+	if err := writeParquet(fw, ch, schema, sorter, cfg); err != nil {
+		fw.Close()
+		os.Remove(filePath)
+		return nil, err
+	}
+
+	logger.Debug("Closing parquet writer...")
+	if err := fw.Close(); err != nil {
+		os.Remove(filePath)
+		return nil, errors.Wrap(err, "Fail to close parquet file")
+	}
+	logger.Debugf("Dumped records: %v", filePath)
+
+	return &filePath, nil
+}
+
+// uploadParquet writes records from ch to dst by S3 multipart upload without local file. Memory usage is bounded by buffered row group of parquet writer and a part of upload. The multipart upload is aborted if anything fails, then no partial object is created.
+func uploadParquet(s3Service *service.S3Service, dst models.S3Object, partSize int, ch chan *models.RecordQueue, schema models.ParquetSchemaName, sorter *recordSorter, cfg *ParquetConfig) error {
+	w, err := s3Service.NewMultipartWriter(dst, partSize)
 	if err != nil {
-		return nil, errors.Wrap(err, "Fail to create parquet writer")
+		return err
 	}
-	defer func() {
-		logger.Debug("Stopping parquet writer...")
 
-		if err := pw.WriteStop(); err != nil {
-			logger.WithError(err).Error("Fail to stop writing parquet file")
+	abort := func() {
+		if err := w.Abort(); err != nil {
+			logger.WithError(err).WithField("dst", dst).Error("Fail to abort multipart upload")
 		}
-		pw = nil
-	}()
+	}
 
-	pw.RowGroupSize = 128 * 1024 * 1024
-	pw.CompressionType = parquet.CompressionCodec_SNAPPY
+	if err := writeParquet(&s3ParquetFile{w: w}, ch, schema, sorter, cfg); err != nil {
+		abort()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		abort()
+		return err
+	}
+
+	logger.WithField("dst", dst).WithField("size", w.Size()).Debug("Uploaded merged parquet by multipart upload")
+	return nil
+}
+
+// writeParquet writes records from ch to fw with cfg. Records are written in sorted order if sorter is not nil.
+func writeParquet(fw source.ParquetFile, ch chan *models.RecordQueue, schema models.ParquetSchemaName, sorter *recordSorter, cfg *ParquetConfig) error {
+	pw, err := cfg.NewWriter(fw, schema, sorter != nil)
+	if err != nil {
+		return err
+	}
 
 	queueCount := 0
 	logger.Debug("Start dumping")
 	for q := range ch {
 		if q.Err != nil {
-			return nil, errors.Wrap(q.Err, "Fail to load IndexRecord")
+			return errors.Wrap(q.Err, "Fail to load IndexRecord")
 		}
 
 		queueCount++
 
 		for i := range q.Records {
+			if sorter != nil {
+				if err := sorter.add(q.Records[i]); err != nil {
+					return err
+				}
+				continue
+			}
+
 			if err := pw.Write(q.Records[i]); err != nil {
-				return nil, errors.Wrapf(err, "Fail to write record as parquet: %v", q.Records[i])
+				return errors.Wrapf(err, "Fail to write record as parquet: %v", q.Records[i])
 			}
 		}
 
@@ -183,13 +282,55 @@ func dumpParquet(ch chan *models.RecordQueue, newRec newRecord) (*string, error)
 			runtime.GC()
 		}
 	}
-	logger.WithField("queueCount", queueCount).Debugf("Dumped records: %v", filePath)
 
-	return &filePath, nil
+	if sorter != nil {
+		if err := sorter.write(func(record models.Record) error {
+			if err := pw.Write(record); err != nil {
+				return errors.Wrapf(err, "Fail to write record as parquet: %v", record)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	logger.Debug("Stopping parquet writer...")
+	if err := pw.WriteStop(); err != nil {
+		return errors.Wrap(err, "Fail to stop writing parquet file")
+	}
+	logger.WithField("queueCount", queueCount).Debug("Wrote records")
+	runtime.GC()
+
+	return nil
+}
+
+// s3ParquetFile is write only source.ParquetFile for parquet writer to upload by S3MultipartWriter. The upload is completed by uploadParquet, not Close.
+type s3ParquetFile struct {
+	w *service.S3MultipartWriter
+}
+
+func (x *s3ParquetFile) Write(p []byte) (int, error) { return x.w.Write(p) }
+func (x *s3ParquetFile) Close() error                { return nil }
+func (x *s3ParquetFile) Read(p []byte) (int, error) {
+	return 0, errors.New("s3ParquetFile does not support Read")
+}
+func (x *s3ParquetFile) Seek(offset int64, whence int) (int64, error) {
+	return 0, errors.New("s3ParquetFile does not support Seek")
+}
+func (x *s3ParquetFile) Open(name string) (source.ParquetFile, error) {
+	return nil, errors.New("s3ParquetFile does not support Open")
+}
+func (x *s3ParquetFile) Create(name string) (source.ParquetFile, error) {
+	return nil, errors.New("s3ParquetFile does not support Create")
 }
 
 type newRecord func() interface{}
 
+var newRecordMap = map[models.ParquetSchemaName]newRecord{
+	models.ParquetSchemaIndex:   newIndexRecord,
+	models.ParquetSchemaMessage: newMessageRecord,
+}
+
 func newIndexRecord() interface{}   { return new(models.IndexRecord) }
 func newMessageRecord() interface{} { return new(models.MessageRecord) }
 
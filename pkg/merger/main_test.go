@@ -1,5 +1,23 @@
 package merger_test
 
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/google/uuid"
+	"github.com/m-mizutani/minerva/internal/adaptor"
+	"github.com/m-mizutani/minerva/internal/mock"
+	"github.com/m-mizutani/minerva/internal/service"
+	"github.com/m-mizutani/minerva/pkg/merger"
+	"github.com/m-mizutani/minerva/pkg/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
 /*
 func TestMerge(t *testing.T) {
 	t.Run("Index records", func(tt *testing.T) {
@@ -12,3 +30,77 @@ func TestMerge(t *testing.T) {
 	})
 }
 */
+
+func TestUploadParquet(t *testing.T) {
+	records := newRandomIndexRecords(5000, 1000)
+
+	getObject := func(t *testing.T, dst models.S3Object) ([]byte, error) {
+		output, err := mock.NewS3Client(dst.Region).GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(dst.Bucket),
+			Key:    aws.String(dst.Key),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(output.Body)
+	}
+
+	t.Run("upload merged parquet by multipart upload", func(tt *testing.T) {
+		dst := models.NewS3Object("ap-northeast-1", uuid.New().String(), "merged/obj.parquet")
+		s3Service := service.NewS3Service(mock.NewS3Client)
+
+		require.NoError(tt, merger.UploadParquet(s3Service, dst, 4096, records, models.ParquetSchemaIndex, nil))
+		assert.Equal(tt, 0, mock.MultipartUploads(dst.Bucket))
+
+		raw, err := getObject(tt, dst)
+		require.NoError(tt, err)
+		assert.True(tt, len(raw) > 4096*2, "should be uploaded as multiple parts")
+
+		fd, err := ioutil.TempFile("", "*.parquet")
+		require.NoError(tt, err)
+		defer os.Remove(fd.Name())
+		_, err = fd.Write(raw)
+		require.NoError(tt, err)
+		fd.Close()
+
+		rows := readIndexParquet(tt, fd.Name())
+		require.Equal(tt, len(records), len(rows))
+		assert.Equal(tt, *(records[0].(*models.IndexRecord)), rows[0])
+		assert.Equal(tt, *(records[len(records)-1].(*models.IndexRecord)), rows[len(rows)-1])
+	})
+
+	t.Run("abort multipart upload if upload part fails", func(tt *testing.T) {
+		dst := models.NewS3Object("ap-northeast-1", uuid.New().String(), "merged/obj.parquet")
+		var uploaded int
+		s3Service := service.NewS3Service(func(region string) adaptor.S3Client {
+			return mock.NewFaultS3Client(region, func(op, key string) error {
+				if op != "UploadPart" {
+					return nil
+				}
+				if uploaded >= 1 {
+					return errors.New("injected failure")
+				}
+				uploaded++
+				return nil
+			})
+		})
+
+		err := merger.UploadParquet(s3Service, dst, 4096, records, models.ParquetSchemaIndex, nil)
+		require.Error(tt, err)
+		assert.Equal(tt, 1, uploaded)
+		assert.Equal(tt, 0, mock.MultipartUploads(dst.Bucket))
+		_, err = getObject(tt, dst)
+		assert.Error(tt, err)
+	})
+
+	t.Run("abort multipart upload if loading records fails", func(tt *testing.T) {
+		dst := models.NewS3Object("ap-northeast-1", uuid.New().String(), "merged/obj.parquet")
+		s3Service := service.NewS3Service(mock.NewS3Client)
+
+		err := merger.UploadParquet(s3Service, dst, 4096, records, models.ParquetSchemaIndex, errors.New("broken raw object"))
+		require.Error(tt, err)
+		assert.Equal(tt, 0, mock.MultipartUploads(dst.Bucket))
+		_, err = getObject(tt, dst)
+		assert.Error(tt, err)
+	})
+}
@@ -0,0 +1,207 @@
+package merger
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/m-mizutani/minerva/pkg/models"
+	"github.com/pkg/errors"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/schema"
+	"github.com/xitongsys/parquet-go/source"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+const (
+	defaultRowGroupSize = 128 * 1024 * 1024 // 128MB
+	defaultPageSize     = 8 * 1024          // 8KB, same as parquet-go
+)
+
+var supportedCompressions = map[string]parquet.CompressionCodec{
+	"SNAPPY":       parquet.CompressionCodec_SNAPPY,
+	"GZIP":         parquet.CompressionCodec_GZIP,
+	"ZSTD":         parquet.CompressionCodec_ZSTD,
+	"UNCOMPRESSED": parquet.CompressionCodec_UNCOMPRESSED,
+}
+
+// supportedEncodings is available encodings for each physical type of columns
+var supportedEncodings = map[parquet.Type][]parquet.Encoding{
+	parquet.Type_BYTE_ARRAY: {
+		parquet.Encoding_PLAIN,
+		parquet.Encoding_PLAIN_DICTIONARY,
+		parquet.Encoding_RLE_DICTIONARY,
+		parquet.Encoding_DELTA_LENGTH_BYTE_ARRAY,
+		parquet.Encoding_DELTA_BYTE_ARRAY,
+	},
+	parquet.Type_INT32: {
+		parquet.Encoding_PLAIN,
+		parquet.Encoding_PLAIN_DICTIONARY,
+		parquet.Encoding_RLE_DICTIONARY,
+		parquet.Encoding_DELTA_BINARY_PACKED,
+	},
+	parquet.Type_INT64: {
+		parquet.Encoding_PLAIN,
+		parquet.Encoding_PLAIN_DICTIONARY,
+		parquet.Encoding_RLE_DICTIONARY,
+		parquet.Encoding_DELTA_BINARY_PACKED,
+	},
+}
+
+// ParquetConfig is settings of parquet writer for merged objects. It's JSON format and given by PARQUET_CONFIG. Zero values mean default.
+type ParquetConfig struct {
+	// Compression is SNAPPY (default), GZIP, ZSTD or UNCOMPRESSED
+	Compression string `json:"compression"`
+	// RowGroupSize is row group size (bytes) estimated by parquet-go. Default is 128MB, and 4MB if records are sorted.
+	RowGroupSize int64 `json:"row_group_size"`
+	// PageSize is page size (bytes). Default is 8KB.
+	PageSize int64 `json:"page_size"`
+	// Parallelism is number of goroutines to encode records. Default is 1.
+	Parallelism int64 `json:"parallelism"`
+	// Encodings overwrites encoding of struct tag by parquet schema ("index" or "message") and column name. e.g. {"message": {"message": "PLAIN"}}
+	Encodings map[models.ParquetSchemaName]map[string]string `json:"encodings"`
+}
+
+// ParseParquetConfig parses and validates JSON of ParquetConfig. It returns default config if raw is empty.
+func ParseParquetConfig(raw string) (*ParquetConfig, error) {
+	var cfg ParquetConfig
+	if raw == "" {
+		return &cfg, nil
+	}
+
+	if err := json.Unmarshal([]byte(raw), &cfg); err != nil {
+		return nil, errors.Wrap(err, "Fail to parse parquet config")
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
+
+// Validate checks values and encodings against columns of parquet schemas
+func (x *ParquetConfig) Validate() error {
+	if _, err := x.compression(); err != nil {
+		return err
+	}
+	if x.RowGroupSize < 0 {
+		return fmt.Errorf("row_group_size must not be negative: %d", x.RowGroupSize)
+	}
+	if x.PageSize < 0 {
+		return fmt.Errorf("page_size must not be negative: %d", x.PageSize)
+	}
+	if x.Parallelism < 0 {
+		return fmt.Errorf("parallelism must not be negative: %d", x.Parallelism)
+	}
+
+	for schemaName := range x.Encodings {
+		newRec, ok := newRecordMap[schemaName]
+		if !ok {
+			return fmt.Errorf("Unsupported schema in parquet encodings: %s", schemaName)
+		}
+		sh, err := schema.NewSchemaHandlerFromStruct(newRec())
+		if err != nil {
+			return errors.Wrapf(err, "Fail to create parquet schema: %s", schemaName)
+		}
+		if _, err := x.encodings(schemaName, sh); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (x *ParquetConfig) compression() (parquet.CompressionCodec, error) {
+	if x.Compression == "" {
+		return parquet.CompressionCodec_SNAPPY, nil
+	}
+
+	codec, ok := supportedCompressions[x.Compression]
+	if !ok {
+		return codec, fmt.Errorf("Unsupported parquet compression: %s", x.Compression)
+	}
+	return codec, nil
+}
+
+// encodings returns encoding by index of schema element
+func (x *ParquetConfig) encodings(schemaName models.ParquetSchemaName, sh *schema.SchemaHandler) (map[int]parquet.Encoding, error) {
+	results := map[int]parquet.Encoding{}
+
+	for column, name := range x.Encodings[schemaName] {
+		idx := -1
+		for i, info := range sh.Infos {
+			if i > 0 && info.ExName == column && sh.SchemaElements[i].Type != nil {
+				idx = i
+			}
+		}
+		if idx < 0 {
+			return nil, fmt.Errorf("Column %s is not found in parquet schema %s", column, schemaName)
+		}
+
+		enc, err := parquet.EncodingFromString(name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid parquet encoding of %s.%s", schemaName, column)
+		}
+
+		colType := *sh.SchemaElements[idx].Type
+		supported := false
+		for _, e := range supportedEncodings[colType] {
+			supported = supported || e == enc
+		}
+		if !supported {
+			return nil, fmt.Errorf("Encoding %s is not available for %s.%s (%s)", name, schemaName, column, colType)
+		}
+
+		results[idx] = enc
+	}
+
+	return results, nil
+}
+
+// NewWriter creates parquet writer of the schema with the config. Default row group size is smaller if records are sorted. nil config means default.
+func (x *ParquetConfig) NewWriter(fw source.ParquetFile, schemaName models.ParquetSchemaName, sorted bool) (*writer.ParquetWriter, error) {
+	if x == nil {
+		x = &ParquetConfig{}
+	}
+	if err := x.Validate(); err != nil {
+		return nil, err
+	}
+
+	newRec, ok := newRecordMap[schemaName]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported schema: %s", schemaName)
+	}
+
+	np := x.Parallelism
+	if np == 0 {
+		np = 1
+	}
+	pw, err := writer.NewParquetWriter(fw, newRec(), np)
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to create parquet writer")
+	}
+
+	pw.CompressionType, _ = x.compression()
+
+	pw.RowGroupSize = defaultRowGroupSize
+	if sorted {
+		pw.RowGroupSize = sortedRowGroupSize
+	}
+	if x.RowGroupSize > 0 {
+		pw.RowGroupSize = x.RowGroupSize
+	}
+
+	pw.PageSize = defaultPageSize
+	if x.PageSize > 0 {
+		pw.PageSize = x.PageSize
+	}
+
+	encodings, err := x.encodings(schemaName, pw.SchemaHandler)
+	if err != nil {
+		return nil, err
+	}
+	for idx, enc := range encodings {
+		pw.SchemaHandler.Infos[idx].Encoding = enc
+	}
+
+	return pw, nil
+}
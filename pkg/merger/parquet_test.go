@@ -0,0 +1,103 @@
+package merger_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/m-mizutani/minerva/pkg/merger"
+	"github.com/m-mizutani/minerva/pkg/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/layout"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/source"
+)
+
+func TestParseParquetConfig(t *testing.T) {
+	testCases := []struct {
+		title string
+		raw   string
+		valid bool
+	}{
+		{title: "empty is default", raw: "", valid: true},
+		{title: "all settings", raw: `{"compression":"ZSTD","row_group_size":1048576,"page_size":65536,"parallelism":4,"encodings":{"index":{"term":"DELTA_BYTE_ARRAY","seq":"DELTA_BINARY_PACKED"},"message":{"message":"PLAIN"}}}`, valid: true},
+		{title: "gzip", raw: `{"compression":"GZIP"}`, valid: true},
+		{title: "invalid JSON", raw: `{"compression":`, valid: false},
+		{title: "unsupported compression", raw: `{"compression":"LZO"}`, valid: false},
+		{title: "negative row group size", raw: `{"row_group_size":-1}`, valid: false},
+		{title: "negative page size", raw: `{"page_size":-1}`, valid: false},
+		{title: "negative parallelism", raw: `{"parallelism":-1}`, valid: false},
+		{title: "unknown schema", raw: `{"encodings":{"indices":{"term":"PLAIN"}}}`, valid: false},
+		{title: "unknown column", raw: `{"encodings":{"message":{"term":"PLAIN"}}}`, valid: false},
+		{title: "unknown encoding", raw: `{"encodings":{"index":{"term":"SOMETHING"}}}`, valid: false},
+		{title: "encoding not for string", raw: `{"encodings":{"index":{"term":"DELTA_BINARY_PACKED"}}}`, valid: false},
+		{title: "encoding not for integer", raw: `{"encodings":{"index":{"seq":"DELTA_BYTE_ARRAY"}}}`, valid: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.title, func(tt *testing.T) {
+			cfg, err := merger.ParseParquetConfig(tc.raw)
+			if tc.valid {
+				require.NoError(tt, err)
+				assert.NotNil(tt, cfg)
+			} else {
+				assert.Error(tt, err)
+			}
+		})
+	}
+}
+
+func TestParquetConfigNewWriter(t *testing.T) {
+	cfg, err := merger.ParseParquetConfig(`{"compression":"ZSTD","parallelism":2,"encodings":{"index":{"term":"DELTA_BYTE_ARRAY"}}}`)
+	require.NoError(t, err)
+
+	fd, err := ioutil.TempFile("", "*.parquet")
+	require.NoError(t, err)
+	fd.Close()
+	defer os.Remove(fd.Name())
+
+	fw, err := local.NewLocalFileWriter(fd.Name())
+	require.NoError(t, err)
+	pw, err := cfg.NewWriter(fw, models.ParquetSchemaIndex, false)
+	require.NoError(t, err)
+	for _, rec := range newRandomIndexRecords(100, 10) {
+		require.NoError(t, pw.Write(rec))
+	}
+	require.NoError(t, pw.WriteStop())
+	require.NoError(t, fw.Close())
+
+	fr, err := local.NewLocalFileReader(fd.Name())
+	require.NoError(t, err)
+	defer fr.Close()
+	pr, err := reader.NewParquetReader(fr, new(models.IndexRecord), 1)
+	require.NoError(t, err)
+	defer pr.ReadStop()
+
+	// Encodings in column metadata are fixed by parquet-go, then encoding is checked by header of first data page
+	dataPageEncoding := func(col *parquet.ColumnChunk) parquet.Encoding {
+		offset := col.MetaData.DataPageOffset
+		size := col.MetaData.TotalCompressedSize - (offset - col.MetaData.GetDictionaryPageOffset())
+		if col.MetaData.DictionaryPageOffset == nil {
+			size = col.MetaData.TotalCompressedSize
+		}
+		header, err := layout.ReadPageHeader(source.ConvertToThriftReader(fr, offset, size))
+		require.NoError(t, err)
+		require.NotNil(t, header.DataPageHeader)
+		return header.DataPageHeader.Encoding
+	}
+
+	require.Equal(t, 1, len(pr.Footer.RowGroups))
+	for _, col := range pr.Footer.RowGroups[0].Columns {
+		assert.Equal(t, parquet.CompressionCodec_ZSTD, col.MetaData.Codec)
+		switch col.MetaData.PathInSchema[0] {
+		case "Term":
+			assert.Equal(t, parquet.Encoding_DELTA_BYTE_ARRAY, dataPageEncoding(col))
+		case "Field":
+			// encoding of struct tag is kept
+			assert.Equal(t, parquet.Encoding_PLAIN_DICTIONARY, dataPageEncoding(col))
+		}
+	}
+}
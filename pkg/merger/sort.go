@@ -0,0 +1,220 @@
+package merger
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/gob"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/m-mizutani/minerva/pkg/models"
+	"github.com/pkg/errors"
+)
+
+const (
+	// defaultSortBufferSize is number of records sorted on memory. About 200MB for index records.
+	defaultSortBufferSize = 500000
+
+	// sortedRowGroupSize is smaller than unsorted one because min/max statistics of each row group can prune row groups only if a file has multiple row groups. It's estimated size by parquet-go and about 250,000 index records.
+	sortedRowGroupSize = 4 * 1024 * 1024
+)
+
+// recordLess returns true if a should be written before b
+type recordLess func(a, b models.Record) bool
+
+var recordLessMap = map[models.ParquetSchemaName]recordLess{
+	models.ParquetSchemaIndex:   lessIndexRecord,
+	models.ParquetSchemaMessage: lessMessageRecord,
+}
+
+// lessIndexRecord sorts index records by (term, field). object_id and seq are compared for stable output.
+func lessIndexRecord(a, b models.Record) bool {
+	x, y := a.(*models.IndexRecord), b.(*models.IndexRecord)
+	if x.Term != y.Term {
+		return x.Term < y.Term
+	}
+	if x.Field != y.Field {
+		return x.Field < y.Field
+	}
+	if x.ObjectID != y.ObjectID {
+		return x.ObjectID < y.ObjectID
+	}
+	return x.Seq < y.Seq
+}
+
+// lessMessageRecord sorts message records by (object_id, seq)
+func lessMessageRecord(a, b models.Record) bool {
+	x, y := a.(*models.MessageRecord), b.(*models.MessageRecord)
+	if x.ObjectID != y.ObjectID {
+		return x.ObjectID < y.ObjectID
+	}
+	return x.Seq < y.Seq
+}
+
+// recordSorter is external sorter of records. Records are sorted on memory up to bufferSize and spilled to temp files (runs) as gob. Runs are merged when writing.
+type recordSorter struct {
+	less       recordLess
+	newRec     newRecord
+	bufferSize int
+	buffer     []models.Record
+	runs       []string
+}
+
+func newRecordSorter(schema models.ParquetSchemaName, bufferSize int) (*recordSorter, error) {
+	less, ok := recordLessMap[schema]
+	if !ok {
+		return nil, errors.Errorf("Unsupported schema for sort: %s", schema)
+	}
+	if bufferSize <= 0 {
+		bufferSize = defaultSortBufferSize
+	}
+
+	return &recordSorter{
+		less:       less,
+		newRec:     newRecordMap[schema],
+		bufferSize: bufferSize,
+	}, nil
+}
+
+func (x *recordSorter) add(record models.Record) error {
+	x.buffer = append(x.buffer, record)
+	if len(x.buffer) >= x.bufferSize {
+		return x.spill()
+	}
+	return nil
+}
+
+func (x *recordSorter) sortBuffer() {
+	sort.Slice(x.buffer, func(i, j int) bool {
+		return x.less(x.buffer[i], x.buffer[j])
+	})
+}
+
+// spill sorts records in buffer and saves them to a run file
+func (x *recordSorter) spill() error {
+	if len(x.buffer) == 0 {
+		return nil
+	}
+	x.sortBuffer()
+
+	fd, err := ioutil.TempFile("", "*.sort")
+	if err != nil {
+		return errors.Wrap(err, "Fail to create a temp file for sort")
+	}
+	defer fd.Close()
+	x.runs = append(x.runs, fd.Name())
+
+	w := bufio.NewWriter(fd)
+	enc := gob.NewEncoder(w)
+	for _, record := range x.buffer {
+		if err := enc.Encode(record); err != nil {
+			return errors.Wrapf(err, "Fail to encode record for sort: %v", record)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return errors.Wrapf(err, "Fail to write sort run: %s", fd.Name())
+	}
+
+	logger.WithField("records", len(x.buffer)).WithField("runs", len(x.runs)).Debug("Spilled sorted records")
+	x.buffer = nil
+	return nil
+}
+
+// write calls callback with all added records in sorted order
+func (x *recordSorter) write(callback func(record models.Record) error) error {
+	if len(x.runs) == 0 {
+		x.sortBuffer()
+		for _, record := range x.buffer {
+			if err := callback(record); err != nil {
+				return err
+			}
+		}
+		x.buffer = nil
+		return nil
+	}
+
+	if err := x.spill(); err != nil {
+		return err
+	}
+
+	h := &runHeap{less: x.less}
+	for _, run := range x.runs {
+		fd, err := os.Open(run)
+		if err != nil {
+			return errors.Wrapf(err, "Fail to open sort run: %s", run)
+		}
+		defer fd.Close()
+
+		r := &runReader{dec: gob.NewDecoder(bufio.NewReader(fd)), newRec: x.newRec}
+		if ok, err := r.next(); err != nil {
+			return err
+		} else if ok {
+			h.readers = append(h.readers, r)
+		}
+	}
+	heap.Init(h)
+
+	for h.Len() > 0 {
+		r := h.readers[0]
+		if err := callback(r.current); err != nil {
+			return err
+		}
+
+		if ok, err := r.next(); err != nil {
+			return err
+		} else if ok {
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+		}
+	}
+
+	return nil
+}
+
+// close removes run files
+func (x *recordSorter) close() {
+	for _, run := range x.runs {
+		if err := os.Remove(run); err != nil {
+			logger.WithError(err).WithField("run", run).Warn("Fail to remove sort run")
+		}
+	}
+	x.runs = nil
+	x.buffer = nil
+}
+
+type runReader struct {
+	dec     *gob.Decoder
+	newRec  newRecord
+	current models.Record
+}
+
+func (x *runReader) next() (bool, error) {
+	record := x.newRec()
+	if err := x.dec.Decode(record); err != nil {
+		if err == io.EOF {
+			return false, nil
+		}
+		return false, errors.Wrap(err, "Fail to decode sorted record")
+	}
+	x.current = record
+	return true, nil
+}
+
+type runHeap struct {
+	less    recordLess
+	readers []*runReader
+}
+
+func (x *runHeap) Len() int           { return len(x.readers) }
+func (x *runHeap) Less(i, j int) bool { return x.less(x.readers[i].current, x.readers[j].current) }
+func (x *runHeap) Swap(i, j int)      { x.readers[i], x.readers[j] = x.readers[j], x.readers[i] }
+func (x *runHeap) Push(v interface{}) { x.readers = append(x.readers, v.(*runReader)) }
+func (x *runHeap) Pop() interface{} {
+	n := len(x.readers)
+	r := x.readers[n-1]
+	x.readers = x.readers[:n-1]
+	return r
+}
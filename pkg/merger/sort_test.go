@@ -0,0 +1,183 @@
+package merger_test
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/m-mizutani/minerva/pkg/merger"
+	"github.com/m-mizutani/minerva/pkg/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+func newRandomIndexRecords(n, termVariety int) []models.Record {
+	rnd := rand.New(rand.NewSource(1))
+	fields := []string{"src", "dst", "user", "host"}
+	var records []models.Record
+	for i := 0; i < n; i++ {
+		records = append(records, &models.IndexRecord{
+			Tag:       "app.log",
+			Timestamp: 1577934000 + int64(i),
+			Field:     fields[rnd.Intn(len(fields))],
+			Term:      fmt.Sprintf("term-%08d", rnd.Intn(termVariety)),
+			ObjectID:  int64(rnd.Intn(100)),
+			Seq:       int32(i),
+		})
+	}
+	return records
+}
+
+func readIndexParquet(t *testing.T, filePath string) []models.IndexRecord {
+	fr, err := local.NewLocalFileReader(filePath)
+	require.NoError(t, err)
+	defer fr.Close()
+	pr, err := reader.NewParquetReader(fr, new(models.IndexRecord), 1)
+	require.NoError(t, err)
+	defer pr.ReadStop()
+
+	rows := make([]models.IndexRecord, pr.GetNumRows())
+	require.NoError(t, pr.Read(&rows))
+	return rows
+}
+
+func TestDumpParquetSorted(t *testing.T) {
+	records := newRandomIndexRecords(2000, 300)
+
+	t.Run("sort index records on memory", func(tt *testing.T) {
+		filePath, err := merger.DumpParquet(records, models.ParquetSchemaIndex, 10000)
+		require.NoError(tt, err)
+		defer os.Remove(filePath)
+
+		rows := readIndexParquet(tt, filePath)
+		require.Equal(tt, len(records), len(rows))
+		assert.True(tt, sort.SliceIsSorted(rows, func(i, j int) bool {
+			if rows[i].Term != rows[j].Term {
+				return rows[i].Term < rows[j].Term
+			}
+			return rows[i].Field < rows[j].Field
+		}))
+	})
+
+	t.Run("sort index records with spilled runs", func(tt *testing.T) {
+		filePath, err := merger.DumpParquet(records, models.ParquetSchemaIndex, 300)
+		require.NoError(tt, err)
+		defer os.Remove(filePath)
+
+		rows := readIndexParquet(tt, filePath)
+		require.Equal(tt, len(records), len(rows))
+		assert.True(tt, sort.SliceIsSorted(rows, func(i, j int) bool {
+			if rows[i].Term != rows[j].Term {
+				return rows[i].Term < rows[j].Term
+			}
+			return rows[i].Field < rows[j].Field
+		}))
+
+		// No record is lost or duplicated
+		seqs := map[int32]bool{}
+		for _, row := range rows {
+			seqs[row.Seq] = true
+		}
+		assert.Equal(tt, len(records), len(seqs))
+	})
+
+	t.Run("sort message records by object_id and seq", func(tt *testing.T) {
+		var msgs []models.Record
+		for i := 0; i < 1000; i++ {
+			msgs = append(msgs, &models.MessageRecord{
+				Timestamp: 1577934000,
+				ObjectID:  int64(9 - i%10),
+				Seq:       int32(1000 - i),
+				Message:   fmt.Sprintf(`{"n":%d}`, i),
+			})
+		}
+
+		filePath, err := merger.DumpParquet(msgs, models.ParquetSchemaMessage, 128)
+		require.NoError(tt, err)
+		defer os.Remove(filePath)
+
+		fr, err := local.NewLocalFileReader(filePath)
+		require.NoError(tt, err)
+		defer fr.Close()
+		pr, err := reader.NewParquetReader(fr, new(models.MessageRecord), 1)
+		require.NoError(tt, err)
+		defer pr.ReadStop()
+
+		rows := make([]models.MessageRecord, pr.GetNumRows())
+		require.NoError(tt, pr.Read(&rows))
+		require.Equal(tt, len(msgs), len(rows))
+		assert.True(tt, sort.SliceIsSorted(rows, func(i, j int) bool {
+			if rows[i].ObjectID != rows[j].ObjectID {
+				return rows[i].ObjectID < rows[j].ObjectID
+			}
+			return rows[i].Seq < rows[j].Seq
+		}))
+	})
+}
+
+// scannedBytes estimates bytes read by Athena for term lookups. Row groups are pruned by min/max statistics of term column.
+func scannedBytes(b *testing.B, filePath string, terms []string) (scanned, total int64) {
+	fr, err := local.NewLocalFileReader(filePath)
+	require.NoError(b, err)
+	defer fr.Close()
+	pr, err := reader.NewParquetReader(fr, new(models.IndexRecord), 1)
+	require.NoError(b, err)
+	defer pr.ReadStop()
+
+	for _, rg := range pr.Footer.RowGroups {
+		var size int64
+		var min, max string
+		for _, col := range rg.Columns {
+			size += col.MetaData.TotalCompressedSize
+			if col.MetaData.PathInSchema[0] == "Term" && col.MetaData.Statistics != nil {
+				// parquet-go v1.5.1 writes only deprecated min/max
+				min, max = string(col.MetaData.Statistics.Min), string(col.MetaData.Statistics.Max)
+			}
+		}
+		total += size
+
+		for _, term := range terms {
+			if min == "" || (min <= term && term <= max) {
+				scanned += size
+			}
+		}
+	}
+
+	return scanned, total
+}
+
+// BenchmarkSortedParquetScan compares scanned bytes of term lookups between unsorted and sorted merged index object.
+func BenchmarkSortedParquetScan(b *testing.B) {
+	records := newRandomIndexRecords(1000000, 1000000)
+	var terms []string
+	for i := 0; i < 100; i++ {
+		terms = append(terms, records[i*997].(*models.IndexRecord).Term)
+	}
+
+	testCases := []struct {
+		name           string
+		sortBufferSize int
+	}{
+		{name: "unsorted", sortBufferSize: 0},
+		{name: "sorted", sortBufferSize: 200000},
+	}
+
+	for _, tc := range testCases {
+		b.Run(tc.name, func(bb *testing.B) {
+			var scanned, total int64
+			for i := 0; i < bb.N; i++ {
+				filePath, err := merger.DumpParquet(records, models.ParquetSchemaIndex, tc.sortBufferSize)
+				require.NoError(bb, err)
+				scanned, total = scannedBytes(bb, filePath, terms)
+				os.Remove(filePath)
+			}
+
+			bb.ReportMetric(float64(scanned)/float64(len(terms)), "scanned-bytes/lookup")
+			bb.ReportMetric(float64(total), "object-bytes")
+		})
+	}
+}
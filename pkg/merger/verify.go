@@ -0,0 +1,91 @@
+package merger
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/m-mizutani/minerva/internal/service"
+	"github.com/m-mizutani/minerva/pkg/models"
+	"github.com/pkg/errors"
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+// parquetTailSize is length of footer size (4 bytes) and magic number "PAR1" at end of parquet file
+const parquetTailSize = 8
+
+// readParquetRowCount reads only footer of parquet object on S3 by range requests and returns number of rows
+func readParquetRowCount(s3Service *service.S3Service, obj models.S3Object) (int64, error) {
+	tail, err := s3Service.ReadObjectTail(obj, parquetTailSize)
+	if err != nil {
+		return 0, err
+	}
+	if len(tail) != parquetTailSize || string(tail[4:]) != "PAR1" {
+		return 0, fmt.Errorf("Merged object is not parquet: %s/%s", obj.Bucket, obj.Key)
+	}
+
+	footerSize := int64(binary.LittleEndian.Uint32(tail[:4]))
+	raw, err := s3Service.ReadObjectTail(obj, footerSize+parquetTailSize)
+	if err != nil {
+		return 0, err
+	}
+	if int64(len(raw)) != footerSize+parquetTailSize {
+		return 0, fmt.Errorf("Footer of merged object is broken: %s/%s", obj.Bucket, obj.Key)
+	}
+
+	bf, err := buffer.NewBufferFile(raw)
+	if err != nil {
+		return 0, errors.Wrap(err, "Fail to create buffer of parquet footer")
+	}
+	pr, err := reader.NewParquetReader(bf, nil, 1)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Fail to read parquet footer: %s/%s", obj.Bucket, obj.Key)
+	}
+
+	return pr.GetNumRows(), nil
+}
+
+// verifyMerged checks that the merged object has all records of sources. The merged object is deleted if not, to be merged again by retry.
+func verifyMerged(s3Service *service.S3Service, dst models.S3Object, manifest *models.MergeManifest) error {
+	rows, err := readParquetRowCount(s3Service, dst)
+	if err != nil {
+		return err
+	}
+
+	if rows != manifest.Rows {
+		if err := s3Service.DeleteS3Objects([]*models.S3Object{&dst}); err != nil {
+			logger.WithError(err).WithField("dst", dst).Error("Fail to delete inconsistent merged object")
+		}
+		return fmt.Errorf("Number of rows in merged object %d does not match with loaded records %d: %s/%s", rows, manifest.Rows, dst.Bucket, dst.Key)
+	}
+
+	return nil
+}
+
+func newMergeManifest(dst models.S3Object, schema models.ParquetSchemaName, srcObjects []*models.S3Object, counts []int64) *models.MergeManifest {
+	manifest := &models.MergeManifest{
+		Object:   dst,
+		Schema:   schema,
+		MergedAt: time.Now().UTC(),
+	}
+	for i, src := range srcObjects {
+		manifest.Sources = append(manifest.Sources, &models.MergeManifestEntry{
+			Object:  *src,
+			Records: counts[i],
+		})
+		manifest.Rows += counts[i]
+	}
+	return manifest
+}
+
+func putMergeManifest(s3Service *service.S3Service, manifest *models.MergeManifest) error {
+	raw, err := json.Marshal(manifest)
+	if err != nil {
+		return errors.Wrap(err, "Fail to marshal merge manifest")
+	}
+
+	obj := models.NewS3Object(manifest.Object.Region, manifest.Object.Bucket, models.BuildMergeManifestKey(manifest.Object.Key))
+	return s3Service.UploadBytesToS3(raw, obj)
+}
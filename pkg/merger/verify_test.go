@@ -0,0 +1,204 @@
+package merger_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/google/uuid"
+	"github.com/m-mizutani/minerva/internal/adaptor"
+	"github.com/m-mizutani/minerva/internal/mock"
+	"github.com/m-mizutani/minerva/internal/repository"
+	"github.com/m-mizutani/minerva/internal/service"
+	"github.com/m-mizutani/minerva/pkg/handler"
+	"github.com/m-mizutani/minerva/pkg/merger"
+	"github.com/m-mizutani/minerva/pkg/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type verifyTestLog struct {
+	Color string
+	Seq   int
+}
+
+// setupRawObjects dumps logs as raw objects to mock S3 and registers index objects to meta repository
+func setupRawObjects(t *testing.T, bucket string, meta repository.MetaRepository, logCount int) ([]string, []*models.S3Object) {
+	recordService := service.NewRecordService(mock.NewS3Client, adaptor.NewMsgpackEncoder, adaptor.NewMsgpackDecoder)
+	base := models.NewS3Object("ap-northeast-1", bucket, "")
+	now := time.Now()
+	for i := 0; i < logCount; i++ {
+		require.NoError(t, recordService.Dump(&models.LogQueue{
+			Value:     &verifyTestLog{Color: "blue", Seq: i},
+			Seq:       int32(i),
+			Tag:       "test.log",
+			Timestamp: now,
+		}, 1, &base))
+	}
+	require.NoError(t, recordService.Close())
+
+	var recordIDs []string
+	var objects []*models.S3Object
+	var items []*repository.MetaRecordObject
+	for _, raw := range recordService.RawObjects() {
+		if raw.Schema() != string(models.ParquetSchemaIndex) {
+			continue
+		}
+		id := uuid.New().String()
+		recordIDs = append(recordIDs, id)
+		objects = append(objects, raw.Object())
+		items = append(items, &repository.MetaRecordObject{
+			S3Object: *raw.Object(),
+			RecordID: id,
+			Schema:   models.ParquetSchemaIndex,
+		})
+	}
+	require.NoError(t, meta.PutRecordObjects(items))
+
+	return recordIDs, objects
+}
+
+func TestMergeChunkVerify(t *testing.T) {
+	t.Run("Write manifest and delete sources after verification", func(tt *testing.T) {
+		bucket := uuid.New().String()
+		meta := mock.NewMetaRepository()
+		recordIDs, srcObjects := setupRawObjects(tt, bucket, meta, 3)
+		require.Equal(tt, 1, len(srcObjects))
+
+		args := handler.Arguments{NewS3: mock.NewS3Client, MetaRepo: meta}
+		dst := models.NewS3Object("ap-northeast-1", bucket, "merged/test.parquet")
+		q := &models.MergeQueue{
+			Schema:    models.ParquetSchemaIndex,
+			RecordIDs: recordIDs,
+			DstObject: dst,
+		}
+		require.NoError(tt, merger.MergeChunk(args, q, nil))
+
+		client := mock.NewS3Client("ap-northeast-1")
+		output, err := client.GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String("merged/_test.manifest.json"),
+		})
+		require.NoError(tt, err)
+		raw, err := ioutil.ReadAll(output.Body)
+		require.NoError(tt, err)
+
+		var manifest models.MergeManifest
+		require.NoError(tt, json.Unmarshal(raw, &manifest))
+		assert.Equal(tt, dst, manifest.Object)
+		assert.Equal(tt, models.ParquetSchemaIndex, manifest.Schema)
+		assert.NotEqual(tt, int64(0), manifest.Rows)
+		require.Equal(tt, 1, len(manifest.Sources))
+		assert.Equal(tt, *srcObjects[0], manifest.Sources[0].Object)
+		assert.Equal(tt, manifest.Rows, manifest.Sources[0].Records)
+
+		s3Service := service.NewS3Service(mock.NewS3Client)
+		exists, err := s3Service.HeadObject(*srcObjects[0])
+		require.NoError(tt, err)
+		assert.False(tt, exists)
+	})
+
+	t.Run("Loader error is returned and sources are kept", func(tt *testing.T) {
+		bucket := uuid.New().String()
+		meta := mock.NewMetaRepository()
+		recordIDs, srcObjects := setupRawObjects(tt, bucket, meta, 3)
+
+		// Add a record ID of missing raw object
+		missing := uuid.New().String()
+		require.NoError(tt, meta.PutRecordObjects([]*repository.MetaRecordObject{
+			{
+				S3Object: models.NewS3Object("ap-northeast-1", bucket, "raw/missing.msg.gz"),
+				RecordID: missing,
+				Schema:   models.ParquetSchemaIndex,
+			},
+		}))
+
+		args := handler.Arguments{NewS3: mock.NewS3Client, MetaRepo: meta}
+		dst := models.NewS3Object("ap-northeast-1", bucket, "merged/test.parquet")
+		q := &models.MergeQueue{
+			Schema:    models.ParquetSchemaIndex,
+			RecordIDs: append(recordIDs, missing),
+			DstObject: dst,
+		}
+		require.Error(tt, merger.MergeChunk(args, q, nil))
+
+		s3Service := service.NewS3Service(mock.NewS3Client)
+		exists, err := s3Service.HeadObject(dst)
+		require.NoError(tt, err)
+		assert.False(tt, exists)
+
+		exists, err = s3Service.HeadObject(*srcObjects[0])
+		require.NoError(tt, err)
+		assert.True(tt, exists)
+	})
+
+	t.Run("Retry completes only deletion if merged object is verified", func(tt *testing.T) {
+		bucket := uuid.New().String()
+		meta := mock.NewMetaRepository()
+		recordIDs, srcObjects := setupRawObjects(tt, bucket, meta, 3)
+
+		args := handler.Arguments{NewS3: mock.NewS3Client, MetaRepo: meta}
+		dst := models.NewS3Object("ap-northeast-1", bucket, "merged/test.parquet")
+		q := &models.MergeQueue{
+			Schema:    models.ParquetSchemaIndex,
+			RecordIDs: recordIDs,
+			DstObject: dst,
+		}
+		// Simulate failure of deleting source objects after verification
+		require.NoError(tt, merger.MergeChunk(args, q, &merger.MergeOptions{DoNotRemoveSrc: true}))
+
+		s3Service := service.NewS3Service(mock.NewS3Client)
+		exists, err := s3Service.HeadObject(*srcObjects[0])
+		require.NoError(tt, err)
+		require.True(tt, exists)
+
+		require.NoError(tt, merger.MergeChunk(args, q, nil))
+		exists, err = s3Service.HeadObject(*srcObjects[0])
+		require.NoError(tt, err)
+		assert.False(tt, exists)
+	})
+
+	t.Run("Retry merges again if merged object is not verified", func(tt *testing.T) {
+		bucket := uuid.New().String()
+		meta := mock.NewMetaRepository()
+		recordIDs, srcObjects := setupRawObjects(tt, bucket, meta, 3)
+
+		s3Service := service.NewS3Service(mock.NewS3Client)
+		dst := models.NewS3Object("ap-northeast-1", bucket, "merged/test.parquet")
+		// Broken object uploaded by previous attempt without manifest
+		require.NoError(tt, s3Service.UploadBytesToS3([]byte("broken"), dst))
+
+		args := handler.Arguments{NewS3: mock.NewS3Client, MetaRepo: meta}
+		q := &models.MergeQueue{
+			Schema:    models.ParquetSchemaIndex,
+			RecordIDs: recordIDs,
+			DstObject: dst,
+		}
+		require.NoError(tt, merger.MergeChunk(args, q, nil))
+
+		exists, err := s3Service.HeadObject(models.NewS3Object("ap-northeast-1", bucket, models.BuildMergeManifestKey(dst.Key)))
+		require.NoError(tt, err)
+		assert.True(tt, exists)
+		exists, err = s3Service.HeadObject(*srcObjects[0])
+		require.NoError(tt, err)
+		assert.False(tt, exists)
+	})
+
+	t.Run("Inconsistent merged object is deleted", func(tt *testing.T) {
+		bucket := uuid.New().String()
+		s3Service := service.NewS3Service(mock.NewS3Client)
+		dst := models.NewS3Object("ap-northeast-1", bucket, "merged/test.parquet")
+
+		records := newRandomIndexRecords(100, 10)
+		require.NoError(tt, merger.UploadParquet(s3Service, dst, 0, records, models.ParquetSchemaIndex, nil))
+		require.NoError(tt, merger.VerifyMerged(s3Service, dst, 100))
+
+		require.Error(tt, merger.VerifyMerged(s3Service, dst, 101))
+		exists, err := s3Service.HeadObject(dst)
+		require.NoError(tt, err)
+		assert.False(tt, exists)
+	})
+}
@@ -3,7 +3,9 @@ package models
 import (
 	"fmt"
 	"log"
+	"path"
 	"strings"
+	"time"
 )
 
 // ParquetSchemaName identifies schema name
@@ -50,3 +52,24 @@ func BuildMergedS3ObjectKey(prefix, schema, partition, chunkKey string) string {
 		fmt.Sprintf("merged-%s.parquet", chunkKey),
 	}, "/")
 }
+
+// BuildMergeManifestKey creates S3 key of manifest of merged object. It's in same directory, but starts with "_" to be ignored by Athena.
+func BuildMergeManifestKey(mergedKey string) string {
+	dir, name := path.Split(mergedKey)
+	return dir + "_" + strings.TrimSuffix(name, ".parquet") + ".manifest.json"
+}
+
+// MergeManifest is saved with merged object by merger. It records number of records of each source raw object at merge time. Compaction saves manifest of compacted object with sources of compacted objects if all of them have manifest, and deletes manifests of compacted objects with them. Purge does not update it.
+type MergeManifest struct {
+	Object   S3Object              `json:"object"`
+	Schema   ParquetSchemaName     `json:"schema"`
+	Rows     int64                 `json:"rows"`
+	MergedAt time.Time             `json:"merged_at"`
+	Sources  []*MergeManifestEntry `json:"sources"`
+}
+
+// MergeManifestEntry is a source raw object of merged object
+type MergeManifestEntry struct {
+	Object  S3Object `json:"object"`
+	Records int64    `json:"records"`
+}
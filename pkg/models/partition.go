@@ -0,0 +1,167 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TagPartitionKey is name of partition key for tag. It's not "tag" because indices table already has "tag" column and Athena does not allow same name for column and partition key.
+const TagPartitionKey = "tag_group"
+
+// CompactionStagingDir is directory under S3 prefix for staging location of compaction. Catalog partition that has location in it is being compacted.
+const CompactionStagingDir = "compaction/"
+
+// TagGroup is set of tags that are stored in same partition.
+type TagGroup struct {
+	Name string `json:"name"`
+	// Tags is glob patterns of tag, e.g. "aws.*"
+	Tags []string `json:"tags"`
+}
+
+// TagPartition is configuration of partitioning by tag. It's JSON format and given by TAG_PARTITION. Tag partitioning is disabled if TAG_PARTITION is empty. Changing the configuration requires new Athena tables because partition keys of existing tables can not be changed.
+type TagPartition struct {
+	// Groups are checked in order and first matched group is used. If no group matches, tag itself is used as partition value. Then empty Groups means one partition per tag.
+	Groups []TagGroup `json:"groups"`
+	// Default is partition value for tag that does not match any group. Empty means tag itself.
+	Default string `json:"default"`
+}
+
+var invalidPartitionChars = regexp.MustCompile(`[^A-Za-z0-9._\-]`)
+
+// ParseTagPartition parses JSON of TagPartition. It returns nil without error if raw is empty.
+func ParseTagPartition(raw string) (*TagPartition, error) {
+	if raw == "" {
+		return nil, nil
+	}
+
+	var tp TagPartition
+	if err := json.Unmarshal([]byte(raw), &tp); err != nil {
+		return nil, errors.Wrap(err, "Fail to parse tag partition config")
+	}
+
+	for i, group := range tp.Groups {
+		if group.Name == "" {
+			return nil, fmt.Errorf("'name' is required in tag group #%d", i)
+		}
+		if invalidPartitionChars.MatchString(group.Name) {
+			return nil, fmt.Errorf("Invalid character in name of tag group #%d: %s", i, group.Name)
+		}
+		for _, tag := range group.Tags {
+			if _, err := path.Match(tag, ""); err != nil {
+				return nil, fmt.Errorf("Invalid tag pattern in tag group #%d: %s", i, tag)
+			}
+		}
+	}
+	if invalidPartitionChars.MatchString(tp.Default) {
+		return nil, fmt.Errorf("Invalid character in default of tag partition: %s", tp.Default)
+	}
+
+	return &tp, nil
+}
+
+// Value returns partition value of the tag. Characters that can not be used in S3 path and SQL literal safely are replaced with "_". It returns empty string if x is nil (tag partitioning is disabled).
+func (x *TagPartition) Value(tag string) string {
+	if x == nil {
+		return ""
+	}
+
+	for _, group := range x.Groups {
+		for _, ptn := range group.Tags {
+			if matched, _ := path.Match(ptn, tag); matched {
+				return group.Name
+			}
+		}
+	}
+
+	if x.Default != "" {
+		return x.Default
+	}
+	if tag == "" {
+		return "_"
+	}
+	return invalidPartitionChars.ReplaceAllString(tag, "_")
+}
+
+// DTGranularity is unit of time for "dt" partition key.
+type DTGranularity string
+
+// Granularity of "dt" partition
+const (
+	DTHourly DTGranularity = "hourly"
+	DTDaily  DTGranularity = "daily"
+)
+
+// Formats of "dt" partition value. Both formats can be compared as string with each other in same prefix of date.
+const (
+	DTHourlyFormat = "2006-01-02-15"
+	DTDailyFormat  = "2006-01-02"
+)
+
+// ParseDTGranularity converts value of PARTITION_GRANULARITY. Empty string means hourly for backward compatibility.
+func ParseDTGranularity(s string) (DTGranularity, error) {
+	switch DTGranularity(s) {
+	case "", DTHourly:
+		return DTHourly, nil
+	case DTDaily:
+		return DTDaily, nil
+	default:
+		return "", fmt.Errorf("Invalid partition granularity, must be 'hourly' or 'daily': %s", s)
+	}
+}
+
+// ParseProjectedGranularity converts values of PARTITION_PROJECTION and PARTITION_GRANULARITY to granularity of projected "dt". Empty granularity is returned without projection, because tables then may have partitions of both hourly and daily.
+func ParseProjectedGranularity(projection bool, granularity string) (DTGranularity, error) {
+	if !projection {
+		return "", nil
+	}
+	return ParseDTGranularity(granularity)
+}
+
+// Format returns "dt" partition value of the timestamp.
+func (x DTGranularity) Format(ts time.Time) string {
+	if x == DTDaily {
+		return ts.Format(DTDailyFormat)
+	}
+	return ts.Format(DTHourlyFormat)
+}
+
+// DTSpan returns time span of "dt" value of both hourly and daily. false is returned if dt is invalid.
+func DTSpan(dt string) (time.Time, time.Time, bool) {
+	if t, err := time.Parse(DTHourlyFormat, dt); err == nil {
+		return t, t.Add(time.Hour), true
+	} else if t, err := time.Parse(DTDailyFormat, dt); err == nil {
+		return t, t.Add(24 * time.Hour), true
+	}
+	return time.Time{}, time.Time{}, false
+}
+
+// DTCondition returns SQL condition of "dt" partition for both of hourly (2006-01-02-15) and daily (2006-01-02) partitions. Both conditions are required by default because partitions of both granularity exist in migration period. Daily partitions are specified by IN instead of range because daily value is less than hourly values of same day as string. If *projected* is given, only condition of the granularity is returned because projected table can not parse value of other format.
+func DTCondition(column string, start, end time.Time, projected DTGranularity) string {
+	hourly := fmt.Sprintf("('%s' <= %s AND %s <= '%s')",
+		start.Format(DTHourlyFormat), column,
+		column, end.Format(DTHourlyFormat))
+
+	var days []string
+	for d := start.Truncate(24 * time.Hour); !d.After(end); d = d.Add(24 * time.Hour) {
+		days = append(days, fmt.Sprintf("'%s'", d.Format(DTDailyFormat)))
+	}
+	if len(days) == 0 { // end is before start, no partition matches anyway
+		return hourly
+	}
+	daily := fmt.Sprintf("%s IN (%s)", column, strings.Join(days, ", "))
+
+	switch projected {
+	case DTHourly:
+		return hourly
+	case DTDaily:
+		return daily
+	default:
+		return fmt.Sprintf("(%s \nOR %s)", hourly, daily)
+	}
+}
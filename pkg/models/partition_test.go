@@ -0,0 +1,95 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTagPartition(t *testing.T) {
+	t.Run("disabled", func(tt *testing.T) {
+		tp, err := ParseTagPartition("")
+		require.NoError(tt, err)
+		assert.Nil(tt, tp)
+		assert.Equal(tt, "", tp.Value("aws.cloudtrail"))
+	})
+
+	t.Run("tag itself", func(tt *testing.T) {
+		tp, err := ParseTagPartition(`{}`)
+		require.NoError(tt, err)
+		assert.Equal(tt, "aws.cloudtrail", tp.Value("aws.cloudtrail"))
+		assert.Equal(tt, "my_app_log", tp.Value("my/app log"))
+	})
+
+	t.Run("groups and default", func(tt *testing.T) {
+		tp, err := ParseTagPartition(`{"groups":[{"name":"trail","tags":["aws.cloudtrail"]},{"name":"aws","tags":["aws.*"]}],"default":"other"}`)
+		require.NoError(tt, err)
+		assert.Equal(tt, "trail", tp.Value("aws.cloudtrail"))
+		assert.Equal(tt, "aws", tp.Value("aws.vpcflow"))
+		assert.Equal(tt, "other", tp.Value("gcp.audit"))
+	})
+
+	t.Run("invalid config", func(tt *testing.T) {
+		_, err := ParseTagPartition(`{"groups":[{"name":"a/b","tags":["x"]}]}`)
+		assert.Error(tt, err)
+		_, err = ParseTagPartition(`{"groups":[{"name":"","tags":["x"]}]}`)
+		assert.Error(tt, err)
+		_, err = ParseTagPartition(`{"groups":[{"name":"a","tags":["["]}]}`)
+		assert.Error(tt, err)
+	})
+}
+
+func TestRawObjectPartition(t *testing.T) {
+	base := NewS3Object("ap-northeast-1", "dst", "prefix/")
+	src := NewS3Object("ap-northeast-1", "src", "logs/obj.gz")
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	t.Run("dt only", func(tt *testing.T) {
+		obj := NewRawObject(NewRawObjectPrefix(ParquetSchemaIndex, base, src, ts, DTHourly, ""), "msg")
+		assert.Equal(tt, "dt=2020-01-02-03", obj.Partition())
+		assert.Equal(tt, map[string]string{"dt": "2020-01-02-03"}, obj.PartitionKeys())
+		assert.Equal(tt, "s3://dst/prefix/indices/dt=2020-01-02-03/", obj.PartitionPath())
+	})
+
+	t.Run("dt and tag", func(tt *testing.T) {
+		obj := NewRawObject(NewRawObjectPrefix(ParquetSchemaIndex, base, src, ts, DTHourly, "aws"), "msg")
+		assert.Equal(tt, "dt=2020-01-02-03/tag_group=aws", obj.Partition())
+		assert.Equal(tt, map[string]string{"dt": "2020-01-02-03", "tag_group": "aws"}, obj.PartitionKeys())
+		assert.Equal(tt, "s3://dst/prefix/indices/dt=2020-01-02-03/tag_group=aws/", obj.PartitionPath())
+		assert.Contains(tt, obj.Object().Key, "prefix/raw/indices/dt=2020-01-02-03/tag_group=aws/src/logs/obj.gz/")
+		assert.Equal(tt, "prefix/indices/dt=2020-01-02-03/tag_group=aws/merged-k1.parquet",
+			BuildMergedS3ObjectKey("prefix/", string(ParquetSchemaIndex), obj.Partition(), "k1"))
+	})
+}
+
+func TestDTGranularity(t *testing.T) {
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	g, err := ParseDTGranularity("")
+	require.NoError(t, err)
+	assert.Equal(t, "2020-01-02-03", g.Format(ts))
+
+	g, err = ParseDTGranularity("daily")
+	require.NoError(t, err)
+	assert.Equal(t, "2020-01-02", g.Format(ts))
+
+	_, err = ParseDTGranularity("minutely")
+	assert.Error(t, err)
+
+	g, err = ParseProjectedGranularity(false, "daily")
+	require.NoError(t, err)
+	assert.Equal(t, DTGranularity(""), g)
+	g, err = ParseProjectedGranularity(true, "")
+	require.NoError(t, err)
+	assert.Equal(t, DTHourly, g)
+	_, err = ParseProjectedGranularity(true, "minutely")
+	assert.Error(t, err)
+
+	base := NewS3Object("ap-northeast-1", "dst", "prefix/")
+	src := NewS3Object("ap-northeast-1", "src", "logs/obj.gz")
+	obj := NewRawObject(NewRawObjectPrefix(ParquetSchemaMessage, base, src, ts, DTDaily, ""), "msg")
+	assert.Equal(t, "dt=2020-01-02", obj.Partition())
+	assert.Equal(t, "s3://dst/prefix/messages/dt=2020-01-02/", obj.PartitionPath())
+}
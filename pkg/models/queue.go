@@ -28,6 +28,19 @@ type PartitionQueue struct {
 	Keys      map[string]string `json:"keys"`
 }
 
+// DetectionEvent is sent by indexer when a log matches with threat intel indicator
+type DetectionEvent struct {
+	Tag           string   `json:"tag"`
+	Timestamp     int64    `json:"timestamp"`
+	ObjectID      int64    `json:"object_id"`
+	Seq           int32    `json:"seq"`
+	Src           S3Object `json:"src"`
+	Field         string   `json:"field"`
+	Indicator     string   `json:"indicator"`
+	IndicatorType string   `json:"indicator_type"`
+	Feed          string   `json:"feed"`
+}
+
 // LogQueue is used in indexer
 type LogQueue struct {
 	Err       error
@@ -31,15 +31,17 @@ type RawObjectPrefix struct {
 	src    S3Object
 	base   S3Object
 	dtKey  string
+	tagKey string
 }
 
-// NewRawObjectPrefix is constructor of RawObjectPrefix. *base* must has destination S3 bucket and prefix. *src* indicates S3 object of original logs. *ts* is log timestamp to identify partition.
-func NewRawObjectPrefix(schema ParquetSchemaName, base, src S3Object, ts time.Time) *RawObjectPrefix {
+// NewRawObjectPrefix is constructor of RawObjectPrefix. *base* must has destination S3 bucket and prefix. *src* indicates S3 object of original logs. *ts* is log timestamp to identify partition, and it's formatted by *granularity*. *tagKey* is value of tag partition (see TagPartition.Value), and empty *tagKey* means no tag partition.
+func NewRawObjectPrefix(schema ParquetSchemaName, base, src S3Object, ts time.Time, granularity DTGranularity, tagKey string) *RawObjectPrefix {
 	return &RawObjectPrefix{
 		schema: schema,
 		base:   base,
 		src:    src,
-		dtKey:  ts.Format("2006-01-02-15"),
+		dtKey:  granularity.Format(ts),
+		tagKey: tagKey,
 	}
 }
 
@@ -48,6 +50,7 @@ func (x *RawObjectPrefix) Key() string {
 	return strings.Join([]string{
 		string(x.schema),
 		x.dtKey,
+		x.tagKey,
 		x.src.Bucket,
 		x.src.Key,
 	}, "/")
@@ -56,13 +59,16 @@ func (x *RawObjectPrefix) Key() string {
 // Schema is getter of schema
 func (x *RawObjectPrefix) Schema() ParquetSchemaName { return x.schema }
 
-// Partition returns a part of path
+// Partition returns a part of path. e.g.) dt=2020-01-02-03 or dt=2020-01-02-03/tag_group=aws
 func (x *RawObject) Partition() string {
+	if x.prefix.tagKey != "" {
+		return fmt.Sprintf("dt=%s/%s=%s", x.prefix.dtKey, TagPartitionKey, x.prefix.tagKey)
+	}
 	return fmt.Sprintf("dt=%s", x.prefix.dtKey)
 }
 
 // PartitionPath returns S3 path to top of the partition. The path including s3:// prefix and bucket name.
-// e.g.) s3://your-bucket/prefix/indicies/dt=2020-01-02-03/
+// e.g.) s3://your-bucket/prefix/indicies/dt=2020-01-02-03/ or s3://your-bucket/prefix/indicies/dt=2020-01-02/ (daily)
 func (x *RawObject) PartitionPath() string {
 	return x.prefix.base.AppendKey(strings.Join([]string{
 		x.TableName(), x.Partition(), "",
@@ -71,9 +77,13 @@ func (x *RawObject) PartitionPath() string {
 
 // PartitionKeys returns map of partition name and value
 func (x *RawObject) PartitionKeys() map[string]string {
-	return map[string]string{
+	keys := map[string]string{
 		"dt": x.prefix.dtKey,
 	}
+	if x.prefix.tagKey != "" {
+		keys[TagPartitionKey] = x.prefix.tagKey
+	}
+	return keys
 }
 
 // TableName returns Athena table name as string type
@@ -93,6 +103,40 @@ func (x *RawObject) Schema() string {
 	return string(x.prefix.schema)
 }
 
+// ParseRawObjectKey extracts schema and partition from S3 key of RawObject. *prefix* is S3 key prefix of base object. It returns false if the key is not RawObject.
+func ParseRawObjectKey(prefix, key string) (ParquetSchemaName, string, bool) {
+	if !strings.HasPrefix(key, prefix+"raw/") {
+		return "", "", false
+	}
+
+	// e.g.) indices/dt=2020-01-02-03/tag_group=aws/src-bucket/src/key.log/uuid.msg.gz
+	parts := strings.Split(strings.TrimPrefix(key, prefix+"raw/"), "/")
+	if len(parts) < 4 || !strings.HasPrefix(parts[1], "dt=") {
+		return "", "", false
+	}
+
+	var schema ParquetSchemaName
+	switch parts[0] {
+	case string(AthenaTableIndex):
+		schema = ParquetSchemaIndex
+	case AthenaTableMessage:
+		schema = ParquetSchemaMessage
+	default:
+		return "", "", false
+	}
+
+	partition := parts[1]
+	// S3 bucket name of source object never has "="
+	if strings.HasPrefix(parts[2], TagPartitionKey+"=") {
+		if len(parts) < 5 {
+			return "", "", false
+		}
+		partition += "/" + parts[2]
+	}
+
+	return schema, partition, true
+}
+
 // Object returns
 func (x *RawObject) Object() *S3Object {
 	additionalKey := strings.Join([]string{
@@ -0,0 +1,48 @@
+package models_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/minerva/pkg/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRawObjectKey(t *testing.T) {
+	base := models.NewS3Object("ap-northeast-1", "data-bucket", "prefix/")
+	src := models.NewS3Object("ap-northeast-1", "log-bucket", "logs/2020/01/02/x.log.gz")
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	t.Run("without tag partition", func(tt *testing.T) {
+		prefix := models.NewRawObjectPrefix(models.ParquetSchemaIndex, base, src, ts, models.DTHourly, "")
+		obj := models.NewRawObject(prefix, "msg.gz")
+
+		schema, partition, ok := models.ParseRawObjectKey("prefix/", obj.Object().Key)
+		assert.True(tt, ok)
+		assert.Equal(tt, models.ParquetSchemaIndex, schema)
+		assert.Equal(tt, obj.Partition(), partition)
+	})
+
+	t.Run("with tag partition", func(tt *testing.T) {
+		prefix := models.NewRawObjectPrefix(models.ParquetSchemaMessage, base, src, ts, models.DTDaily, "aws")
+		obj := models.NewRawObject(prefix, "msg.gz")
+
+		schema, partition, ok := models.ParseRawObjectKey("prefix/", obj.Object().Key)
+		assert.True(tt, ok)
+		assert.Equal(tt, models.ParquetSchemaMessage, schema)
+		assert.Equal(tt, "dt=2020-01-02/tag_group=aws", partition)
+	})
+
+	t.Run("not raw object", func(tt *testing.T) {
+		for _, key := range []string{
+			"prefix/indices/dt=2020-01-02-03/merged-x.parquet",
+			"other/raw/indices/dt=2020-01-02-03/b/k/x.msg.gz",
+			"prefix/raw/unknown/dt=2020-01-02-03/b/k/x.msg.gz",
+			"prefix/raw/indices/2020-01-02-03/b/k/x.msg.gz",
+			"prefix/raw/indices/dt=2020-01-02-03/x.msg.gz",
+		} {
+			_, _, ok := models.ParseRawObjectKey("prefix/", key)
+			assert.False(tt, ok, key)
+		}
+	})
+}
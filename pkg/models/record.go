@@ -20,5 +20,5 @@ type MessageRecord struct {
 	Timestamp int64  `parquet:"name=timestamp, type=INT64" json:"timestamp" msgpack:"timestamp"`
 	ObjectID  int64  `parquet:"name=object_id, type=INT64" json:"object_id" msgpack:"object_id"`
 	Seq       int32  `parquet:"name=seq, type=INT32" json:"seq" msgpack:"seq"`
-	Message   string `parquet:"name=message, type=UTF8, encoding=PLAIN_DICTIONARY" json:"message" msgpack:"message"`
+	Message   string `parquet:"name=message, type=UTF8, encoding=PLAIN" json:"message" msgpack:"message"`
 }
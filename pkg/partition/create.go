@@ -0,0 +1,157 @@
+// Package partition manages partitions of Athena tables in Glue Data Catalog.
+package partition
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/glue"
+	"github.com/m-mizutani/minerva/internal"
+	"github.com/m-mizutani/minerva/internal/adaptor"
+	"github.com/m-mizutani/minerva/internal/service"
+	"github.com/m-mizutani/minerva/pkg/models"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var logger = internal.Logger
+
+// maxPartitionsPerBatch is limit of BatchCreatePartition API
+const maxPartitionsPerBatch = 100
+
+type partitionEntry struct {
+	queue  *models.PartitionQueue
+	values []string
+}
+
+// Create registers partitions to Glue Data Catalog by BatchCreatePartition. A partition is marked in MetaService only after Glue accepts it (or it already exists), then failed partition can be retried. Marker of partition is not checked here, caller should skip marked partitions if required.
+func Create(client adaptor.GlueClient, athenaDB string, queues []*models.PartitionQueue, meta *service.MetaService) error {
+	var tableNames []string
+	tableQueues := map[string][]*models.PartitionQueue{}
+	seen := map[string]bool{}
+
+	for _, q := range queues {
+		if seen[q.Location] {
+			continue
+		}
+		seen[q.Location] = true
+
+		if _, ok := tableQueues[q.TableName]; !ok {
+			tableNames = append(tableNames, q.TableName)
+		}
+		tableQueues[q.TableName] = append(tableQueues[q.TableName], q)
+	}
+
+	var failed []string
+	for _, tableName := range tableNames {
+		errs, err := createTablePartitions(client, athenaDB, tableName, tableQueues[tableName], meta)
+		if err != nil {
+			return err
+		}
+		failed = append(failed, errs...)
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("Fail to create %d partitions: %s", len(failed), strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+func createTablePartitions(client adaptor.GlueClient, athenaDB, tableName string, queues []*models.PartitionQueue, meta *service.MetaService) ([]string, error) {
+	resp, err := client.GetTable(&glue.GetTableInput{
+		DatabaseName: aws.String(athenaDB),
+		Name:         aws.String(tableName),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to get Glue table: %s.%s", athenaDB, tableName)
+	}
+	table := resp.Table
+	if table.StorageDescriptor == nil {
+		return nil, fmt.Errorf("Glue table has no StorageDescriptor: %s.%s", athenaDB, tableName)
+	}
+
+	// Values must be in order of partition keys of table
+	var entries []*partitionEntry
+	for _, q := range queues {
+		entry := &partitionEntry{queue: q}
+		for _, col := range table.PartitionKeys {
+			v, ok := q.Keys[aws.StringValue(col.Name)]
+			if !ok {
+				return nil, fmt.Errorf("Partition key '%s' of %s is not in queue: %v", aws.StringValue(col.Name), tableName, q.Keys)
+			}
+			entry.values = append(entry.values, v)
+		}
+		if len(entry.values) != len(q.Keys) {
+			return nil, fmt.Errorf("Queue has unknown partition key for %s: %v", tableName, q.Keys)
+		}
+		entries = append(entries, entry)
+	}
+
+	var failed []string
+	for i := 0; i < len(entries); i += maxPartitionsPerBatch {
+		end := i + maxPartitionsPerBatch
+		if end > len(entries) {
+			end = len(entries)
+		}
+
+		errs, err := batchCreatePartition(client, athenaDB, table, entries[i:end], meta)
+		if err != nil {
+			return nil, err
+		}
+		failed = append(failed, errs...)
+	}
+
+	return failed, nil
+}
+
+func batchCreatePartition(client adaptor.GlueClient, athenaDB string, table *glue.TableData, entries []*partitionEntry, meta *service.MetaService) ([]string, error) {
+	input := &glue.BatchCreatePartitionInput{
+		DatabaseName: aws.String(athenaDB),
+		TableName:    table.Name,
+	}
+	for _, entry := range entries {
+		sd := *table.StorageDescriptor
+		sd.Location = aws.String(entry.queue.Location)
+		input.PartitionInputList = append(input.PartitionInputList, &glue.PartitionInput{
+			Values:            aws.StringSlice(entry.values),
+			StorageDescriptor: &sd,
+		})
+	}
+
+	logger.WithFields(logrus.Fields{
+		"table":      aws.StringValue(table.Name),
+		"partitions": len(entries),
+	}).Info("BatchCreatePartition")
+
+	output, err := client.BatchCreatePartition(input)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to BatchCreatePartition: %s", aws.StringValue(table.Name))
+	}
+
+	errorCodes := map[string]*glue.ErrorDetail{}
+	for _, pe := range output.Errors {
+		errorCodes[strings.Join(aws.StringValueSlice(pe.PartitionValues), "/")] = pe.ErrorDetail
+	}
+
+	var failed []string
+	for _, entry := range entries {
+		detail, hasError := errorCodes[strings.Join(entry.values, "/")]
+		if hasError && aws.StringValue(detail.ErrorCode) != glue.ErrCodeAlreadyExistsException {
+			logger.WithFields(logrus.Fields{
+				"location": entry.queue.Location,
+				"code":     aws.StringValue(detail.ErrorCode),
+				"message":  aws.StringValue(detail.ErrorMessage),
+			}).Error("Fail to create partition")
+			failed = append(failed, entry.queue.Location)
+			continue
+		}
+
+		if err := meta.PutPartition(entry.queue.Location); err != nil {
+			return nil, err
+		}
+	}
+
+	return failed, nil
+}
@@ -0,0 +1,408 @@
+package partition
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/glue"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/google/uuid"
+	"github.com/m-mizutani/minerva/internal/adaptor"
+	"github.com/m-mizutani/minerva/internal/service"
+	"github.com/m-mizutani/minerva/pkg/models"
+	"github.com/pkg/errors"
+)
+
+// Actions of repair
+const (
+	// ActionAdd means data exists in S3, but partition is not in catalog
+	ActionAdd = "add"
+	// ActionDrop means partition is in catalog, but no data in S3
+	ActionDrop = "drop"
+	// ActionMark means partition is in both of S3 and catalog, but marker in meta table is missing
+	ActionMark = "mark"
+)
+
+const (
+	// maxDeletePartitionsPerBatch is limit of BatchDeletePartition API
+	maxDeletePartitionsPerBatch = 25
+
+	// DefaultRepairMergeWindow is default of Repairer.MergeWindow
+	DefaultRepairMergeWindow = time.Hour
+)
+
+// Change is a difference between S3, catalog and meta table
+type Change struct {
+	Action    string `json:"action"`
+	Table     string `json:"table"`
+	Partition string `json:"partition"`
+	Location  string `json:"location"`
+
+	keys   map[string]string
+	values []string
+}
+
+func (x *Change) String() string {
+	mark := map[string]string{ActionAdd: "+", ActionDrop: "-", ActionMark: "~"}[x.Action]
+	return fmt.Sprintf("%s %-4s %s/%s %s", mark, x.Action, x.Table, x.Partition, x.Location)
+}
+
+// Repairer reconciles partitions of S3 (merged objects), Glue Data Catalog and markers in meta table. Partition is locked by MetaService.LockPartition while changing it because compaction, retention and purge also modify the partition, and partition locked by them is skipped.
+type Repairer struct {
+	S3       adaptor.S3Client
+	Glue     adaptor.GlueClient
+	Meta     *service.MetaService
+	Bucket   string
+	Prefix   string
+	Database string
+	// Tables is target Athena tables. Default is indices and messages.
+	Tables []string
+	// MergeWindow is period that raw objects can be waiting to be merged. Partition that has "dt" after now - MergeWindow is not repaired because merged objects and partition of it may be being created. Default is DefaultRepairMergeWindow.
+	MergeWindow time.Duration
+	// DryRun only returns changes without modification.
+	DryRun bool
+}
+
+type partitionInfo struct {
+	location string
+	values   []string
+}
+
+// Repair checks partitions that have "dt" in range from begin to end and fixes them. It returns all found changes, but changes of partitions locked by other job are not included.
+func (x *Repairer) Repair(begin, end, now time.Time) ([]*Change, error) {
+	tables := x.Tables
+	if len(tables) == 0 {
+		tables = []string{string(models.AthenaTableIndex), models.AthenaTableMessage}
+	}
+
+	window := x.MergeWindow
+	if window == 0 {
+		window = DefaultRepairMergeWindow
+	}
+	limit := now.Add(-window)
+
+	owner := "repair:" + uuid.New().String()
+	var changes []*Change
+	for _, table := range tables {
+		tableChanges, err := x.repairTable(table, begin, end, limit, owner)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, tableChanges...)
+	}
+
+	return changes, nil
+}
+
+func (x *Repairer) repairTable(table string, begin, end, limit time.Time, owner string) ([]*Change, error) {
+	keys, err := getPartitionKeys(x.Glue, x.Database, table)
+	if err != nil {
+		return nil, err
+	}
+
+	// Partition that has data after limit may be being merged
+	inRange := func(values []string) bool {
+		_, to, ok := models.DTSpan(values[0])
+		return ok && !to.After(limit) && dtInRange(values[0], begin, end)
+	}
+	inS3, err := listS3Partitions(x.S3, x.Bucket, x.Prefix+table+"/", keys, inRange)
+	if err != nil {
+		return nil, err
+	}
+	inCatalog, err := listCatalogPartitions(x.Glue, x.Database, table, inRange)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []*Change
+	newChange := func(action string, p *partitionInfo) *Change {
+		c := &Change{
+			Action:   action,
+			Table:    table,
+			Location: p.location,
+			keys:     map[string]string{},
+			values:   p.values,
+		}
+		var parts []string
+		for i, k := range keys {
+			parts = append(parts, k+"="+p.values[i])
+			c.keys[k] = p.values[i]
+		}
+		c.Partition = strings.Join(parts, "/")
+		return c
+	}
+
+	for key, p := range inS3 {
+		if _, ok := inCatalog[key]; !ok {
+			changes = append(changes, newChange(ActionAdd, p))
+			continue
+		}
+
+		has, err := x.Meta.HeadPartition(p.location)
+		if err != nil {
+			return nil, err
+		}
+		if !has {
+			changes = append(changes, newChange(ActionMark, p))
+		}
+	}
+	staging := fmt.Sprintf("s3://%s/%s%s", x.Bucket, x.Prefix, models.CompactionStagingDir)
+	for key, p := range inCatalog {
+		if _, ok := inS3[key]; ok {
+			continue
+		}
+
+		c := newChange(ActionDrop, p)
+		if strings.HasPrefix(p.location, staging) {
+			logger.WithField("change", c.String()).Warn("Partition is being compacted, skip drop")
+			continue
+		}
+
+		// Raw objects will be merged into the partition
+		raw := x.Prefix + "raw/" + table + "/" + c.Partition + "/"
+		output, err := x.S3.ListObjectsV2(&s3.ListObjectsV2Input{
+			Bucket:  aws.String(x.Bucket),
+			Prefix:  aws.String(raw),
+			MaxKeys: aws.Int64(1),
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "Fail to list raw objects: s3://%s/%s", x.Bucket, raw)
+		}
+		if len(output.Contents) > 0 {
+			logger.WithField("change", c.String()).Warn("Partition has raw objects that are not merged yet, skip drop")
+			continue
+		}
+
+		changes = append(changes, c)
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Partition < changes[j].Partition
+	})
+
+	if x.DryRun {
+		return changes, nil
+	}
+
+	locked, unlock, err := x.lock(changes, owner)
+	defer unlock()
+	if err != nil {
+		return nil, err
+	}
+	if err := x.apply(table, locked); err != nil {
+		return nil, err
+	}
+
+	return locked, nil
+}
+
+// lock locks partitions of changes and returns changes of locked partitions. Change of partition locked by other job is skipped.
+func (x *Repairer) lock(changes []*Change, owner string) ([]*Change, func(), error) {
+	var locked []*Change
+	unlock := func() {
+		for _, c := range locked {
+			if err := x.Meta.UnlockPartition(c.Location, owner); err != nil {
+				logger.WithError(err).WithField("location", c.Location).Error("Fail to unlock partition")
+			}
+		}
+	}
+
+	for _, c := range changes {
+		ok, err := x.Meta.LockPartition(c.Location, owner)
+		if err != nil {
+			return nil, unlock, err
+		}
+		if !ok {
+			logger.WithField("change", c.String()).Warn("Partition is locked by other job, skip repair")
+			continue
+		}
+		locked = append(locked, c)
+	}
+
+	return locked, unlock, nil
+}
+
+func (x *Repairer) apply(table string, changes []*Change) error {
+	var queues []*models.PartitionQueue
+	var drops []*Change
+	for _, c := range changes {
+		switch c.Action {
+		case ActionAdd:
+			queues = append(queues, &models.PartitionQueue{
+				Location:  c.Location,
+				TableName: table,
+				Keys:      c.keys,
+			})
+		case ActionMark:
+			if err := x.Meta.PutPartition(c.Location); err != nil {
+				return err
+			}
+		case ActionDrop:
+			drops = append(drops, c)
+		}
+	}
+
+	if len(queues) > 0 {
+		if err := Create(x.Glue, x.Database, queues, x.Meta); err != nil {
+			return err
+		}
+	}
+
+	var values [][]string
+	for _, c := range drops {
+		values = append(values, c.values)
+	}
+	if err := dropCatalogPartitions(x.Glue, x.Database, table, values); err != nil {
+		return err
+	}
+	for _, c := range drops {
+		if err := x.Meta.DeletePartition(c.Location); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getPartitionKeys returns names of partition keys of the table. First key must be "dt".
+func getPartitionKeys(client adaptor.GlueClient, db, table string) ([]string, error) {
+	resp, err := client.GetTable(&glue.GetTableInput{
+		DatabaseName: aws.String(db),
+		Name:         aws.String(table),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to get Glue table: %s.%s", db, table)
+	}
+
+	var keys []string
+	for _, col := range resp.Table.PartitionKeys {
+		keys = append(keys, aws.StringValue(col.Name))
+	}
+	if len(keys) == 0 || keys[0] != "dt" {
+		return nil, fmt.Errorf("First partition key of %s must be dt: %v", table, keys)
+	}
+
+	return keys, nil
+}
+
+// dropCatalogPartitions deletes partitions by BatchDeletePartition. Not existing partition is ignored.
+func dropCatalogPartitions(client adaptor.GlueClient, db, table string, values [][]string) error {
+	for i := 0; i < len(values); i += maxDeletePartitionsPerBatch {
+		end := i + maxDeletePartitionsPerBatch
+		if end > len(values) {
+			end = len(values)
+		}
+
+		input := &glue.BatchDeletePartitionInput{
+			DatabaseName: aws.String(db),
+			TableName:    aws.String(table),
+		}
+		for _, v := range values[i:end] {
+			input.PartitionsToDelete = append(input.PartitionsToDelete, &glue.PartitionValueList{
+				Values: aws.StringSlice(v),
+			})
+		}
+		output, err := client.BatchDeletePartition(input)
+		if err != nil {
+			return errors.Wrapf(err, "Fail to BatchDeletePartition: %s", table)
+		}
+		for _, pe := range output.Errors {
+			if aws.StringValue(pe.ErrorDetail.ErrorCode) != glue.ErrCodeEntityNotFoundException {
+				return fmt.Errorf("Fail to delete partition %v of %s: %s", aws.StringValueSlice(pe.PartitionValues), table, aws.StringValue(pe.ErrorDetail.ErrorMessage))
+			}
+		}
+	}
+
+	return nil
+}
+
+// listS3Partitions finds directories such as "dt=2020-01-02-03/" in prefix of the table. Directory is found only if it has any object. *match* is called with values of each depth (e.g. [dt] and then [dt, tag_group]) to skip needless listing.
+func listS3Partitions(client adaptor.S3Client, bucket, tablePrefix string, keys []string, match func(values []string) bool) (map[string]*partitionInfo, error) {
+	partitions := map[string]*partitionInfo{}
+
+	var walk func(prefix string, values []string) error
+	walk = func(prefix string, values []string) error {
+		if len(values) == len(keys) {
+			partitions[strings.Join(values, "/")] = &partitionInfo{
+				location: fmt.Sprintf("s3://%s/%s", bucket, prefix),
+				values:   values,
+			}
+			return nil
+		}
+
+		dirs, err := service.NewS3ServiceWithClient(client).ListS3Dirs(models.NewS3Object("", bucket, prefix))
+		if err != nil {
+			return err
+		}
+
+		key := keys[len(values)]
+		for _, dir := range dirs {
+			name := strings.TrimSuffix(strings.TrimPrefix(dir, prefix), "/")
+			if !strings.HasPrefix(name, key+"=") {
+				continue
+			}
+			next := append(append([]string{}, values...), strings.TrimPrefix(name, key+"="))
+			if !match(next) {
+				continue
+			}
+
+			if err := walk(dir, next); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := walk(tablePrefix, nil); err != nil {
+		return nil, err
+	}
+	return partitions, nil
+}
+
+// listCatalogPartitions returns partitions of table in Glue Data Catalog that *match* returns true with values.
+func listCatalogPartitions(client adaptor.GlueClient, db, table string, match func(values []string) bool) (map[string]*partitionInfo, error) {
+	partitions := map[string]*partitionInfo{}
+	input := &glue.GetPartitionsInput{
+		DatabaseName: aws.String(db),
+		TableName:    aws.String(table),
+	}
+
+	for {
+		output, err := client.GetPartitions(input)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Fail to get partitions: %s.%s", db, table)
+		}
+
+		for _, p := range output.Partitions {
+			values := aws.StringValueSlice(p.Values)
+			if len(values) == 0 || !match(values) {
+				continue
+			}
+
+			info := &partitionInfo{values: values}
+			if p.StorageDescriptor != nil {
+				info.location = aws.StringValue(p.StorageDescriptor.Location)
+			}
+			partitions[strings.Join(values, "/")] = info
+		}
+
+		if output.NextToken == nil {
+			break
+		}
+		input.NextToken = output.NextToken
+	}
+
+	return partitions, nil
+}
+
+// dtInRange checks if time span of dt (hourly or daily) overlaps with range from begin to end. Invalid dt is not in range.
+func dtInRange(dt string, begin, end time.Time) bool {
+	from, to, ok := models.DTSpan(dt)
+	if !ok {
+		return false
+	}
+
+	return from.Before(end.Add(time.Nanosecond)) && begin.Before(to)
+}
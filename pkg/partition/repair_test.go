@@ -0,0 +1,187 @@
+package partition_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/google/uuid"
+	"github.com/m-mizutani/minerva/internal/adaptor"
+	"github.com/m-mizutani/minerva/internal/mock"
+	"github.com/m-mizutani/minerva/internal/service"
+	"github.com/m-mizutani/minerva/internal/util"
+	"github.com/m-mizutani/minerva/pkg/partition"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRepairer(keys ...string) *partition.Repairer {
+	bucket := "repair-" + uuid.New().String()
+	catalog := mock.NewGlueCatalog()
+	catalog.PutTable("db", "indices", "s3://"+bucket+"/prefix/indices/", keys...)
+
+	return &partition.Repairer{
+		S3:       mock.NewS3Client("ap-northeast-1"),
+		Glue:     catalog,
+		Meta:     service.NewMetaService(mock.NewMetaRepository(), util.NewExpRetryTimer),
+		Bucket:   bucket,
+		Prefix:   "prefix/",
+		Database: "db",
+		Tables:   []string{"indices"},
+	}
+}
+
+func putObject(t *testing.T, client adaptor.S3Client, bucket, key string) {
+	_, err := client.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader([]byte("x")),
+	})
+	require.NoError(t, err)
+}
+
+func indicesLocation(bucket, path string) string {
+	return "s3://" + bucket + "/prefix/indices/" + path
+}
+
+func TestRepair(t *testing.T) {
+	begin := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2020, 1, 2, 23, 59, 59, 0, time.UTC)
+	now := time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)
+
+	setup := func(tt *testing.T) *partition.Repairer {
+		repairer := newRepairer("dt")
+		bucket, catalog := repairer.Bucket, repairer.Glue.(*mock.GlueCatalog)
+		location := func(dt string) string { return indicesLocation(bucket, "dt="+dt+"/") }
+
+		// Data only in S3 (partitioner failed)
+		putObject(tt, repairer.S3, bucket, "prefix/indices/dt=2020-01-02-03/merged-a.parquet")
+		// Data in S3 and catalog, but marker is expired
+		putObject(tt, repairer.S3, bucket, "prefix/indices/dt=2020-01-02-04/merged-b.parquet")
+		catalog.PutPartition("db", "indices", location("2020-01-02-04"), "2020-01-02-04")
+		// Healthy partition (daily)
+		putObject(tt, repairer.S3, bucket, "prefix/indices/dt=2020-01-02/merged-c.parquet")
+		catalog.PutPartition("db", "indices", location("2020-01-02"), "2020-01-02")
+		require.NoError(tt, repairer.Meta.PutPartition(location("2020-01-02")))
+		// Partition without data
+		catalog.PutPartition("db", "indices", location("2020-01-02-05"), "2020-01-02-05")
+		require.NoError(tt, repairer.Meta.PutPartition(location("2020-01-02-05")))
+		// Out of range
+		putObject(tt, repairer.S3, bucket, "prefix/indices/dt=2020-01-03-00/merged-d.parquet")
+		catalog.PutPartition("db", "indices", location("2020-01-01-23"), "2020-01-01-23")
+		// Not a partition
+		putObject(tt, repairer.S3, bucket, "prefix/raw/indices/dt=2020-01-02-06/src-bucket/a.log/a.msg")
+		return repairer
+	}
+
+	t.Run("dry run", func(tt *testing.T) {
+		repairer := setup(tt)
+		repairer.DryRun = true
+
+		changes, err := repairer.Repair(begin, end, now)
+		require.NoError(tt, err)
+		require.Equal(tt, 3, len(changes))
+		assert.Equal(tt, partition.ActionAdd, changes[0].Action)
+		assert.Equal(tt, "dt=2020-01-02-03", changes[0].Partition)
+		assert.Equal(tt, indicesLocation(repairer.Bucket, "dt=2020-01-02-03/"), changes[0].Location)
+		assert.Equal(tt, partition.ActionMark, changes[1].Action)
+		assert.Equal(tt, "dt=2020-01-02-04", changes[1].Partition)
+		assert.Equal(tt, partition.ActionDrop, changes[2].Action)
+		assert.Equal(tt, "dt=2020-01-02-05", changes[2].Partition)
+
+		// Nothing changed
+		assert.Equal(tt, []string{"2020-01-01-23", "2020-01-02", "2020-01-02-04", "2020-01-02-05"}, repairer.Glue.(*mock.GlueCatalog).Partitions("db", "indices"))
+		has, err := repairer.Meta.HeadPartition(indicesLocation(repairer.Bucket, "dt=2020-01-02-04/"))
+		require.NoError(tt, err)
+		assert.False(tt, has)
+	})
+
+	t.Run("apply", func(tt *testing.T) {
+		repairer := setup(tt)
+
+		changes, err := repairer.Repair(begin, end, now)
+		require.NoError(tt, err)
+		assert.Equal(tt, 3, len(changes))
+
+		assert.Equal(tt, []string{"2020-01-01-23", "2020-01-02", "2020-01-02-03", "2020-01-02-04"}, repairer.Glue.(*mock.GlueCatalog).Partitions("db", "indices"))
+		for _, dt := range []string{"2020-01-02-03", "2020-01-02-04"} {
+			has, err := repairer.Meta.HeadPartition(indicesLocation(repairer.Bucket, "dt="+dt+"/"))
+			require.NoError(tt, err)
+			assert.True(tt, has, dt)
+		}
+		has, err := repairer.Meta.HeadPartition(indicesLocation(repairer.Bucket, "dt=2020-01-02-05/"))
+		require.NoError(tt, err)
+		assert.False(tt, has)
+
+		// Second run has no change
+		changes, err = repairer.Repair(begin, end, now)
+		require.NoError(tt, err)
+		assert.Equal(tt, 0, len(changes))
+
+		// Locks are released
+		locked, err := repairer.Meta.LockPartition(indicesLocation(repairer.Bucket, "dt=2020-01-02-03/"), "other")
+		require.NoError(tt, err)
+		assert.True(tt, locked)
+	})
+
+	t.Run("partition in merge window is not repaired", func(tt *testing.T) {
+		repairer := setup(tt)
+		repairer.DryRun = true
+
+		changes, err := repairer.Repair(begin, end, time.Date(2020, 1, 2, 5, 30, 0, 0, time.UTC))
+		require.NoError(tt, err)
+		require.Equal(tt, 1, len(changes))
+		assert.Equal(tt, "dt=2020-01-02-03", changes[0].Partition)
+
+		repairer.MergeWindow = 10 * time.Minute
+		changes, err = repairer.Repair(begin, end, time.Date(2020, 1, 2, 5, 30, 0, 0, time.UTC))
+		require.NoError(tt, err)
+		assert.Equal(tt, 2, len(changes))
+	})
+
+	t.Run("partition that has raw objects is not dropped", func(tt *testing.T) {
+		repairer := setup(tt)
+		putObject(tt, repairer.S3, repairer.Bucket, "prefix/raw/indices/dt=2020-01-02-05/src-bucket/a.log/b.msg")
+
+		changes, err := repairer.Repair(begin, end, now)
+		require.NoError(tt, err)
+		require.Equal(tt, 2, len(changes))
+		assert.Equal(tt, partition.ActionMark, changes[1].Action)
+		assert.Contains(tt, repairer.Glue.(*mock.GlueCatalog).Partitions("db", "indices"), "2020-01-02-05")
+	})
+
+	t.Run("partition locked by other job is skipped", func(tt *testing.T) {
+		repairer := setup(tt)
+		location := indicesLocation(repairer.Bucket, "dt=2020-01-02-05/")
+		locked, err := repairer.Meta.LockPartition(location, "compaction:test")
+		require.NoError(tt, err)
+		require.True(tt, locked)
+
+		changes, err := repairer.Repair(begin, end, now)
+		require.NoError(tt, err)
+		require.Equal(tt, 2, len(changes))
+		assert.Contains(tt, repairer.Glue.(*mock.GlueCatalog).Partitions("db", "indices"), "2020-01-02-05")
+
+		require.NoError(tt, repairer.Meta.UnlockPartition(location, "compaction:test"))
+		changes, err = repairer.Repair(begin, end, now)
+		require.NoError(tt, err)
+		require.Equal(tt, 1, len(changes))
+		assert.Equal(tt, partition.ActionDrop, changes[0].Action)
+	})
+
+	t.Run("tag partition", func(tt *testing.T) {
+		repairer := newRepairer("dt", "tag_group")
+		putObject(tt, repairer.S3, repairer.Bucket, "prefix/indices/dt=2020-01-02-03/tag_group=aws/merged-a.parquet")
+		putObject(tt, repairer.S3, repairer.Bucket, "prefix/indices/dt=2020-01-02-03/tag_group=other/merged-b.parquet")
+
+		changes, err := repairer.Repair(begin, end, now)
+		require.NoError(tt, err)
+		require.Equal(tt, 2, len(changes))
+		assert.Equal(tt, "dt=2020-01-02-03/tag_group=aws", changes[0].Partition)
+		catalog := repairer.Glue.(*mock.GlueCatalog)
+		assert.Equal(tt, []string{"2020-01-02-03/aws", "2020-01-02-03/other"}, catalog.Partitions("db", "indices"))
+		assert.NotNil(tt, catalog.Partition("db", "indices", "2020-01-02-03", "aws"))
+	})
+}
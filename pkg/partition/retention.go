@@ -0,0 +1,464 @@
+package partition
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/google/uuid"
+	"github.com/m-mizutani/minerva/internal/adaptor"
+	"github.com/m-mizutani/minerva/internal/service"
+	"github.com/m-mizutani/minerva/pkg/models"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// RetentionPolicy is configuration of data retention. It's JSON format and given by RETENTION_CONFIG.
+type RetentionPolicy struct {
+	// DefaultDays is retention days of all data. Zero means no expiration.
+	DefaultDays int `json:"default_days"`
+	// Groups is retention days per value of tag partition (tag_group). It works only if tag partitioning is enabled. Zero means no expiration of the group.
+	Groups map[string]int `json:"groups"`
+}
+
+// ParseRetentionPolicy parses JSON of RetentionPolicy. It returns nil without error if raw is empty.
+func ParseRetentionPolicy(raw string) (*RetentionPolicy, error) {
+	if raw == "" {
+		return nil, nil
+	}
+
+	var policy RetentionPolicy
+	if err := json.Unmarshal([]byte(raw), &policy); err != nil {
+		return nil, errors.Wrap(err, "Fail to parse retention config")
+	}
+	if policy.DefaultDays < 0 {
+		return nil, fmt.Errorf("default_days of retention must not be negative: %d", policy.DefaultDays)
+	}
+	for group, days := range policy.Groups {
+		if days < 0 {
+			return nil, fmt.Errorf("Retention days of %s must not be negative: %d", group, days)
+		}
+	}
+
+	return &policy, nil
+}
+
+func (x *RetentionPolicy) daysOf(group string) int {
+	if days, ok := x.Groups[group]; ok {
+		return days
+	}
+	return x.DefaultDays
+}
+
+// minDays returns shortest retention days except no expiration. Zero means no data expires.
+func (x *RetentionPolicy) minDays() int {
+	min := x.DefaultDays
+	for _, days := range x.Groups {
+		if days > 0 && (min == 0 || days < min) {
+			min = days
+		}
+	}
+	return min
+}
+
+// expired checks if all data in partition is older than retention. *values* can be partial (only dt) and then it checks if any group can be expired.
+func (x *RetentionPolicy) expired(keys, values []string, now time.Time) bool {
+	_, end, ok := models.DTSpan(values[0])
+	if !ok {
+		return false
+	}
+
+	days := x.minDays()
+	for i := 1; i < len(values); i++ {
+		if keys[i] == models.TagPartitionKey {
+			days = x.daysOf(values[i])
+		}
+	}
+	if days == 0 {
+		return false
+	}
+
+	return !end.After(now.Add(-time.Duration(days) * 24 * time.Hour))
+}
+
+// ExpiredPartition is a partition deleted by retention
+type ExpiredPartition struct {
+	Table     string `json:"table"`
+	Partition string `json:"partition"`
+	Location  string `json:"location"`
+	Objects   int    `json:"objects"`
+	Bytes     int64  `json:"bytes"`
+	// Error is set if expiration of the partition failed in the middle. Some objects may have been deleted.
+	Error string `json:"error,omitempty"`
+	// Skipped is reason why the partition was not expired, e.g. it's locked by compaction. The partition is expired in next run.
+	Skipped string `json:"skipped,omitempty"`
+}
+
+// RetentionReport is result of a retention run. It's saved after each partition is expired, then the report shows what was deleted even if the run failed.
+type RetentionReport struct {
+	RunAt      time.Time           `json:"run_at"`
+	DryRun     bool                `json:"dry_run"`
+	Policy     RetentionPolicy     `json:"policy"`
+	Partitions []*ExpiredPartition `json:"partitions"`
+	// RawPartitions is expired partitions of raw objects that are not merged yet. Location is the prefix under raw/.
+	RawPartitions []*ExpiredPartition `json:"raw_partitions,omitempty"`
+	// Outputs is number of expired Athena query outputs and result caches.
+	Outputs int `json:"outputs"`
+	// Objects and Bytes are total of all deleted objects, including raw objects and outputs.
+	Objects int   `json:"objects"`
+	Bytes   int64 `json:"bytes"`
+	// Completed is false while the run is in progress or if the run failed
+	Completed bool   `json:"completed"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Expirer deletes data expired by RetentionPolicy.
+//   - Merged objects, catalog partitions and meta markers of partitions: Each partition is locked by MetaService.LockPartition while expiration, and partition locked by compaction or purge is skipped. Partition that is switched to staging location of compaction is also skipped until the compaction is finished.
+//   - Raw objects under raw/<table>/ in expired partitions: They are deleted before merged objects, then they are not merged into a partition that has been expired. A raw object being merged at the time may still create the partition again, and it's expired in next run.
+//   - Athena query outputs and result caches of search API under OutputPrefix: Output can not be mapped to partitions, then output older than the shortest retention days of the policy is deleted. Fetching logs of the search fails after that.
+type Expirer struct {
+	S3       adaptor.S3Client
+	Glue     adaptor.GlueClient
+	Meta     *service.MetaService
+	Bucket   string
+	Prefix   string
+	Database string
+	// Tables is target Athena tables. Default is indices and messages.
+	Tables []string
+	// OutputPrefix is S3 key prefix of Athena query outputs of search API. Default is Prefix + "output/".
+	OutputPrefix string
+	// ReportPrefix is S3 key prefix of deletion report. Default is Prefix + "retention/". Report is not saved in dry run.
+	ReportPrefix string
+	// DryRun only returns report without deletion.
+	DryRun bool
+}
+
+// Expire deletes expired partitions and saves report to S3.
+func (x *Expirer) Expire(policy *RetentionPolicy, now time.Time) (*RetentionReport, error) {
+	report := &RetentionReport{
+		RunAt:  now,
+		DryRun: x.DryRun,
+		Policy: *policy,
+	}
+
+	tables := x.Tables
+	if len(tables) == 0 {
+		tables = []string{string(models.AthenaTableIndex), models.AthenaTableMessage}
+	}
+
+	owner := "retention:" + uuid.New().String()
+	for _, table := range tables {
+		if err := x.expireTable(table, policy, now, report, owner); err != nil {
+			report.Error = err.Error()
+			if !x.DryRun {
+				if err := x.putReport(report); err != nil {
+					logger.WithError(err).Error("Fail to save retention report of failed run")
+				}
+			}
+			return nil, err
+		}
+	}
+
+	if err := x.expireOutputs(policy, now, report); err != nil {
+		report.Error = err.Error()
+		if !x.DryRun {
+			if err := x.putReport(report); err != nil {
+				logger.WithError(err).Error("Fail to save retention report of failed run")
+			}
+		}
+		return nil, err
+	}
+
+	report.Completed = true
+	if !x.DryRun {
+		if err := x.putReport(report); err != nil {
+			return nil, err
+		}
+	}
+
+	return report, nil
+}
+
+func (x *Expirer) expireTable(table string, policy *RetentionPolicy, now time.Time, report *RetentionReport, owner string) error {
+	keys, err := getPartitionKeys(x.Glue, x.Database, table)
+	if err != nil {
+		return err
+	}
+
+	match := func(values []string) bool { return policy.expired(keys, values, now) }
+	if err := x.expireRaw(table, keys, match, report); err != nil {
+		return err
+	}
+
+	inS3, err := listS3Partitions(x.S3, x.Bucket, x.Prefix+table+"/", keys, match)
+	if err != nil {
+		return err
+	}
+	inCatalog, err := listCatalogPartitions(x.Glue, x.Database, table, match)
+	if err != nil {
+		return err
+	}
+	staging := fmt.Sprintf("s3://%s/%s%s", x.Bucket, x.Prefix, models.CompactionStagingDir)
+	// Partitions only in catalog are also dropped
+	for key, p := range inCatalog {
+		if _, ok := inS3[key]; !ok {
+			inS3[key] = p
+		}
+	}
+
+	var pkeys []string
+	for key := range inS3 {
+		pkeys = append(pkeys, key)
+	}
+	sort.Strings(pkeys)
+
+	for _, key := range pkeys {
+		p := inS3[key]
+		var parts []string
+		for i, k := range keys {
+			parts = append(parts, k+"="+p.values[i])
+		}
+		ep := &ExpiredPartition{
+			Table:     table,
+			Partition: strings.Join(parts, "/"),
+			Location:  p.location,
+		}
+
+		if c, ok := inCatalog[key]; ok && strings.HasPrefix(c.location, staging) {
+			ep.Skipped = "Partition is being compacted: " + c.location
+			logger.WithField("partition", ep).Warn("Skip expiration of partition")
+			report.Partitions = append(report.Partitions, ep)
+			continue
+		}
+
+		if !x.DryRun {
+			locked, err := x.Meta.LockPartition(p.location, owner)
+			if err != nil {
+				return err
+			}
+			if !locked {
+				ep.Skipped = "Partition is locked by other job"
+				logger.WithField("partition", ep).Warn("Skip expiration of partition")
+				report.Partitions = append(report.Partitions, ep)
+				continue
+			}
+		}
+
+		err := x.expirePartition(table, p, ep)
+		if err != nil {
+			ep.Error = err.Error()
+		}
+		if !x.DryRun {
+			if e := x.Meta.UnlockPartition(p.location, owner); e != nil {
+				logger.WithError(e).WithField("location", p.location).Error("Fail to unlock partition")
+			}
+		}
+
+		report.Partitions = append(report.Partitions, ep)
+		report.Objects += ep.Objects
+		report.Bytes += ep.Bytes
+
+		if err != nil {
+			return err
+		}
+		if !x.DryRun {
+			if err := x.putReport(report); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// expirePartition drops catalog partition at first to stop search, and then deletes objects and meta marker.
+func (x *Expirer) expirePartition(table string, p *partitionInfo, ep *ExpiredPartition) error {
+	prefix := strings.TrimPrefix(p.location, fmt.Sprintf("s3://%s/", x.Bucket))
+	if prefix == p.location || prefix == "" {
+		return fmt.Errorf("Partition location is not in bucket %s: %s", x.Bucket, p.location)
+	}
+
+	svc := service.NewS3ServiceWithClient(x.S3)
+	objects, err := svc.ListS3Objects(models.NewS3Object("", x.Bucket, prefix), false)
+	if err != nil {
+		return err
+	}
+	var keys []string
+	for _, obj := range objects {
+		keys = append(keys, aws.StringValue(obj.Key))
+		ep.Bytes += aws.Int64Value(obj.Size)
+	}
+	ep.Objects = len(keys)
+
+	logger.WithFields(logrus.Fields{
+		"table":     table,
+		"partition": ep.Partition,
+		"objects":   ep.Objects,
+		"dryrun":    x.DryRun,
+	}).Info("Expire partition")
+
+	if x.DryRun {
+		return nil
+	}
+
+	if err := dropCatalogPartitions(x.Glue, x.Database, table, [][]string{p.values}); err != nil {
+		return err
+	}
+
+	if err := svc.DeleteS3Keys("", x.Bucket, keys); err != nil {
+		return errors.Wrapf(err, "Fail to delete objects: %s", p.location)
+	}
+
+	if err := x.Meta.DeletePartition(p.location); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// expireRaw deletes raw objects in expired partitions under raw/<table>/. Raw objects are not in catalog, then the partition is not locked.
+func (x *Expirer) expireRaw(table string, keys []string, match func(values []string) bool, report *RetentionReport) error {
+	partitions, err := listS3Partitions(x.S3, x.Bucket, x.Prefix+"raw/"+table+"/", keys, match)
+	if err != nil {
+		return err
+	}
+
+	var pkeys []string
+	for key := range partitions {
+		pkeys = append(pkeys, key)
+	}
+	sort.Strings(pkeys)
+
+	svc := service.NewS3ServiceWithClient(x.S3)
+	for _, key := range pkeys {
+		p := partitions[key]
+		var parts []string
+		for i, k := range keys {
+			parts = append(parts, k+"="+p.values[i])
+		}
+		ep := &ExpiredPartition{
+			Table:     table,
+			Partition: strings.Join(parts, "/"),
+			Location:  p.location,
+		}
+
+		prefix := strings.TrimPrefix(p.location, fmt.Sprintf("s3://%s/", x.Bucket))
+		objects, err := svc.ListS3Objects(models.NewS3Object("", x.Bucket, prefix), false)
+		if err != nil {
+			return err
+		}
+		var objKeys []string
+		for _, obj := range objects {
+			objKeys = append(objKeys, aws.StringValue(obj.Key))
+			ep.Bytes += aws.Int64Value(obj.Size)
+		}
+		ep.Objects = len(objKeys)
+
+		logger.WithFields(logrus.Fields{
+			"table":     table,
+			"partition": ep.Partition,
+			"objects":   ep.Objects,
+			"dryrun":    x.DryRun,
+		}).Info("Expire raw objects")
+
+		var delErr error
+		if !x.DryRun {
+			if delErr = svc.DeleteS3Keys("", x.Bucket, objKeys); delErr != nil {
+				ep.Error = delErr.Error()
+			}
+		}
+
+		report.RawPartitions = append(report.RawPartitions, ep)
+		report.Objects += ep.Objects
+		report.Bytes += ep.Bytes
+
+		if delErr != nil {
+			return errors.Wrapf(delErr, "Fail to delete raw objects: %s", p.location)
+		}
+	}
+
+	return nil
+}
+
+// expireOutputs deletes Athena query outputs and result caches that are older than the shortest retention days. A result cache (xxx.csv.cache/) can be newer than its output and is deleted in a later run.
+func (x *Expirer) expireOutputs(policy *RetentionPolicy, now time.Time, report *RetentionReport) error {
+	days := policy.minDays()
+	if days == 0 {
+		return nil
+	}
+	limit := now.Add(-time.Duration(days) * 24 * time.Hour)
+
+	prefix := x.OutputPrefix
+	if prefix == "" {
+		prefix = x.Prefix + "output/"
+	}
+
+	svc := service.NewS3ServiceWithClient(x.S3)
+	objects, err := svc.ListS3Objects(models.NewS3Object("", x.Bucket, prefix), false)
+	if err != nil {
+		return err
+	}
+
+	var keys []string
+	var size int64
+	for _, obj := range objects {
+		if aws.TimeValue(obj.LastModified).After(limit) {
+			continue
+		}
+		keys = append(keys, aws.StringValue(obj.Key))
+		size += aws.Int64Value(obj.Size)
+	}
+
+	logger.WithFields(logrus.Fields{
+		"prefix":  prefix,
+		"scanned": len(objects),
+		"expired": len(keys),
+		"dryrun":  x.DryRun,
+	}).Info("Expire query outputs")
+
+	if !x.DryRun {
+		if err := svc.DeleteS3Keys("", x.Bucket, keys); err != nil {
+			return errors.Wrapf(err, "Fail to delete query outputs: s3://%s/%s", x.Bucket, prefix)
+		}
+	}
+
+	report.Outputs = len(keys)
+	report.Objects += len(keys)
+	report.Bytes += size
+	return nil
+}
+
+func (x *Expirer) putReport(report *RetentionReport) error {
+	raw, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Fail to marshal retention report")
+	}
+
+	prefix := x.ReportPrefix
+	if prefix == "" {
+		prefix = x.Prefix + "retention/"
+	}
+	key := prefix + report.RunAt.UTC().Format("2006/01/02/150405") + ".json"
+
+	if _, err := x.S3.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(x.Bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(raw),
+		ContentType: aws.String("application/json"),
+	}); err != nil {
+		return errors.Wrapf(err, "Fail to put retention report: s3://%s/%s", x.Bucket, key)
+	}
+
+	logger.WithFields(logrus.Fields{
+		"report":     fmt.Sprintf("s3://%s/%s", x.Bucket, key),
+		"partitions": len(report.Partitions),
+		"objects":    report.Objects,
+	}).Info("Saved retention report")
+
+	return nil
+}
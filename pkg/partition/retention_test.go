@@ -0,0 +1,329 @@
+package partition_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/google/uuid"
+	"github.com/m-mizutani/minerva/internal/mock"
+	"github.com/m-mizutani/minerva/internal/service"
+	"github.com/m-mizutani/minerva/internal/util"
+	"github.com/m-mizutani/minerva/pkg/partition"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRetentionPolicy(t *testing.T) {
+	t.Run("empty means disabled", func(tt *testing.T) {
+		policy, err := partition.ParseRetentionPolicy("")
+		require.NoError(tt, err)
+		assert.Nil(tt, policy)
+	})
+
+	t.Run("parse default and groups", func(tt *testing.T) {
+		policy, err := partition.ParseRetentionPolicy(`{"default_days":30,"groups":{"aws":90}}`)
+		require.NoError(tt, err)
+		require.NotNil(tt, policy)
+		assert.Equal(tt, 30, policy.DefaultDays)
+		assert.Equal(tt, 90, policy.Groups["aws"])
+	})
+
+	t.Run("negative days is error", func(tt *testing.T) {
+		_, err := partition.ParseRetentionPolicy(`{"default_days":-1}`)
+		assert.Error(tt, err)
+		_, err = partition.ParseRetentionPolicy(`{"groups":{"aws":-1}}`)
+		assert.Error(tt, err)
+	})
+
+	t.Run("invalid JSON is error", func(tt *testing.T) {
+		_, err := partition.ParseRetentionPolicy(`{`)
+		assert.Error(tt, err)
+	})
+}
+
+func newExpirer(keys ...string) *partition.Expirer {
+	bucket := "retention-" + uuid.New().String()
+	catalog := mock.NewGlueCatalog()
+	catalog.PutTable("db", "indices", "s3://"+bucket+"/prefix/indices/", keys...)
+
+	return &partition.Expirer{
+		S3:       mock.NewS3Client("ap-northeast-1"),
+		Glue:     catalog,
+		Meta:     service.NewMetaService(mock.NewMetaRepository(), util.NewExpRetryTimer),
+		Bucket:   bucket,
+		Prefix:   "prefix/",
+		Database: "db",
+		Tables:   []string{"indices"},
+	}
+}
+
+// putPartition puts a merged object to S3, partition to catalog and marker to meta table
+func putPartition(t *testing.T, expirer *partition.Expirer, path string, values ...string) string {
+	location := indicesLocation(expirer.Bucket, path)
+	putObject(t, expirer.S3, expirer.Bucket, "prefix/indices/"+path+"merged-"+uuid.New().String()+".parquet")
+	expirer.Glue.(*mock.GlueCatalog).PutPartition("db", "indices", location, values...)
+	require.NoError(t, expirer.Meta.PutPartition(location))
+	return location
+}
+
+func exists(expirer *partition.Expirer, prefix string) bool {
+	return len(expirer.S3.(*mock.S3Client).Keys(expirer.Bucket, prefix)) > 0
+}
+
+func readReport(t *testing.T, expirer *partition.Expirer, key string) *partition.RetentionReport {
+	output, err := expirer.S3.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(expirer.Bucket),
+		Key:    aws.String(key),
+	})
+	require.NoError(t, err)
+	raw, err := ioutil.ReadAll(output.Body)
+	require.NoError(t, err)
+
+	var report partition.RetentionReport
+	require.NoError(t, json.Unmarshal(raw, &report))
+	return &report
+}
+
+func TestExpire(t *testing.T) {
+	now := time.Date(2020, 2, 1, 12, 0, 0, 0, time.UTC)
+	policy := &partition.RetentionPolicy{DefaultDays: 10}
+
+	setup := func(tt *testing.T) (*partition.Expirer, *mock.GlueCatalog, []string) {
+		expirer := newExpirer("dt")
+		locations := []string{
+			// Expired
+			putPartition(tt, expirer, "dt=2020-01-21-11/", "2020-01-21-11"),
+			putPartition(tt, expirer, "dt=2020-01-20/", "2020-01-20"),
+			// Not expired (hour ends after 2020-01-22 12:00)
+			putPartition(tt, expirer, "dt=2020-01-22-12/", "2020-01-22-12"),
+			// Not expired (day ends 2020-01-22 00:00, but includes later hours)
+			putPartition(tt, expirer, "dt=2020-01-22/", "2020-01-22"),
+		}
+		return expirer, expirer.Glue.(*mock.GlueCatalog), locations
+	}
+
+	t.Run("delete expired objects, partitions and markers", func(tt *testing.T) {
+		expirer, catalog, locations := setup(tt)
+		report, err := expirer.Expire(policy, now)
+		require.NoError(tt, err)
+
+		require.Equal(tt, 2, len(report.Partitions))
+		assert.Equal(tt, "dt=2020-01-20", report.Partitions[0].Partition)
+		assert.Equal(tt, "dt=2020-01-21-11", report.Partitions[1].Partition)
+		assert.Equal(tt, 2, report.Objects)
+		assert.Equal(tt, int64(2), report.Bytes)
+
+		assert.False(tt, exists(expirer, "prefix/indices/dt=2020-01-21-11/"))
+		assert.False(tt, exists(expirer, "prefix/indices/dt=2020-01-20/"))
+		assert.True(tt, exists(expirer, "prefix/indices/dt=2020-01-22-12/"))
+		assert.True(tt, exists(expirer, "prefix/indices/dt=2020-01-22/"))
+		assert.Equal(tt, []string{"2020-01-22", "2020-01-22-12"}, catalog.Partitions("db", "indices"))
+
+		expected := []bool{false, false, true, true}
+		for i, loc := range locations {
+			has, err := expirer.Meta.HeadPartition(loc)
+			require.NoError(tt, err)
+			assert.Equal(tt, expected[i], has, loc)
+		}
+	})
+
+	t.Run("skip partition locked by other job", func(tt *testing.T) {
+		expirer, _, locations := setup(tt)
+		locked, err := expirer.Meta.LockPartition(locations[0], "compaction:test")
+		require.NoError(tt, err)
+		require.True(tt, locked)
+
+		report, err := expirer.Expire(policy, now)
+		require.NoError(tt, err)
+		require.Equal(tt, 2, len(report.Partitions))
+		assert.Equal(tt, "", report.Partitions[0].Skipped)
+		assert.Equal(tt, "dt=2020-01-21-11", report.Partitions[1].Partition)
+		assert.NotEqual(tt, "", report.Partitions[1].Skipped)
+		assert.Equal(tt, 1, report.Objects)
+		assert.True(tt, exists(expirer, "prefix/indices/dt=2020-01-21-11/"))
+		assert.False(tt, exists(expirer, "prefix/indices/dt=2020-01-20/"))
+
+		// Expired in next run after the lock is released
+		require.NoError(tt, expirer.Meta.UnlockPartition(locations[0], "compaction:test"))
+		report, err = expirer.Expire(policy, now)
+		require.NoError(tt, err)
+		require.Equal(tt, 1, len(report.Partitions))
+		assert.Equal(tt, "", report.Partitions[0].Skipped)
+		assert.False(tt, exists(expirer, "prefix/indices/dt=2020-01-21-11/"))
+	})
+
+	t.Run("skip partition being compacted", func(tt *testing.T) {
+		expirer, catalog, _ := setup(tt)
+		staging := "s3://" + expirer.Bucket + "/prefix/compaction/" + uuid.New().String() + "/indices/dt=2020-01-20/"
+		catalog.PutPartition("db", "indices", staging, "2020-01-20")
+
+		report, err := expirer.Expire(policy, now)
+		require.NoError(tt, err)
+		require.Equal(tt, 2, len(report.Partitions))
+		assert.Equal(tt, "dt=2020-01-20", report.Partitions[0].Partition)
+		assert.Contains(tt, report.Partitions[0].Skipped, staging)
+		assert.True(tt, exists(expirer, "prefix/indices/dt=2020-01-20/"))
+		assert.False(tt, exists(expirer, "prefix/indices/dt=2020-01-21-11/"))
+		assert.Equal(tt, []string{"2020-01-20", "2020-01-22", "2020-01-22-12"}, catalog.Partitions("db", "indices"))
+	})
+
+	t.Run("save deletion report", func(tt *testing.T) {
+		expirer, _, _ := setup(tt)
+		_, err := expirer.Expire(policy, now)
+		require.NoError(tt, err)
+
+		report := readReport(tt, expirer, "prefix/retention/2020/02/01/120000.json")
+		assert.Equal(tt, 2, len(report.Partitions))
+		assert.Equal(tt, 10, report.Policy.DefaultDays)
+		assert.True(tt, report.Completed)
+	})
+
+	t.Run("save report of failed run", func(tt *testing.T) {
+		expirer, catalog, _ := setup(tt)
+		catalog.PutPartition("db", "indices", "s3://other-bucket/prefix/indices/dt=2020-01-21-12/", "2020-01-21-12")
+		_, err := expirer.Expire(policy, now)
+		require.Error(tt, err)
+
+		report := readReport(tt, expirer, "prefix/retention/2020/02/01/120000.json")
+		assert.False(tt, report.Completed)
+		assert.NotEqual(tt, "", report.Error)
+		require.Equal(tt, 3, len(report.Partitions))
+		assert.Equal(tt, "dt=2020-01-20", report.Partitions[0].Partition)
+		assert.Equal(tt, "", report.Partitions[0].Error)
+		assert.Equal(tt, "dt=2020-01-21-12", report.Partitions[2].Partition)
+		assert.NotEqual(tt, "", report.Partitions[2].Error)
+		assert.False(tt, exists(expirer, "prefix/indices/dt=2020-01-20/"))
+	})
+
+	t.Run("dry run does not delete anything", func(tt *testing.T) {
+		expirer, catalog, locations := setup(tt)
+		expirer.DryRun = true
+		report, err := expirer.Expire(policy, now)
+		require.NoError(tt, err)
+
+		assert.Equal(tt, 2, len(report.Partitions))
+		assert.True(tt, report.DryRun)
+		assert.True(tt, exists(expirer, "prefix/indices/dt=2020-01-20/"))
+		assert.Equal(tt, 4, len(catalog.Partitions("db", "indices")))
+		has, err := expirer.Meta.HeadPartition(locations[0])
+		require.NoError(tt, err)
+		assert.True(tt, has)
+		assert.False(tt, exists(expirer, "prefix/retention/"))
+	})
+
+	t.Run("zero days keeps all data", func(tt *testing.T) {
+		expirer, catalog, _ := setup(tt)
+		report, err := expirer.Expire(&partition.RetentionPolicy{}, now)
+		require.NoError(tt, err)
+		assert.Equal(tt, 0, len(report.Partitions))
+		assert.Equal(tt, 4, len(catalog.Partitions("db", "indices")))
+	})
+
+	t.Run("delete expired raw objects that are not merged", func(tt *testing.T) {
+		expirer, _, _ := setup(tt)
+		putObject(tt, expirer.S3, expirer.Bucket, "prefix/raw/indices/dt=2020-01-20-05/src-bucket/k1.log/"+uuid.New().String()+".idx.gz")
+		putObject(tt, expirer.S3, expirer.Bucket, "prefix/raw/indices/dt=2020-01-22-12/src-bucket/k2.log/"+uuid.New().String()+".idx.gz")
+
+		report, err := expirer.Expire(policy, now)
+		require.NoError(tt, err)
+		require.Equal(tt, 1, len(report.RawPartitions))
+		assert.Equal(tt, "dt=2020-01-20-05", report.RawPartitions[0].Partition)
+		assert.Equal(tt, 1, report.RawPartitions[0].Objects)
+		assert.Equal(tt, 3, report.Objects)
+		assert.False(tt, exists(expirer, "prefix/raw/indices/dt=2020-01-20-05/"))
+		assert.True(tt, exists(expirer, "prefix/raw/indices/dt=2020-01-22-12/"))
+	})
+
+	t.Run("drop partition only in catalog", func(tt *testing.T) {
+		expirer, catalog, _ := setup(tt)
+		catalog.PutPartition("db", "indices", "s3://"+expirer.Bucket+"/prefix/indices/dt=2020-01-01-00/", "2020-01-01-00")
+		report, err := expirer.Expire(policy, now)
+		require.NoError(tt, err)
+		require.Equal(tt, 3, len(report.Partitions))
+		assert.Equal(tt, "dt=2020-01-01-00", report.Partitions[0].Partition)
+		assert.Equal(tt, 0, report.Partitions[0].Objects)
+		assert.Equal(tt, []string{"2020-01-22", "2020-01-22-12"}, catalog.Partitions("db", "indices"))
+	})
+}
+
+func TestExpireByTagGroup(t *testing.T) {
+	now := time.Date(2020, 2, 1, 12, 0, 0, 0, time.UTC)
+	policy := &partition.RetentionPolicy{
+		DefaultDays: 10,
+		Groups: map[string]int{
+			"aws":   5,
+			"audit": 0, // keep forever
+		},
+	}
+
+	expirer := newExpirer("dt", "tag_group")
+	putPartition(t, expirer, "dt=2020-01-25-00/tag_group=aws/", "2020-01-25-00", "aws")
+	putPartition(t, expirer, "dt=2020-01-25-00/tag_group=gcp/", "2020-01-25-00", "gcp")
+	putPartition(t, expirer, "dt=2020-01-10-00/tag_group=gcp/", "2020-01-10-00", "gcp")
+	putPartition(t, expirer, "dt=2020-01-10-00/tag_group=audit/", "2020-01-10-00", "audit")
+	putPartition(t, expirer, "dt=2020-01-30-00/tag_group=aws/", "2020-01-30-00", "aws")
+	putObject(t, expirer.S3, expirer.Bucket, "prefix/raw/indices/dt=2020-01-25-00/tag_group=aws/src-bucket/k1.log/"+uuid.New().String()+".idx.gz")
+	putObject(t, expirer.S3, expirer.Bucket, "prefix/raw/indices/dt=2020-01-25-00/tag_group=gcp/src-bucket/k2.log/"+uuid.New().String()+".idx.gz")
+
+	report, err := expirer.Expire(policy, now)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(report.Partitions))
+	assert.Equal(t, "dt=2020-01-10-00/tag_group=gcp", report.Partitions[0].Partition)
+	assert.Equal(t, "dt=2020-01-25-00/tag_group=aws", report.Partitions[1].Partition)
+
+	assert.Equal(t, []string{
+		"2020-01-10-00/audit",
+		"2020-01-25-00/gcp",
+		"2020-01-30-00/aws",
+	}, expirer.Glue.(*mock.GlueCatalog).Partitions("db", "indices"))
+	assert.True(t, exists(expirer, "prefix/indices/dt=2020-01-10-00/tag_group=audit/"))
+	assert.False(t, exists(expirer, "prefix/indices/dt=2020-01-25-00/tag_group=aws/"))
+
+	require.Equal(t, 1, len(report.RawPartitions))
+	assert.Equal(t, "dt=2020-01-25-00/tag_group=aws", report.RawPartitions[0].Partition)
+	assert.False(t, exists(expirer, "prefix/raw/indices/dt=2020-01-25-00/tag_group=aws/"))
+	assert.True(t, exists(expirer, "prefix/raw/indices/dt=2020-01-25-00/tag_group=gcp/"))
+}
+
+func TestExpireOutputs(t *testing.T) {
+	// Mock S3 sets current time to LastModified
+	now := time.Now().UTC().Add(6 * 24 * time.Hour)
+
+	setup := func(tt *testing.T) *partition.Expirer {
+		expirer := newExpirer("dt", "tag_group")
+		putObject(tt, expirer.S3, expirer.Bucket, "prefix/output/q1.csv")
+		putObject(tt, expirer.S3, expirer.Bucket, "prefix/output/q1.csv.metadata")
+		putObject(tt, expirer.S3, expirer.Bucket, "prefix/output/q1.csv.cache/rows.jsonl")
+		return expirer
+	}
+
+	t.Run("delete outputs older than shortest retention", func(tt *testing.T) {
+		expirer := setup(tt)
+		report, err := expirer.Expire(&partition.RetentionPolicy{DefaultDays: 10, Groups: map[string]int{"aws": 5}}, now)
+		require.NoError(tt, err)
+		assert.Equal(tt, 3, report.Outputs)
+		assert.Equal(tt, 3, report.Objects)
+		assert.False(tt, exists(expirer, "prefix/output/"))
+	})
+
+	t.Run("keep outputs in retention", func(tt *testing.T) {
+		expirer := setup(tt)
+		report, err := expirer.Expire(&partition.RetentionPolicy{DefaultDays: 10}, now)
+		require.NoError(tt, err)
+		assert.Equal(tt, 0, report.Outputs)
+		assert.Equal(tt, 3, len(expirer.S3.(*mock.S3Client).Keys(expirer.Bucket, "prefix/output/")))
+	})
+
+	t.Run("dry run does not delete outputs", func(tt *testing.T) {
+		expirer := setup(tt)
+		expirer.DryRun = true
+		report, err := expirer.Expire(&partition.RetentionPolicy{DefaultDays: 5}, now)
+		require.NoError(tt, err)
+		assert.Equal(tt, 3, report.Outputs)
+		assert.True(tt, exists(expirer, "prefix/output/"))
+	})
+}
@@ -0,0 +1,6 @@
+package purge
+
+var (
+	BuildSQL    = buildSQL
+	ContainsAll = containsAll
+)
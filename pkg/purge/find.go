@@ -0,0 +1,235 @@
+package purge
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/athena"
+	"github.com/aws/aws-sdk-go/service/athena/athenaiface"
+	"github.com/m-mizutani/minerva/internal/tokenizer"
+	"github.com/m-mizutani/minerva/pkg/models"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Finder looks up merged objects that have logs matched with the request.
+type Finder interface {
+	Find(req *Request) ([]*Target, error)
+}
+
+// AthenaFinder finds target logs by indices table and confirms them by message of messages table. Only merged objects that are registered as partition can be found.
+type AthenaFinder struct {
+	Client     athenaiface.AthenaAPI
+	Database   string
+	OutputPath string
+	// Projected is granularity of "dt" if tables use partition projection. Empty means both of hourly and daily.
+	Projected models.DTGranularity
+	// Interval of polling query status. Default is 1 second.
+	Interval time.Duration
+}
+
+// Find runs Athena query and waits for completion.
+func (x *AthenaFinder) Find(req *Request) ([]*Target, error) {
+	sql, err := buildSQL(req, x.Projected)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := x.Client.StartQueryExecution(&athena.StartQueryExecutionInput{
+		QueryExecutionContext: &athena.QueryExecutionContext{
+			Database: aws.String(x.Database),
+		},
+		QueryString: aws.String(sql),
+		ResultConfiguration: &athena.ResultConfiguration{
+			OutputLocation: aws.String(x.OutputPath),
+		},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to start Athena query to find purge targets")
+	}
+	queryID := aws.StringValue(resp.QueryExecutionId)
+	logger.WithField("query_id", queryID).Info("Started Athena query to find purge targets")
+
+	if err := x.wait(queryID); err != nil {
+		return nil, err
+	}
+
+	return x.getResults(queryID)
+}
+
+func (x *AthenaFinder) wait(queryID string) error {
+	interval := x.Interval
+	if interval == 0 {
+		interval = time.Second
+	}
+
+	for {
+		output, err := x.Client.GetQueryExecution(&athena.GetQueryExecutionInput{
+			QueryExecutionId: aws.String(queryID),
+		})
+		if err != nil {
+			return errors.Wrapf(err, "Fail to get Athena query status: %s", queryID)
+		}
+
+		status := output.QueryExecution.Status
+		switch aws.StringValue(status.State) {
+		case athena.QueryExecutionStateSucceeded:
+			return nil
+		case athena.QueryExecutionStateFailed, athena.QueryExecutionStateCancelled:
+			return fmt.Errorf("Athena query %s is %s: %s", queryID,
+				aws.StringValue(status.State), aws.StringValue(status.StateChangeReason))
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+func (x *AthenaFinder) getResults(queryID string) ([]*Target, error) {
+	targets := map[string]*Target{}
+	var order []string
+
+	input := &athena.GetQueryResultsInput{QueryExecutionId: aws.String(queryID)}
+	header := true
+	for {
+		output, err := x.Client.GetQueryResults(input)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Fail to get Athena query results: %s", queryID)
+		}
+
+		for _, row := range output.ResultSet.Rows {
+			if header { // First row of first page is column names
+				header = false
+				continue
+			}
+			if len(row.Data) != 4 {
+				return nil, fmt.Errorf("Unexpected columns of purge query result: %d", len(row.Data))
+			}
+
+			table := aws.StringValue(row.Data[0].VarCharValue)
+			location := aws.StringValue(row.Data[1].VarCharValue)
+			objectID, err := strconv.ParseInt(aws.StringValue(row.Data[2].VarCharValue), 10, 64)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Invalid object_id in purge query result")
+			}
+			seq, err := strconv.ParseInt(aws.StringValue(row.Data[3].VarCharValue), 10, 32)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Invalid seq in purge query result")
+			}
+
+			t, ok := targets[location]
+			if !ok {
+				t = &Target{Table: table, Location: location}
+				targets[location] = t
+				order = append(order, location)
+			}
+			t.Rows = append(t.Rows, RowID{ObjectID: objectID, Seq: int32(seq)})
+		}
+
+		if output.NextToken == nil {
+			break
+		}
+		input.NextToken = output.NextToken
+	}
+
+	var results []*Target
+	for _, location := range order {
+		results = append(results, targets[location])
+	}
+
+	logger.WithFields(logrus.Fields{
+		"query_id": queryID,
+		"objects":  len(results),
+	}).Info("Found purge targets")
+
+	return results, nil
+}
+
+func quote(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// buildSQL creates a query that returns table, $path, object_id and seq of all rows to be deleted. Logs are looked up by terms in indices table as same as search, and then confirmed by strpos() in messages table because a tokenized term can match separated words.
+func buildSQL(req *Request, projected models.DTGranularity) (string, error) {
+	if err := req.Validate(); err != nil {
+		return "", err
+	}
+
+	termSet := map[string]bool{}
+	tkn := tokenizer.NewSimpleTokenizer()
+	for _, term := range req.Terms {
+		for _, t := range tkn.Split(term) {
+			if !t.IsDelim {
+				termSet[t.Data] = true
+			}
+		}
+	}
+	if len(termSet) == 0 {
+		return "", fmt.Errorf("No index term in purge terms: %v", req.Terms)
+	}
+
+	var terms []string
+	for t := range termSet {
+		terms = append(terms, quote(t))
+	}
+	sort.Strings(terms) // for stable query
+
+	var msgConds []string
+	for _, term := range req.Terms {
+		msgConds = append(msgConds, fmt.Sprintf("strpos(messages.message, %s) > 0", quote(term)))
+	}
+
+	var tagCond string
+	if len(req.Tags) > 0 {
+		var tags []string
+		for _, tag := range req.Tags {
+			tags = append(tags, quote(tag))
+		}
+		tagCond = fmt.Sprintf("\nAND indices.tag IN (%s)", strings.Join(tags, ", "))
+	}
+
+	idxDT := models.DTCondition("indices.dt", req.Begin, req.End, projected)
+	msgDT := models.DTCondition("messages.dt", req.Begin, req.End, projected)
+
+	sql := fmt.Sprintf(`WITH candidates AS (
+SELECT indices.object_id, indices.seq
+FROM indices
+WHERE %s
+AND %d <= indices.timestamp
+AND indices.timestamp <= %d %s
+AND indices.term IN (%s)
+GROUP BY indices.object_id, indices.seq
+HAVING count(distinct(indices.term)) = %d
+),
+targets AS (
+SELECT DISTINCT messages.object_id, messages.seq
+FROM messages
+JOIN candidates
+ON messages.object_id = candidates.object_id
+AND messages.seq = candidates.seq
+WHERE %s
+AND %s
+)
+SELECT DISTINCT 'indices', indices."$path", indices.object_id, indices.seq
+FROM indices
+JOIN targets
+ON indices.object_id = targets.object_id
+AND indices.seq = targets.seq
+WHERE %s
+UNION ALL
+SELECT DISTINCT 'messages', messages."$path", messages.object_id, messages.seq
+FROM messages
+JOIN targets
+ON messages.object_id = targets.object_id
+AND messages.seq = targets.seq
+WHERE %s`,
+		idxDT, req.Begin.Unix(), req.End.Unix(), tagCond,
+		strings.Join(terms, ", "), len(termSet),
+		msgDT, strings.Join(msgConds, "\nAND "),
+		idxDT, msgDT)
+
+	return sql, nil
+}
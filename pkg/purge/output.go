@@ -0,0 +1,235 @@
+package purge
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/m-mizutani/minerva/internal/service"
+	"github.com/m-mizutani/minerva/pkg/models"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const outputScanBufSize = 1024 * 1024
+
+func (x *Purger) outputPrefix() string {
+	if x.OutputPrefix != "" {
+		return x.OutputPrefix
+	}
+	return x.Prefix + "output/"
+}
+
+// mergedRawObjects returns S3 keys of raw objects in partitions of the time range that are already merged, i.e. in sources of merge manifest in the merged partition. It returns error if raw object that is not merged yet (pending in queue or failed to merge) exists. Logs in the raw object can not be found by Finder and would be merged after purge.
+func (x *Purger) mergedRawObjects(req *Request) ([]string, error) {
+	var merged []string
+	sources := map[string]map[string]bool{}
+
+	for _, table := range []string{string(models.AthenaTableIndex), models.AthenaTableMessage} {
+		prefix := x.Prefix + "raw/" + table + "/"
+		partitions, err := x.s3Service().ListS3Dirs(x.object(prefix))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, p := range partitions {
+			dt := strings.TrimPrefix(strings.TrimSuffix(strings.TrimPrefix(p, prefix), "/"), "dt=")
+			from, to, ok := models.DTSpan(dt)
+			if !ok || !to.After(req.Begin) || from.After(req.End) {
+				continue
+			}
+
+			keys, err := x.listKeys(p)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, key := range keys {
+				_, partition, ok := models.ParseRawObjectKey(x.Prefix, key)
+				if !ok {
+					return nil, fmt.Errorf("Unknown object exists in raw partition: s3://%s/%s", x.Bucket, key)
+				}
+
+				dir := x.Prefix + path.Join(table, partition) + "/"
+				if _, ok := sources[dir]; !ok {
+					if sources[dir], err = x.readMergeSources(dir); err != nil {
+						return nil, err
+					}
+				}
+
+				if !sources[dir][key] {
+					return nil, fmt.Errorf("Raw object that is not merged yet exists in s3://%s/%s, retry after it is merged or swept: %s", x.Bucket, p, key)
+				}
+				merged = append(merged, key)
+			}
+		}
+	}
+
+	return merged, nil
+}
+
+// readMergeSources returns S3 keys of source raw objects in merge manifests under dir
+func (x *Purger) readMergeSources(dir string) (map[string]bool, error) {
+	keys, err := x.listKeys(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	sources := map[string]bool{}
+	for _, key := range keys {
+		if matched, _ := path.Match("_merged-*.manifest.json", path.Base(key)); !matched {
+			continue
+		}
+
+		output, err := x.S3.GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(x.Bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "Fail to get merge manifest: s3://%s/%s", x.Bucket, key)
+		}
+
+		var manifest models.MergeManifest
+		err = json.NewDecoder(output.Body).Decode(&manifest)
+		output.Body.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "Fail to parse merge manifest: s3://%s/%s", x.Bucket, key)
+		}
+
+		for _, src := range manifest.Sources {
+			sources[src.Object.Key] = true
+		}
+	}
+
+	return sources, nil
+}
+
+// findOutputs returns S3 keys of Athena query outputs (CSV) that have all terms of the request, and their metadata and result caches. A term is matched as CSV escaped string in whole of output, then the output may not have a log matched with all terms.
+func (x *Purger) findOutputs(req *Request) ([]string, error) {
+	keys, err := x.listKeys(x.outputPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	var terms [][]byte
+	for _, term := range req.Terms {
+		terms = append(terms, []byte(strings.Replace(term, `"`, `""`, -1)))
+	}
+
+	var results []string
+	for _, key := range keys {
+		if !strings.HasSuffix(key, ".csv") || strings.Contains(key, ".cache/") {
+			continue
+		}
+
+		matched, err := x.outputContains(key, terms)
+		if err != nil {
+			return nil, err
+		}
+		if !matched {
+			continue
+		}
+
+		// e.g.) xxx.csv, xxx.csv.metadata and xxx.csv.cache/rows.jsonl
+		for _, k := range keys {
+			if k == key || strings.HasPrefix(k, key+".") {
+				results = append(results, k)
+			}
+		}
+		logger.WithField("output", fmt.Sprintf("s3://%s/%s", x.Bucket, key)).Info("Found query output to be purged")
+	}
+
+	logger.WithFields(logrus.Fields{
+		"prefix":  x.outputPrefix(),
+		"scanned": len(keys),
+		"matched": len(results),
+	}).Info("Scanned query outputs")
+
+	return results, nil
+}
+
+func (x *Purger) outputContains(key string, terms [][]byte) (bool, error) {
+	output, err := x.S3.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(x.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return false, errors.Wrapf(err, "Fail to get query output: s3://%s/%s", x.Bucket, key)
+	}
+	defer output.Body.Close()
+
+	matched, err := containsAll(output.Body, terms)
+	if err != nil {
+		return false, errors.Wrapf(err, "Fail to read query output: s3://%s/%s", x.Bucket, key)
+	}
+	return matched, nil
+}
+
+// containsAll reads r by chunk and checks if all terms appear. Tail of previous chunk is kept to find a term across chunks.
+func containsAll(r io.Reader, terms [][]byte) (bool, error) {
+	found := make([]bool, len(terms))
+	remains := len(terms)
+	overlap := 0
+	for _, t := range terms {
+		if len(t)-1 > overlap {
+			overlap = len(t) - 1
+		}
+	}
+
+	var buf []byte
+	chunk := make([]byte, outputScanBufSize)
+	for {
+		n, err := r.Read(chunk)
+		buf = append(buf, chunk[:n]...)
+		for i, t := range terms {
+			if !found[i] && bytes.Contains(buf, t) {
+				found[i] = true
+				remains--
+			}
+		}
+		if remains == 0 {
+			return true, nil
+		}
+
+		if err == io.EOF {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+
+		if len(buf) > overlap {
+			buf = append(buf[:0], buf[len(buf)-overlap:]...)
+		}
+	}
+}
+
+func (x *Purger) s3Service() *service.S3Service {
+	return service.NewS3ServiceWithClient(x.S3)
+}
+
+func (x *Purger) object(key string) models.S3Object {
+	return models.NewS3Object("", x.Bucket, key)
+}
+
+// listKeys returns all keys under prefix
+func (x *Purger) listKeys(prefix string) ([]string, error) {
+	objects, err := x.s3Service().ListS3Objects(x.object(prefix), false)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, obj := range objects {
+		keys = append(keys, aws.StringValue(obj.Key))
+	}
+	return keys, nil
+}
+
+func (x *Purger) deleteKeys(keys []string) error {
+	return x.s3Service().DeleteS3Keys("", x.Bucket, keys)
+}
@@ -0,0 +1,476 @@
+package purge
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/google/uuid"
+	"github.com/m-mizutani/minerva/internal"
+	"github.com/m-mizutani/minerva/internal/adaptor"
+	"github.com/m-mizutani/minerva/internal/service"
+	"github.com/m-mizutani/minerva/pkg/merger"
+	"github.com/m-mizutani/minerva/pkg/models"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var logger = internal.Logger
+
+// Request is a deletion request of logs, e.g. data-subject deletion request. Logs that have all of Terms in range from Begin to End are deleted.
+type Request struct {
+	Terms []string  `json:"terms"`
+	Tags  []string  `json:"tags,omitempty"`
+	Begin time.Time `json:"begin"`
+	End   time.Time `json:"end"`
+	// Reason is recorded to audit record, e.g. ticket ID of the request.
+	Reason string `json:"reason"`
+}
+
+// Validate checks required fields of Request
+func (x *Request) Validate() error {
+	if len(x.Terms) == 0 {
+		return fmt.Errorf("At least one term is required for purge")
+	}
+	for _, term := range x.Terms {
+		if term == "" {
+			return fmt.Errorf("Empty term is not allowed for purge")
+		}
+	}
+	if x.Begin.IsZero() || x.End.IsZero() {
+		return fmt.Errorf("Both of begin and end are required for purge")
+	}
+	if x.End.Before(x.Begin) {
+		return fmt.Errorf("end (%v) is before begin (%v)", x.End, x.Begin)
+	}
+	return nil
+}
+
+// RequestRecord is Request saved in audit record. Terms are saved as salted SHA-256 hashes to not keep the personal data in the record forever. A term can be confirmed by comparing HashTerm(Salt, term) with TermHashes.
+type RequestRecord struct {
+	TermHashes []string  `json:"term_hashes"`
+	Salt       string    `json:"salt"`
+	Tags       []string  `json:"tags,omitempty"`
+	Begin      time.Time `json:"begin"`
+	End        time.Time `json:"end"`
+	Reason     string    `json:"reason"`
+}
+
+// HashTerm returns hex encoded SHA-256 hash of salt and term
+func HashTerm(salt, term string) string {
+	h := sha256.Sum256([]byte(salt + term))
+	return hex.EncodeToString(h[:])
+}
+
+func newRequestRecord(req *Request) (RequestRecord, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return RequestRecord{}, errors.Wrap(err, "Fail to generate salt of purge record")
+	}
+
+	record := RequestRecord{
+		Salt:   hex.EncodeToString(buf),
+		Tags:   req.Tags,
+		Begin:  req.Begin,
+		End:    req.End,
+		Reason: req.Reason,
+	}
+	for _, term := range req.Terms {
+		record.TermHashes = append(record.TermHashes, HashTerm(record.Salt, term))
+	}
+	return record, nil
+}
+
+// RowID identifies a log in both of indices and messages tables.
+type RowID struct {
+	ObjectID int64 `json:"object_id"`
+	Seq      int32 `json:"seq"`
+}
+
+// Target is a merged object and rows to be deleted from it.
+type Target struct {
+	Table    string  `json:"table"`
+	Location string  `json:"location"`
+	Rows     []RowID `json:"rows"`
+}
+
+// Status of purge record and objects in the record
+const (
+	StatusPending    = "pending"
+	StatusReplaced   = "replaced"
+	StatusRolledBack = "rolled_back"
+	StatusCompleted  = "completed"
+	StatusFailed     = "failed"
+)
+
+// ObjectRecord is result of rewriting an object
+type ObjectRecord struct {
+	Target
+	RowsBefore int64 `json:"rows_before"`
+	RowsAfter  int64 `json:"rows_after"`
+	// Deleted means no row remained and the object was deleted instead of rewriting.
+	Deleted bool   `json:"deleted"`
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Record is audit record of a purge job. It has only identifiers of deleted logs and does not have their contents. The record is saved as pending before any replacement and updated after each object, then it shows which objects were replaced even if the job is interrupted.
+type Record struct {
+	ID          string          `json:"id"`
+	ExecutedAt  time.Time       `json:"executed_at"`
+	DryRun      bool            `json:"dry_run"`
+	Request     RequestRecord   `json:"request"`
+	Status      string          `json:"status"`
+	Error       string          `json:"error,omitempty"`
+	Objects     []*ObjectRecord `json:"objects"`
+	RemovedRows int64           `json:"removed_rows"`
+	// Outputs are S3 keys of deleted Athena query outputs and result caches that had the terms.
+	Outputs []string `json:"outputs,omitempty"`
+	// RawObjects are S3 keys of deleted raw objects that were already merged.
+	RawObjects []string `json:"raw_objects,omitempty"`
+}
+
+// Purger removes logs from merged objects. Copies of logs out of merged objects are handled as following.
+//   - Raw objects that are not merged yet: Logs in them can not be found by Finder, then Purge is rejected if such raw object exists in partitions of the time range. Run purge again after they are merged (or swept if orphaned).
+//   - Raw objects that are already merged: They are left if merger failed to delete them. A raw object is regarded as merged if it is in sources of merge manifest, and it's deleted after replacement of merged objects. Raw object of merged object without manifest (merged by old version) can not be distinguished from not merged one and Purge is rejected.
+//   - Merged objects in staging location of compaction: Purge is rejected because they are replaced by compaction. Run purge again after the compaction is finished.
+//   - Merged objects of partition locked by compaction or retention: Purge is rejected because they are replaced or deleted by the job. Partitions of targets are locked by MetaService.LockPartition while purge.
+//   - Athena query outputs and result caches of search API under OutputPrefix: Query output (CSV) that has all terms is deleted with its metadata and result cache. Fetching logs of the search fails after that and the search should be executed again.
+type Purger struct {
+	S3     adaptor.S3Client
+	Meta   *service.MetaService
+	Finder Finder
+	Bucket string
+	Prefix string
+	// RecordPrefix is S3 key prefix of audit record. Default is Prefix + "purge/". Record is not saved in dry run.
+	RecordPrefix string
+	// OutputPrefix is S3 key prefix of Athena query outputs of search API. Default is Prefix + "output/".
+	OutputPrefix string
+	// Parquet is writer settings of rewritten objects. nil means default.
+	Parquet *merger.ParquetConfig
+	// DryRun rewrites objects only in local and does not replace them. Query outputs to be deleted are also reported, but not deleted.
+	DryRun bool
+}
+
+// Purge finds merged objects that have logs of the request and replaces them with rewritten objects without the logs. All objects of both schemas are rewritten in local before replacement and no object is replaced if any rewrite fails.
+//
+// Objects are replaced one by one and each replacement is done by single PutObject, then readers get either of original or rewritten object, but searches during replacement may see logs in some objects and not in others. Original objects are copied to backup location under RecordPrefix before replacement. If any replacement fails, replaced objects are restored from the backups and the record is saved as failed, then the request can be retried. Backups are deleted when all objects are replaced or restored.
+func (x *Purger) Purge(req *Request, now time.Time) (*Record, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+
+	rawObjects, err := x.mergedRawObjects(req)
+	if err != nil {
+		return nil, err
+	}
+
+	targets, err := x.Finder.Find(req)
+	if err != nil {
+		return nil, err
+	}
+
+	reqRecord, err := newRequestRecord(req)
+	if err != nil {
+		return nil, err
+	}
+
+	record := &Record{
+		ID:         uuid.New().String(),
+		ExecutedAt: now,
+		DryRun:     x.DryRun,
+		Request:    reqRecord,
+		Status:     StatusPending,
+	}
+
+	// Objects must not be changed by compaction or retention between rewrite and replacement
+	owner := "purge:" + record.ID
+	if !x.DryRun {
+		unlock, err := x.lockPartitions(targets, owner)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+	}
+
+	var files []string
+	defer func() {
+		for _, f := range files {
+			if f != "" {
+				os.Remove(f)
+			}
+		}
+	}()
+
+	for _, target := range targets {
+		key, err := x.targetKey(target)
+		if err != nil {
+			return nil, err
+		}
+
+		result, err := rewriteObject(x.S3, x.Bucket, key, target, x.Parquet)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, result.path)
+
+		obj := &ObjectRecord{
+			Target:     *target,
+			RowsBefore: result.before,
+			RowsAfter:  result.after,
+			Deleted:    result.after == 0,
+			Status:     StatusPending,
+		}
+		record.Objects = append(record.Objects, obj)
+		record.RemovedRows += result.before - result.after
+	}
+
+	if x.DryRun {
+		outputs, err := x.findOutputs(req)
+		if err != nil {
+			return nil, err
+		}
+		record.Outputs = outputs
+		record.RawObjects = rawObjects
+		return record, nil
+	}
+
+	// Extend locks because rewrite can take long time
+	if _, err := x.lockPartitions(targets, owner); err != nil {
+		return nil, err
+	}
+
+	if err := x.putRecord(record); err != nil {
+		return nil, err
+	}
+
+	if err := x.replaceObjects(record, files); err != nil {
+		return nil, x.fail(record, err)
+	}
+
+	// Query outputs are looked up after replacement to find also outputs of searches that ran during replacement
+	outputs, err := x.findOutputs(req)
+	if err != nil {
+		return nil, x.fail(record, err)
+	}
+	if err := x.deleteKeys(outputs); err != nil {
+		return nil, x.fail(record, err)
+	}
+	record.Outputs = outputs
+
+	if err := x.deleteKeys(rawObjects); err != nil {
+		return nil, x.fail(record, err)
+	}
+	record.RawObjects = rawObjects
+
+	record.Status = StatusCompleted
+	if err := x.putRecord(record); err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// fail saves the record as failed and returns the error with record ID
+func (x *Purger) fail(record *Record, err error) error {
+	record.Status = StatusFailed
+	record.Error = err.Error()
+	if e := x.putRecord(record); e != nil {
+		logger.WithError(e).WithField("record", record.ID).Error("Fail to save failed purge record")
+	}
+	return errors.Wrapf(err, "Purge is failed, record ID: %s", record.ID)
+}
+
+// targetKey returns S3 key of the target. Only merged object in Bucket and Prefix can be rewritten.
+func (x *Purger) targetKey(target *Target) (string, error) {
+	key := strings.TrimPrefix(target.Location, fmt.Sprintf("s3://%s/", x.Bucket))
+	if key == target.Location || !strings.HasPrefix(key, x.Prefix) {
+		return "", fmt.Errorf("Purge target is not in s3://%s/%s: %s", x.Bucket, x.Prefix, target.Location)
+	}
+	if strings.HasPrefix(key, x.Prefix+models.CompactionStagingDir) {
+		return "", fmt.Errorf("Purge target is in staging location of compaction, retry after the compaction is finished: %s", target.Location)
+	}
+	if matched, _ := path.Match("merged-*.parquet", path.Base(key)); !matched {
+		return "", fmt.Errorf("Purge target is not merged object: %s", target.Location)
+	}
+	if target.Table != string(models.AthenaTableIndex) && target.Table != models.AthenaTableMessage {
+		return "", fmt.Errorf("Unsupported table of purge target: %s", target.Table)
+	}
+
+	return key, nil
+}
+
+// lockPartitions locks partitions that have targets for owner. If any partition is locked by other job, acquired locks are released and error is returned. Calling it again by same owner extends the locks.
+func (x *Purger) lockPartitions(targets []*Target, owner string) (func(), error) {
+	var locations []string
+	seen := map[string]bool{}
+	for _, target := range targets {
+		location := target.Location[:strings.LastIndex(target.Location, "/")+1]
+		if !seen[location] {
+			seen[location] = true
+			locations = append(locations, location)
+		}
+	}
+	sort.Strings(locations)
+
+	var locked []string
+	unlock := func() {
+		for _, location := range locked {
+			if err := x.Meta.UnlockPartition(location, owner); err != nil {
+				logger.WithError(err).WithField("location", location).Error("Fail to unlock partition")
+			}
+		}
+	}
+
+	for _, location := range locations {
+		ok, err := x.Meta.LockPartition(location, owner)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		if !ok {
+			unlock()
+			return nil, fmt.Errorf("Partition is locked by other job (compaction or retention), retry later: %s", location)
+		}
+		locked = append(locked, location)
+	}
+
+	return unlock, nil
+}
+
+func (x *Purger) recordPrefix() string {
+	if x.RecordPrefix != "" {
+		return x.RecordPrefix
+	}
+	return x.Prefix + "purge/"
+}
+
+func (x *Purger) backupKey(record *Record, key string) string {
+	return x.recordPrefix() + "backup/" + record.ID + "/" + key
+}
+
+// replaceObjects backs up and replaces objects in order of record. Replaced objects are restored if any of backup and replacement fails.
+func (x *Purger) replaceObjects(record *Record, files []string) error {
+	var backups []string
+	for i, obj := range record.Objects {
+		key, err := x.targetKey(&obj.Target)
+		if err != nil {
+			return err
+		}
+
+		backup := x.backupKey(record, key)
+		if err := x.s3Service().CopyS3Object(x.object(key), x.object(backup)); err != nil {
+			obj.Status, obj.Error = StatusFailed, err.Error()
+			x.rollback(record, backups)
+			return err
+		}
+		backups = append(backups, backup)
+
+		if err := x.replaceObject(key, files[i], obj); err != nil {
+			obj.Status, obj.Error = StatusFailed, err.Error()
+			x.rollback(record, backups)
+			return err
+		}
+		obj.Status = StatusReplaced
+
+		if err := x.putRecord(record); err != nil {
+			x.rollback(record, backups)
+			return err
+		}
+	}
+
+	// All objects are replaced, then backups having the purged logs are not required
+	return x.deleteKeys(backups)
+}
+
+// rollback restores objects from backups. Backup that can not be restored is kept and the error is recorded to the object.
+func (x *Purger) rollback(record *Record, backups []string) {
+	var restored []string
+	for i, backup := range backups {
+		obj := record.Objects[i]
+		key := strings.TrimPrefix(backup, x.backupKey(record, ""))
+
+		if err := x.s3Service().CopyS3Object(x.object(backup), x.object(key)); err != nil {
+			logger.WithError(err).WithField("location", obj.Location).Error("Fail to restore purged object")
+			obj.Error = fmt.Sprintf("Fail to restore from s3://%s/%s: %v", x.Bucket, backup, err)
+			continue
+		}
+
+		if obj.Status == StatusReplaced {
+			obj.Status = StatusRolledBack
+		}
+		restored = append(restored, backup)
+	}
+
+	if err := x.deleteKeys(restored); err != nil {
+		logger.WithError(err).WithField("record", record.ID).Error("Fail to delete backups of restored objects")
+	}
+}
+
+func (x *Purger) replaceObject(key, filePath string, obj *ObjectRecord) error {
+	logger.WithFields(logrus.Fields{
+		"location": obj.Location,
+		"before":   obj.RowsBefore,
+		"after":    obj.RowsAfter,
+	}).Info("Replace purged object")
+
+	if obj.Deleted {
+		if err := x.deleteKeys([]string{key}); err != nil {
+			return errors.Wrapf(err, "Fail to delete purged object: %s", obj.Location)
+		}
+		return nil
+	}
+
+	fd, err := os.Open(filePath)
+	if err != nil {
+		return errors.Wrapf(err, "Fail to open rewritten parquet file: %s", filePath)
+	}
+	defer fd.Close()
+
+	if _, err := x.S3.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(x.Bucket),
+		Key:    aws.String(key),
+		Body:   fd,
+	}); err != nil {
+		return errors.Wrapf(err, "Fail to put rewritten object: %s", obj.Location)
+	}
+
+	return nil
+}
+
+func (x *Purger) putRecord(record *Record) error {
+	raw, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Fail to marshal purge record")
+	}
+
+	key := x.recordPrefix() + record.ExecutedAt.UTC().Format("2006/01/02/") + record.ID + ".json"
+
+	if _, err := x.S3.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(x.Bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(raw),
+		ContentType: aws.String("application/json"),
+	}); err != nil {
+		return errors.Wrapf(err, "Fail to put purge record: s3://%s/%s", x.Bucket, key)
+	}
+
+	logger.WithFields(logrus.Fields{
+		"record":  fmt.Sprintf("s3://%s/%s", x.Bucket, key),
+		"status":  record.Status,
+		"objects": len(record.Objects),
+		"rows":    record.RemovedRows,
+	}).Info("Saved purge record")
+
+	return nil
+}
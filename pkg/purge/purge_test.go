@@ -0,0 +1,561 @@
+package purge_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/athena"
+	"github.com/aws/aws-sdk-go/service/athena/athenaiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/google/uuid"
+	"github.com/m-mizutani/minerva/internal/adaptor"
+	"github.com/m-mizutani/minerva/internal/mock"
+	"github.com/m-mizutani/minerva/internal/service"
+	"github.com/m-mizutani/minerva/internal/util"
+	"github.com/m-mizutani/minerva/pkg/models"
+	"github.com/m-mizutani/minerva/pkg/purge"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+var (
+	testBegin = time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	testEnd   = time.Date(2020, 1, 2, 23, 59, 59, 0, time.UTC)
+)
+
+func TestBuildSQL(t *testing.T) {
+	req := &purge.Request{
+		Terms: []string{"alice@example.com"},
+		Begin: testBegin,
+		End:   testEnd,
+	}
+
+	t.Run("terms are tokenized for indices and confirmed with messages", func(tt *testing.T) {
+		sql, err := purge.BuildSQL(req, "")
+		require.NoError(tt, err)
+		assert.Contains(tt, sql, "indices.term IN ('alice', 'com', 'example')")
+		assert.Contains(tt, sql, "HAVING count(distinct(indices.term)) = 3")
+		assert.Contains(tt, sql, "strpos(messages.message, 'alice@example.com') > 0")
+		assert.Contains(tt, sql, `indices."$path"`)
+		assert.Contains(tt, sql, `messages."$path"`)
+		assert.Contains(tt, sql, "'2020-01-02-00' <= indices.dt")
+		assert.Contains(tt, sql, "messages.dt IN ('2020-01-02')")
+		assert.NotContains(tt, sql, "indices.tag IN")
+	})
+
+	t.Run("single quote is escaped", func(tt *testing.T) {
+		sql, err := purge.BuildSQL(&purge.Request{
+			Terms: []string{"o'reilly"},
+			Begin: testBegin,
+			End:   testEnd,
+		}, "")
+		require.NoError(tt, err)
+		assert.Contains(tt, sql, "strpos(messages.message, 'o''reilly') > 0")
+		assert.NotContains(tt, sql, "'o'reilly'")
+	})
+
+	t.Run("tags and projected granularity", func(tt *testing.T) {
+		sql, err := purge.BuildSQL(&purge.Request{
+			Terms: []string{"alice"},
+			Tags:  []string{"app.login"},
+			Begin: testBegin,
+			End:   testEnd,
+		}, models.DTDaily)
+		require.NoError(tt, err)
+		assert.Contains(tt, sql, "AND indices.tag IN ('app.login')")
+		assert.NotContains(tt, sql, "'2020-01-02-00'")
+	})
+
+	t.Run("invalid request", func(tt *testing.T) {
+		_, err := purge.BuildSQL(&purge.Request{Begin: testBegin, End: testEnd}, "")
+		assert.Error(tt, err)
+		_, err = purge.BuildSQL(&purge.Request{Terms: []string{"alice"}, Begin: testEnd, End: testBegin}, "")
+		assert.Error(tt, err)
+		_, err = purge.BuildSQL(&purge.Request{Terms: []string{"alice"}}, "")
+		assert.Error(tt, err)
+	})
+}
+
+// fakeAthena completes query immediately and returns rows by pages of pageSize.
+type fakeAthena struct {
+	athenaiface.AthenaAPI
+	state    string
+	rows     [][]string
+	pageSize int
+	queries  []string
+}
+
+func (x *fakeAthena) StartQueryExecution(input *athena.StartQueryExecutionInput) (*athena.StartQueryExecutionOutput, error) {
+	x.queries = append(x.queries, aws.StringValue(input.QueryString))
+	return &athena.StartQueryExecutionOutput{QueryExecutionId: aws.String("q1")}, nil
+}
+
+func (x *fakeAthena) GetQueryExecution(input *athena.GetQueryExecutionInput) (*athena.GetQueryExecutionOutput, error) {
+	return &athena.GetQueryExecutionOutput{
+		QueryExecution: &athena.QueryExecution{
+			Status: &athena.QueryExecutionStatus{
+				State:             aws.String(x.state),
+				StateChangeReason: aws.String("reason"),
+			},
+		},
+	}, nil
+}
+
+func (x *fakeAthena) GetQueryResults(input *athena.GetQueryResultsInput) (*athena.GetQueryResultsOutput, error) {
+	rows := append([][]string{{"_col0", "_col1", "object_id", "seq"}}, x.rows...)
+	var offset int
+	if input.NextToken != nil {
+		fmt.Sscanf(aws.StringValue(input.NextToken), "%d", &offset)
+	}
+	end := offset + x.pageSize
+	output := &athena.GetQueryResultsOutput{ResultSet: &athena.ResultSet{}}
+	if end < len(rows) {
+		output.NextToken = aws.String(fmt.Sprintf("%d", end))
+	} else {
+		end = len(rows)
+	}
+
+	for _, row := range rows[offset:end] {
+		r := &athena.Row{}
+		for _, v := range row {
+			r.Data = append(r.Data, &athena.Datum{VarCharValue: aws.String(v)})
+		}
+		output.ResultSet.Rows = append(output.ResultSet.Rows, r)
+	}
+	return output, nil
+}
+
+func TestAthenaFinder(t *testing.T) {
+	req := &purge.Request{Terms: []string{"alice"}, Begin: testBegin, End: testEnd}
+
+	t.Run("group rows by location over pages", func(tt *testing.T) {
+		client := &fakeAthena{
+			state:    "SUCCEEDED",
+			pageSize: 2,
+			rows: [][]string{
+				{"indices", "s3://b/p/indices/dt=2020-01-02-00/merged-a.parquet", "10", "1"},
+				{"indices", "s3://b/p/indices/dt=2020-01-02-00/merged-a.parquet", "10", "2"},
+				{"messages", "s3://b/p/messages/dt=2020-01-02-00/merged-b.parquet", "10", "1"},
+				{"messages", "s3://b/p/messages/dt=2020-01-02-00/merged-b.parquet", "10", "2"},
+			},
+		}
+		finder := &purge.AthenaFinder{Client: client, Database: "db", OutputPath: "s3://b/output", Interval: time.Millisecond}
+
+		targets, err := finder.Find(req)
+		require.NoError(tt, err)
+		require.Equal(tt, 1, len(client.queries))
+		require.Equal(tt, 2, len(targets))
+		assert.Equal(tt, "indices", targets[0].Table)
+		assert.Equal(tt, []purge.RowID{{ObjectID: 10, Seq: 1}, {ObjectID: 10, Seq: 2}}, targets[0].Rows)
+		assert.Equal(tt, "messages", targets[1].Table)
+		assert.Equal(tt, "s3://b/p/messages/dt=2020-01-02-00/merged-b.parquet", targets[1].Location)
+	})
+
+	t.Run("failed query", func(tt *testing.T) {
+		client := &fakeAthena{state: "FAILED", pageSize: 10}
+		finder := &purge.AthenaFinder{Client: client, Database: "db", OutputPath: "s3://b/output", Interval: time.Millisecond}
+		_, err := finder.Find(req)
+		assert.Error(tt, err)
+	})
+}
+
+type fixedFinder struct {
+	targets []*purge.Target
+}
+
+func (x *fixedFinder) Find(req *purge.Request) ([]*purge.Target, error) {
+	return x.targets, nil
+}
+
+const (
+	idxKey  = "prefix/indices/dt=2020-01-02-03/merged-a.parquet"
+	msgKey  = "prefix/messages/dt=2020-01-02-03/merged-a.parquet"
+	msgKey2 = "prefix/messages/dt=2020-01-02-04/merged-b.parquet"
+)
+
+func location(bucket, key string) string {
+	return "s3://" + bucket + "/" + key
+}
+
+// newPurgeBucket creates bucket that has merged objects of idxKey, msgKey and msgKey2
+func newPurgeBucket(t *testing.T, client adaptor.S3Client) string {
+	bucket := "purge-" + uuid.New().String()
+
+	require.NoError(t, mock.PutParquet(client, bucket, idxKey, new(models.IndexRecord),
+		&models.IndexRecord{Tag: "app", Timestamp: 100, Field: "user", Term: "alice", ObjectID: 1, Seq: 0},
+		&models.IndexRecord{Tag: "app", Timestamp: 100, Field: "action", Term: "login", ObjectID: 1, Seq: 0},
+		&models.IndexRecord{Tag: "app", Timestamp: 101, Field: "user", Term: "bob", ObjectID: 1, Seq: 1},
+		&models.IndexRecord{Tag: "app", Timestamp: 102, Field: "user", Term: "alice", ObjectID: 2, Seq: 0},
+	))
+	require.NoError(t, mock.PutParquet(client, bucket, msgKey, new(models.MessageRecord),
+		&models.MessageRecord{Timestamp: 100, ObjectID: 1, Seq: 0, Message: `{"user":"alice","action":"login"}`},
+		&models.MessageRecord{Timestamp: 101, ObjectID: 1, Seq: 1, Message: `{"user":"bob"}`},
+	))
+	require.NoError(t, mock.PutParquet(client, bucket, msgKey2, new(models.MessageRecord),
+		&models.MessageRecord{Timestamp: 102, ObjectID: 2, Seq: 0, Message: `{"user":"alice"}`},
+	))
+
+	return bucket
+}
+
+func newTargets(bucket string) []*purge.Target {
+	return []*purge.Target{
+		{Table: "indices", Location: location(bucket, idxKey), Rows: []purge.RowID{{ObjectID: 1, Seq: 0}, {ObjectID: 2, Seq: 0}}},
+		{Table: "messages", Location: location(bucket, msgKey), Rows: []purge.RowID{{ObjectID: 1, Seq: 0}}},
+		{Table: "messages", Location: location(bucket, msgKey2), Rows: []purge.RowID{{ObjectID: 2, Seq: 0}}},
+	}
+}
+
+func newPurger(client adaptor.S3Client, bucket string, targets []*purge.Target) *purge.Purger {
+	return &purge.Purger{
+		S3:     client,
+		Meta:   service.NewMetaService(mock.NewMetaRepository(), util.NewExpRetryTimer),
+		Finder: &fixedFinder{targets: targets},
+		Bucket: bucket,
+		Prefix: "prefix/",
+	}
+}
+
+func putObject(t *testing.T, client adaptor.S3Client, bucket, key, body string) {
+	_, err := client.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Body:   strings.NewReader(body),
+	})
+	require.NoError(t, err)
+}
+
+func download(t *testing.T, client adaptor.S3Client, bucket, key string) string {
+	output, err := client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	require.NoError(t, err)
+	raw, err := ioutil.ReadAll(output.Body)
+	require.NoError(t, err)
+
+	fd, err := ioutil.TempFile("", "*.parquet")
+	require.NoError(t, err)
+	_, err = fd.Write(raw)
+	require.NoError(t, err)
+	fd.Close()
+	return fd.Name()
+}
+
+func readIndices(t *testing.T, client adaptor.S3Client, bucket, key string) []models.IndexRecord {
+	path := download(t, client, bucket, key)
+	defer os.Remove(path)
+
+	fr, err := local.NewLocalFileReader(path)
+	require.NoError(t, err)
+	defer fr.Close()
+	pr, err := reader.NewParquetReader(fr, new(models.IndexRecord), 1)
+	require.NoError(t, err)
+	defer pr.ReadStop()
+
+	rows := make([]models.IndexRecord, pr.GetNumRows())
+	require.NoError(t, pr.Read(&rows))
+	return rows
+}
+
+func readMessages(t *testing.T, client adaptor.S3Client, bucket, key string) []models.MessageRecord {
+	path := download(t, client, bucket, key)
+	defer os.Remove(path)
+
+	fr, err := local.NewLocalFileReader(path)
+	require.NoError(t, err)
+	defer fr.Close()
+	pr, err := reader.NewParquetReader(fr, new(models.MessageRecord), 1)
+	require.NoError(t, err)
+	defer pr.ReadStop()
+
+	rows := make([]models.MessageRecord, pr.GetNumRows())
+	require.NoError(t, pr.Read(&rows))
+	return rows
+}
+
+func readRecord(t *testing.T, client *mock.FaultS3Client, bucket string) *purge.Record {
+	keys := client.Keys(bucket, "prefix/purge/2020/02/01/")
+	require.Equal(t, 1, len(keys))
+	obj, err := client.GetObject(&s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(keys[0])})
+	require.NoError(t, err)
+
+	var record purge.Record
+	require.NoError(t, json.NewDecoder(obj.Body).Decode(&record))
+	return &record
+}
+
+func TestPurge(t *testing.T) {
+	now := time.Date(2020, 2, 1, 12, 0, 0, 0, time.UTC)
+	req := &purge.Request{
+		Terms:  []string{"alice"},
+		Begin:  testBegin,
+		End:    testEnd,
+		Reason: "ticket-1",
+	}
+
+	t.Run("rewrite objects without target rows", func(tt *testing.T) {
+		client := mock.NewFaultS3Client("ap-northeast-1", nil)
+		bucket := newPurgeBucket(tt, client)
+		purger := newPurger(client, bucket, newTargets(bucket))
+
+		record, err := purger.Purge(req, now)
+		require.NoError(tt, err)
+		require.Equal(tt, 3, len(record.Objects))
+		assert.Equal(tt, int64(5), record.RemovedRows)
+		assert.Equal(tt, int64(4), record.Objects[0].RowsBefore)
+		assert.Equal(tt, int64(1), record.Objects[0].RowsAfter)
+		assert.True(tt, record.Objects[2].Deleted)
+
+		indices := readIndices(tt, client, bucket, idxKey)
+		require.Equal(tt, 1, len(indices))
+		assert.Equal(tt, "bob", indices[0].Term)
+
+		messages := readMessages(tt, client, bucket, msgKey)
+		require.Equal(tt, 1, len(messages))
+		assert.Equal(tt, `{"user":"bob"}`, messages[0].Message)
+
+		// No row remains in msgKey2
+		assert.Empty(tt, client.Keys(bucket, msgKey2))
+
+		// Audit record has identifiers and reason, but not contents of logs and terms
+		keys := client.Keys(bucket, "prefix/purge/2020/02/01/")
+		require.Equal(tt, 1, len(keys))
+		obj, err := client.GetObject(&s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(keys[0])})
+		require.NoError(tt, err)
+		raw, err := ioutil.ReadAll(obj.Body)
+		require.NoError(tt, err)
+		assert.Contains(tt, string(raw), "ticket-1")
+		assert.Contains(tt, string(raw), `"object_id": 2`)
+		assert.NotContains(tt, string(raw), "login")
+		assert.NotContains(tt, string(raw), "alice")
+
+		saved := readRecord(tt, client, bucket)
+		assert.Equal(tt, purge.StatusCompleted, saved.Status)
+		for _, obj := range saved.Objects {
+			assert.Equal(tt, purge.StatusReplaced, obj.Status)
+		}
+		assert.Empty(tt, client.Keys(bucket, "prefix/purge/backup/"))
+
+		// Term can be confirmed with salt in the record
+		assert.NotEmpty(tt, saved.Request.Salt)
+		assert.Equal(tt, []string{purge.HashTerm(saved.Request.Salt, "alice")}, saved.Request.TermHashes)
+		assert.NotEqual(tt, purge.HashTerm(saved.Request.Salt, "bob"), saved.Request.TermHashes[0])
+		assert.Equal(tt, "ticket-1", saved.Request.Reason)
+	})
+
+	t.Run("restore replaced objects if replacement fails", func(tt *testing.T) {
+		client := mock.NewFaultS3Client("ap-northeast-1", func(op, key string) error {
+			if op == "PutObject" && key == msgKey {
+				return fmt.Errorf("put error")
+			}
+			return nil
+		})
+		bucket := newPurgeBucket(tt, client.S3Client)
+		purger := newPurger(client, bucket, newTargets(bucket))
+
+		_, err := purger.Purge(req, now)
+		require.Error(tt, err)
+		assert.Equal(tt, 4, len(readIndices(tt, client, bucket, idxKey)))
+		assert.Equal(tt, 2, len(readMessages(tt, client, bucket, msgKey)))
+		assert.NotEmpty(tt, client.Keys(bucket, msgKey2))
+		assert.Empty(tt, client.Keys(bucket, "prefix/purge/backup/"))
+
+		record := readRecord(tt, client, bucket)
+		assert.Equal(tt, purge.StatusFailed, record.Status)
+		assert.Contains(tt, record.Error, "put error")
+		require.Equal(tt, 3, len(record.Objects))
+		assert.Equal(tt, purge.StatusRolledBack, record.Objects[0].Status)
+		assert.Equal(tt, purge.StatusFailed, record.Objects[1].Status)
+		assert.Equal(tt, purge.StatusPending, record.Objects[2].Status)
+	})
+
+	t.Run("delete query outputs that have terms", func(tt *testing.T) {
+		client := mock.NewFaultS3Client("ap-northeast-1", nil)
+		bucket := newPurgeBucket(tt, client)
+		putObject(tt, client, bucket, "prefix/output/q1.csv", `"tag","timestamp","log"`+"\n"+`"app","100","{""user"":""alice""}"`)
+		putObject(tt, client, bucket, "prefix/output/q1.csv.metadata", "meta")
+		putObject(tt, client, bucket, "prefix/output/q1.csv.cache/rows.jsonl", `{"log":{"user":"alice"}}`)
+		putObject(tt, client, bucket, "prefix/output/q2.csv", `"tag","timestamp","log"`+"\n"+`"app","101","{""user"":""bob""}"`)
+
+		dryRun := newPurger(client, bucket, newTargets(bucket))
+		dryRun.DryRun = true
+		record, err := dryRun.Purge(req, now)
+		require.NoError(tt, err)
+		assert.Equal(tt, 3, len(record.Outputs))
+		assert.NotEmpty(tt, client.Keys(bucket, "prefix/output/q1.csv"))
+
+		purger := newPurger(client, bucket, newTargets(bucket))
+		record, err = purger.Purge(req, now)
+		require.NoError(tt, err)
+		assert.Equal(tt, []string{
+			"prefix/output/q1.csv",
+			"prefix/output/q1.csv.cache/rows.jsonl",
+			"prefix/output/q1.csv.metadata",
+		}, record.Outputs)
+		assert.Empty(tt, client.Keys(bucket, "prefix/output/q1.csv"))
+		assert.NotEmpty(tt, client.Keys(bucket, "prefix/output/q2.csv"))
+		assert.Equal(tt, 3, len(readRecord(tt, client, bucket).Outputs))
+	})
+
+	t.Run("reject if partition is locked by other job", func(tt *testing.T) {
+		client := mock.NewFaultS3Client("ap-northeast-1", nil)
+		bucket := newPurgeBucket(tt, client)
+		purger := newPurger(client, bucket, newTargets(bucket))
+
+		idxDir := location(bucket, "prefix/indices/dt=2020-01-02-03/")
+		msgDir := location(bucket, "prefix/messages/dt=2020-01-02-03/")
+		locked, err := purger.Meta.LockPartition(idxDir, "compaction:test")
+		require.NoError(tt, err)
+		require.True(tt, locked)
+
+		_, err = purger.Purge(req, now)
+		require.Error(tt, err)
+		assert.Contains(tt, err.Error(), idxDir)
+		assert.Equal(tt, 4, len(readIndices(tt, client, bucket, idxKey)))
+		assert.Empty(tt, client.Keys(bucket, "prefix/purge/"))
+
+		// Locks acquired by purge are released
+		locked, err = purger.Meta.LockPartition(msgDir, "compaction:test")
+		require.NoError(tt, err)
+		assert.True(tt, locked)
+
+		// Lock of purge itself is also released after purge
+		require.NoError(tt, purger.Meta.UnlockPartition(idxDir, "compaction:test"))
+		require.NoError(tt, purger.Meta.UnlockPartition(msgDir, "compaction:test"))
+		_, err = purger.Purge(req, now)
+		require.NoError(tt, err)
+		locked, err = purger.Meta.LockPartition(idxDir, "compaction:test")
+		require.NoError(tt, err)
+		assert.True(tt, locked)
+	})
+
+	t.Run("reject if raw objects are not merged yet", func(tt *testing.T) {
+		client := mock.NewFaultS3Client("ap-northeast-1", nil)
+		bucket := newPurgeBucket(tt, client)
+		purger := newPurger(client, bucket, newTargets(bucket))
+
+		// Out of time range
+		putObject(tt, client, bucket, "prefix/raw/indices/dt=2020-01-05-03/src-bucket/logs/a.log/x.msg.gz", "raw")
+		_, err := purger.Purge(req, now)
+		require.NoError(tt, err)
+
+		bucket = newPurgeBucket(tt, client)
+		purger = newPurger(client, bucket, newTargets(bucket))
+		putObject(tt, client, bucket, "prefix/raw/messages/dt=2020-01-02/src-bucket/logs/a.log/x.msg.gz", "raw")
+		_, err = purger.Purge(req, now)
+		require.Error(tt, err)
+		assert.Contains(tt, err.Error(), "prefix/raw/messages/dt=2020-01-02/")
+		assert.Equal(tt, 4, len(readIndices(tt, client, bucket, idxKey)))
+	})
+
+	t.Run("delete raw objects that are already merged", func(tt *testing.T) {
+		client := mock.NewFaultS3Client("ap-northeast-1", nil)
+		bucket := newPurgeBucket(tt, client)
+		purger := newPurger(client, bucket, newTargets(bucket))
+
+		// Merger failed to delete raw objects of msgKey
+		merged := []string{
+			"prefix/raw/messages/dt=2020-01-02-03/src-bucket/logs/a.log/x.msg.gz",
+			"prefix/raw/messages/dt=2020-01-02-03/src-bucket/logs/b.log/y.msg.gz",
+		}
+		manifest := &models.MergeManifest{Object: models.NewS3Object("ap-northeast-1", bucket, msgKey)}
+		for _, key := range merged {
+			putObject(tt, client, bucket, key, "raw")
+			manifest.Sources = append(manifest.Sources, &models.MergeManifestEntry{Object: models.NewS3Object("ap-northeast-1", bucket, key)})
+		}
+		raw, err := json.Marshal(manifest)
+		require.NoError(tt, err)
+		putObject(tt, client, bucket, models.BuildMergeManifestKey(msgKey), string(raw))
+
+		dryRun := newPurger(client, bucket, newTargets(bucket))
+		dryRun.DryRun = true
+		record, err := dryRun.Purge(req, now)
+		require.NoError(tt, err)
+		assert.Equal(tt, merged, record.RawObjects)
+		assert.Equal(tt, merged, client.Keys(bucket, "prefix/raw/"))
+
+		record, err = purger.Purge(req, now)
+		require.NoError(tt, err)
+		assert.Equal(tt, merged, record.RawObjects)
+		assert.Empty(tt, client.Keys(bucket, "prefix/raw/"))
+		assert.Equal(tt, merged, readRecord(tt, client, bucket).RawObjects)
+
+		// Raw object not in manifest is pending and blocks purge
+		bucket = newPurgeBucket(tt, client)
+		purger = newPurger(client, bucket, newTargets(bucket))
+		putObject(tt, client, bucket, models.BuildMergeManifestKey(msgKey), string(raw))
+		pending := "prefix/raw/messages/dt=2020-01-02-03/src-bucket/logs/c.log/z.msg.gz"
+		putObject(tt, client, bucket, merged[0], "raw")
+		putObject(tt, client, bucket, pending, "raw")
+		_, err = purger.Purge(req, now)
+		require.Error(tt, err)
+		assert.Contains(tt, err.Error(), pending)
+		assert.Equal(tt, []string{merged[0], pending}, client.Keys(bucket, "prefix/raw/"))
+	})
+
+	t.Run("dry run does not replace objects", func(tt *testing.T) {
+		client := mock.NewFaultS3Client("ap-northeast-1", nil)
+		bucket := newPurgeBucket(tt, client)
+		purger := newPurger(client, bucket, newTargets(bucket))
+		purger.DryRun = true
+
+		record, err := purger.Purge(req, now)
+		require.NoError(tt, err)
+		assert.Equal(tt, int64(5), record.RemovedRows)
+		assert.Equal(tt, 4, len(readIndices(tt, client, bucket, idxKey)))
+		assert.NotEmpty(tt, client.Keys(bucket, msgKey2))
+		assert.Empty(tt, client.Keys(bucket, "prefix/purge/"))
+	})
+
+	t.Run("no object is replaced if a target row is missing", func(tt *testing.T) {
+		client := mock.NewFaultS3Client("ap-northeast-1", nil)
+		bucket := newPurgeBucket(tt, client)
+		targets := newTargets(bucket)
+		targets[2].Rows = append(targets[2].Rows, purge.RowID{ObjectID: 9, Seq: 9})
+		purger := newPurger(client, bucket, targets)
+
+		_, err := purger.Purge(req, now)
+		require.Error(tt, err)
+		assert.True(tt, strings.Contains(err.Error(), "object_id=9"))
+		assert.Equal(tt, 4, len(readIndices(tt, client, bucket, idxKey)))
+		assert.Equal(tt, 2, len(readMessages(tt, client, bucket, msgKey)))
+		assert.NotEmpty(tt, client.Keys(bucket, msgKey2))
+	})
+
+	t.Run("reject object out of prefix or not merged", func(tt *testing.T) {
+		client := mock.NewFaultS3Client("ap-northeast-1", nil)
+		bucket := newPurgeBucket(tt, client)
+		for _, target := range []*purge.Target{
+			{Table: "indices", Location: "s3://other-bucket/" + idxKey},
+			{Table: "indices", Location: location(bucket, "other/indices/dt=2020-01-02-03/merged-a.parquet")},
+			{Table: "indices", Location: location(bucket, "prefix/raw/indices/dt=2020-01-02-03/x.msg")},
+			{Table: "indices", Location: location(bucket, "prefix/compaction/xxx/indices/dt=2020-01-02-03/merged-a.parquet")},
+			{Table: "unknown", Location: location(bucket, idxKey)},
+		} {
+			purger := newPurger(client, bucket, []*purge.Target{target})
+			_, err := purger.Purge(req, now)
+			assert.Error(tt, err, target.Location)
+		}
+	})
+}
+
+func TestContainsAll(t *testing.T) {
+	terms := [][]byte{[]byte("alice"), []byte("example")}
+	ok, err := purge.ContainsAll(iotest.OneByteReader(strings.NewReader("user=alice@example.com")), terms)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = purge.ContainsAll(iotest.OneByteReader(strings.NewReader("user=alice@test.com")), terms)
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
@@ -0,0 +1,173 @@
+package purge
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/m-mizutani/minerva/internal/adaptor"
+	"github.com/m-mizutani/minerva/internal/service"
+	"github.com/m-mizutani/minerva/pkg/merger"
+	"github.com/m-mizutani/minerva/pkg/models"
+	"github.com/pkg/errors"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+const rewriteBatchSize = 1024
+
+type readRows func(pr *reader.ParquetReader, n int) ([]models.Record, []RowID, error)
+
+type rewriteSchema struct {
+	name      models.ParquetSchemaName
+	newRecord func() models.Record
+	read      readRows
+}
+
+var rewriteSchemaMap = map[string]rewriteSchema{
+	string(models.AthenaTableIndex): {
+		name:      models.ParquetSchemaIndex,
+		newRecord: func() models.Record { return new(models.IndexRecord) },
+		read:      readIndexRows,
+	},
+	models.AthenaTableMessage: {
+		name:      models.ParquetSchemaMessage,
+		newRecord: func() models.Record { return new(models.MessageRecord) },
+		read:      readMessageRows,
+	},
+}
+
+func readIndexRows(pr *reader.ParquetReader, n int) ([]models.Record, []RowID, error) {
+	rows := make([]models.IndexRecord, n)
+	if err := pr.Read(&rows); err != nil {
+		return nil, nil, err
+	}
+
+	records := make([]models.Record, len(rows))
+	ids := make([]RowID, len(rows))
+	for i := range rows {
+		records[i] = &rows[i]
+		ids[i] = RowID{ObjectID: rows[i].ObjectID, Seq: rows[i].Seq}
+	}
+	return records, ids, nil
+}
+
+func readMessageRows(pr *reader.ParquetReader, n int) ([]models.Record, []RowID, error) {
+	rows := make([]models.MessageRecord, n)
+	if err := pr.Read(&rows); err != nil {
+		return nil, nil, err
+	}
+
+	records := make([]models.Record, len(rows))
+	ids := make([]RowID, len(rows))
+	for i := range rows {
+		records[i] = &rows[i]
+		ids[i] = RowID{ObjectID: rows[i].ObjectID, Seq: rows[i].Seq}
+	}
+	return records, ids, nil
+}
+
+type rewriteResult struct {
+	path   string
+	before int64
+	after  int64
+}
+
+// rewriteObject downloads the object and writes rows except target rows to a local parquet file. It fails if any target row is not found in the object, because the object may be changed after query.
+func rewriteObject(client adaptor.S3Client, bucket, key string, target *Target, cfg *merger.ParquetConfig) (*rewriteResult, error) {
+	schema, ok := rewriteSchemaMap[target.Table]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported table of purge target: %s", target.Table)
+	}
+
+	downloaded, err := service.NewS3ServiceWithClient(client).DownloadS3Object(models.NewS3Object("", bucket, key))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to download purge target: s3://%s/%s", bucket, key)
+	}
+	if downloaded == nil {
+		return nil, fmt.Errorf("Purge target is not found: s3://%s/%s", bucket, key)
+	}
+	src := *downloaded
+	defer os.Remove(src)
+
+	fd, err := ioutil.TempFile("", "*.parquet")
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to create a temp parquet file")
+	}
+	fd.Close()
+	result := &rewriteResult{path: fd.Name()}
+
+	if err := rewriteFile(src, result, schema, target, cfg); err != nil {
+		os.Remove(result.path)
+		return nil, errors.Wrapf(err, "Fail to rewrite %s", target.Location)
+	}
+
+	return result, nil
+}
+
+func rewriteFile(src string, result *rewriteResult, schema rewriteSchema, target *Target, cfg *merger.ParquetConfig) error {
+	removing := map[RowID]bool{}
+	for _, id := range target.Rows {
+		removing[id] = false
+	}
+
+	fr, err := local.NewLocalFileReader(src)
+	if err != nil {
+		return errors.Wrap(err, "Fail to open downloaded parquet file")
+	}
+	defer fr.Close()
+
+	pr, err := reader.NewParquetReader(fr, schema.newRecord(), 1)
+	if err != nil {
+		return errors.Wrap(err, "Fail to create parquet reader")
+	}
+	defer pr.ReadStop()
+
+	fw, err := local.NewLocalFileWriter(result.path)
+	if err != nil {
+		return errors.Wrap(err, "Fail to create a parquet file")
+	}
+	defer fw.Close()
+
+	pw, err := cfg.NewWriter(fw, schema.name, false)
+	if err != nil {
+		return err
+	}
+
+	num := pr.GetNumRows()
+	result.before = num
+	for i := int64(0); i < num; i += rewriteBatchSize {
+		n := rewriteBatchSize
+		if num-i < int64(n) {
+			n = int(num - i)
+		}
+
+		records, ids, err := schema.read(pr, n)
+		if err != nil {
+			return errors.Wrap(err, "Fail to read parquet rows")
+		}
+
+		for j := range records {
+			if _, ok := removing[ids[j]]; ok {
+				removing[ids[j]] = true
+				continue
+			}
+			if err := pw.Write(records[j]); err != nil {
+				return errors.Wrap(err, "Fail to write parquet row")
+			}
+			result.after++
+		}
+	}
+
+	if err := pw.WriteStop(); err != nil {
+		return errors.Wrap(err, "Fail to stop writing parquet file")
+	}
+
+	for id, found := range removing {
+		if !found {
+			return fmt.Errorf("Target row (object_id=%d, seq=%d) is not found, object may be changed after query", id.ObjectID, id.Seq)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,214 @@
+package sigma
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// expr is boolean expression built from condition and selections of detection.
+type expr interface{}
+
+type exprAnd struct{ items []expr }
+type exprOr struct{ items []expr }
+type exprNot struct{ item expr }
+
+// exprTerms matches a log that has all terms. source is original expression for report.
+type exprTerms struct {
+	terms  []string
+	source string
+}
+
+// exprAny matches any log. It's used as replacement of unsupported expression, then search result becomes broader than the rule.
+type exprAny struct{}
+
+func tokenizeCondition(cond string) []string {
+	var tokens []string
+	var buf strings.Builder
+	flush := func() {
+		if buf.Len() > 0 {
+			tokens = append(tokens, buf.String())
+			buf.Reset()
+		}
+	}
+
+	for _, r := range cond {
+		switch r {
+		case '(', ')':
+			flush()
+			tokens = append(tokens, string(r))
+		case ' ', '\t', '\n', '\r':
+			flush()
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	flush()
+
+	return tokens
+}
+
+// conditionParser is recursive descent parser of Sigma condition.
+//
+//	expr    := and ("or" and)*
+//	and     := not ("and" not)*
+//	not     := "not" not | primary
+//	primary := "(" expr ")" | ("1"|"any"|"all") "of" (pattern|"them") | identifier
+type conditionParser struct {
+	tokens     []string
+	pos        int
+	selections map[string]expr
+}
+
+func (x *conditionParser) peek() string {
+	if x.pos < len(x.tokens) {
+		return x.tokens[x.pos]
+	}
+	return ""
+}
+
+func (x *conditionParser) next() string {
+	t := x.peek()
+	x.pos++
+	return t
+}
+
+func (x *conditionParser) parse() (expr, error) {
+	e, err := x.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if x.pos < len(x.tokens) {
+		return nil, fmt.Errorf("Unexpected token in condition: %s", x.peek())
+	}
+	return e, nil
+}
+
+func (x *conditionParser) parseOr() (expr, error) {
+	var items []expr
+	for {
+		e, err := x.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, e)
+
+		if strings.ToLower(x.peek()) != "or" {
+			break
+		}
+		x.next()
+	}
+
+	if len(items) == 1 {
+		return items[0], nil
+	}
+	return &exprOr{items: items}, nil
+}
+
+func (x *conditionParser) parseAnd() (expr, error) {
+	var items []expr
+	for {
+		e, err := x.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, e)
+
+		if strings.ToLower(x.peek()) != "and" {
+			break
+		}
+		x.next()
+	}
+
+	if len(items) == 1 {
+		return items[0], nil
+	}
+	return &exprAnd{items: items}, nil
+}
+
+func (x *conditionParser) parseNot() (expr, error) {
+	if strings.ToLower(x.peek()) == "not" {
+		x.next()
+		e, err := x.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &exprNot{item: e}, nil
+	}
+	return x.parsePrimary()
+}
+
+func (x *conditionParser) parsePrimary() (expr, error) {
+	token := x.next()
+	switch lower := strings.ToLower(token); {
+	case token == "":
+		return nil, fmt.Errorf("Unexpected end of condition")
+
+	case token == "(":
+		e, err := x.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if x.next() != ")" {
+			return nil, fmt.Errorf("Missing ')' in condition")
+		}
+		return e, nil
+
+	case lower == "1" || lower == "any" || lower == "all":
+		if strings.ToLower(x.next()) != "of" {
+			return nil, fmt.Errorf("Missing 'of' after '%s' in condition", token)
+		}
+		items, err := x.matchSelections(x.next())
+		if err != nil {
+			return nil, err
+		}
+		if lower == "all" {
+			return &exprAnd{items: items}, nil
+		}
+		return &exprOr{items: items}, nil
+
+	default:
+		e, ok := x.selections[token]
+		if !ok {
+			return nil, fmt.Errorf("Selection is not found: %s", token)
+		}
+		return e, nil
+	}
+}
+
+// matchSelections returns selections matched with pattern in name order. "them" means all selections except ones starting with underscore.
+func (x *conditionParser) matchSelections(pattern string) ([]expr, error) {
+	if pattern == "" {
+		return nil, fmt.Errorf("Missing selection pattern after 'of' in condition")
+	}
+
+	var names []string
+	for name := range x.selections {
+		if pattern == "them" {
+			if !strings.HasPrefix(name, "_") {
+				names = append(names, name)
+			}
+			continue
+		}
+
+		matched, err := path.Match(pattern, name)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid selection pattern: %s", pattern)
+		}
+		if matched {
+			names = append(names, name)
+		}
+	}
+
+	if len(names) == 0 {
+		return nil, fmt.Errorf("No selection matches with '%s'", pattern)
+	}
+
+	sort.Strings(names)
+	var items []expr
+	for _, name := range names {
+		items = append(items, x.selections[name])
+	}
+	return items, nil
+}
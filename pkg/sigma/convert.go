@@ -0,0 +1,419 @@
+package sigma
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/m-mizutani/minerva/internal/tokenizer"
+	"github.com/m-mizutani/minerva/pkg/api"
+	"github.com/pkg/errors"
+)
+
+// maxSearches is limit of OR branches of a rule to avoid explosion of searches.
+const maxSearches = 64
+
+// Search is a set of terms that can be used as query of ExecSearch. A log matches when it has all terms.
+type Search struct {
+	Query []api.Query `json:"query"`
+}
+
+// Result of conversion. A log matches the rule when it matches one of Searches. Unsupported describes parts of the rule that can not be expressed, then results of Searches can be broader than the rule. Searches are never narrower than the rule, conversion fails instead.
+type Result struct {
+	Title       string    `json:"title"`
+	ID          string    `json:"id,omitempty"`
+	LogSource   LogSource `json:"logsource"`
+	Tags        []string  `json:"tags"`
+	Searches    []Search  `json:"searches"`
+	Unsupported []string  `json:"unsupported,omitempty"`
+}
+
+type converter struct {
+	reported    map[string]bool
+	unsupported []string
+}
+
+func (x *converter) report(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if !x.reported[msg] {
+		x.reported[msg] = true
+		x.unsupported = append(x.unsupported, msg)
+	}
+}
+
+// Convert compiles Sigma rule to Minerva searches. Tags are looked up from logsource by tagMap.
+func Convert(rule *Rule, tagMap TagMap) (*Result, error) {
+	cv := &converter{reported: map[string]bool{}}
+
+	result := &Result{
+		Title:     rule.Title,
+		ID:        rule.ID,
+		LogSource: rule.LogSource,
+		Tags:      tagMap.Lookup(rule.LogSource),
+	}
+	if len(result.Tags) == 0 {
+		cv.report("No tag is mapped to logsource %+v", rule.LogSource)
+	}
+
+	selections := map[string]expr{}
+	for name, v := range rule.Detection {
+		switch name {
+		case "condition":
+			continue
+		case "timeframe":
+			cv.report("timeframe is not supported")
+			continue
+		}
+
+		e, err := cv.selectionToExpr(name, v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Fail to convert selection '%s'", name)
+		}
+		selections[name] = e
+	}
+
+	conditions, err := toConditions(rule.Detection["condition"])
+	if err != nil {
+		return nil, err
+	}
+
+	var exprs []expr
+	for _, cond := range conditions {
+		if idx := strings.Index(cond, "|"); idx >= 0 {
+			cv.report("Aggregation is not supported: %s", strings.TrimSpace(cond[idx+1:]))
+			cond = cond[:idx]
+		}
+
+		parser := &conditionParser{tokens: tokenizeCondition(cond), selections: selections}
+		e, err := parser.parse()
+		if err != nil {
+			return nil, errors.Wrapf(err, "Fail to parse condition: %s", cond)
+		}
+		exprs = append(exprs, e)
+	}
+
+	branches, err := cv.toDNF(cv.pushNot(&exprOr{items: exprs}, false))
+	if err != nil {
+		return nil, err
+	}
+
+	// A branch without searchable term matches any log, then OR of the branches also matches any log. Dropping the branch makes searches narrower than the rule and some detections are missed.
+	for _, terms := range branches {
+		if len(terms) == 0 {
+			return nil, errors.New("A part of condition has no searchable term, then the rule matches any log and can not be converted to searches")
+		}
+	}
+
+	for _, terms := range reduceBranches(branches) {
+		var search Search
+		for _, t := range terms {
+			search.Query = append(search.Query, api.Query{Term: t})
+		}
+		result.Searches = append(result.Searches, search)
+	}
+
+	if len(result.Searches) == 0 {
+		return nil, errors.New("No search can be built from the rule")
+	}
+
+	result.Unsupported = cv.unsupported
+	return result, nil
+}
+
+func toConditions(v interface{}) ([]string, error) {
+	switch cond := v.(type) {
+	case string:
+		return []string{cond}, nil
+	case []interface{}:
+		// List of conditions is OR of them
+		var conditions []string
+		for _, c := range cond {
+			s, ok := c.(string)
+			if !ok {
+				return nil, fmt.Errorf("Invalid condition: %v", c)
+			}
+			conditions = append(conditions, s)
+		}
+		return conditions, nil
+	default:
+		return nil, fmt.Errorf("Invalid condition: %v", v)
+	}
+}
+
+func (x *converter) selectionToExpr(name string, v interface{}) (expr, error) {
+	switch sel := v.(type) {
+	case map[interface{}]interface{}:
+		return x.fieldsToExpr(sel)
+
+	case []interface{}:
+		var items []expr
+		for _, item := range sel {
+			if m, ok := item.(map[interface{}]interface{}); ok {
+				e, err := x.fieldsToExpr(m)
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, e)
+			} else {
+				// keyword
+				items = append(items, x.valueToExpr(item))
+			}
+		}
+		return &exprOr{items: items}, nil
+
+	case string, int, float64, bool:
+		return x.valueToExpr(sel), nil
+
+	default:
+		return nil, fmt.Errorf("Unsupported selection format: %v", v)
+	}
+}
+
+// fieldsToExpr converts map of field and value. Minerva search does not restrict field of term, then field name is ignored.
+func (x *converter) fieldsToExpr(fields map[interface{}]interface{}) (expr, error) {
+	values := map[string]interface{}{}
+	var keys []string
+	for k, v := range fields {
+		key := fmt.Sprintf("%v", k)
+		values[key] = v
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var items []expr
+	for _, key := range keys {
+		parts := strings.Split(key, "|")
+		field, modifiers := parts[0], parts[1:]
+		x.report("Field name is ignored, value is matched in any field: %s", field)
+
+		matchAll := false
+		supported := true
+		for _, mod := range modifiers {
+			switch mod {
+			case "contains":
+			case "startswith", "endswith":
+				x.report("Modifier '%s' is approximated as 'contains'", mod)
+			case "all":
+				matchAll = true
+			default:
+				x.report("Modifier '%s' is not supported: %s", mod, key)
+				supported = false
+			}
+		}
+		if !supported {
+			items = append(items, &exprAny{})
+			continue
+		}
+
+		switch v := values[key].(type) {
+		case nil:
+			x.report("Null value is not supported: %s", key)
+			items = append(items, &exprAny{})
+
+		case []interface{}:
+			var values []expr
+			for _, item := range v {
+				values = append(values, x.valueToExpr(item))
+			}
+			if matchAll {
+				items = append(items, &exprAnd{items: values})
+			} else {
+				items = append(items, &exprOr{items: values})
+			}
+
+		case map[interface{}]interface{}:
+			return nil, fmt.Errorf("Nested map is not allowed as value: %s", key)
+
+		default:
+			items = append(items, x.valueToExpr(v))
+		}
+	}
+
+	return &exprAnd{items: items}, nil
+}
+
+func (x *converter) valueToExpr(v interface{}) expr {
+	s := fmt.Sprintf("%v", v)
+	terms := valueToTerms(s)
+	if len(terms) == 0 {
+		return &exprAny{}
+	}
+	return &exprTerms{terms: terms, source: s}
+}
+
+var valueTokenizer = tokenizer.NewSimpleTokenizer()
+
+// valueToTerms splits a Sigma value by wildcards into terms. A term matches as substring, then leading and trailing wildcards are not needed. Inner wildcard is replaced with AND of both sides. Backslash, double quote and single quote are also separators because they are escaped in stored JSON message and SQL.
+func valueToTerms(s string) []string {
+	var terms []string
+	var buf strings.Builder
+	flush := func() {
+		term := strings.TrimSpace(buf.String())
+		buf.Reset()
+		for _, token := range valueTokenizer.Split(term) {
+			if !token.IsDelim {
+				// Keep only a term having indexed token
+				terms = append(terms, term)
+				return
+			}
+		}
+	}
+
+	runes := []rune(s)
+	for i := 0; i < len(runes); i++ {
+		switch r := runes[i]; r {
+		case '\\':
+			if i+1 < len(runes) && (runes[i+1] == '*' || runes[i+1] == '?' || runes[i+1] == '\\') {
+				// Escaped character is literal. Escaped backslash is still a separator.
+				i++
+				if runes[i] != '\\' {
+					buf.WriteRune(runes[i])
+					continue
+				}
+			}
+			flush()
+		case '*', '?', '"', '\'':
+			flush()
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	flush()
+
+	return terms
+}
+
+// pushNot moves negation to leaves by De Morgan's laws. Negation of terms can not be expressed by Minerva search, then it's replaced with exprAny.
+func (x *converter) pushNot(e expr, negated bool) expr {
+	switch v := e.(type) {
+	case *exprNot:
+		return x.pushNot(v.item, !negated)
+
+	case *exprAnd:
+		var items []expr
+		for _, item := range v.items {
+			items = append(items, x.pushNot(item, negated))
+		}
+		if negated {
+			return &exprOr{items: items}
+		}
+		return &exprAnd{items: items}
+
+	case *exprOr:
+		var items []expr
+		for _, item := range v.items {
+			items = append(items, x.pushNot(item, negated))
+		}
+		if negated {
+			return &exprAnd{items: items}
+		}
+		return &exprOr{items: items}
+
+	case *exprTerms:
+		if negated {
+			x.report("NOT condition is not supported, ignored: %s", v.source)
+			return &exprAny{}
+		}
+		return v
+
+	default:
+		return e
+	}
+}
+
+// toDNF converts negation free expression to OR of term sets.
+func (x *converter) toDNF(e expr) ([][]string, error) {
+	switch v := e.(type) {
+	case *exprAny:
+		return [][]string{{}}, nil
+
+	case *exprTerms:
+		return [][]string{v.terms}, nil
+
+	case *exprOr:
+		var branches [][]string
+		for _, item := range v.items {
+			sub, err := x.toDNF(item)
+			if err != nil {
+				return nil, err
+			}
+			branches = append(branches, sub...)
+		}
+		if len(branches) > maxSearches {
+			return nil, fmt.Errorf("Too many OR branches (> %d)", maxSearches)
+		}
+		return branches, nil
+
+	case *exprAnd:
+		branches := [][]string{{}}
+		for _, item := range v.items {
+			sub, err := x.toDNF(item)
+			if err != nil {
+				return nil, err
+			}
+
+			var product [][]string
+			for _, b := range branches {
+				for _, s := range sub {
+					merged := append(append([]string{}, b...), s...)
+					product = append(product, merged)
+				}
+			}
+			if len(product) > maxSearches {
+				return nil, fmt.Errorf("Too many OR branches (> %d)", maxSearches)
+			}
+			branches = product
+		}
+		return branches, nil
+
+	default:
+		return nil, fmt.Errorf("Unexpected expression: %T", e)
+	}
+}
+
+// reduceBranches sorts and deduplicates terms of each branch, and removes a branch that is absorbed by other branch (A OR (A AND B) = A).
+func reduceBranches(branches [][]string) [][]string {
+	sets := make([]map[string]bool, len(branches))
+	for i, b := range branches {
+		sets[i] = map[string]bool{}
+		for _, t := range b {
+			sets[i][t] = true
+		}
+	}
+
+	isSubset := func(a, b map[string]bool) bool {
+		for t := range a {
+			if !b[t] {
+				return false
+			}
+		}
+		return true
+	}
+
+	var results [][]string
+	for i := range sets {
+		absorbed := false
+		for j := range sets {
+			if i == j || !isSubset(sets[j], sets[i]) {
+				continue
+			}
+			// Keep the first one if both are same
+			if len(sets[j]) < len(sets[i]) || j < i {
+				absorbed = true
+				break
+			}
+		}
+		if absorbed {
+			continue
+		}
+
+		var terms []string
+		for t := range sets[i] {
+			terms = append(terms, t)
+		}
+		sort.Strings(terms)
+		results = append(results, terms)
+	}
+
+	return results
+}
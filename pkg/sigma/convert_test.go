@@ -0,0 +1,178 @@
+package sigma_test
+
+import (
+	"testing"
+
+	"github.com/m-mizutani/minerva/pkg/sigma"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testTagMap = sigma.TagMap{
+	{Product: "windows", Tags: []string{"windows.sysmon"}},
+	{Product: "windows", Service: "security", Tags: []string{"windows.security"}},
+}
+
+func convertRule(t *testing.T, raw string) *sigma.Result {
+	rule, err := sigma.ParseRule([]byte(raw))
+	require.NoError(t, err)
+	result, err := sigma.Convert(rule, testTagMap)
+	require.NoError(t, err)
+	return result
+}
+
+func searchTerms(result *sigma.Result) [][]string {
+	var terms [][]string
+	for _, s := range result.Searches {
+		var t []string
+		for _, q := range s.Query {
+			t = append(t, q.Term)
+		}
+		terms = append(terms, t)
+	}
+	return terms
+}
+
+func TestConvertBasicRule(t *testing.T) {
+	result := convertRule(t, `
+title: Suspicious whoami
+id: 11111111-2222-3333-4444-555555555555
+logsource:
+  product: windows
+  service: security
+detection:
+  selection:
+    Image|endswith: '\whoami.exe'
+    User: admin
+  condition: selection
+`)
+
+	assert.Equal(t, "Suspicious whoami", result.Title)
+	assert.Equal(t, []string{"windows.sysmon", "windows.security"}, result.Tags)
+	assert.Equal(t, [][]string{{"admin", "whoami.exe"}}, searchTerms(result))
+	assert.Contains(t, result.Unsupported, "Modifier 'endswith' is approximated as 'contains'")
+	assert.Contains(t, result.Unsupported, "Field name is ignored, value is matched in any field: Image")
+}
+
+func TestConvertOrAndWildcard(t *testing.T) {
+	result := convertRule(t, `
+title: Encoded powershell
+logsource:
+  product: windows
+detection:
+  selection_img:
+    Image:
+      - '*\powershell.exe'
+      - '*\pwsh.exe'
+  selection_cmd:
+    CommandLine|contains|all:
+      - ' -enc'
+      - 'bypass*hidden'
+  condition: all of selection_*
+`)
+
+	assert.Equal(t, [][]string{
+		{"-enc", "bypass", "hidden", "powershell.exe"},
+		{"-enc", "bypass", "hidden", "pwsh.exe"},
+	}, searchTerms(result))
+}
+
+func TestConvertNotAndKeywords(t *testing.T) {
+	result := convertRule(t, `
+title: Keywords
+logsource:
+  product: linux
+detection:
+  keywords:
+    - 'rm -rf'
+    - 'mkfifo'
+  filter:
+    User: root
+  condition: keywords and not filter
+`)
+
+	assert.Equal(t, [][]string{{"rm -rf"}, {"mkfifo"}}, searchTerms(result))
+	assert.Contains(t, result.Unsupported, "NOT condition is not supported, ignored: root")
+	assert.Contains(t, result.Unsupported, "No tag is mapped to logsource {Category: Product:linux Service:}")
+}
+
+func TestConvertAbsorbAndAggregation(t *testing.T) {
+	result := convertRule(t, `
+title: Brute force
+logsource:
+  product: windows
+  service: security
+detection:
+  sel1:
+    EventID: 4625
+  sel2:
+    EventID: 4625
+    LogonType: 3
+  condition:
+    - 1 of them | count() by IpAddress > 10
+  timeframe: 5m
+`)
+
+	// (4625) OR (4625 AND 3) is reduced to (4625)
+	assert.Equal(t, [][]string{{"4625"}}, searchTerms(result))
+	assert.Contains(t, result.Unsupported, "Aggregation is not supported: count() by IpAddress > 10")
+	assert.Contains(t, result.Unsupported, "timeframe is not supported")
+}
+
+func TestConvertError(t *testing.T) {
+	testCases := []struct {
+		title string
+		rule  string
+	}{
+		{"no condition", `
+detection:
+  selection:
+    a: b
+`},
+		{"unknown selection", `
+detection:
+  selection:
+    a: b
+  condition: selection or other
+`},
+		{"unbalanced parenthesis", `
+detection:
+  selection:
+    a: b
+  condition: (selection
+`},
+		{"only negation", `
+detection:
+  selection:
+    a: b
+  condition: not selection
+`},
+		{"OR with negation", `
+detection:
+  selection:
+    a: b
+  filter:
+    c: d
+  condition: selection or not filter
+`},
+		{"OR with unsupported modifier", `
+detection:
+  selection:
+    a: b
+  sel_re:
+    c|re: 'd.*e'
+  condition: selection or sel_re
+`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.title, func(tt *testing.T) {
+			rule, err := sigma.ParseRule([]byte(tc.rule))
+			if err != nil {
+				return
+			}
+			_, err = sigma.Convert(rule, testTagMap)
+			assert.Error(tt, err)
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package sigma
+
+import (
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// Rule is a Sigma rule. Only fields required for conversion are decoded.
+type Rule struct {
+	Title       string                 `yaml:"title"`
+	ID          string                 `yaml:"id"`
+	Description string                 `yaml:"description"`
+	Level       string                 `yaml:"level"`
+	LogSource   LogSource              `yaml:"logsource"`
+	Detection   map[string]interface{} `yaml:"detection"`
+}
+
+// LogSource of Sigma rule
+type LogSource struct {
+	Category string `yaml:"category" json:"category,omitempty"`
+	Product  string `yaml:"product" json:"product,omitempty"`
+	Service  string `yaml:"service" json:"service,omitempty"`
+}
+
+// ParseRule decodes a Sigma rule of YAML format.
+func ParseRule(raw []byte) (*Rule, error) {
+	var rule Rule
+	if err := yaml.Unmarshal(raw, &rule); err != nil {
+		return nil, errors.Wrap(err, "Fail to parse Sigma rule")
+	}
+
+	if rule.Detection == nil {
+		return nil, errors.New("No 'detection' in Sigma rule")
+	}
+	if _, ok := rule.Detection["condition"]; !ok {
+		return nil, errors.New("No 'condition' in detection of Sigma rule")
+	}
+
+	return &rule, nil
+}
+
+// TagMapEntry maps a logsource to Minerva tags. Empty field of entry matches any value.
+type TagMapEntry struct {
+	Category string   `yaml:"category" json:"category"`
+	Product  string   `yaml:"product" json:"product"`
+	Service  string   `yaml:"service" json:"service"`
+	Tags     []string `yaml:"tags" json:"tags"`
+}
+
+// TagMap is list of TagMapEntry. All matched entries are used.
+type TagMap []TagMapEntry
+
+// ParseTagMap decodes TagMap of YAML (or JSON) format.
+func ParseTagMap(raw []byte) (TagMap, error) {
+	var tagMap TagMap
+	if err := yaml.Unmarshal(raw, &tagMap); err != nil {
+		return nil, errors.Wrap(err, "Fail to parse tag map")
+	}
+	return tagMap, nil
+}
+
+func (x *TagMapEntry) match(src LogSource) bool {
+	return (x.Category == "" || x.Category == src.Category) &&
+		(x.Product == "" || x.Product == src.Product) &&
+		(x.Service == "" || x.Service == src.Service)
+}
+
+// Lookup returns tags of the logsource without duplication.
+func (x TagMap) Lookup(src LogSource) []string {
+	var tags []string
+	found := map[string]bool{}
+	for _, entry := range x {
+		if !entry.match(src) {
+			continue
+		}
+		for _, tag := range entry.Tags {
+			if !found[tag] {
+				found[tag] = true
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
@@ -0,0 +1,556 @@
+package sweeper
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/m-mizutani/minerva/internal"
+	"github.com/m-mizutani/minerva/internal/adaptor"
+	"github.com/m-mizutani/minerva/internal/repository"
+	"github.com/m-mizutani/minerva/internal/service"
+	"github.com/m-mizutani/minerva/pkg/models"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var logger = internal.Logger
+
+const (
+	// DefaultMinAge is default age of raw object to be checked. Raw objects in normal pipeline are merged and deleted in a few minutes.
+	DefaultMinAge = 24 * time.Hour
+	// DefaultMergeTimeout is default time to confirm orphan. Merge message is retried in merge queue for visibility timeout (450s) x max receive count (3) at most, then it's merged or moved to merge DLQ.
+	DefaultMergeTimeout = 30 * time.Minute
+	// DefaultMetricNamespace is default CloudWatch namespace of sweeper metrics
+	DefaultMetricNamespace = "Minerva"
+
+	// sweepRecordIDPrefix is prefix of record ID for requeued raw object. Same record ID is used for same object to find last requeue.
+	sweepRecordIDPrefix = "sweep/"
+	// foundRecordIDPrefix is prefix of record ID for raw object found as orphan first to confirm it in next run.
+	foundRecordIDPrefix = "sweep-found/"
+	// dlqPeekTimeout is visibility timeout (seconds) of merge DLQ messages received by sweeper
+	dlqPeekTimeout = 60
+)
+
+// OrphanObject is raw object that is not merged and not in pipeline
+type OrphanObject struct {
+	Object       models.S3Object          `json:"object"`
+	Schema       models.ParquetSchemaName `json:"schema"`
+	Partition    string                   `json:"partition"`
+	Size         int64                    `json:"size"`
+	LastModified time.Time                `json:"last_modified"`
+	// Merged means the object is a source in merge manifest, then it was merged but failed to be deleted. It's never requeued to avoid duplicated records.
+	Merged bool `json:"merged"`
+	// MergeFailed means the object is in a message of merge DLQ. It's not requeued, redrive the DLQ to merge it.
+	MergeFailed bool `json:"merge_failed"`
+	// Unknown means the partition has merged objects without merge manifest, e.g. merged before merge manifest was introduced, and the object may have been merged into them. It's not requeued to avoid duplicated records.
+	Unknown bool `json:"unknown"`
+	// RecordID is set if the object is requeued to compose queue
+	RecordID string `json:"record_id,omitempty"`
+}
+
+// SweepReport is result of a sweeper run
+type SweepReport struct {
+	RunAt   time.Time `json:"run_at"`
+	Requeue bool      `json:"requeue"`
+	// Scanned is number of raw objects in S3
+	Scanned int `json:"scanned"`
+	// Pending is number of old raw objects in chunks, possibly in merge queue or requeued recently
+	Pending     int             `json:"pending"`
+	Orphans     []*OrphanObject `json:"orphans"`
+	Merged      int             `json:"merged"`
+	MergeFailed int             `json:"merge_failed"`
+	Unknown     int             `json:"unknown"`
+	Requeued    int             `json:"requeued"`
+	Bytes       int64           `json:"bytes"`
+}
+
+// Sweeper finds raw objects that are older than MinAge but not in chunks. They are orphaned by lost compose message, chunk deleted after failure of sending merge queue or dead merger. Found objects are reported and requeued to compose queue if Requeue is true.
+//
+// Raw object in merge queue also looks orphan because dispatcher deletes the chunk after sending merge message. Then an orphan is confirmed in a run after MergeTimeout since it's found first, and objects in merge DLQ are excluded. Merge queue is not checked directly because receiving a message counts up retry of the message. If merge queue is so backlogged that a message waits longer than MergeTimeout, its objects can be requeued and merged twice.
+type Sweeper struct {
+	S3    adaptor.S3Client
+	Chunk *service.ChunkService
+	Meta  *service.MetaService
+	SQS   *service.SQSService
+	// CloudWatch is used to put metrics of orphans. No metrics if nil.
+	CloudWatch adaptor.CloudWatchClient
+
+	Region string
+	Bucket string
+	Prefix string
+	// ComposeQueueURL is required if Requeue is true
+	ComposeQueueURL string
+	// MergeDLQURL is dead letter queue of merge queue. Objects in its messages are not requeued. DLQ is not checked if empty.
+	MergeDLQURL string
+
+	// MinAge is age of raw object to be checked, and also interval to requeue same object again. Default is DefaultMinAge.
+	MinAge time.Duration
+	// MergeTimeout is time from first finding to confirm orphan. Default is DefaultMergeTimeout.
+	MergeTimeout time.Duration
+	// Requeue sends orphans to compose queue. Only report is saved if false.
+	Requeue bool
+	// ReportPrefix is S3 key prefix of report. Default is Prefix + "sweeper/". Report is saved only if orphans are found.
+	ReportPrefix string
+	// MetricNamespace is CloudWatch namespace. Default is DefaultMetricNamespace.
+	MetricNamespace string
+}
+
+// Sweep checks raw objects and requeues orphans. It saves report to S3 and puts metrics to CloudWatch.
+func (x *Sweeper) Sweep(now time.Time) (*SweepReport, error) {
+	if x.Requeue && x.ComposeQueueURL == "" {
+		return nil, fmt.Errorf("ComposeQueueURL is required to requeue orphan raw objects")
+	}
+
+	minAge := x.MinAge
+	if minAge == 0 {
+		minAge = DefaultMinAge
+	}
+	threshold := now.Add(-minAge)
+
+	report := &SweepReport{
+		RunAt:   now,
+		Requeue: x.Requeue,
+	}
+
+	pending, err := x.pendingObjects()
+	if err != nil {
+		return nil, err
+	}
+	failed, err := x.failedObjects()
+	if err != nil {
+		return nil, err
+	}
+
+	candidates, err := x.listCandidates(threshold, pending, report)
+	if err != nil {
+		return nil, err
+	}
+
+	mergeStates := map[string]*mergeState{}
+	for _, orphan := range candidates {
+		last, err := x.Meta.LookupObject(sweepRecordID(orphan.Object.Key), orphan.Schema)
+		if err != nil {
+			return nil, err
+		}
+		if last != nil && last.PutAt().After(threshold) {
+			report.Pending++
+			continue
+		}
+
+		dir := x.Prefix + path.Join(tableOf(orphan.Schema), orphan.Partition) + "/"
+		state, ok := mergeStates[dir]
+		if !ok {
+			if state, err = x.readMergeState(dir); err != nil {
+				return nil, err
+			}
+			mergeStates[dir] = state
+		}
+		orphan.Merged = state.sources[orphan.Object.Key]
+		orphan.MergeFailed = !orphan.Merged && failed[orphan.Object.Key]
+		orphan.Unknown = !orphan.Merged && !orphan.MergeFailed && state.mayBeMerged(orphan.LastModified)
+
+		if !orphan.Merged && !orphan.MergeFailed && !orphan.Unknown {
+			confirmed, err := x.confirm(orphan, now)
+			if err != nil {
+				return nil, err
+			}
+			if !confirmed {
+				report.Pending++
+				continue
+			}
+		}
+
+		report.Orphans = append(report.Orphans, orphan)
+		report.Bytes += orphan.Size
+		switch {
+		case orphan.Merged:
+			report.Merged++
+			continue
+		case orphan.MergeFailed:
+			report.MergeFailed++
+			continue
+		case orphan.Unknown:
+			report.Unknown++
+			continue
+		}
+
+		if x.Requeue {
+			if err := x.requeue(orphan); err != nil {
+				return nil, err
+			}
+			report.Requeued++
+		}
+	}
+
+	logger.WithFields(logrus.Fields{
+		"scanned":  report.Scanned,
+		"pending":  report.Pending,
+		"orphans":  len(report.Orphans),
+		"merged":   report.Merged,
+		"failed":   report.MergeFailed,
+		"unknown":  report.Unknown,
+		"requeued": report.Requeued,
+	}).Info("Swept raw objects")
+
+	if len(report.Orphans) > 0 {
+		if err := x.putReport(report); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := x.putMetrics(report); err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// pendingObjects returns S3 keys of raw objects in chunks. They will be merged by dispatcher and merger. Meta records not found, e.g. expired, are ignored.
+func (x *Sweeper) pendingObjects() (map[string]bool, error) {
+	pending := map[string]bool{}
+
+	for _, schema := range []models.ParquetSchemaName{models.ParquetSchemaIndex, models.ParquetSchemaMessage} {
+		chunks, err := x.Chunk.GetAllChunks(string(schema))
+		if err != nil {
+			return nil, err
+		}
+
+		var recordIDs []string
+		for _, chunk := range chunks {
+			recordIDs = append(recordIDs, chunk.RecordIDs...)
+		}
+
+		objects, err := x.Meta.LookupObjects(recordIDs, schema)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range objects {
+			pending[obj.Key] = true
+		}
+	}
+
+	return pending, nil
+}
+
+// failedObjects returns S3 keys of raw objects in messages of merge DLQ. Messages are received without delete, then they are back to DLQ after timeout.
+func (x *Sweeper) failedObjects() (map[string]bool, error) {
+	failed := map[string]bool{}
+	if x.MergeDLQURL == "" {
+		return failed, nil
+	}
+
+	bodies, err := x.SQS.PeekMessages(x.MergeDLQURL, dlqPeekTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	recordIDs := map[models.ParquetSchemaName][]string{}
+	for _, body := range bodies {
+		var q models.MergeQueue
+		if err := json.Unmarshal([]byte(body), &q); err != nil {
+			return nil, errors.Wrapf(err, "Fail to parse message of merge DLQ: %s", body)
+		}
+		recordIDs[q.Schema] = append(recordIDs[q.Schema], q.RecordIDs...)
+	}
+
+	for schema, ids := range recordIDs {
+		objects, err := x.Meta.LookupObjects(ids, schema)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range objects {
+			failed[obj.Key] = true
+		}
+	}
+
+	logger.WithFields(logrus.Fields{
+		"messages": len(bodies),
+		"objects":  len(failed),
+	}).Debug("Peeked merge DLQ")
+
+	return failed, nil
+}
+
+// confirm returns true if the orphan was found before MergeTimeout. Orphan found first is registered to meta table and confirmed in a later run.
+func (x *Sweeper) confirm(orphan *OrphanObject, now time.Time) (bool, error) {
+	timeout := x.MergeTimeout
+	if timeout == 0 {
+		timeout = DefaultMergeTimeout
+	}
+
+	recordID := foundRecordIDPrefix + orphan.Object.Key
+	found, err := x.Meta.LookupObject(recordID, orphan.Schema)
+	if err != nil {
+		return false, err
+	}
+	if found != nil {
+		return !found.PutAt().After(now.Add(-timeout)), nil
+	}
+
+	if err := x.Meta.PutObjects([]*repository.MetaRecordObject{
+		{
+			RecordID: recordID,
+			S3Object: orphan.Object,
+			Schema:   orphan.Schema,
+		},
+	}); err != nil {
+		return false, errors.Wrapf(err, "Fail to put meta record of found orphan: %s", orphan.Object.Key)
+	}
+
+	logger.WithField("key", orphan.Object.Key).Debug("Found orphan candidate, confirm it in next run")
+	return false, nil
+}
+
+// listCandidates returns raw objects older than threshold and not in pending
+func (x *Sweeper) listCandidates(threshold time.Time, pending map[string]bool, report *SweepReport) ([]*OrphanObject, error) {
+	var candidates []*OrphanObject
+
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(x.Bucket),
+		Prefix: aws.String(x.Prefix + "raw/"),
+	}
+	for {
+		output, err := x.S3.ListObjectsV2(input)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Fail to list raw objects: s3://%s/%sraw/", x.Bucket, x.Prefix)
+		}
+
+		for _, obj := range output.Contents {
+			key := aws.StringValue(obj.Key)
+			schema, partition, ok := models.ParseRawObjectKey(x.Prefix, key)
+			if !ok {
+				logger.WithField("key", key).Debug("Not raw object, skip")
+				continue
+			}
+			report.Scanned++
+
+			if aws.TimeValue(obj.LastModified).After(threshold) {
+				continue
+			}
+			if pending[key] {
+				report.Pending++
+				continue
+			}
+
+			candidates = append(candidates, &OrphanObject{
+				Object:       models.NewS3Object(x.Region, x.Bucket, key),
+				Schema:       schema,
+				Partition:    partition,
+				Size:         aws.Int64Value(obj.Size),
+				LastModified: aws.TimeValue(obj.LastModified).UTC(),
+			})
+		}
+
+		if !aws.BoolValue(output.IsTruncated) {
+			break
+		}
+		input.ContinuationToken = output.NextContinuationToken
+	}
+
+	return candidates, nil
+}
+
+// mergeState is merged objects and their manifests in a partition directory
+type mergeState struct {
+	// sources are S3 keys of source raw objects in merge manifests
+	sources map[string]bool
+	// unknownUntil is LastModified of the latest merged object without merge manifest
+	unknownUntil time.Time
+}
+
+// mayBeMerged returns true if raw object put at lastModified may have been merged into a merged object without manifest
+func (x *mergeState) mayBeMerged(lastModified time.Time) bool {
+	return !x.unknownUntil.IsZero() && !lastModified.After(x.unknownUntil)
+}
+
+// readMergeState reads merge manifests of the partition directory and finds merged objects without manifest
+func (x *Sweeper) readMergeState(dir string) (*mergeState, error) {
+	state := &mergeState{sources: map[string]bool{}}
+	keys := map[string]bool{}
+	var merged []*s3.Object
+
+	input := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(x.Bucket),
+		Prefix:    aws.String(dir),
+		Delimiter: aws.String("/"),
+	}
+	for {
+		output, err := x.S3.ListObjectsV2(input)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Fail to list merged objects: s3://%s/%s", x.Bucket, dir)
+		}
+
+		for _, obj := range output.Contents {
+			key := aws.StringValue(obj.Key)
+			keys[key] = true
+
+			name := path.Base(key)
+			if strings.HasPrefix(name, "merged-") && strings.HasSuffix(name, ".parquet") {
+				merged = append(merged, obj)
+			}
+			if !strings.HasPrefix(name, "_merged-") || !strings.HasSuffix(name, ".manifest.json") {
+				continue
+			}
+
+			manifest, err := x.readMergeManifest(key)
+			if err != nil {
+				return nil, err
+			}
+			for _, src := range manifest.Sources {
+				state.sources[src.Object.Key] = true
+			}
+		}
+
+		if !aws.BoolValue(output.IsTruncated) {
+			break
+		}
+		input.ContinuationToken = output.NextContinuationToken
+	}
+
+	for _, obj := range merged {
+		if keys[models.BuildMergeManifestKey(aws.StringValue(obj.Key))] {
+			continue
+		}
+		if ts := aws.TimeValue(obj.LastModified); ts.After(state.unknownUntil) {
+			state.unknownUntil = ts
+		}
+	}
+
+	return state, nil
+}
+
+func (x *Sweeper) readMergeManifest(key string) (*models.MergeManifest, error) {
+	resp, err := x.S3.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(x.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to get merge manifest: s3://%s/%s", x.Bucket, key)
+	}
+	raw, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to read merge manifest: s3://%s/%s", x.Bucket, key)
+	}
+
+	var manifest models.MergeManifest
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return nil, errors.Wrapf(err, "Fail to parse merge manifest: s3://%s/%s", x.Bucket, key)
+	}
+	return &manifest, nil
+}
+
+// requeue registers the orphan to meta table with sweep record ID and sends it to compose queue.
+func (x *Sweeper) requeue(orphan *OrphanObject) error {
+	recordID := sweepRecordID(orphan.Object.Key)
+	if err := x.Meta.PutObjects([]*repository.MetaRecordObject{
+		{
+			RecordID: recordID,
+			S3Object: orphan.Object,
+			Schema:   orphan.Schema,
+		},
+	}); err != nil {
+		return errors.Wrapf(err, "Fail to put meta record of orphan: %s", orphan.Object.Key)
+	}
+
+	// Size is compressed size because original data size is not available. Then the chunk can be larger than ChunkMaxSize, but it's acceptable for a few orphans.
+	q := &models.ComposeQueue{
+		RecordID:  recordID,
+		S3Object:  orphan.Object,
+		Size:      orphan.Size,
+		Schema:    string(orphan.Schema),
+		Partition: orphan.Partition,
+	}
+	if err := x.SQS.SendSQS(q, x.ComposeQueueURL); err != nil {
+		return errors.Wrapf(err, "Fail to requeue orphan: %s", orphan.Object.Key)
+	}
+
+	orphan.RecordID = recordID
+	logger.WithField("q", q).Info("Requeued orphan raw object")
+	return nil
+}
+
+func (x *Sweeper) putReport(report *SweepReport) error {
+	raw, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Fail to marshal sweeper report")
+	}
+
+	prefix := x.ReportPrefix
+	if prefix == "" {
+		prefix = x.Prefix + "sweeper/"
+	}
+	key := prefix + report.RunAt.UTC().Format("2006/01/02/150405") + ".json"
+
+	if _, err := x.S3.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(x.Bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(raw),
+		ContentType: aws.String("application/json"),
+	}); err != nil {
+		return errors.Wrapf(err, "Fail to put sweeper report: s3://%s/%s", x.Bucket, key)
+	}
+
+	logger.WithFields(logrus.Fields{
+		"report":  fmt.Sprintf("s3://%s/%s", x.Bucket, key),
+		"orphans": len(report.Orphans),
+	}).Warn("Found orphan raw objects")
+
+	return nil
+}
+
+// putMetrics puts metrics even if zero to distinguish no orphan from no sweeper run
+func (x *Sweeper) putMetrics(report *SweepReport) error {
+	if x.CloudWatch == nil {
+		return nil
+	}
+
+	namespace := x.MetricNamespace
+	if namespace == "" {
+		namespace = DefaultMetricNamespace
+	}
+
+	datum := func(name string, value float64, unit string) *cloudwatch.MetricDatum {
+		return &cloudwatch.MetricDatum{
+			MetricName: aws.String(name),
+			Value:      aws.Float64(value),
+			Unit:       aws.String(unit),
+			Timestamp:  aws.Time(report.RunAt),
+		}
+	}
+
+	if _, err := x.CloudWatch.PutMetricData(&cloudwatch.PutMetricDataInput{
+		Namespace: aws.String(namespace),
+		MetricData: []*cloudwatch.MetricDatum{
+			datum("OrphanRawObjects", float64(len(report.Orphans)), cloudwatch.StandardUnitCount),
+			datum("OrphanRawBytes", float64(report.Bytes), cloudwatch.StandardUnitBytes),
+			datum("MergedRawObjects", float64(report.Merged), cloudwatch.StandardUnitCount),
+			datum("MergeFailedRawObjects", float64(report.MergeFailed), cloudwatch.StandardUnitCount),
+			datum("UnknownRawObjects", float64(report.Unknown), cloudwatch.StandardUnitCount),
+			datum("RequeuedRawObjects", float64(report.Requeued), cloudwatch.StandardUnitCount),
+		},
+	}); err != nil {
+		return errors.Wrap(err, "Fail to put sweeper metrics")
+	}
+
+	return nil
+}
+
+func sweepRecordID(key string) string {
+	return sweepRecordIDPrefix + key
+}
+
+func tableOf(schema models.ParquetSchemaName) string {
+	if schema == models.ParquetSchemaMessage {
+		return models.AthenaTableMessage
+	}
+	return string(models.AthenaTableIndex)
+}
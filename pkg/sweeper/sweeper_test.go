@@ -0,0 +1,360 @@
+package sweeper_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/google/uuid"
+	"github.com/m-mizutani/minerva/internal/adaptor"
+	"github.com/m-mizutani/minerva/internal/mock"
+	"github.com/m-mizutani/minerva/internal/repository"
+	"github.com/m-mizutani/minerva/internal/service"
+	"github.com/m-mizutani/minerva/internal/util"
+	"github.com/m-mizutani/minerva/pkg/models"
+	"github.com/m-mizutani/minerva/pkg/sweeper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	composeQueueURL = "https://sqs.ap-northeast-1.amazonaws.com/123456789012/compose"
+	mergeDLQURL     = "https://sqs.ap-northeast-1.amazonaws.com/123456789012/merge-dlq"
+)
+
+func newSQSClient() *mock.SQSClient {
+	return mock.NewSQSClient("ap-northeast-1").(*mock.SQSClient)
+}
+
+func newSweeper(metaRepo repository.MetaRepository, chunk *mock.ChunkMockDB, sqs *mock.SQSClient) *sweeper.Sweeper {
+	return &sweeper.Sweeper{
+		S3:              mock.NewS3Client("ap-northeast-1"),
+		Chunk:           service.NewChunkService(chunk, nil),
+		Meta:            service.NewMetaService(metaRepo, util.NewExpRetryTimer),
+		SQS:             service.NewSQSService(func(region string) adaptor.SQSClient { return sqs }),
+		CloudWatch:      &mock.CloudWatchClient{},
+		Region:          "ap-northeast-1",
+		Bucket:          "sweeper-" + uuid.New().String(),
+		Prefix:          "prefix/",
+		ComposeQueueURL: composeQueueURL,
+		MinAge:          time.Hour,
+		Requeue:         true,
+	}
+}
+
+func putObject(t *testing.T, sw *sweeper.Sweeper, key string, body []byte) {
+	_, err := sw.S3.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(sw.Bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(body),
+	})
+	require.NoError(t, err)
+}
+
+// putRawObjects puts raw objects: in a chunk, orphan, merged but not deleted and not raw object. It returns keys of them.
+func putRawObjects(t *testing.T, sw *sweeper.Sweeper, metaRepo repository.MetaRepository, chunk *mock.ChunkMockDB) (string, string, string) {
+	inChunk := "prefix/raw/indices/dt=2020-01-02-03/src-bucket/logs/a.log/" + uuid.New().String() + ".msg.gz"
+	orphan := "prefix/raw/indices/dt=2020-01-02-03/src-bucket/logs/b.log/" + uuid.New().String() + ".msg.gz"
+	merged := "prefix/raw/messages/dt=2020-01-02-03/tag_group=aws/src-bucket/logs/c.log/" + uuid.New().String() + ".msg.gz"
+	for _, key := range []string{inChunk, orphan, merged} {
+		putObject(t, sw, key, []byte("dummy"))
+	}
+	putObject(t, sw, "prefix/raw/README", []byte("not raw object"))
+
+	require.NoError(t, metaRepo.PutRecordObjects([]*repository.MetaRecordObject{
+		{
+			RecordID: "1/0",
+			S3Object: models.NewS3Object("ap-northeast-1", sw.Bucket, inChunk),
+			Schema:   models.ParquetSchemaIndex,
+		},
+	}))
+	require.NoError(t, chunk.PutChunk("1/0", 5, "index", "dt=2020-01-02-03", time.Now()))
+
+	mergedObj := models.NewS3Object("ap-northeast-1", sw.Bucket, "prefix/messages/dt=2020-01-02-03/tag_group=aws/merged-x.parquet")
+	manifest := models.MergeManifest{
+		Object: mergedObj,
+		Schema: models.ParquetSchemaMessage,
+		Rows:   1,
+		Sources: []*models.MergeManifestEntry{
+			{Object: models.NewS3Object("ap-northeast-1", sw.Bucket, merged), Records: 1},
+		},
+	}
+	raw, err := json.Marshal(manifest)
+	require.NoError(t, err)
+	putObject(t, sw, models.BuildMergeManifestKey(mergedObj.Key), raw)
+
+	return inChunk, orphan, merged
+}
+
+// setPutAt changes put time of meta record by ExpiresAt because mock repository returns stored item
+func setPutAt(t *testing.T, metaRepo repository.MetaRepository, recordID string, schema models.ParquetSchemaName, putAt time.Time) {
+	items, err := metaRepo.GetRecordObjects([]string{recordID}, schema)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(items))
+	items[0].ExpiresAt = putAt.Add(repository.MetaRecordTTL).Unix()
+}
+
+// found makes the raw object be found as orphan candidate by previous run at foundAt
+func found(t *testing.T, sw *sweeper.Sweeper, metaRepo repository.MetaRepository, key string, schema models.ParquetSchemaName, foundAt time.Time) {
+	recordID := "sweep-found/" + key
+	require.NoError(t, metaRepo.PutRecordObjects([]*repository.MetaRecordObject{
+		{
+			RecordID: recordID,
+			S3Object: models.NewS3Object("ap-northeast-1", sw.Bucket, key),
+			Schema:   schema,
+		},
+	}))
+	setPutAt(t, metaRepo, recordID, schema, foundAt)
+}
+
+func TestSweeper(t *testing.T) {
+	t.Run("Requeue orphan and skip merged object", func(tt *testing.T) {
+		metaRepo, chunk, sqs := mock.NewMetaRepository(), mock.NewChunkMockDB(), newSQSClient()
+		sw := newSweeper(metaRepo, chunk, sqs)
+		cloudWatch := sw.CloudWatch.(*mock.CloudWatchClient)
+		_, orphan, merged := putRawObjects(tt, sw, metaRepo, chunk)
+		now := time.Now().UTC().Add(2 * time.Hour)
+
+		// Orphan found first may be in merge queue, then it's not requeued yet
+		report, err := sw.Sweep(now)
+		require.NoError(tt, err)
+		assert.Equal(tt, 3, report.Scanned)
+		assert.Equal(tt, 2, report.Pending)
+		require.Equal(tt, 1, len(report.Orphans))
+		assert.Equal(tt, merged, report.Orphans[0].Object.Key)
+		assert.Equal(tt, 0, report.Requeued)
+		assert.Equal(tt, 0, len(sqs.Input))
+		setPutAt(tt, metaRepo, "sweep-found/"+orphan, models.ParquetSchemaIndex, now)
+
+		report, err = sw.Sweep(now.Add(10 * time.Minute))
+		require.NoError(tt, err)
+		assert.Equal(tt, 2, report.Pending)
+		assert.Equal(tt, 0, report.Requeued)
+
+		// Confirmed after merge timeout
+		cloudWatch.Input = nil
+		now = now.Add(sweeper.DefaultMergeTimeout)
+		report, err = sw.Sweep(now)
+		require.NoError(tt, err)
+		assert.Equal(tt, 3, report.Scanned)
+		assert.Equal(tt, 1, report.Pending)
+		require.Equal(tt, 2, len(report.Orphans))
+		assert.Equal(tt, 1, report.Merged)
+		assert.Equal(tt, 1, report.Requeued)
+
+		for _, o := range report.Orphans {
+			switch o.Object.Key {
+			case orphan:
+				assert.False(tt, o.Merged)
+				assert.Equal(tt, "sweep/"+orphan, o.RecordID)
+			case merged:
+				assert.True(tt, o.Merged)
+				assert.Equal(tt, "dt=2020-01-02-03/tag_group=aws", o.Partition)
+				assert.Equal(tt, "", o.RecordID)
+			default:
+				tt.Errorf("Unexpected orphan: %s", o.Object.Key)
+			}
+		}
+
+		// Only orphan is sent to compose queue with new meta record
+		require.Equal(tt, 1, len(sqs.Input))
+		assert.Equal(tt, composeQueueURL, aws.StringValue(sqs.Input[0].QueueUrl))
+		var q models.ComposeQueue
+		require.NoError(tt, json.Unmarshal([]byte(aws.StringValue(sqs.Input[0].MessageBody)), &q))
+		assert.Equal(tt, "sweep/"+orphan, q.RecordID)
+		assert.Equal(tt, orphan, q.S3Object.Key)
+		assert.Equal(tt, "index", q.Schema)
+		assert.Equal(tt, "dt=2020-01-02-03", q.Partition)
+		assert.Equal(tt, int64(5), q.Size)
+
+		objects, err := sw.Meta.GetObjects([]string{q.RecordID}, models.ParquetSchemaIndex)
+		require.NoError(tt, err)
+		require.Equal(tt, 1, len(objects))
+		assert.Equal(tt, orphan, objects[0].Key)
+
+		v, ok := cloudWatch.Metric(sweeper.DefaultMetricNamespace, "OrphanRawObjects")
+		assert.True(tt, ok)
+		assert.Equal(tt, float64(2), v)
+		v, ok = cloudWatch.Metric(sweeper.DefaultMetricNamespace, "RequeuedRawObjects")
+		assert.True(tt, ok)
+		assert.Equal(tt, float64(1), v)
+
+		output, err := sw.S3.ListObjectsV2(&s3.ListObjectsV2Input{
+			Bucket: aws.String(sw.Bucket),
+			Prefix: aws.String("prefix/sweeper/"),
+		})
+		require.NoError(tt, err)
+		require.Equal(tt, 3, len(output.Contents))
+		assert.True(tt, strings.HasSuffix(aws.StringValue(output.Contents[0].Key), ".json"))
+	})
+
+	t.Run("Requeued object is not requeued again in MinAge", func(tt *testing.T) {
+		metaRepo, chunk, sqs := mock.NewMetaRepository(), mock.NewChunkMockDB(), newSQSClient()
+		sw := newSweeper(metaRepo, chunk, sqs)
+		_, orphan, _ := putRawObjects(tt, sw, metaRepo, chunk)
+		now := time.Now().UTC().Add(2 * time.Hour)
+		found(tt, sw, metaRepo, orphan, models.ParquetSchemaIndex, now.Add(-time.Hour))
+
+		_, err := sw.Sweep(now)
+		require.NoError(tt, err)
+		require.Equal(tt, 1, len(sqs.Input))
+
+		// Meta record of requeue is put at "now" of the first run
+		items, err := metaRepo.GetRecordObjects([]string{"sweep/" + orphan}, models.ParquetSchemaIndex)
+		require.NoError(tt, err)
+		require.Equal(tt, 1, len(items))
+		items[0].ExpiresAt = now.Add(repository.MetaRecordTTL).Unix()
+
+		report, err := sw.Sweep(now.Add(30 * time.Minute))
+		require.NoError(tt, err)
+		assert.Equal(tt, 2, report.Pending)
+		assert.Equal(tt, 0, report.Requeued)
+		assert.Equal(tt, 1, len(sqs.Input))
+
+		// Requeue again after MinAge because compose message may be lost again
+		report, err = sw.Sweep(now.Add(2 * time.Hour))
+		require.NoError(tt, err)
+		assert.Equal(tt, 1, report.Requeued)
+		assert.Equal(tt, 2, len(sqs.Input))
+	})
+
+	t.Run("Only report without requeue", func(tt *testing.T) {
+		metaRepo, chunk, sqs := mock.NewMetaRepository(), mock.NewChunkMockDB(), newSQSClient()
+		sw := newSweeper(metaRepo, chunk, sqs)
+		cloudWatch := sw.CloudWatch.(*mock.CloudWatchClient)
+		sw.Requeue = false
+		_, orphan, _ := putRawObjects(tt, sw, metaRepo, chunk)
+		now := time.Now().UTC().Add(2 * time.Hour)
+		found(tt, sw, metaRepo, orphan, models.ParquetSchemaIndex, now.Add(-time.Hour))
+
+		report, err := sw.Sweep(now)
+		require.NoError(tt, err)
+		assert.Equal(tt, 2, len(report.Orphans))
+		assert.Equal(tt, 0, report.Requeued)
+		assert.Equal(tt, 0, len(sqs.Input))
+
+		v, ok := cloudWatch.Metric(sweeper.DefaultMetricNamespace, "OrphanRawObjects")
+		assert.True(tt, ok)
+		assert.Equal(tt, float64(2), v)
+	})
+
+	t.Run("Object in merge DLQ is not requeued", func(tt *testing.T) {
+		metaRepo, chunk, sqs := mock.NewMetaRepository(), mock.NewChunkMockDB(), newSQSClient()
+		sw := newSweeper(metaRepo, chunk, sqs)
+		cloudWatch := sw.CloudWatch.(*mock.CloudWatchClient)
+		sw.MergeDLQURL = mergeDLQURL
+		_, orphan, _ := putRawObjects(tt, sw, metaRepo, chunk)
+		now := time.Now().UTC().Add(2 * time.Hour)
+
+		require.NoError(tt, metaRepo.PutRecordObjects([]*repository.MetaRecordObject{
+			{
+				RecordID: "2/0",
+				S3Object: models.NewS3Object("ap-northeast-1", sw.Bucket, orphan),
+				Schema:   models.ParquetSchemaIndex,
+			},
+		}))
+		// Meta record of "2/1" is expired
+		require.NoError(tt, sw.SQS.SendSQS(&models.MergeQueue{
+			Schema:    models.ParquetSchemaIndex,
+			RecordIDs: []string{"2/0", "2/1"},
+		}, mergeDLQURL))
+
+		report, err := sw.Sweep(now)
+		require.NoError(tt, err)
+		assert.Equal(tt, 1, report.Pending)
+		require.Equal(tt, 2, len(report.Orphans))
+		assert.Equal(tt, 1, report.MergeFailed)
+		assert.Equal(tt, 0, report.Requeued)
+		for _, o := range report.Orphans {
+			assert.Equal(tt, o.Object.Key == orphan, o.MergeFailed)
+			assert.Equal(tt, "", o.RecordID)
+		}
+
+		// Only the DLQ message, nothing is sent to compose queue
+		assert.Equal(tt, 1, len(sqs.Input))
+		v, ok := cloudWatch.Metric(sweeper.DefaultMetricNamespace, "MergeFailedRawObjects")
+		assert.True(tt, ok)
+		assert.Equal(tt, float64(1), v)
+	})
+
+	t.Run("Expired meta record of chunk does not fail sweep", func(tt *testing.T) {
+		metaRepo, chunk := mock.NewMetaRepository(), mock.NewChunkMockDB()
+		sw := newSweeper(metaRepo, chunk, newSQSClient())
+		putRawObjects(tt, sw, metaRepo, chunk)
+		require.NoError(tt, chunk.PutChunk("3/0", 5, "index", "dt=2020-01-02-03", time.Now()))
+
+		report, err := sw.Sweep(time.Now().UTC().Add(2 * time.Hour))
+		require.NoError(tt, err)
+		assert.Equal(tt, 3, report.Scanned)
+	})
+
+	t.Run("Object that may be merged without manifest is unknown", func(tt *testing.T) {
+		metaRepo, chunk, sqs := mock.NewMetaRepository(), mock.NewChunkMockDB(), newSQSClient()
+		sw := newSweeper(metaRepo, chunk, sqs)
+		_, orphan, _ := putRawObjects(tt, sw, metaRepo, chunk)
+		putObject(tt, sw, "prefix/indices/dt=2020-01-02-03/merged-old.parquet", []byte("merged before manifest"))
+		newer := "prefix/raw/indices/dt=2020-01-02-03/src-bucket/logs/d.log/" + uuid.New().String() + ".msg.gz"
+		putObject(tt, sw, newer, []byte("dummy"))
+		now := time.Now().UTC().Add(2 * time.Hour)
+		found(tt, sw, metaRepo, orphan, models.ParquetSchemaIndex, now.Add(-time.Hour))
+		found(tt, sw, metaRepo, newer, models.ParquetSchemaIndex, now.Add(-time.Hour))
+
+		report, err := sw.Sweep(now)
+		require.NoError(tt, err)
+		assert.Equal(tt, 4, report.Scanned)
+		require.Equal(tt, 3, len(report.Orphans))
+		assert.Equal(tt, 1, report.Unknown)
+		assert.Equal(tt, 1, report.Requeued)
+		for _, o := range report.Orphans {
+			assert.Equal(tt, o.Object.Key == orphan, o.Unknown)
+		}
+
+		require.Equal(tt, 1, len(sqs.Input))
+		var q models.ComposeQueue
+		require.NoError(tt, json.Unmarshal([]byte(aws.StringValue(sqs.Input[0].MessageBody)), &q))
+		assert.Equal(tt, newer, q.S3Object.Key)
+	})
+
+	t.Run("Merged object with manifest does not make objects unknown", func(tt *testing.T) {
+		metaRepo, chunk := mock.NewMetaRepository(), mock.NewChunkMockDB()
+		sw := newSweeper(metaRepo, chunk, newSQSClient())
+		_, orphan, _ := putRawObjects(tt, sw, metaRepo, chunk)
+		putObject(tt, sw, "prefix/indices/dt=2020-01-02-03/merged-y.parquet", []byte("merged"))
+		putObject(tt, sw, "prefix/indices/dt=2020-01-02-03/_merged-y.manifest.json", []byte(`{"sources":[]}`))
+		now := time.Now().UTC().Add(2 * time.Hour)
+		found(tt, sw, metaRepo, orphan, models.ParquetSchemaIndex, now.Add(-time.Hour))
+
+		report, err := sw.Sweep(now)
+		require.NoError(tt, err)
+		assert.Equal(tt, 0, report.Unknown)
+		assert.Equal(tt, 1, report.Requeued)
+	})
+
+	t.Run("Recent raw objects are not orphans", func(tt *testing.T) {
+		metaRepo, chunk := mock.NewMetaRepository(), mock.NewChunkMockDB()
+		sw := newSweeper(metaRepo, chunk, newSQSClient())
+		cloudWatch := sw.CloudWatch.(*mock.CloudWatchClient)
+		putRawObjects(tt, sw, metaRepo, chunk)
+
+		report, err := sw.Sweep(time.Now().UTC())
+		require.NoError(tt, err)
+		assert.Equal(tt, 3, report.Scanned)
+		assert.Equal(tt, 0, len(report.Orphans))
+
+		// Metrics are put even if no orphan
+		v, ok := cloudWatch.Metric(sweeper.DefaultMetricNamespace, "OrphanRawObjects")
+		assert.True(tt, ok)
+		assert.Equal(tt, float64(0), v)
+	})
+
+	t.Run("Requeue requires compose queue URL", func(tt *testing.T) {
+		sw := newSweeper(mock.NewMetaRepository(), mock.NewChunkMockDB(), newSQSClient())
+		sw.ComposeQueueURL = ""
+		_, err := sw.Sweep(time.Now().UTC())
+		assert.Error(tt, err)
+	})
+}